@@ -0,0 +1,86 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+)
+
+// queuedPacket is packet in the send queue tagged with the enqueue time
+type queuedPacket struct {
+	buf []byte
+	// enqueue time (UnixNano), tracked only with MaxPacketAge
+	enqueued int64
+}
+
+// queued tags packet with the enqueue time
+func (t *transport) queued(buf []byte) queuedPacket {
+	return queuedPacket{buf: buf, enqueued: t.enqueueTime()}
+}
+
+// enqueueTime returns current time (UnixNano) if MaxPacketAge is enabled, zero otherwise
+func (t *transport) enqueueTime() int64 {
+	if t.maxPacketAge == 0 {
+		return 0
+	}
+
+	return t.now().UnixNano()
+}
+
+// stale returns true if packet enqueued at the time is older than MaxPacketAge
+func (t *transport) stale(enqueued int64) bool {
+	return t.maxPacketAge > 0 && t.now().UnixNano()-enqueued > int64(t.maxPacketAge)
+}
+
+// sendQueued writes packet to the socket, stale packet is dropped instead
+func (t *transport) sendQueued(sock net.Conn, p queuedPacket, addr string, log SomeLogger) error {
+	if t.stale(p.enqueued) {
+		t.packetStale(p.buf)
+		return nil
+	}
+
+	return t.sendPacket(sock, p.buf, addr, log, nil)
+}
+
+// packetStale drops packet which waited in the queue longer than MaxPacketAge
+func (t *transport) packetStale(buf []byte) {
+	atomic.AddInt64(&t.stalePackets, 1)
+	atomic.AddInt64(&t.staleMetrics, int64(bytes.Count(buf, newline)))
+
+	t.packetLost(buf, DropReasonStale)
+	t.releaseBuf(buf)
+}
+
+// GetStalePackets returns number of packets dropped as they waited in the queue longer than MaxPacketAge
+func (c *Client) GetStalePackets() int64 {
+	return atomic.LoadInt64(&c.trans.stalePackets)
+}
+
+// GetStaleMetrics returns number of metrics in the packets counted in GetStalePackets
+func (c *Client) GetStaleMetrics() int64 {
+	return atomic.LoadInt64(&c.trans.staleMetrics)
+}
@@ -0,0 +1,144 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxPacketAge(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Queue", nil},
+		{"HighPriority", []Option{PriorityLanes(10)}},
+		{"Batches", []Option{SendBatchSize(2)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			unblock := make(chan struct{})
+
+			var (
+				droppedLock sync.Mutex
+				dropped     []string
+			)
+
+			client := NewClient(inSocket.LocalAddr().String(), append([]Option{FlushInterval(time.Hour), SendLoopCount(1),
+				SendQueueCapacity(10), MaxPacketAge(time.Minute),
+				OnDroppedPacket(func(packet []byte, reason DropReason) {
+					droppedLock.Lock()
+					dropped = append(dropped, reason.String()+" "+strings.TrimSpace(string(packet)))
+					droppedLock.Unlock()
+				}),
+				func(c *ClientOptions) {
+					c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+						var d net.Dialer
+
+						conn, err := d.DialContext(ctx, network, addr)
+						if err != nil {
+							return nil, err
+						}
+
+						return &blockingConn{Conn: conn, unblock: unblock}, nil
+					}
+				}}, tt.opts...)...)
+			defer client.Close() //nolint:errcheck
+
+			// fake clock
+			var now int64 = 1700000000 * int64(time.Second)
+			client.trans.now = func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) }
+
+			cl := client
+			if tt.name == "HighPriority" {
+				cl = client.WithPriority(PriorityHigh)
+			}
+
+			cl.Incr("req.first", 1)
+			cl.Flush()
+
+			// wait for the send loop to pick up first packet, it's blocked writing it (listener is paused)
+			for client.GetStats().SendQueueLength+client.GetStats().HighPriorityQueueLength > 0 || len(client.trans.batchQueue) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			// packets queued during the outage
+			cl.Incr("req.old", 1)
+			cl.Flush()
+			cl.Incr("req.old", 2)
+			cl.Flush()
+
+			atomic.AddInt64(&now, int64(2*time.Minute))
+
+			cl.Incr("req.fresh", 1)
+			cl.Flush()
+
+			close(unblock)
+
+			ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+			defer ctxCancel()
+
+			// stale packets are dropped
+			if err := client.FlushAndWait(ctx); !errors.Is(err, ErrFlushIncomplete) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, expected := range []string{"req.first:1|c", "req.fresh:1|c"} {
+				select {
+				case buf := <-received:
+					if string(buf) != expected {
+						t.Errorf("unexpected packet: %#v != %#v", string(buf), expected)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("timeout waiting for metrics")
+				}
+			}
+
+			if stale := client.GetStalePackets(); stale != 2 {
+				t.Errorf("unexpected number of stale packets: %d", stale)
+			}
+
+			if stale := client.GetStaleMetrics(); stale != 2 {
+				t.Errorf("unexpected number of stale metrics: %d", stale)
+			}
+
+			droppedLock.Lock()
+			defer droppedLock.Unlock()
+
+			if strings.Join(dropped, ", ") != "stale req.old:1|c, stale req.old:2|c" {
+				t.Errorf("unexpected dropped packets: %v", dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+import (
+	"sync"
+)
+
+// packetBatch is a set of packets handed to the send loop at once
+type packetBatch struct {
+	packets [][]byte
+	// enqueue time (UnixNano), tracked only with MaxPacketAge
+	enqueued int64
+}
+
+// stagedPacket is a packet of the current batch which is not reported to OnFlush yet
+type stagedPacket struct {
+	length, lines int
+}
+
+// initBatches enables batching of ready packets if batchSize > 1
+//
+// Batches are kept in a separate queue, so that the send queue keeps
+// its semantics when batch doesn't fit into the batch queue.
+func (t *transport) initBatches(batchSize, queueCapacity int) {
+	if batchSize <= 1 {
+		return
+	}
+
+	t.batchSize = batchSize
+
+	capacity := queueCapacity / batchSize
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	t.batchQueue = make(chan *packetBatch, capacity)
+	t.batchPool = sync.Pool{
+		New: func() interface{} {
+			return &packetBatch{packets: make([][]byte, 0, batchSize)}
+		},
+	}
+}
+
+// stage appends ready packet to the current batch submitting the batch if it's full
+func (t *transport) stage(buf []byte, lines int) {
+	t.batchLock.Lock()
+
+	if t.batch == nil {
+		t.batch = t.batchPool.Get().(*packetBatch) //nolint:errcheck,forcetypeassert
+	}
+
+	t.batch.packets = append(t.batch.packets, buf)
+
+	if t.onFlush != nil {
+		t.staged = append(t.staged, stagedPacket{length: len(buf), lines: lines})
+	}
+
+	if len(t.batch.packets) >= t.batchSize {
+		t.submitBatchLocked()
+	}
+
+	t.batchLock.Unlock()
+}
+
+// submitBatch sends partially filled batch to the batch queue
+func (t *transport) submitBatch() {
+	if t.batchSize <= 1 {
+		return
+	}
+
+	t.batchLock.Lock()
+	t.submitBatchLocked()
+	t.batchLock.Unlock()
+}
+
+func (t *transport) submitBatchLocked() {
+	batch := t.batch
+	if batch == nil {
+		return
+	}
+
+	t.batch = nil
+	batch.enqueued = t.enqueueTime()
+
+	// batch is owned by the send loop once it's queued, so staged packets are tracked separately
+	staged := t.staged
+	t.staged = t.staged[:0]
+
+	select {
+	case t.batchQueue <- batch:
+		for _, p := range staged {
+			t.packetFlushed(p.length, p.lines)
+		}
+	default:
+		// batch queue is full, packets go through the send queue one by one
+		for i, buf := range batch.packets {
+			if t.enqueue(&t.batchTimer, buf) && i < len(staged) {
+				t.packetFlushed(staged[i].length, staged[i].lines)
+			}
+		}
+
+		t.releaseBatch(batch)
+	}
+}
+
+// releaseBatch returns processed batch to the pool
+func (t *transport) releaseBatch(batch *packetBatch) {
+	for i := range batch.packets {
+		batch.packets[i] = nil
+	}
+
+	batch.packets = batch.packets[:0]
+	t.batchPool.Put(batch)
+}
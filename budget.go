@@ -0,0 +1,164 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// liveBuffers is number of buffers metrics are appended to: buffer shards,
+// high priority lane and emitter buffer in Unlocked mode
+//
+// Buffers of Local handles are not included.
+func (t *transport) liveBuffers() int64 {
+	n := int64(len(t.shards))
+
+	if t.highShard != nil {
+		n++
+	}
+
+	if t.unlocked != nil {
+		n++
+	}
+
+	return n
+}
+
+// reserveBuf accounts buffer which is about to be allocated (or taken from the spare pool)
+//
+// It returns false if buffer doesn't fit into MaxBufferedBytes.
+func (t *transport) reserveBuf() bool {
+	held := atomic.AddInt64(&t.buffersHeld, 1)
+	if t.maxBuffered == 0 || (held+t.liveBuffers())*atomic.LoadInt64(&t.bufCapLimit) <= t.maxBuffered {
+		return true
+	}
+
+	atomic.AddInt64(&t.buffersHeld, -1)
+
+	return false
+}
+
+// nextBuf returns empty buffer to replace flushed shard buffer
+//
+// Buffer is taken from the pool, new buffer is allocated only within MaxBufferedBytes.
+// Result is false if buffer budget is exhausted, and flushed packet should be dropped.
+func (t *transport) nextBuf(timer **time.Timer) ([]byte, bool) {
+	select {
+	case buf := <-t.bufPool:
+		return buf[0:0], true
+	default:
+	}
+
+	if !t.reserveBuf() {
+		return t.bufferExhausted(timer)
+	}
+
+	buf := t.spareBuf()
+	t.poolMiss()
+
+	return buf, true
+}
+
+// bufferExhausted applies overflow policy when buffer budget is exhausted
+//
+// With BlockTimeout it waits for a buffer to be released, with DropOldest
+// buffer of the oldest queued packet is reused, otherwise flushed packet is dropped.
+func (t *transport) bufferExhausted(timer **time.Timer) ([]byte, bool) {
+	if t.blockTimeout > 0 {
+		if buf, ok := t.waitBuf(timer); ok {
+			return buf, true
+		}
+	}
+
+	if t.dropPolicy == DropOldest {
+		select {
+		case oldest := <-t.sendQueue:
+			t.overflowLost(PriorityNormal, oldest.buf)
+			return oldest.buf[0:0], true
+		default:
+		}
+	}
+
+	return nil, false
+}
+
+// waitBuf waits up to blockTimeout for a buffer to be released to the pool
+//
+// Timer is reused across the calls, so it should be protected by the caller's lock
+// (e.g. shard bufLock)
+func (t *transport) waitBuf(timer **time.Timer) ([]byte, bool) {
+	if *timer == nil {
+		*timer = time.NewTimer(t.blockTimeout)
+	} else {
+		(*timer).Reset(t.blockTimeout)
+	}
+
+	select {
+	case buf := <-t.bufPool:
+		if !(*timer).Stop() {
+			select {
+			case <-(*timer).C:
+			default:
+			}
+		}
+
+		return buf[0:0], true
+	case <-(*timer).C:
+	}
+
+	// buffers released while the pool is full are not returned to the pool
+	if t.reserveBuf() {
+		return t.spareBuf(), true
+	}
+
+	return nil, false
+}
+
+// dropOverBudget drops length bytes of the shard buffer as there's no buffer to replace it
+//
+// Packet is reported as lost on overflow, and shard buffer is reused.
+func (t *transport) dropOverBudget(s *bufShard, length int) {
+	priority := PriorityNormal
+	if s.high {
+		priority = PriorityHigh
+	}
+
+	// packet was about to be flushed
+	atomic.AddInt64(&t.pendingPackets, 1)
+	t.overflowLost(priority, s.buf[0:length])
+
+	s.discard(length)
+
+	if len(s.buf) > 0 && t.minFlushSize > 0 {
+		s.firstAppend = time.Now().UnixNano()
+	}
+}
+
+// GetBufferedBytes returns memory held by the client buffers: buffers metrics are
+// appended to, buffer pool and packets waiting to be sent, see MaxBufferedBytes
+func (c *Client) GetBufferedBytes() int64 {
+	return (atomic.LoadInt64(&c.trans.buffersHeld) + c.trans.liveBuffers()) * atomic.LoadInt64(&c.trans.bufCapLimit)
+}
@@ -0,0 +1,194 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxBufferedBytes(t *testing.T) {
+	// each buffer is MaxPacketSize + 1KiB
+	const bufSize = 1000 + 1024
+
+	blockingDial := func(unblock chan struct{}) Option {
+		return func(c *ClientOptions) {
+			c.dial = func(context.Context, string, string) (net.Conn, error) {
+				return &blockingConn{Conn: discardConn{}, unblock: unblock}, nil
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		policy int
+	}{
+		{"DropNewest", DropNewest},
+		{"DropOldest", DropOldest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			unblock := make(chan struct{})
+
+			// two shard buffers and six buffers for the pool and the queue
+			budget := int64(8 * bufSize)
+
+			client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), MaxPacketSize(1000), BufferShards(2),
+				SendLoopCount(1), SendQueueCapacity(1000), BufPoolCapacity(100), PrewarmBufPool(true),
+				MaxBufferedBytes(budget), DropPolicy(tt.policy), blockingDial(unblock))
+			defer client.Close() //nolint:errcheck
+
+			if buffered := client.GetBufferedBytes(); buffered != budget {
+				t.Errorf("pool should be prewarmed up to the budget: %d", buffered)
+			}
+
+			var (
+				wg          sync.WaitGroup
+				maxBuffered int64
+				done        = make(chan struct{})
+			)
+
+			go func() {
+				for {
+					atomicMax(&maxBuffered, client.GetBufferedBytes())
+
+					select {
+					case <-done:
+						return
+					default:
+						time.Sleep(10 * time.Microsecond)
+					}
+				}
+			}()
+
+			// sustained overload: send loop is stuck, and nothing is delivered
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					for j := 0; j < 20000; j++ {
+						client.Incr("req.count", 1, IntTag("worker", j))
+					}
+				}()
+			}
+
+			wg.Wait()
+			close(done)
+
+			if buffered := atomic.LoadInt64(&maxBuffered); buffered > budget {
+				t.Errorf("budget exceeded: %d > %d", buffered, budget)
+			}
+
+			if queued := len(client.trans.sendQueue); queued > 6 {
+				t.Errorf("too many packets queued: %d", queued)
+			}
+
+			if client.GetLostPackets() == 0 {
+				t.Error("packets should be dropped")
+			}
+
+			close(unblock)
+
+			ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+			defer ctxCancel()
+
+			// final flush might be dropped as well, if buffers are still held by the queue
+			if err := client.FlushAndWait(ctx); err != nil && !errors.Is(err, ErrFlushIncomplete) {
+				t.Fatal(err)
+			}
+
+			// all the buffers are returned, so client keeps sending metrics
+			if buffered, pooled := client.GetBufferedBytes(), int64(2+len(client.trans.bufPool))*bufSize; buffered != pooled {
+				t.Errorf("buffers leaked: %d != %d", buffered, pooled)
+			}
+
+			lost, sent := client.GetLostPackets(), client.GetStats().PacketsSent
+
+			client.Incr("req.count", 1)
+
+			if err := client.FlushAndWait(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if client.GetLostPackets() != lost || client.GetStats().PacketsSent != sent+1 {
+				t.Error("packet should be sent")
+			}
+		})
+	}
+
+	t.Run("Block", func(t *testing.T) {
+		unblock := make(chan struct{})
+
+		// shard buffer and one more buffer
+		client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), MaxPacketSize(1000), BufferShards(1),
+			SendLoopCount(1), MaxBufferedBytes(2*bufSize), BlockWithTimeout(time.Second), blockingDial(unblock))
+		defer client.Close() //nolint:errcheck
+
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		// wait for the send loop to pick up first packet, it's blocked writing it
+		for len(client.trans.sendQueue) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		time.AfterFunc(50*time.Millisecond, func() { close(unblock) })
+
+		// no more buffers can be allocated, so flush waits for the first packet to be sent
+		start := time.Now()
+
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			t.Errorf("flush should wait for the buffer: %v", elapsed)
+		}
+
+		ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+		defer ctxCancel()
+
+		if err := client.FlushAndWait(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		if lost := client.GetLostPackets(); lost != 0 {
+			t.Errorf("unexpected lost packets: %d", lost)
+		}
+
+		if sent := client.GetStats().PacketsSent; sent != 2 {
+			t.Errorf("unexpected sent packets: %d", sent)
+		}
+
+		if buffered := client.GetBufferedBytes(); buffered > 2*bufSize {
+			t.Errorf("budget exceeded: %d", buffered)
+		}
+	})
+}
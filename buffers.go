@@ -24,40 +24,558 @@ SOFTWARE.
 
 */
 
-import "sync/atomic"
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+)
 
-// checkBuf checks current buffer for overflow, and flushes buffer up to lastLen bytes on overflow
+var newline = []byte{'\n'}
+
+// metric type suffixes and gauge delta sign
+var (
+	counterSuffix = []byte("|c")
+	timingSuffix  = []byte("|ms")
+	gaugeSuffix   = []byte("|g")
+	setSuffix     = []byte("|s")
+	plusSign      = []byte{'+'}
+)
+
+// checkBuf checks shard buffer for overflow, and flushes buffer up to lastLen bytes on overflow
 //
 // overflow part is preserved in flushBuf
-func (t *transport) checkBuf(lastLen int) {
-	if len(t.buf) > t.maxPacketSize {
-		t.flushBuf(lastLen)
+//
+// checkBuf is called after each metric appended (which might be more than
+// one line), so it also flushes the buffer once it reaches maxMetricsPerPacket lines,
+// or right away in immediate mode. Result is false if metric was dropped.
+func (t *transport) checkBuf(s *bufShard, lastLen int) bool {
+	if t.queueClosed {
+		// final flush has already happened, metric was emitted concurrently with Close
+		s.buf = s.buf[:lastLen]
+		atomic.AddInt64(&t.closedMetrics, 1)
+
+		return false
+	}
+
+	maxPacketSize := t.packetSize()
+
+	if len(s.buf)-lastLen > maxPacketSize {
+		// metric alone doesn't fit into the packet, so it's dropped
+		s.buf = s.buf[:lastLen]
+		atomic.AddInt64(&t.oversizedPeriod, 1)
+		atomic.AddInt64(&t.oversizedOverall, 1)
+
+		return false
+	}
+
+	s.bufLines += bytes.Count(s.buf[lastLen:], newline)
+
+	if lastLen == 0 && t.minFlushSize > 0 {
+		s.firstAppend = time.Now().UnixNano()
 	}
+
+	if len(s.buf) > maxPacketSize {
+		t.flushBuf(s, lastLen)
+	} else if t.maxMetricsPerPacket > 0 && s.bufLines >= t.maxMetricsPerPacket {
+		t.flushBuf(s, len(s.buf))
+	} else if t.immediate && len(t.sendQueue) < cap(t.sendQueue) {
+		// in immediate mode metrics are batched only while send queue is full
+		t.flushBuf(s, len(s.buf))
+	}
+
+	return true
 }
 
-// flushBuf sends buffer to the queue and initializes new buffer
-func (t *transport) flushBuf(length int) {
-	sendBuf := t.buf[0:length]
-	tail := t.buf[length:len(t.buf)]
+// flushBuf sends shard buffer to the queue and initializes new buffer
+func (t *transport) flushBuf(s *bufShard, length int) {
+	if t.queueClosed {
+		t.dropClosed(s, length)
+		return
+	}
+
+	sendBuf := s.buf[0:length]
+	tail := s.buf[length:len(s.buf)]
 
 	// get new buffer
-	select {
-	case t.buf = <-t.bufPool:
-		t.buf = t.buf[0:0]
-	default:
-		t.buf = make([]byte, 0, t.bufSize)
+	buf, ok := t.nextBuf(&s.blockTimer)
+	if !ok {
+		t.dropOverBudget(s, length)
+		return
 	}
 
+	s.buf = buf
+
 	// copy tail to the new buffer
-	t.buf = append(t.buf, tail...)
+	s.buf = append(s.buf, tail...)
+
+	lines := s.bufLines
+	s.bufLines = bytes.Count(tail, newline)
+	lines -= s.bufLines
+
+	if len(tail) > 0 && t.minFlushSize > 0 {
+		s.firstAppend = time.Now().UnixNano()
+	}
 
 	// flush current buffer
+	atomic.AddInt64(&t.pendingPackets, 1)
+
+	if t.syncQueue != nil {
+		t.sendSync(sendBuf, lines)
+		return
+	}
+
+	if s.high {
+		t.enqueueHigh(sendBuf, lines)
+		return
+	}
+
+	if t.retainMax > 0 && !t.flushRetained() && t.retain(sendBuf) {
+		// older packets are still waiting for the space in the queue
+		t.packetFlushed(len(sendBuf), lines)
+		return
+	}
+
+	if t.batchSize > 1 {
+		// flush is reported once batch is accepted by the queue
+		t.stage(sendBuf, lines)
+		return
+	}
+
+	if t.enqueue(&s.blockTimer, sendBuf) {
+		t.packetFlushed(len(sendBuf), lines)
+	}
+}
+
+// enqueue sends packet to the queue applying overflow policies if queue is full
+//
+// It returns false if packet was dropped.
+func (t *transport) enqueue(timer **time.Timer, sendBuf []byte) bool {
 	select {
-	case t.sendQueue <- sendBuf:
+	case t.sendQueue <- t.queued(sendBuf):
+		t.updateQueueHighWater()
 	default:
-		// flush failed, we lost some data
-		atomic.AddInt64(&t.lostPacketsPeriod, 1)
-		atomic.AddInt64(&t.lostPacketsOverall, 1)
+		if t.blockTimeout > 0 && t.enqueueWithTimeout(timer, sendBuf) {
+			t.updateQueueHighWater()
+			return true
+		}
+
+		t.updateQueueHighWater()
+
+		if t.retain(sendBuf) {
+			return true
+		}
+
+		if t.dropPolicy == DropOldest && t.replaceOldest(sendBuf) {
+			return true
+		}
+
+		t.overflowLost(PriorityNormal, sendBuf)
+		t.releaseBuf(sendBuf)
+
+		return false
+	}
+
+	return true
+}
+
+// retain keeps packet which doesn't fit into the send queue to be retried later
+//
+// It returns false if RetainOverflow is not enabled or retained packets limit is reached
+func (t *transport) retain(buf []byte) bool {
+	if t.retainMax == 0 {
+		return false
+	}
+
+	t.retainLock.Lock()
+	defer t.retainLock.Unlock()
+
+	if len(t.retained) >= t.retainMax {
+		return false
+	}
+
+	t.retained = append(t.retained, t.queued(buf))
+
+	return true
+}
+
+// flushRetained enqueues retained packets (oldest first) while there's space in the send queue
+//
+// It returns true if all the retained packets were enqueued
+func (t *transport) flushRetained() bool {
+	t.retainLock.Lock()
+	defer t.retainLock.Unlock()
+
+	for len(t.retained) > 0 {
+		select {
+		case t.sendQueue <- t.retained[0]:
+			t.updateQueueHighWater()
+		default:
+			return false
+		}
+
+		t.retained[0] = queuedPacket{}
+		t.retained = t.retained[1:]
+	}
+
+	// reuse backing array
+	t.retained = t.retained[:0]
+
+	return true
+}
+
+// retryRetained tries to enqueue retained packets
+func (t *transport) retryRetained() {
+	if t.retainMax > 0 {
+		t.flushRetained()
+	}
+}
+
+// hasRetained returns true if there are packets waiting to be retried
+func (t *transport) hasRetained() bool {
+	if t.retainMax == 0 {
+		return false
+	}
+
+	t.retainLock.Lock()
+	defer t.retainLock.Unlock()
+
+	return len(t.retained) > 0
+}
+
+// replaceOldest drops oldest packet from the send queue to make room for buf
+//
+// It returns false if buf still couldn't be enqueued
+func (t *transport) replaceOldest(buf []byte) bool {
+	select {
+	case oldest := <-t.sendQueue:
+		t.overflowLost(PriorityNormal, oldest.buf)
+		t.releaseBuf(oldest.buf)
+	default:
+	}
+
+	select {
+	case t.sendQueue <- t.queued(buf):
+		return true
+	default:
+		return false
+	}
+}
+
+// packetLost records packet which was enqueued (or was about to be), but was dropped
+func (t *transport) packetLost(buf []byte, reason DropReason) {
+	t.packetDone()
+
+	// flush failed, we lost some data
+	t.countLost(buf)
+	atomic.AddInt64(&t.lostByReason[reason], 1)
+	t.packetDropped(buf, reason)
+}
+
+// countLost updates lost packets, metrics and bytes counters
+//
+// buf is passed with trailing newline
+func (t *transport) countLost(buf []byte) {
+	metrics := int64(bytes.Count(buf, newline))
+	size := int64(len(buf))
+	if size > 0 {
+		size--
+	}
+
+	atomic.AddInt64(&t.lostPacketsPeriod, 1)
+	atomic.AddInt64(&t.lostPacketsOverall, 1)
+	atomic.AddInt64(&t.lostMetricsPeriod, metrics)
+	atomic.AddInt64(&t.lostMetricsOverall, metrics)
+	atomic.AddInt64(&t.lostBytesPeriod, size)
+	atomic.AddInt64(&t.lostBytesOverall, size)
+}
+
+// dropClosed drops length bytes of the shard buffer when client is already closed
+func (t *transport) dropClosed(s *bufShard, length int) {
+	t.countLost(s.buf[0:length])
+	atomic.AddInt64(&t.lostByReason[DropReasonClosed], 1)
+	t.packetDropped(s.buf[0:length], DropReasonClosed)
+
+	s.discard(length)
+}
+
+// discard removes first length bytes of the buffer keeping the rest
+func (s *bufShard) discard(length int) {
+	tail := len(s.buf) - length
+	copy(s.buf, s.buf[length:])
+	s.buf = s.buf[:tail]
+
+	s.bufLines = bytes.Count(s.buf, newline)
+}
+
+// poolGrowthMisses is number of buffer pool misses which trigger pool growth
+const poolGrowthMisses = 2
+
+// poolMiss records buffer pool miss and grows the pool if adaptive pool is enabled
+func (t *transport) poolMiss() {
+	atomic.AddInt64(&t.poolMissesPeriod, 1)
+	allocated := atomic.AddInt64(&t.poolMissesOverall, 1)
+
+	capacity := atomic.LoadInt64(&t.bufPoolCapacity)
+	if int64(t.bufPoolMax) <= capacity {
+		return
+	}
+
+	// pool is not warmed up yet
+	if allocated+t.bufPoolPrewarmed <= capacity {
+		return
+	}
+
+	if atomic.AddInt64(&t.missesSinceGrowth, 1) >= poolGrowthMisses {
+		atomic.StoreInt64(&t.missesSinceGrowth, 0)
+		atomicMax(&t.bufPoolCapacity, min(capacity+1, int64(t.bufPoolMax)))
+	}
+}
+
+// releaseBuf returns buffer to the pool
+//
+// If the pool is full, buffer goes to the spare pool (which is cleaned up by GC),
+// and it's no longer accounted in MaxBufferedBytes
+func (t *transport) releaseBuf(buf []byte) {
+	if int64(cap(buf)) > atomic.LoadInt64(&t.bufCapLimit) {
+		// buffer was grown by append, don't keep it around
+		atomic.AddInt64(&t.buffersHeld, -1)
+		return
+	}
+
+	if int64(len(t.bufPool)) < atomic.LoadInt64(&t.bufPoolCapacity) {
+		select {
+		case t.bufPool <- buf:
+			return
+		default:
+		}
+	}
+
+	atomic.AddInt64(&t.buffersHeld, -1)
+
+	// slice headers are pooled as well, so that putting buffer to the pool doesn't allocate
+	header, _ := t.bufHeaders.Get().(*[]byte)
+	if header == nil {
+		header = new([]byte)
+	}
+
+	*header = buf
+	t.bufSpare.Put(header)
+}
+
+// spareBuf returns buffer from the spare pool or allocates new one
+func (t *transport) spareBuf() []byte {
+	if header, _ := t.bufSpare.Get().(*[]byte); header != nil {
+		buf := (*header)[:0]
+		*header = nil
+		t.bufHeaders.Put(header)
+
+		if cap(buf) >= t.bufferSize() {
+			return buf
+		}
+	}
+
+	atomic.AddInt64(&t.buffersAllocated, 1)
+
+	return make([]byte, 0, t.bufferSize())
+}
+
+// packetSize returns maximum packet size, it's changed at runtime by SetMaxPacketSize
+func (t *transport) packetSize() int {
+	return int(atomic.LoadInt64(&t.packetSizeLimit))
+}
+
+// bufferSize returns capacity of the new buffers (packet size plus room for overflow metric)
+func (t *transport) bufferSize() int {
+	return int(atomic.LoadInt64(&t.bufCapLimit))
+}
+
+// updateQueueHighWater tracks maximum send queue length
+func (t *transport) updateQueueHighWater() {
+	depth := int64(len(t.sendQueue))
+
+	atomicMax(&t.queueHighWaterPeriod, depth)
+	atomicMax(&t.queueHighWaterOverall, depth)
+}
+
+// atomicMax updates *addr to be at least value
+func atomicMax(addr *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(addr)
+		if value <= current || atomic.CompareAndSwapInt64(addr, current, value) {
+			return
+		}
+	}
+}
+
+// enqueueWithTimeout waits up to blockTimeout for the space in the send queue
+//
+// Timer is reused across the calls, so it should be protected by the caller's lock
+// (e.g. shard bufLock)
+func (t *transport) enqueueWithTimeout(timer **time.Timer, buf []byte) bool {
+	if *timer == nil {
+		*timer = time.NewTimer(t.blockTimeout)
+	} else {
+		(*timer).Reset(t.blockTimeout)
+	}
+
+	select {
+	case t.sendQueue <- t.queued(buf):
+		if !(*timer).Stop() {
+			select {
+			case <-(*timer).C:
+			default:
+			}
+		}
+
+		return true
+	case <-(*timer).C:
+		return false
+	}
+}
+
+// flush sends buffered metrics (including compressed gauges) and retained packets to the queue
+//
+// Periodic flush skips buffers smaller than MinFlushSize.
+func (t *transport) flush(periodic bool) {
+	t.flushGauges()
+
+	if t.pipeline != nil && atomic.LoadInt32(&t.pipeline.running) != 0 {
+		t.flushPipeline(periodic)
+		return
+	}
+
+	if t.pipeline != nil && t.passive {
+		t.drainPipeline()
+	}
+
+	t.flushShards(periodic)
+}
+
+// flushShards sends buffers of all the shards and local buffers (if not empty) and retained packets to the queue
+func (t *transport) flushShards(periodic bool) {
+	var now int64
+	if periodic && t.minFlushSize > 0 {
+		now = time.Now().UnixNano()
+	}
+
+	for _, s := range t.shards {
+		s.bufLock.Lock()
+		if t.flushDue(s, now) {
+			t.flushBuf(s, len(s.buf))
+		}
+		s.bufLock.Unlock()
+	}
+
+	t.localsLock.Lock()
+	for s := range t.locals {
+		s.bufLock.Lock()
+		if t.flushDue(s, now) {
+			t.flushBuf(s, len(s.buf))
+		}
+		s.bufLock.Unlock()
+	}
+	t.localsLock.Unlock()
+
+	t.submitBatch()
+	t.retryRetained()
+}
+
+// flushDue checks whether buffer should be flushed
+//
+// If now is zero, any non-empty buffer is flushed, otherwise buffers smaller
+// than MinFlushSize are kept until the oldest metric waits longer than maxFlushDelay.
+func (t *transport) flushDue(s *bufShard, now int64) bool {
+	if len(s.buf) == 0 {
+		return false
+	}
+
+	if now == 0 || len(s.buf) >= t.minFlushSize {
+		return true
+	}
+
+	return time.Duration(now-s.firstAppend) >= t.maxFlushDelay
+}
+
+// DropReason describes why packet was dropped
+type DropReason int
+
+// Drop reasons
+const (
+	// DropReasonOverflow is reported when send queue is full
+	DropReasonOverflow DropReason = iota
+	// DropReasonWriteError is reported when packet couldn't be written to the socket
+	DropReasonWriteError
+	// DropReasonClosed is reported for packets which couldn't be delivered as client was closed
+	DropReasonClosed
+	// DropReasonStale is reported for packets which waited in the queue longer than MaxPacketAge
+	DropReasonStale
+
+	// number of drop reasons
+	dropReasons = iota
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropReasonOverflow:
+		return "overflow"
+	case DropReasonWriteError:
+		return "write error"
+	case DropReasonClosed:
+		return "closed"
+	case DropReasonStale:
+		return "stale"
+	default:
+		return "unknown"
+	}
+}
+
+// packetFlushed calls OnFlush callback (if set)
+//
+// length is the packet length including trailing newline. Panics in the callback
+// are recovered and counted, so that buffer lock is released.
+func (t *transport) packetFlushed(length, lines int) {
+	if t.onFlush == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&t.flushHookPanics, 1)
+		}
+	}()
+
+	t.onFlush(length-1, lines)
+}
+
+// packetDropped calls OnDroppedPacket callback (if set) respecting the rate limit
+//
+// buf is passed with trailing newline
+func (t *transport) packetDropped(buf []byte, reason DropReason) {
+	if t.onDropped == nil {
+		return
+	}
+
+	if t.droppedRateLimit > 0 {
+		now := time.Now().Unix()
+
+		if window := atomic.LoadInt64(&t.droppedWindow); window != now {
+			if atomic.CompareAndSwapInt64(&t.droppedWindow, window, now) {
+				atomic.StoreInt64(&t.droppedInWindow, 0)
+			}
+		}
+
+		if atomic.AddInt64(&t.droppedInWindow, 1) > int64(t.droppedRateLimit) {
+			return
+		}
+	}
+
+	if len(buf) > 0 {
+		buf = buf[:len(buf)-1]
+	}
+
+	if t.copyDropped {
+		buf = append([]byte(nil), buf...)
 	}
 
+	t.onDropped(buf, reason)
 }
@@ -0,0 +1,191 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"math"
+	"time"
+)
+
+// MetricBuilder builds metric with tags and per-call options and sends it with a terminal method
+//
+//	client.Metric("req.count").Tags(route, status).Rate(0.5).Incr(1)
+//
+// Builder is a value type, setters return modified copy, so builder could be
+// stored (e.g. in the struct fields) and reused. First few tags are stored in the
+// builder itself, so builder stays on the stack and terminal methods serialize metric
+// straight into the client buffer without allocations. Name normalization and validation
+// are applied by the terminal method, as with the Client methods.
+//
+// Catalogs generated by cmd/statsdgen keep a builder per metric, and per-call
+// tags are passed to the terminal method via Tags.
+type MetricBuilder struct {
+	client *Client
+	stat   string
+	// tags are kept in inline array until it overflows, then in spill
+	inline [builderInlineTags]Tag
+	ntags  int
+	spill  []Tag
+	opts   callOptions
+}
+
+// builderInlineTags is a number of tags stored in the builder without allocations
+const builderInlineTags = 4
+
+// Metric creates builder of the metric stat
+func (c *Client) Metric(stat string) MetricBuilder {
+	return MetricBuilder{client: c, stat: stat}
+}
+
+// Name returns metric name (without the client prefix)
+func (b MetricBuilder) Name() string {
+	return b.stat
+}
+
+// Tags adds tags to the metric
+//
+// Call options (WithRate, WithTimestamp, WithTags) are accepted as well, as with
+// the Client methods. Options set later in the chain take precedence.
+func (b MetricBuilder) Tags(tags ...Tag) MetricBuilder {
+	// spill might be shared with other builders, so it's never appended in place
+	b.spill = b.spill[:len(b.spill):len(b.spill)]
+	b.addTags(tags)
+
+	return b
+}
+
+func (b *MetricBuilder) addTags(tags []Tag) {
+	for i := range tags {
+		switch tags[i].typ {
+		case typeRate:
+			b.opts.rate = math.Float64frombits(uint64(tags[i].intvalue))
+		case typeTimestamp:
+			b.opts.timestamp = tags[i].intvalue
+		case typeGroup:
+			b.addTags(*tags[i].group)
+		default:
+			if b.spill == nil && b.ntags < len(b.inline) {
+				b.inline[b.ntags] = tags[i]
+				b.ntags++
+			} else {
+				if b.spill == nil {
+					b.spill = append([]Tag(nil), b.inline[:b.ntags]...)
+				}
+
+				b.spill = append(b.spill, tags[i])
+			}
+		}
+	}
+}
+
+// tagList returns tags added to the builder
+func (b *MetricBuilder) tagList() []Tag {
+	if b.spill != nil {
+		return b.spill
+	}
+
+	return b.inline[:b.ntags]
+}
+
+// Rate sets sample rate of the counter or timing, see WithRate
+func (b MetricBuilder) Rate(rate float64) MetricBuilder {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+
+	b.opts.rate = rate
+
+	return b
+}
+
+// Timestamp sets metric timestamp, see WithTimestamp
+func (b MetricBuilder) Timestamp(ts time.Time) MetricBuilder {
+	b.opts.timestamp = ts.Unix()
+
+	return b
+}
+
+// Incr increments a counter metric, see Client.Incr
+func (b MetricBuilder) Incr(count int64) {
+	b.client.incr(b.stat, count, b.tagList(), b.opts)
+}
+
+// Decr decrements a counter metric, see Client.Decr
+func (b MetricBuilder) Decr(count int64) {
+	b.client.incr(b.stat, -count, b.tagList(), b.opts)
+}
+
+// FIncr increments a float counter metric, see Client.FIncr
+func (b MetricBuilder) FIncr(count float64) {
+	b.client.fincr(b.stat, count, b.tagList(), b.opts)
+}
+
+// Timing tracks a duration event in milliseconds, see Client.Timing
+func (b MetricBuilder) Timing(delta int64) {
+	b.client.timing(b.stat, delta, b.tagList(), b.opts)
+}
+
+// PrecisionTiming tracks a duration event, see Client.PrecisionTiming
+func (b MetricBuilder) PrecisionTiming(delta time.Duration) {
+	b.client.precisionTiming(b.stat, delta, b.tagList(), b.opts)
+}
+
+// Observe tracks a value (in milliseconds) as a timing event
+//
+// Timing is the only metric type for the distributions in statsd, so this is
+// the way to send value for the histogram or percentiles computed by statsd server.
+func (b MetricBuilder) Observe(value float64) {
+	b.client.precisionTiming(b.stat, time.Duration(value*float64(time.Millisecond)), b.tagList(), b.opts)
+}
+
+// Gauge sets or updates constant value for the interval, see Client.Gauge
+func (b MetricBuilder) Gauge(value int64) {
+	b.client.gauge(b.stat, value, b.tagList(), b.opts)
+}
+
+// GaugeDelta sends a change for a gauge, see Client.GaugeDelta
+func (b MetricBuilder) GaugeDelta(value int64) {
+	b.client.gaugeDelta(b.stat, value, b.tagList(), b.opts)
+}
+
+// FGauge sends a floating point value for a gauge, see Client.FGauge
+func (b MetricBuilder) FGauge(value float64) {
+	b.client.floatGauge(b.stat, value, b.tagList(), b.opts)
+}
+
+// FGaugeDelta sends a floating point change for a gauge, see Client.FGaugeDelta
+func (b MetricBuilder) FGaugeDelta(value float64) {
+	b.client.floatGaugeDelta(b.stat, value, b.tagList(), b.opts)
+}
+
+// SetAdd adds unique element to a set, see Client.SetAdd
+func (b MetricBuilder) SetAdd(value string) {
+	b.client.setAdd(b.stat, value, b.tagList(), b.opts)
+}
+
+// Custom sends metric of the custom type, see Client.Custom
+func (b MetricBuilder) Custom(value []byte, typeSuffix string) {
+	b.client.custom(b.stat, value, typeSuffix, b.tagList(), b.opts)
+}
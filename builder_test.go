@@ -0,0 +1,149 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetricBuilder(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), MetricPrefix("web."), TagStyle(TagFormatDatadog))
+	defer client.Close() //nolint:errcheck
+
+	compare := func(actions func(), expected []string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions()
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != strings.Join(expected, "\n") {
+					t.Errorf("unexpected packet: %#v != %#v", string(buf), strings.Join(expected, "\n"))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for metrics")
+			}
+		}
+	}
+
+	m := client.Metric("req")
+	if m.Name() != "req" {
+		t.Errorf("unexpected name %q", m.Name())
+	}
+
+	tagged := m.Tags(StringTag("route", "api"))
+
+	t.Run("Terminal", compare(func() {
+		m.Incr(2)
+		m.Decr(1)
+		m.FIncr(0.5)
+		m.Timing(3)
+		m.PrecisionTiming(1500 * time.Microsecond)
+		m.Observe(2.25)
+		m.Gauge(-1)
+		m.GaugeDelta(2)
+		m.FGauge(1.5)
+		m.FGaugeDelta(-0.5)
+		m.SetAdd("a")
+	}, []string{
+		"web.req:2|c", "web.req:-1|c", "web.req:0.5|c", "web.req:3|ms", "web.req:1.5|ms", "web.req:2.25|ms",
+		"web.req:0|g", "web.req:-1|g", "web.req:+2|g", "web.req:1.5|g", "web.req:-0.5|g", "web.req:a|s",
+	}))
+
+	t.Run("Chained", compare(func() {
+		tagged.Tags(IntTag("status", 200)).Timestamp(time.Unix(1700000000, 0)).Incr(1)
+		// builder is a value, so tagged is not affected by the chain above
+		tagged.Gauge(5)
+		tagged.Tags(IntTag("status", 500)).Rate(1).Timing(7)
+		// rate close to 1 keeps the test stable
+		for emitted := atomic.LoadInt64(&client.trans.emittedOverall); atomic.LoadInt64(&client.trans.emittedOverall) == emitted; {
+			tagged.Rate(0.999999).Incr(1)
+		}
+	}, []string{
+		"web.req:1|c|#route:api,status:200|T1700000000",
+		"web.req:5|g|#route:api",
+		"web.req:7|ms|#route:api,status:500",
+		"web.req:1|c|@0.999999|#route:api",
+	}))
+
+	t.Run("ManyTags", compare(func() {
+		many := tagged.Tags(StringTag("a", "1"), StringTag("b", "2"), StringTag("c", "3"))
+		many.Tags(StringTag("d", "4")).Incr(1)
+		// builders derived from the same one don't share appended tags
+		many.Tags(StringTag("e", "5"), WithTags(StringTag("f", "6"))).Incr(2)
+		many.Incr(3)
+	}, []string{
+		"web.req:1|c|#route:api,a:1,b:2,c:3,d:4",
+		"web.req:2|c|#route:api,a:1,b:2,c:3,e:5,f:6",
+		"web.req:3|c|#route:api,a:1,b:2,c:3",
+	}))
+
+	t.Run("Options", compare(func() {
+		// options set later in the chain take precedence
+		m.Tags(WithRate(0.5), StringTag("route", "api")).Rate(1).Timing(1)
+		m.Tags(WithTimestamp(time.Unix(1, 0))).Timestamp(time.Unix(1700000000, 0)).SetAdd("b")
+		m.Timestamp(time.Unix(1, 0)).Tags(WithTimestamp(time.Unix(1700000001, 0))).Gauge(1)
+		m.Rate(5).FIncr(1)
+	}, []string{
+		"web.req:1|ms|#route:api",
+		"web.req:b|s|T1700000000",
+		"web.req:1|g|T1700000001",
+		"web.req:1|c",
+	}))
+}
+
+func TestMetricBuilderAllocs(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", MetricPrefix("metricPrefix."), MaxPacketSize(65000), SuppressMTUWarning(), FlushInterval(time.Hour),
+		TagStyle(TagFormatDatadog))
+	defer client.Close() //nolint:errcheck
+
+	route := StringTag("route", "api")
+	stored := client.Metric("stored").Tags(route)
+
+	for _, tt := range []struct {
+		name   string
+		action func()
+	}{
+		{"Incr", func() { client.Metric("req.count").Tags(route, IntTag("status", 200)).Rate(1).Incr(1) }},
+		{"Timing", func() { client.Metric("req.time").Tags(route).Timing(15) }},
+		{"Observe", func() { client.Metric("req.size").Tags(route).Observe(1.5) }},
+		{"Gauge", func() { client.Metric("depth").Timestamp(time.Unix(1700000000, 0)).Gauge(-3) }},
+		{"SetAdd", func() { client.Metric("users").SetAdd("bob") }},
+		{"Stored", func() { stored.Incr(1) }},
+		{"Options", func() { stored.Tags(WithRate(1), WithTimestamp(time.Unix(1700000000, 0))).Incr(1) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if allocs := testing.AllocsPerRun(1000, tt.action); allocs != 0 {
+				t.Errorf("unexpected allocations: %v", allocs)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import "runtime/debug"
+
+// readBuildInfo reads build information of the binary, it's replaced in tests
+var readBuildInfo = debug.ReadBuildInfo
+
+// buildInfoTags returns tags describing the binary build
+//
+// Tags are omitted if the information is not available, e.g. version is
+// not set for binaries built out of the module tree (go run, go test).
+func buildInfoTags() []Tag {
+	info, ok := readBuildInfo()
+	if !ok || info == nil {
+		return nil
+	}
+
+	var tags []Tag
+
+	if version := info.Main.Version; version != "" && version != "(devel)" {
+		tags = append(tags, StringTag("version", version))
+	}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			tags = append(tags, StringTag("vcs_sha", setting.Value))
+		case "vcs.modified":
+			tags = append(tags, StringTag("vcs_dirty", setting.Value))
+		}
+	}
+
+	return tags
+}
+
+// withBuildInfoTags prepends build info tags to the default tags
+//
+// Default tags set explicitly override build info tags with the same name.
+func withBuildInfoTags(tags []Tag) []Tag {
+	var result []Tag
+
+outer:
+	for _, buildTag := range buildInfoTags() {
+		for _, tag := range tags {
+			if tag.name == buildTag.name {
+				continue outer
+			}
+		}
+
+		result = append(result, buildTag)
+	}
+
+	return append(result, tags...)
+}
@@ -0,0 +1,100 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+func TestBuildInfoTags(t *testing.T) {
+	defer func(orig func() (*debug.BuildInfo, bool)) { readBuildInfo = orig }(readBuildInfo)
+
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	stamped := &debug.BuildInfo{
+		Main: debug.Module{Path: "example.com/app", Version: "v1.2.3"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "0123abcd"},
+			{Key: "vcs.time", Value: "2024-01-01T00:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		info     *debug.BuildInfo
+		options  []Option
+		expected string
+	}{
+		{
+			name:     "Stamped",
+			info:     stamped,
+			expected: "req,version=v1.2.3,vcs_sha=0123abcd,vcs_dirty=true:1|c",
+		},
+		{
+			name:     "Override",
+			info:     stamped,
+			options:  []Option{DefaultTags(StringTag("version", "canary"), StringTag("region", "eu"))},
+			expected: "req,vcs_sha=0123abcd,vcs_dirty=true,version=canary,region=eu:1|c",
+		},
+		{
+			name:     "Devel",
+			info:     &debug.BuildInfo{Main: debug.Module{Path: "example.com/app", Version: "(devel)"}},
+			options:  []Option{DefaultTags(StringTag("region", "eu"))},
+			expected: "req,region=eu:1|c",
+		},
+		{
+			name:     "Missing",
+			expected: "req:1|c",
+		},
+		{
+			name:     "Disabled",
+			info:     stamped,
+			options:  []Option{BuildInfoTags(false)},
+			expected: "req:1|c",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			readBuildInfo = func() (*debug.BuildInfo, bool) { return tt.info, tt.info != nil }
+
+			client := NewClient(inSocket.LocalAddr().String(), append([]Option{BuildInfoTags(true)}, tt.options...)...)
+			client.Incr("req", 1)
+			_ = client.Close()
+
+			select {
+			case buf := <-received:
+				if string(buf) != tt.expected {
+					t.Errorf("unexpected output: %#v != %#v", string(buf), tt.expected)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for metrics")
+			}
+		})
+	}
+}
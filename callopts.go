@@ -0,0 +1,172 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"math"
+	"time"
+)
+
+// CallOption is a per-call option passed to the metric methods along with the tags
+//
+//	client.Incr("req.count", 1, statsd.WithRate(0.1), statsd.StringTag("route", "api"))
+//
+// Options are special Tag values, so methods with variadic tags accept them
+// without signature changes (including tags passed as a slice), options and
+// tags could be mixed in any order. Plain tags are checked for options with
+// a single pass, so the fast path doesn't allocate. Options are ignored
+// everywhere else tags are accepted (DefaultTags, CloneWithTags, TagSet, Tag.Append),
+// except for the tags grouped with WithTags.
+type CallOption = Tag
+
+// callOptions are parsed per-call options
+type callOptions struct {
+	// rate is per-call sample rate, zero if not set
+	rate float64
+	// timestamp is unix timestamp in seconds, zero if not set
+	timestamp int64
+}
+
+// WithRate sets sample rate for the counter or timing
+//
+// Metric is sampled with the rate instead of the client sample rate and sent
+// with the rate annotation, so that statsd server scales it back. Rate is
+// ignored for gauges and sets. Rate outside of (0, 1] means no sampling.
+func WithRate(rate float64) CallOption {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+
+	return Tag{typ: typeRate, intvalue: int64(math.Float64bits(rate))}
+}
+
+// WithTimestamp sets metric timestamp
+//
+// Timestamp is sent (with seconds precision) only in the formats which support
+// it (TagFormatDatadog, as |T field), it's ignored for other formats.
+func WithTimestamp(ts time.Time) CallOption {
+	return Tag{typ: typeTimestamp, intvalue: ts.Unix()}
+}
+
+// WithTags groups tags (and options) into single option
+//
+// It's useful to pass a slice of tags along with other tags and options:
+//
+//	client.Incr("req.count", 1, statsd.WithTags(commonTags...), statsd.StringTag("route", "api"))
+func WithTags(tags ...Tag) CallOption {
+	return Tag{typ: typeGroup, group: &tags}
+}
+
+// sampleRate returns per-call sample rate or 1 if not set
+func (opts callOptions) sampleRate() float64 {
+	if opts.rate == 0 {
+		return 1
+	}
+
+	return opts.rate
+}
+
+// splitCallOptions separates call options from the tags
+//
+// If there are no options, tags are returned as is without allocations.
+func splitCallOptions(tags []Tag) (plain []Tag, opts callOptions) {
+	for i := range tags {
+		// types after typeInt64 are call options
+		if tags[i].typ > typeInt64 {
+			return splitCallOptionsSlow(tags)
+		}
+	}
+
+	return tags, opts
+}
+
+// splitCallOptionsSlow is a slow path of splitCallOptions, kept separate so that the fast path is inlined
+//
+//go:noinline
+func splitCallOptionsSlow(tags []Tag) ([]Tag, callOptions) {
+	var opts callOptions
+
+	plain := collectCallOptions(make([]Tag, 0, len(tags)), &opts, tags)
+
+	return plain, opts
+}
+
+func collectCallOptions(plain []Tag, opts *callOptions, tags []Tag) []Tag {
+	for i := range tags {
+		switch tags[i].typ {
+		case typeRate:
+			opts.rate = math.Float64frombits(uint64(tags[i].intvalue))
+		case typeTimestamp:
+			opts.timestamp = tags[i].intvalue
+		case typeGroup:
+			plain = collectCallOptions(plain, opts, *tags[i].group)
+		default:
+			plain = append(plain, tags[i])
+		}
+	}
+
+	return plain
+}
+
+// plainTags returns tags without call options, tags grouped with WithTags are flattened
+//
+// Call options make sense only for the metric methods, so they're dropped from
+// the tags which are kept around (DefaultTags, CloneWithTags, TagSet).
+func plainTags(tags []Tag) []Tag {
+	plain, _ := splitCallOptions(tags)
+
+	return plain
+}
+
+// SplitCallOptions separates call options from the tags
+//
+// It's intended for Statter implementations (e.g. test recorders). Rate is zero if
+// it's not set with WithRate, timestamp is zero time if it's not set with WithTimestamp.
+func SplitCallOptions(tags []Tag) (plain []Tag, rate float64, timestamp time.Time) {
+	plain, opts := splitCallOptions(tags)
+
+	if opts.timestamp != 0 {
+		timestamp = time.Unix(opts.timestamp, 0)
+	}
+
+	return plain, opts.rate, timestamp
+}
+
+// supportsTimestamps returns true if timestamps could be sent in the format
+// as DogStatsD |T field
+func supportsTimestamps(format *TagFormat) bool {
+	return format.Placement == TagPlacementSuffix && format.FirstSeparator == TagFormatDatadog.FirstSeparator
+}
+
+// appendTimestamp appends timestamp field if it's set and supported by the format
+func appendTimestamp(buf []byte, timestamp int64, format *TagFormat) []byte {
+	if timestamp == 0 || !supportsTimestamps(format) {
+		return buf
+	}
+
+	buf = append(buf, '|', 'T')
+
+	return appendInt(buf, timestamp)
+}
@@ -0,0 +1,229 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallOptions(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	ts := time.Unix(1700000000, 0)
+
+	compare := func(client *Client, actions func(*Client), expected []string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions(client)
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != strings.Join(expected, "\n") {
+					t.Errorf("unexpected packet: %#v != %#v", string(buf), strings.Join(expected, "\n"))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for metrics")
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		style    *TagFormat
+		expected []string
+	}{
+		{
+			name:  "Datadog",
+			style: TagFormatDatadog,
+			expected: []string{
+				"req:1|c|@0.999999|#route:api,status:200",
+				"req:1|c|@0.999999|#route:api,status:200",
+				"req:1|c|#route:api,status:200|T1700000000",
+				"req:2.5|c|T1700000000",
+				"lat:5|ms|@0.999999|#route:api",
+				"lat:1.5|ms|#route:api|T1700000000",
+				"depth:0|g|#q:a|T1700000000",
+				"depth:-3|g|#q:a|T1700000000",
+				"depth:+1|g|#q:a",
+				"temp:1.5|g|T1700000000",
+				"temp:-0.5|g",
+				"users:bob|s|#route:api|T1700000000",
+			},
+		},
+		{
+			name:  "Influx",
+			style: TagFormatInfluxDB,
+			expected: []string{
+				"req,route=api,status=200:1|c|@0.999999",
+				"req,route=api,status=200:1|c|@0.999999",
+				"req,route=api,status=200:1|c",
+				"req:2.5|c",
+				"lat,route=api:5|ms|@0.999999",
+				"lat,route=api:1.5|ms",
+				"depth,q=a:0|g",
+				"depth,q=a:-3|g",
+				"depth,q=a:+1|g",
+				"temp:1.5|g",
+				"temp:-0.5|g",
+				"users,route=api:bob|s",
+			},
+		},
+	} {
+		client := NewClient(inSocket.LocalAddr().String(), TagStyle(tc.style), FlushInterval(time.Hour))
+
+		common := []Tag{StringTag("route", "api"), WithRate(0.999999)}
+
+		t.Run(tc.name, compare(client,
+			func(c *Client) {
+				// options and tags in any order, rate close to 1 to keep the test stable
+				for atomic.LoadInt64(&c.trans.emittedOverall) == 0 {
+					c.Incr("req", 1, WithRate(0.999999), StringTag("route", "api"), IntTag("status", 200))
+				}
+
+				for atomic.LoadInt64(&c.trans.emittedOverall) == 1 {
+					c.Incr("req", 1, WithTags(common...), IntTag("status", 200))
+				}
+
+				c.Incr("req", 1, StringTag("route", "api"), WithTimestamp(ts), IntTag("status", 200))
+				c.FIncr("req", 2.5, WithTags(WithTimestamp(ts)))
+
+				for atomic.LoadInt64(&c.trans.emittedOverall) == 4 {
+					c.Timing("lat", 5, common...)
+				}
+
+				c.PrecisionTiming("lat", 1500*time.Microsecond, WithTimestamp(ts), StringTag("route", "api"))
+				c.Gauge("depth", -3, WithTimestamp(ts), StringTag("q", "a"))
+				// rate is ignored for gauges
+				c.GaugeDelta("depth", 1, StringTag("q", "a"), WithRate(0.0001))
+				c.FGauge("temp", 1.5, WithTimestamp(ts))
+				c.FGaugeDelta("temp", -0.5, WithRate(0.0001))
+				c.SetAdd("users", "bob", WithTimestamp(ts), StringTag("route", "api"))
+			},
+			tc.expected))
+
+		_ = client.Close()
+	}
+}
+
+func TestCallOptionsSampling(t *testing.T) {
+	client := NewClient("127.0.0.1:4444", FlushInterval(time.Hour), DefaultSampleRate(1))
+	defer client.Close() //nolint:errcheck
+
+	// rate is checked before any other processing
+	for i := 0; i < 1000; i++ {
+		client.Incr("req", 1, WithRate(0.01))
+		client.Timing("lat", 1, WithRate(0.01))
+	}
+
+	if emitted := atomic.LoadInt64(&client.trans.emittedOverall); emitted == 0 || emitted > 200 {
+		t.Errorf("unexpected number of emitted metrics: %d", emitted)
+	}
+
+	// invalid rate means no sampling
+	for i := 0; i < 100; i++ {
+		client.Incr("req", 1, WithRate(-1))
+	}
+
+	if tag := WithRate(5); tag.intvalue != WithRate(1).intvalue {
+		t.Error("rate wasn't normalized")
+	}
+}
+
+func TestSplitCallOptions(t *testing.T) {
+	tags := []Tag{StringTag("a", "1"), IntTag("b", 2)}
+
+	plain, rate, ts := SplitCallOptions(tags)
+	if &plain[0] != &tags[0] || rate != 0 || !ts.IsZero() {
+		t.Errorf("unexpected result for plain tags: %v %v %v", plain, rate, ts)
+	}
+
+	plain, rate, ts = SplitCallOptions([]Tag{
+		WithTimestamp(time.Unix(1700000000, 0)),
+		StringTag("a", "1"),
+		WithTags(IntTag("b", 2), WithRate(0.5), WithTags(StringTag("c", "3"))),
+	})
+
+	if len(plain) != 3 || plain[0].name != "a" || plain[1].name != "b" || plain[2].name != "c" {
+		t.Errorf("unexpected tags: %v", plain)
+	}
+
+	if rate != 0.5 || ts.Unix() != 1700000000 {
+		t.Errorf("unexpected options: %v %v", rate, ts)
+	}
+
+	if allocs := testing.AllocsPerRun(100, func() { SplitCallOptions(tags) }); allocs != 0 {
+		t.Errorf("unexpected allocations for plain tags: %v", allocs)
+	}
+}
+
+func TestCallOptionsNotTags(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+
+	client := NewClient("127.0.0.1:4444", TagStyle(TagFormatDatadog),
+		DefaultTags(WithRate(0.1), StringTag("a", "1"), WithTags(IntTag("b", 2), WithTimestamp(ts))))
+	defer client.Close() //nolint:errcheck
+
+	if string(client.defaultTagBytes) != "a:1,b:2" || len(client.defaultTags) != 2 {
+		t.Errorf("unexpected default tags: %q", client.defaultTagBytes)
+	}
+
+	clone := client.CloneWithTags(WithTimestamp(ts), StringTag("c", "3"), WithRate(0.5))
+	if string(clone.defaultTagBytes) != "a:1,b:2,c:3" || len(clone.defaultTags) != 3 {
+		t.Errorf("unexpected clone tags: %q", clone.defaultTagBytes)
+	}
+
+	set := NewTagSet(WithRate(0.5), StringTag("a", "1")).With(WithTags(IntTag("b", 2), WithTimestamp(ts)))
+	if set.Len() != 2 {
+		t.Errorf("unexpected tag set: %v", set.list())
+	}
+
+	if buf := WithRate(0.5).Append(nil, TagFormatDatadog); len(buf) != 0 {
+		t.Errorf("option was serialized as tag: %q", buf)
+	}
+}
+
+func TestAppendCallOptions(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+
+	for _, tc := range []struct {
+		line     []byte
+		expected string
+	}{
+		{AppendCounter(nil, "", "req", 1, []Tag{WithRate(0.5), StringTag("route", "api")}, TagFormatDatadog), "req:1|c|@0.5|#route:api\n"},
+		{AppendFloatCounter(nil, "", "req", 1.5, []Tag{WithTimestamp(ts)}, TagFormatDatadog), "req:1.5|c|T1700000000\n"},
+		{AppendTiming(nil, "", "lat", 3, []Tag{WithRate(0.5), WithTimestamp(ts)}, TagFormatInfluxDB), "lat:3|ms|@0.5\n"},
+		{AppendPrecisionTiming(nil, "", "lat", time.Millisecond, []Tag{WithTags(StringTag("route", "api"), WithRate(0.1))}, nil), "lat,route=api:1|ms|@0.1\n"},
+		{AppendGauge(nil, "", "g", -1, []Tag{WithTimestamp(ts)}, TagFormatDatadog), "g:0|g|T1700000000\ng:-1|g|T1700000000\n"},
+		{AppendSet(nil, "", "s", "x", []Tag{WithRate(0.5)}, TagFormatDatadog), "s:x|s\n"},
+	} {
+		if string(tc.line) != tc.expected {
+			t.Errorf("unexpected line %q != %q", string(tc.line), tc.expected)
+		}
+	}
+}
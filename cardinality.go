@@ -0,0 +1,231 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// CardinalityTopNames is number of metric names in CardinalityReport.Top
+const CardinalityTopNames = 10
+
+// cardinalityShards is number of independently locked parts of the tracker
+const cardinalityShards = 16
+
+// CardinalityReport is a snapshot of metric names cardinality, see TrackCardinality
+type CardinalityReport struct {
+	// Names is number of distinct metric names (with prefix) emitted since client was created
+	Names int
+	// Series is number of distinct metric names with tags, it's zero if TrackSeriesCardinality is not enabled
+	Series int
+	// Top is metric names with the most emissions (up to CardinalityTopNames), most emitted first
+	Top []NameCount
+	// CapReached is set if new names (or series) were not tracked as maxNames limit was reached
+	CapReached bool
+	// Untracked is number of emissions of the names which were not tracked
+	Untracked int64
+}
+
+// NameCount is number of emissions of the metric name
+type NameCount struct {
+	Name  string
+	Count int64
+}
+
+// cardinalityTracker records distinct metric names and number of their emissions
+type cardinalityTracker struct {
+	// these fields are updated with atomic operations
+	names      int64
+	series     int64
+	untracked  int64
+	capReached int32
+
+	maxNames    int64
+	trackSeries bool
+
+	shards [cardinalityShards]cardinalityShard
+}
+
+type cardinalityShard struct {
+	lock   sync.Mutex
+	counts map[cardinalityKey]int64
+	series map[uint64]struct{}
+}
+
+// cardinalityKey is metric name, prefix is kept separately so that it's not concatenated on the hot path
+type cardinalityKey struct {
+	prefix string
+	name   string
+}
+
+func newCardinalityTracker(maxNames int, trackSeries bool) *cardinalityTracker {
+	if maxNames <= 0 {
+		return nil
+	}
+
+	tracker := &cardinalityTracker{
+		maxNames:    int64(maxNames),
+		trackSeries: trackSeries,
+	}
+
+	for i := range tracker.shards {
+		tracker.shards[i].counts = make(map[cardinalityKey]int64)
+		if trackSeries {
+			tracker.shards[i].series = make(map[uint64]struct{})
+		}
+	}
+
+	return tracker
+}
+
+// reserve accounts new distinct value, it returns false if limit is reached
+func (tracker *cardinalityTracker) reserve(counter *int64) bool {
+	if atomic.AddInt64(counter, 1) <= tracker.maxNames {
+		return true
+	}
+
+	atomic.AddInt64(counter, -1)
+	atomic.StoreInt32(&tracker.capReached, 1)
+
+	return false
+}
+
+// observe counts emission of the metric name
+func (tracker *cardinalityTracker) observe(prefix, name string) {
+	// FNV-1a
+	hash := uint32(2166136261)
+	for i := 0; i < len(prefix); i++ {
+		hash ^= uint32(prefix[i])
+		hash *= 16777619
+	}
+	for i := 0; i < len(name); i++ {
+		hash ^= uint32(name[i])
+		hash *= 16777619
+	}
+
+	shard := &tracker.shards[hash%cardinalityShards]
+	key := cardinalityKey{prefix: prefix, name: name}
+
+	shard.lock.Lock()
+	if count, ok := shard.counts[key]; ok {
+		shard.counts[key] = count + 1
+	} else if tracker.reserve(&tracker.names) {
+		shard.counts[key] = 1
+	} else {
+		atomic.AddInt64(&tracker.untracked, 1)
+	}
+	shard.lock.Unlock()
+}
+
+// observeSeries records metric name with tags (as a hash)
+func (tracker *cardinalityTracker) observeSeries(hash uint64) {
+	shard := &tracker.shards[hash%cardinalityShards]
+
+	shard.lock.Lock()
+	if _, ok := shard.series[hash]; !ok && tracker.reserve(&tracker.series) {
+		shard.series[hash] = struct{}{}
+	}
+	shard.lock.Unlock()
+}
+
+// seriesHash hashes metric name with default and per-call tags
+func (c *Client) seriesHash(stat string, tags []Tag) uint64 {
+	hash := fnvAdd(fnvAdd(fnvOffset64, c.metricPrefix), stat)
+	hash = fnvAdd(hash, c.defaultTagBytes)
+
+	for i := range tags {
+		hash = fnvAdd(hash, tags[i].name)
+		if tags[i].typ == typeString {
+			hash = fnvAdd(hash, tags[i].strvalue)
+		} else {
+			hash = (hash ^ uint64(tags[i].intvalue)) * fnvPrime64
+		}
+	}
+
+	return hash
+}
+
+// FNV-1a 64-bit
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnvAdd hashes s followed by a separator, so that "ab"+"c" and "a"+"bc" differ
+func fnvAdd[T string | []byte](hash uint64, s T) uint64 {
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= fnvPrime64
+	}
+
+	return (hash ^ 0xff) * fnvPrime64
+}
+
+// Cardinality returns distinct metric names emitted since client was created
+//
+// Report is empty if TrackCardinality is not enabled.
+func (c *Client) Cardinality() CardinalityReport {
+	tracker := c.trans.cardinality
+	if tracker == nil {
+		return CardinalityReport{}
+	}
+
+	report := CardinalityReport{
+		Names:      int(atomic.LoadInt64(&tracker.names)),
+		Series:     int(atomic.LoadInt64(&tracker.series)),
+		CapReached: atomic.LoadInt32(&tracker.capReached) != 0,
+		Untracked:  atomic.LoadInt64(&tracker.untracked),
+	}
+
+	var all []NameCount
+
+	for i := range tracker.shards {
+		shard := &tracker.shards[i]
+
+		shard.lock.Lock()
+		for key, count := range shard.counts {
+			all = append(all, NameCount{Name: key.prefix + key.name, Count: count})
+		}
+		shard.lock.Unlock()
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+
+		return all[i].Name < all[j].Name
+	})
+
+	if len(all) > CardinalityTopNames {
+		all = all[:CardinalityTopNames]
+	}
+
+	report.Top = all
+
+	return report
+}
@@ -0,0 +1,148 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCardinality(t *testing.T) {
+	emit := func(client *Client) {
+		for i := 0; i < 10; i++ {
+			client.Incr("req.count", 1)
+		}
+
+		for i := 0; i < 6; i++ {
+			client.Timing("req.time", 5, IntTag("route", i%3))
+		}
+
+		rpc := client.CloneWithPrefix("rpc.")
+		for i := 0; i < 3; i++ {
+			rpc.Incr("req.count", 1)
+		}
+
+		// gauge reset to zero is not counted as a separate emission
+		client.Gauge("queue.depth", -1)
+		client.Gauge("queue.depth", 1)
+		client.SetAdd("users", "bob", StringTag("app", "web"))
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour))
+		defer client.Close() //nolint:errcheck
+
+		emit(client)
+
+		if report := client.Cardinality(); !reflect.DeepEqual(report, CardinalityReport{}) {
+			t.Errorf("unexpected report: %+v", report)
+		}
+	})
+
+	t.Run("Tracked", func(t *testing.T) {
+		client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), TrackCardinality(100), TrackSeriesCardinality(true),
+			DenyMetrics("debug.*"))
+		defer client.Close() //nolint:errcheck
+
+		emit(client)
+		// filtered metrics are not emitted
+		client.Incr("debug.count", 1)
+
+		expected := CardinalityReport{
+			Names:  5,
+			Series: 7,
+			Top: []NameCount{
+				{"req.count", 10},
+				{"req.time", 6},
+				{"rpc.req.count", 3},
+				{"queue.depth", 2},
+				{"users", 1},
+			},
+		}
+
+		if report := client.Cardinality(); !reflect.DeepEqual(report, expected) {
+			t.Errorf("unexpected report: %+v != %+v", report, expected)
+		}
+	})
+
+	t.Run("Capped", func(t *testing.T) {
+		client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), TrackCardinality(2))
+		defer client.Close() //nolint:errcheck
+
+		emit(client)
+
+		for i := 0; i < 100; i++ {
+			client.Incr("req.count", 1)
+		}
+
+		expected := CardinalityReport{
+			Names: 2,
+			Top: []NameCount{
+				{"req.count", 110},
+				{"req.time", 6},
+			},
+			CapReached: true,
+			Untracked:  6,
+		}
+
+		if report := client.Cardinality(); !reflect.DeepEqual(report, expected) {
+			t.Errorf("unexpected report: %+v != %+v", report, expected)
+		}
+	})
+
+	t.Run("TopNames", func(t *testing.T) {
+		client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), TrackCardinality(1000))
+		defer client.Close() //nolint:errcheck
+
+		names := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"}
+		for i, name := range names {
+			for j := 0; j <= i; j++ {
+				client.Incr(name, 1)
+			}
+		}
+
+		report := client.Cardinality()
+		if report.Names != len(names) || len(report.Top) != CardinalityTopNames {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+
+		if report.Top[0] != (NameCount{"l", 12}) || report.Top[CardinalityTopNames-1] != (NameCount{"c", 3}) {
+			t.Errorf("unexpected top names: %+v", report.Top)
+		}
+	})
+}
+
+func TestCardinalityAllocs(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), MaxPacketSize(65000), SuppressMTUWarning(), TrackCardinality(100),
+		TrackSeriesCardinality(true))
+	defer client.Close() //nolint:errcheck
+
+	route := StringTag("route", "api")
+
+	if allocs := testing.AllocsPerRun(1000, func() { client.Incr("req.count", 1, route) }); allocs != 0 {
+		t.Errorf("unexpected allocations: %v", allocs)
+	}
+}
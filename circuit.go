@@ -0,0 +1,103 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// circuit breaker states
+const (
+	circuitClosed = iota
+	circuitOpen
+)
+
+// IsCircuitOpen returns true if circuit breaker is open
+//
+// While circuit breaker is open, metrics are discarded without being
+// serialized. See CircuitBreaker option.
+func (c *Client) IsCircuitOpen() bool {
+	return atomic.LoadInt32(&c.trans.circuitState) == circuitOpen
+}
+
+// deliveryFailed records dial or write failure, opening circuit breaker if
+// failures persist for longer than circuitOpenAfter
+func (t *transport) deliveryFailed(log SomeLogger) {
+	if t.circuitOpenAfter <= 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+
+	atomic.CompareAndSwapInt64(&t.failingSince, 0, now)
+
+	if now-atomic.LoadInt64(&t.failingSince) < int64(t.circuitOpenAfter) {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&t.circuitState, circuitClosed, circuitOpen) {
+		if t.slogger != nil {
+			t.slogger.LogAttrs(context.Background(), slog.LevelWarn, "statsd circuit breaker open")
+		} else {
+			log.Printf("[STATSD] Circuit breaker open, metrics are discarded")
+		}
+	}
+}
+
+// packetDelivered resets failure streak
+func (t *transport) packetDelivered() {
+	if t.circuitOpenAfter > 0 && atomic.LoadInt64(&t.failingSince) != 0 {
+		atomic.StoreInt64(&t.failingSince, 0)
+	}
+}
+
+// connected closes circuit breaker (if open) once probe connection succeeds
+func (t *transport) connected(log SomeLogger) {
+	if t.circuitOpenAfter <= 0 {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&t.circuitState, circuitOpen, circuitClosed) {
+		atomic.StoreInt64(&t.failingSince, 0)
+
+		if t.slogger != nil {
+			t.slogger.LogAttrs(context.Background(), slog.LevelInfo, "statsd circuit breaker closed")
+		} else {
+			log.Printf("[STATSD] Circuit breaker closed, resuming")
+		}
+	}
+}
+
+// retryInterval returns time to wait before next connection attempt
+func (t *transport) retryInterval(retryTimeout time.Duration) time.Duration {
+	if atomic.LoadInt32(&t.circuitState) == circuitOpen {
+		return t.circuitProbeInterval
+	}
+
+	return retryTimeout
+}
@@ -25,9 +25,16 @@ SOFTWARE.
 */
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"os"
-	"strconv"
+	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -37,26 +44,211 @@ import (
 type Client struct {
 	trans        *transport
 	metricPrefix string
+	prefixBytes  []byte
 	defaultTags  []Tag
+	// defaultTags serialized in the client tag format
+	defaultTagBytes []byte
+	nameAppender    func(dst []byte, name string) []byte
+	nameReplace     byte
+	tagMapper       func(name, value string) (string, string, bool)
+	filter          *metricFilter
+	limiter         *rateLimiter
+
+	isClone  bool
+	detached int32
+
+	// buffer of the Local handle
+	local *bufShard
+	// metrics are appended to the emitter buffer without locking
+	unlocked bool
+	// cache of formatted hot metric names, nil if disabled
+	names *nameCache
+	// name is rewritten by NormalizeNames or the format restrictions
+	rewriteNames bool
+	// metrics are sent through the high priority lane, see WithPriority
+	high bool
+	// destinations picked by metric name, nil if Route is not used
+	router *router
+	// clones of the client sending to the router destinations, created on first use
+	routed atomic.Pointer[[]*Client]
 }
 
 type transport struct {
 	// these fields are updated with atomic operations,
 	// so they should be at the top for proper alignment
-	lostPacketsPeriod  int64
-	lostPacketsOverall int64
+	lostPacketsPeriod     int64
+	lostPacketsOverall    int64
+	lostMetricsPeriod     int64
+	lostMetricsOverall    int64
+	lostBytesPeriod       int64
+	lostBytesOverall      int64
+	flushHookPanics       int64
+	lostPacketsPolled     int64
+	lostMetricsPolled     int64
+	writeErrorsPolled     int64
+	packetSizeLimit       int64
+	recommendedPacketSize int64
+	pendingPackets        int64
+	filteredMetrics       int64
+	invalidMetrics        int64
+	closedMetrics         int64
+	abandonedPackets      int64
+	abandonedMetrics      int64
+	consecutiveFailures   int64
+	lastSuccessfulWrite   int64
+	oversizedPeriod       int64
+	oversizedOverall      int64
+	bufCapLimit           int64
+	droppedWindow         int64
+	droppedInWindow       int64
+	rateLimitedPeriod     int64
+	rateLimitedOverall    int64
+	failingSince          int64
+	queueHighWaterPeriod  int64
+	queueHighWaterOverall int64
+	poolMissesPeriod      int64
+	poolMissesOverall     int64
+	buffersAllocated      int64
+	missesSinceGrowth     int64
+	bufPoolCapacity       int64
+	writeErrorsPeriod     int64
+	sentPacketsPeriod     int64
+	sentBytesPeriod       int64
+	writeErrorsOverall    int64
+	sentPacketsOverall    int64
+	sentBytesOverall      int64
+	dialFailuresPeriod    int64
+	dialFailuresOverall   int64
+	connectsOverall       int64
+	lastErrorLog          int64
+	emittedOverall        int64
+	laneLostPackets       [2]int64
+	laneLostMetrics       [2]int64
+	lostByReason          [dropReasons]int64
+	stalePackets          int64
+	staleMetrics          int64
+	buffersHeld           int64
+	sampleRate            uint64
+	circuitState          int32
+	connectedLoops        int32
+	mtuWarned             int32
+	sendLoopsActive       int32
+	closed                int32
+
+	maxMetricsPerPacket int
+	suppressMTUWarning  bool
+	floatPrecision      int
+	tagFormat           *TagFormat
+	nameSeparator       string
+	slogger             *slog.Logger
+	errorLogInterval    time.Duration
+
+	reportHandler func(r Report)
+
+	onDropped       func(packet []byte, reason DropReason)
+	onFlush         func(packetLen int, metrics int)
+	errorClassifier func(err error) string
+	jobNames        atomic.Pointer[map[string]*jobNames]
+	// drained is closed once there are no pending packets, see FlushAndWait
+	drained          chan struct{}
+	drainedLock      sync.Mutex
+	jobNamesLock     sync.Mutex
+	droppedRateLimit int
+	copyDropped      bool
+
+	sendLoopCount int
+
+	bufPool          chan []byte
+	bufPoolMin       int
+	bufPoolMax       int
+	bufPoolPrewarmed int64
+	bufSpare         sync.Pool
+	bufHeaders       sync.Pool
+	maxBuffered      int64
+	shards           []*bufShard
+	shardPool        sync.Pool
+	chunkPool        sync.Pool
+	pipeline         *pipeline
+	unlocked         *unlockedBuf
+	locals           map[*bufShard]struct{}
+	localsLock       sync.Mutex
+	localPool        sync.Pool
+	queueClosed      bool
+	immediate        bool
+	minFlushSize     int
+	maxFlushDelay    time.Duration
+	sendQueue        chan queuedPacket
+	syncQueue        chan syncPacket
+	syncErr          atomic.Pointer[error]
+
+	// high priority lane, nil if PriorityLanes is not enabled
+	highShard *bufShard
+	highQueue chan queuedPacket
+
+	// packets waiting in the queue longer are dropped, see MaxPacketAge
+	maxPacketAge time.Duration
+
+	// custom metric types (suffix -> "|suffix"), see RegisterMetricType
+	customTypesLock sync.Mutex
+	customTypes     atomic.Pointer[map[string][]byte]
+
+	reportersLock sync.Mutex
+	reporters     []flushReporter
+	rateMinWindow time.Duration
+	// now is time source for reporters (for tests)
+	now func() time.Time
 
-	maxPacketSize int
-	tagFormat     *TagFormat
+	batchSize  int
+	batchQueue chan *packetBatch
+	batchLock  sync.Mutex
+	batch      *packetBatch
+	batchTimer *time.Timer
+	batchPool  sync.Pool
+	// packets of the current batch to be reported to OnFlush
+	staged []stagedPacket
 
-	bufPool   chan []byte
-	buf       []byte
-	bufSize   int
-	bufLock   sync.Mutex
-	sendQueue chan []byte
+	blockTimeout time.Duration
+	dropPolicy   int
+	retained     []queuedPacket
+	retainMax    int
+	retainLock   sync.Mutex
+
+	newlinePolicy int
+
+	gauges *gaugeState
+	// last values of the gauges in the flush window, nil if CompressGauges is not enabled
+	gaugeWindow *gaugeWindow
+	// distinct metric names, nil if TrackCardinality is not enabled
+	cardinality *cardinalityTracker
+
+	healthLock     sync.Mutex
+	lastDialError  error
+	lastWriteError error
+
+	circuitOpenAfter     time.Duration
+	circuitProbeInterval time.Duration
+
+	tee     io.Writer
+	teeLock sync.Mutex
+
+	dump     io.Writer
+	dumpLock sync.Mutex
+	dumpBuf  []byte
+
+	writeRetries      int
+	writeRetryBackoff time.Duration
+	dial              func(ctx context.Context, network, addr string) (net.Conn, error)
+	addr              string
+
+	startOnce  sync.Once
+	startLoops func()
+	started    bool
+	passive    bool
 
 	shutdown     chan struct{}
 	shutdownOnce sync.Once
+	closeTimeout time.Duration
+	closeExpired chan struct{}
 	shutdownWg   sync.WaitGroup
 }
 
@@ -64,7 +256,11 @@ type transport struct {
 //
 // Client connects to statsd server at addr ("host:port")
 //
-// Client settings could be controlled via functions of type Option
+// Client settings could be controlled via functions of type Option.
+//
+// Background goroutines (flushing, sending and reporting) are started when
+// first metric is emitted, so client which is never used doesn't hold any
+// resources even if it's not closed.
 func NewClient(addr string, options ...Option) *Client {
 	opts := ClientOptions{
 		Addr:              addr,
@@ -78,74 +274,555 @@ func NewClient(addr string, options ...Option) *Client {
 		Logger:            log.New(os.Stderr, DefaultLogPrefix, log.LstdFlags),
 		BufPoolCapacity:   DefaultBufPoolCapacity,
 		SendQueueCapacity: DefaultSendQueueCapacity,
+		SendBatchSize:     DefaultSendBatchSize,
 		SendLoopCount:     DefaultSendLoopCount,
+		BufferShards:      DefaultBufferShards,
 		TagFormat:         TagFormatInfluxDB,
+		NameSeparator:     DefaultNameSeparator,
+		FloatPrecision:    DefaultFloatPrecision,
 	}
 
 	c := &Client{
 		trans: &transport{
-			shutdown: make(chan struct{}),
+			shutdown:     make(chan struct{}),
+			closeExpired: make(chan struct{}),
 		},
 	}
-	// 1024 is room for overflow metric
-	c.trans.bufSize = opts.MaxPacketSize + 1024
 
 	for _, option := range options {
 		option(&opts)
 	}
 
-	c.metricPrefix = opts.MetricPrefix
-	c.defaultTags = opts.DefaultTags
+	// 1024 is room for overflow metric
+	c.trans.bufCapLimit = int64(opts.MaxPacketSize) + 1024
+
+	c.nameAppender = opts.NameAppender
+	c.nameReplace = opts.NormalizeNames
+	c.tagMapper = opts.TagMapper
+	c.limiter = newRateLimiter(opts.MaxMetricsPerSecond)
+
+	if c.nameAppender == nil && opts.NameMapper != nil {
+		mapper := opts.NameMapper
+		c.nameAppender = func(dst []byte, name string) []byte {
+			return append(dst, mapper(name)...)
+		}
+	}
+
+	if opts.InternNames > 0 {
+		c.names = newNameCache(opts.InternNames)
+	}
+
+	c.trans.nameSeparator = opts.NameSeparator
+	if c.trans.nameSeparator == "" {
+		c.trans.nameSeparator = DefaultNameSeparator
+	}
+
+	c.filter = newMetricFilter(opts.AllowMetrics, opts.DenyMetrics, c.trans.nameSeparator)
 
 	c.trans.tagFormat = opts.TagFormat
-	c.trans.maxPacketSize = opts.MaxPacketSize
-	c.trans.buf = make([]byte, 0, c.trans.bufSize)
-	c.trans.bufPool = make(chan []byte, opts.BufPoolCapacity)
-	c.trans.sendQueue = make(chan []byte, opts.SendQueueCapacity)
+	if flattensTags(opts.TagFormat) && c.trans.nameSeparator != DefaultNameSeparator && len(c.trans.nameSeparator) == 1 {
+		// tags are flattened into the metric name, so they should be joined with name separator
+		format := *opts.TagFormat
+		format.FirstSeparator = c.trans.nameSeparator
+		format.OtherSeparator = c.trans.nameSeparator[0]
+		c.trans.tagFormat = &format
+	}
+	if opts.BuildInfoTags {
+		opts.DefaultTags = withBuildInfoTags(opts.DefaultTags)
+	}
+	c.rewriteNames = c.nameReplace != 0 || c.trans.tagFormat.sanitize != sanitizeNone
+	c.setPrefix(opts.MetricPrefix)
+	c.setDefaultTags(opts.DefaultTags)
+	c.trans.slogger = opts.SlogLogger
+	c.trans.reportHandler = opts.ReportHandler
+	c.trans.onDropped = opts.OnDroppedPacket
+	c.trans.onFlush = opts.OnFlush
+	c.trans.errorClassifier = opts.ErrorClassifier
+	c.trans.droppedRateLimit = opts.DroppedPacketRateLimit
+	c.trans.copyDropped = opts.CopyDroppedPackets
+	c.trans.blockTimeout = opts.BlockTimeout
+	c.trans.dropPolicy = opts.DropPolicy
+	c.trans.retainMax = opts.RetainOverflow
+	c.trans.newlinePolicy = opts.NewlinePolicy
+	c.trans.gauges = newGaugeState(opts.TrackGaugeState)
+	c.trans.gaugeWindow = newGaugeWindow(opts.CompressGauges)
+	c.trans.cardinality = newCardinalityTracker(opts.TrackCardinality, opts.TrackSeriesCardinality)
+	c.trans.circuitOpenAfter = opts.CircuitOpenAfter
+	c.trans.circuitProbeInterval = opts.CircuitProbeInterval
+	c.trans.tee = opts.TeeWriter
+	c.trans.dump = opts.DebugDump
+	c.trans.closeTimeout = opts.CloseTimeout
+	c.trans.writeRetries = opts.WriteRetries
+	c.trans.writeRetryBackoff = opts.WriteRetryBackoff
+	c.trans.addr = opts.Addr
+	c.trans.dial = opts.dial
+	if c.trans.dial == nil {
+		var d net.Dialer
+		c.trans.dial = d.DialContext
+	}
+	c.trans.packetSizeLimit = int64(opts.MaxPacketSize)
+	c.trans.suppressMTUWarning = opts.SuppressMTUWarning
+	c.trans.checkPacketSize(opts.AddrNetwork, opts.Logger)
+	c.trans.maxMetricsPerPacket = opts.MaxMetricsPerPacket
+	c.trans.floatPrecision = opts.FloatPrecision
+	c.SetSampleRate(opts.DefaultSampleRate)
+	c.trans.bufPoolCapacity = int64(opts.BufPoolCapacity)
+	c.trans.bufPoolMin = opts.BufPoolCapacity
+	c.trans.bufPoolMax = opts.BufPoolMaxCapacity
+	if c.trans.bufPoolMax < opts.BufPoolCapacity {
+		c.trans.bufPoolMax = opts.BufPoolCapacity
+	}
+	c.trans.bufPool = make(chan []byte, c.trans.bufPoolMax)
+	c.trans.maxBuffered = opts.MaxBufferedBytes
+	c.trans.sendQueue = make(chan queuedPacket, opts.SendQueueCapacity)
+	c.trans.maxPacketAge = opts.MaxPacketAge
+	if opts.SynchronousMode && !opts.PassiveMode {
+		c.trans.syncQueue = make(chan syncPacket)
+	}
+	c.trans.initBatches(opts.SendBatchSize, opts.SendQueueCapacity)
+	if opts.ExperimentalPipeline {
+		// pipeline packs all the metrics into single buffer
+		c.trans.initShards(1)
+		c.trans.pipeline = newPipeline()
+	} else {
+		c.trans.initShards(opts.BufferShards)
+	}
+	if opts.PriorityLanes > 0 {
+		c.trans.initPriorityLanes(opts.PriorityLanes)
+	}
+	if opts.Unlocked {
+		c.trans.initUnlocked(opts.UnlockedDebug)
+		c.unlocked = true
+	}
+	if opts.PrewarmBufPool {
+		// pool is filled once all the shard buffers are allocated, so that it fits into MaxBufferedBytes
+		for i := 0; i < opts.BufPoolCapacity && c.trans.reserveBuf(); i++ {
+			c.trans.bufPool <- make([]byte, 0, c.trans.bufferSize())
+			c.trans.bufPoolPrewarmed++
+		}
+	}
+
+	c.trans.sendLoopCount = opts.SendLoopCount
+	if c.trans.sendLoopCount <= 0 {
+		c.trans.sendLoopCount = runtime.GOMAXPROCS(0)
+		if c.trans.sendLoopCount > MaxAutoSendLoopCount {
+			c.trans.sendLoopCount = MaxAutoSendLoopCount
+		}
+	}
+	c.trans.sendLoopsActive = int32(c.trans.sendLoopCount)
+
+	flushInterval := opts.FlushInterval
+	if opts.DisablePeriodicFlush {
+		flushInterval = 0
+	} else if flushInterval <= 0 {
+		// immediate mode, periodic flush picks up metrics batched while send queue was full
+		c.trans.immediate = true
+		flushInterval = DefaultFlushInterval
+	}
+
+	c.trans.now = time.Now
+	c.trans.rateMinWindow = flushInterval / 2
+
+	if opts.MinFlushSize > 0 && !c.trans.immediate {
+		c.trans.minFlushSize = opts.MinFlushSize
+		c.trans.maxFlushDelay = opts.MaxFlushDelay
+	}
+
+	// errors are summarized in the report, so they're logged at most once per report interval
+	c.trans.errorLogInterval = opts.ReportInterval
+
+	// background goroutines are started on first metric, so unused client doesn't consume any resources
+	c.trans.startLoops = func() {
+		if c.trans.pipeline != nil {
+			atomic.StoreInt32(&c.trans.pipeline.running, 1)
+			go c.trans.packLoop()
+		}
+
+		go c.trans.flushLoop(flushInterval)
+
+		for i := 0; i < c.trans.sendLoopCount; i++ {
+			c.trans.shutdownWg.Add(1)
+			go c.trans.sendLoop(i, opts.Addr, opts.AddrNetwork, opts.ReconnectInterval, opts.RetryTimeout, opts.Logger, nil)
+		}
+
+		if opts.SendLoopMax > c.trans.sendLoopCount {
+			scaleInterval := opts.scaleInterval
+			if scaleInterval <= 0 {
+				scaleInterval = DefaultScaleInterval
+			}
+
+			c.trans.shutdownWg.Add(1)
+			go c.trans.scaleLoop(opts.SendLoopMax, scaleInterval, func(index int, stop <-chan struct{}) {
+				go c.trans.sendLoop(index, opts.Addr, opts.AddrNetwork, opts.ReconnectInterval, opts.RetryTimeout, opts.Logger, stop)
+			})
+		}
 
-	go c.trans.flushLoop(opts.FlushInterval)
+		if opts.ReportInterval > 0 {
+			c.trans.shutdownWg.Add(1)
+			go c.trans.reportLoop(opts.ReportInterval, opts.Logger)
+		}
 
-	for i := 0; i < opts.SendLoopCount; i++ {
-		c.trans.shutdownWg.Add(1)
-		go c.trans.sendLoop(opts.Addr, opts.AddrNetwork, opts.ReconnectInterval, opts.RetryTimeout, opts.Logger)
+		if opts.TelemetryInterval > 0 {
+			c.trans.shutdownWg.Add(1)
+			go c.trans.telemetryLoop(c.newTelemetryClient(opts.TelemetryPrefix), opts.TelemetryInterval)
+		}
 	}
 
-	if opts.ReportInterval > 0 {
-		c.trans.shutdownWg.Add(1)
-		go c.trans.reportLoop(opts.ReportInterval, opts.Logger)
+	if opts.PassiveMode {
+		// metrics are delivered by FlushTo
+		c.trans.passive = true
+		c.trans.startLoops = func() {}
+	}
+
+	if len(opts.Routes) > 0 {
+		c.router = newRouter(opts.Addr, opts.Routes, options)
 	}
 
 	return c
 }
 
-// Close stops the client and all its clones. Calling it on a clone has the
-// same effect as calling it on the original client - it is stopped with all
-// its clones.
+// start launches background goroutines (once)
+func (t *transport) start() {
+	t.startOnce.Do(func() {
+		t.started = true
+		t.startLoops()
+	})
+}
+
+// Close stops the client and all its clones.
+//
+// Calling Close on a clone detaches the clone: metrics sent via the clone
+// are discarded from now on, while the original client and other clones
+// are not affected. Clones share delivery machinery (buffers, send queue,
+// connections) with the original client, so closing them doesn't release
+// any resources.
+//
+// Close could be called multiple times (including concurrent calls), every call
+// returns after the client has flushed buffered metrics and stopped.
+//
+// Metrics emitted concurrently with Close are either flushed or discarded,
+// discarded metrics are counted in GetClosedMetrics.
+//
+// If statsd server is not reachable, Close keeps trying to deliver queued
+// packets for CloseTimeout. Packets which couldn't be delivered are abandoned,
+// and first call to Close returns an error with number of abandoned packets.
+// In PassiveMode metrics which were not written with FlushTo are abandoned.
 func (c *Client) Close() error {
-	c.trans.close()
-	return nil
+	if c.isClone {
+		atomic.StoreInt32(&c.detached, 1)
+		return nil
+	}
+
+	routesErr := c.closeRoutes()
+
+	if err := c.trans.close(); err != nil {
+		return err
+	}
+
+	return routesErr
 }
 
-func (t *transport) close() {
+func (t *transport) close() error {
+	first := false
+
 	t.shutdownOnce.Do(func() {
+		first = true
+
+		if t.passive {
+			// report the last window while metrics are still accepted, as there's no flush loop to do that
+			t.runReporters()
+		}
+
+		atomic.StoreInt32(&t.closed, 1)
+
+		// make sure background goroutines are not started after close
+		t.startOnce.Do(func() {})
+		if !t.started || t.passive {
+			if t.passive {
+				t.flushGauges()
+
+				if t.pipeline != nil {
+					t.drainPipeline()
+				}
+			}
+
+			if t.pipeline != nil {
+				t.stopPipeline(false)
+			}
+
+			// metrics emitted concurrently with close are discarded
+			t.lockShards()
+			t.queueClosed = true
+			if t.passive {
+				// there's no flush loop, so metrics which were not written with FlushTo are abandoned
+				t.abandonBuffered()
+			}
+			t.unlockShards()
+		}
+
 		close(t.shutdown)
+
+		if t.closeTimeout > 0 {
+			time.AfterFunc(t.closeTimeout, func() { close(t.closeExpired) })
+		} else {
+			close(t.closeExpired)
+		}
 	})
 	t.shutdownWg.Wait()
+
+	if abandoned := atomic.LoadInt64(&t.abandonedPackets); first && abandoned > 0 {
+		return fmt.Errorf("statsd: %d packets (%d metrics) abandoned on close", abandoned, atomic.LoadInt64(&t.abandonedMetrics))
+	}
+
+	return nil
+}
+
+// clone creates a copy of the client sharing the transport
+//
+// Clone gets its own name cache, as its prefix might be changed.
+func (c *Client) clone() *Client {
+	var names *nameCache
+	if c.names != nil {
+		names = newNameCache(c.names.max)
+	}
+
+	return &Client{
+		trans:           c.trans,
+		metricPrefix:    c.metricPrefix,
+		prefixBytes:     c.prefixBytes,
+		defaultTags:     c.defaultTags,
+		defaultTagBytes: c.defaultTagBytes,
+		nameAppender:    c.nameAppender,
+		nameReplace:     c.nameReplace,
+		rewriteNames:    c.rewriteNames,
+		tagMapper:       c.tagMapper,
+		filter:          c.filter,
+		limiter:         c.limiter.clone(),
+		unlocked:        c.unlocked,
+		names:           names,
+		isClone:         true,
+		high:            c.high,
+		router:          c.router,
+	}
+}
+
+// setPrefix sets metric prefix caching it as a byte slice
+func (c *Client) setPrefix(prefix string) {
+	c.metricPrefix = prefix
+	c.prefixBytes = []byte(prefix)
+
+	c.trans.tagFormat.sanitizeName(c.prefixBytes)
 }
 
 // CloneWithPrefix returns a clone of the original client with different metricPrefix.
 func (c *Client) CloneWithPrefix(prefix string) *Client {
-	clone := *c
-	clone.metricPrefix = prefix
-	return &clone
+	clone := c.clone()
+	clone.setPrefix(prefix)
+	return clone
 }
 
 // CloneWithPrefixExtension returns a clone of the original client with the
 // original prefixed extended with the specified string.
+//
+// Original prefix and extension are joined with exactly one NameSeparator,
+// e.g. "app" or "app." extended with "http." or ".http." results in "app.http.".
 func (c *Client) CloneWithPrefixExtension(extension string) *Client {
-	clone := *c
-	clone.metricPrefix = clone.metricPrefix + extension
-	return &clone
+	clone := c.clone()
+	clone.setPrefix(joinPrefix(clone.metricPrefix, extension, c.trans.nameSeparator))
+	return clone
+}
+
+// CloneWithTags returns a clone of the original client with tags added to
+// default tags.
+func (c *Client) CloneWithTags(tags ...Tag) *Client {
+	clone := c.clone()
+	clone.setDefaultTags(append(append([]Tag(nil), c.defaultTags...), tags...))
+	return clone
+}
+
+// CloneWithPrefixParts returns a clone of the original client with the
+// original prefix extended with parts, each part followed by NameSeparator.
+//
+// E.g. with MetricPrefix("app.") CloneWithPrefixParts("http", "api") results
+// in prefix "app.http.api.".
+func (c *Client) CloneWithPrefixParts(parts ...string) *Client {
+	sep := c.trans.nameSeparator
+
+	prefix := c.metricPrefix
+	for _, part := range parts {
+		if part = trimTrailingSeparators(trimLeadingSeparators(part, sep), sep); part != "" {
+			prefix = joinPrefix(prefix, part+sep, sep)
+		}
+	}
+
+	return c.CloneWithPrefix(prefix)
+}
+
+// trimLeadingSeparators removes all the leading separators from s
+func trimLeadingSeparators(s, sep string) string {
+	for sep != "" && strings.HasPrefix(s, sep) {
+		s = s[len(sep):]
+	}
+
+	return s
+}
+
+// trimTrailingSeparators removes all the trailing separators from s
+func trimTrailingSeparators(s, sep string) string {
+	for sep != "" && strings.HasSuffix(s, sep) {
+		s = s[:len(s)-len(sep)]
+	}
+
+	return s
+}
+
+// joinPrefix joins prefix and extension with exactly one separator
+//
+// Trailing separators of the prefix and leading separators of the extension
+// are collapsed, the rest of the extension is kept as is.
+func joinPrefix(prefix, extension, sep string) string {
+	extension = trimLeadingSeparators(extension, sep)
+	if extension == "" {
+		return prefix
+	}
+
+	if prefix = trimTrailingSeparators(prefix, sep); prefix == "" {
+		return extension
+	}
+
+	return prefix + sep + extension
+}
+
+// SetMaxPacketSize changes maximum packet size at runtime
+//
+// New value is applied to the packets being built from now on.
+func (c *Client) SetMaxPacketSize(packetSize int) {
+	c.trans.lockShards()
+	// sizes are read without shard locks in Unlocked mode and by the send loops
+	atomic.StoreInt64(&c.trans.packetSizeLimit, int64(packetSize))
+	atomic.StoreInt64(&c.trans.bufCapLimit, int64(packetSize)+1024)
+	c.trans.unlockShards()
+
+	if c.router != nil {
+		for _, dest := range c.router.clients {
+			dest.SetMaxPacketSize(packetSize)
+		}
+	}
+}
+
+// Flush sends buffered metrics to the send queue
+//
+// Metrics are delivered asynchronously, so Flush doesn't wait for
+// the packets to be actually sent, use FlushAndWait for that.
+//
+// In Unlocked mode Flush should be called from the goroutine sending metrics.
+func (c *Client) Flush() {
+	c.flushUnlocked()
+	c.trans.flush(false)
+	c.flushRoutes()
+}
+
+// flushUnlocked flushes the emitter buffer in Unlocked mode
+func (c *Client) flushUnlocked() {
+	if c.unlocked {
+		c.trans.flushUnlocked()
+	}
+}
+
+// ErrFlushIncomplete is returned by FlushAndWait if some packets were lost
+// (e.g. failed to be written) while waiting
+var ErrFlushIncomplete = errors.New("statsd: packets lost during flush")
+
+// FlushAndWait flushes buffered metrics and waits for all the queued
+// packets to be written to the socket
+//
+// This is useful in environments where process might be frozen
+// right after the unit of work is finished (e.g. AWS Lambda): call
+// FlushAndWait at the end of each invocation. Context controls
+// maximum wait time, so that dead statsd server doesn't hang the caller,
+// context error is returned if context is done before all the
+// packets were sent.
+//
+// If packets were lost (dropped or failed to be written) since FlushAndWait was
+// called, error wrapping ErrFlushIncomplete is returned. In SynchronousMode FlushAndWait
+// returns the first error writing packets since the previous call.
+func (c *Client) FlushAndWait(ctx context.Context) error {
+	t := c.trans
+
+	lost, writeErrors := atomic.LoadInt64(&t.lostPacketsOverall), atomic.LoadInt64(&t.writeErrorsOverall)
+
+	c.flushUnlocked()
+	t.flush(false)
+
+	routesErr := c.waitRoutes(ctx)
+
+	if err := t.waitDrained(ctx); err != nil {
+		return err
+	}
+
+	if err := t.takeSyncErr(); err != nil {
+		return err
+	}
+
+	lost = atomic.LoadInt64(&t.lostPacketsOverall) - lost
+	writeErrors = atomic.LoadInt64(&t.writeErrorsOverall) - writeErrors
+
+	if lost > 0 || writeErrors > 0 {
+		return fmt.Errorf("%w: %d packets lost, %d write errors", ErrFlushIncomplete, lost, writeErrors)
+	}
+
+	return routesErr
+}
+
+// retainRetryInterval is how often FlushAndWait retries to enqueue retained packets
+const retainRetryInterval = time.Millisecond
+
+// waitDrained waits until there are no pending packets
+//
+// Retained packets (see RetainOverflow) are moved to the send queue while waiting.
+func (t *transport) waitDrained(ctx context.Context) error {
+	for {
+		t.drainedLock.Lock()
+		if atomic.LoadInt64(&t.pendingPackets) <= 0 {
+			t.drainedLock.Unlock()
+			return nil
+		}
+
+		if t.drained == nil {
+			t.drained = make(chan struct{})
+		}
+		drained := t.drained
+		t.drainedLock.Unlock()
+
+		var retry <-chan time.Time
+
+		if t.hasRetained() {
+			// retained packets are not signaled, they're moved as the send queue is drained
+			retry = time.After(retainRetryInterval)
+		}
+
+		select {
+		case <-drained:
+		case <-retry:
+			t.retryRetained()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// packetDone records that pending packet was sent or dropped, FlushAndWait is woken up once all the packets are done
+func (t *transport) packetDone() {
+	if atomic.AddInt64(&t.pendingPackets, -1) > 0 {
+		return
+	}
+
+	t.drainedLock.Lock()
+	if t.drained != nil {
+		close(t.drained)
+		t.drained = nil
+	}
+	t.drainedLock.Unlock()
 }
 
 // GetLostPackets returns number of packets lost during client lifecycle
@@ -153,29 +830,281 @@ func (c *Client) GetLostPackets() int64 {
 	return atomic.LoadInt64(&c.trans.lostPacketsOverall)
 }
 
+// GetAndResetLostPackets returns number of packets lost since the previous call
+//
+// Counter is independent from the periodic report (which resets its own per-interval
+// counters), so external poller can compute rate without double-counting or missing
+// packets, and report handler keeps receiving complete numbers. Concurrent pollers
+// split the packets between themselves.
+func (c *Client) GetAndResetLostPackets() int64 {
+	return pollCounter(&c.trans.lostPacketsOverall, &c.trans.lostPacketsPolled)
+}
+
+// GetAndResetLostMetrics returns number of metrics in the packets lost since the previous call,
+// see GetAndResetLostPackets
+func (c *Client) GetAndResetLostMetrics() int64 {
+	return pollCounter(&c.trans.lostMetricsOverall, &c.trans.lostMetricsPolled)
+}
+
+// GetAndResetWriteErrors returns number of packets which failed to be written to the socket
+// since the previous call, see GetAndResetLostPackets
+func (c *Client) GetAndResetWriteErrors() int64 {
+	return pollCounter(&c.trans.writeErrorsOverall, &c.trans.writeErrorsPolled)
+}
+
+// pollCounter returns increase of the counter since the value stored in polled
+func pollCounter(counter, polled *int64) int64 {
+	for {
+		// counter is loaded after polled, so it's never behind polled value
+		last := atomic.LoadInt64(polled)
+		value := atomic.LoadInt64(counter)
+
+		if atomic.CompareAndSwapInt64(polled, last, value) {
+			return value - last
+		}
+	}
+}
+
+// GetInvalidMetrics returns number of metrics dropped because of newlines
+// in metric name or set value (see NewlinePolicy), or invalid custom metrics (see Custom),
+// or invalid metrics passed to SendMetrics
+func (c *Client) GetInvalidMetrics() int64 {
+	return atomic.LoadInt64(&c.trans.invalidMetrics)
+}
+
+// GetOversizedMetrics returns number of metrics dropped as they don't fit into MaxPacketSize
+func (c *Client) GetOversizedMetrics() int64 {
+	return atomic.LoadInt64(&c.trans.oversizedOverall)
+}
+
+// GetLostMetrics returns number of metrics in the packets lost during client lifecycle
+func (c *Client) GetLostMetrics() int64 {
+	return atomic.LoadInt64(&c.trans.lostMetricsOverall)
+}
+
+// GetLostBytes returns number of bytes in the packets lost during client lifecycle
+func (c *Client) GetLostBytes() int64 {
+	return atomic.LoadInt64(&c.trans.lostBytesOverall)
+}
+
+// GetFilteredMetrics returns number of metrics dropped by AllowMetrics/DenyMetrics filters
+func (c *Client) GetFilteredMetrics() int64 {
+	return atomic.LoadInt64(&c.trans.filteredMetrics)
+}
+
+// GetClosedMetrics returns number of metrics discarded as they were emitted
+// after (or concurrently with) Close
+func (c *Client) GetClosedMetrics() int64 {
+	return atomic.LoadInt64(&c.trans.closedMetrics)
+}
+
+// GetRateLimitedMetrics returns number of metrics dropped due to MaxMetricsPerSecond limit
+func (c *Client) GetRateLimitedMetrics() int64 {
+	return atomic.LoadInt64(&c.trans.rateLimitedOverall)
+}
+
+// allowed checks circuit breaker state, metric name against allow/deny filters and rate limit
+func (c *Client) allowed(stat string) bool {
+	if atomic.LoadInt32(&c.trans.closed) != 0 {
+		atomic.AddInt64(&c.trans.closedMetrics, 1)
+		return false
+	}
+
+	if atomic.LoadInt32(&c.detached) != 0 {
+		return false
+	}
+
+	if c.trans.newlinePolicy == NewlineDrop && strings.IndexByte(stat, '\n') >= 0 {
+		atomic.AddInt64(&c.trans.invalidMetrics, 1)
+		return false
+	}
+
+	if atomic.LoadInt32(&c.trans.circuitState) == circuitOpen {
+		return false
+	}
+
+	if c.filter != nil && !c.filter.allowed(stat) {
+		atomic.AddInt64(&c.trans.filteredMetrics, 1)
+		return false
+	}
+
+	if c.limiter != nil && !c.limiter.allow() {
+		atomic.AddInt64(&c.trans.rateLimitedPeriod, 1)
+		atomic.AddInt64(&c.trans.rateLimitedOverall, 1)
+		return false
+	}
+
+	atomic.AddInt64(&c.trans.emittedOverall, 1)
+	c.trans.start()
+
+	if c.trans.cardinality != nil {
+		c.trans.cardinality.observe(c.metricPrefix, stat)
+	}
+
+	return true
+}
+
+// sanitizeNewlines replaces newlines which would otherwise break packet format
+func sanitizeNewlines(s string) string {
+	if strings.IndexByte(s, '\n') < 0 {
+		return s
+	}
+
+	return strings.ReplaceAll(s, "\n", "_")
+}
+
+// hasSetValueDelimiters checks whether set value contains protocol delimiters (newline, ':' or '|')
+func hasSetValueDelimiters(value string) bool {
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\n', ':', '|':
+			return true
+		}
+	}
+
+	return false
+}
+
+// sanitizeSetValue replaces protocol delimiters in set value with '_'
+func sanitizeSetValue(value string) string {
+	b := []byte(value)
+
+	for i, c := range b {
+		switch c {
+		case '\n', ':', '|':
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
+
+// appendName appends metric prefix and (possibly rewritten) metric name to the buffer
+//
+// If InternNames is enabled, formatted name is taken from the cache. Names which
+// are not rewritten bypass the cache, as copying prefix and name is cheaper than lookup.
+func (c *Client) appendName(buf []byte, stat string) []byte {
+	if c.names == nil || (!c.rewriteNames && c.nameAppender == nil) {
+		return c.formatName(buf, stat)
+	}
+
+	if name := c.names.lookup(stat); name != nil {
+		return append(buf, name...)
+	}
+
+	start := len(buf)
+	buf = c.formatName(buf, stat)
+	c.names.store(stat, buf[start:])
+
+	return buf
+}
+
+// formatName appends metric prefix and (possibly rewritten) metric name to the buffer
+func (c *Client) formatName(buf []byte, stat string) []byte {
+	stat = sanitizeNewlines(stat)
+
+	buf = append(buf, c.prefixBytes...)
+	if c.rewriteNames {
+		nameStart := len(buf)
+		buf = c.appendRawName(buf, stat)
+
+		if c.nameReplace != 0 {
+			normalizeName(buf[nameStart:], c.nameReplace)
+		}
+
+		c.trans.tagFormat.sanitizeName(buf[nameStart:])
+
+		return buf
+	}
+
+	return c.appendRawName(buf, stat)
+}
+
+// appendRawName appends metric name applying NameMapper/NameAppender if set
+func (c *Client) appendRawName(buf []byte, stat string) []byte {
+	if c.nameAppender != nil {
+		return c.nameAppender(buf, stat)
+	}
+	return append(buf, stat...)
+}
+
+// safeNameChars is a set of bytes which are kept as is by NormalizeNames
+var safeNameChars = func() (set [256]bool) {
+	for c := 'a'; c <= 'z'; c++ {
+		set[c] = true
+	}
+	for c := 'A'; c <= 'Z'; c++ {
+		set[c] = true
+	}
+	for c := '0'; c <= '9'; c++ {
+		set[c] = true
+	}
+	set['.'], set['_'], set['-'] = true, true, true
+
+	return
+}()
+
+// normalizeName replaces (in place) bytes outside of [a-zA-Z0-9._-] with replacement
+func normalizeName(name []byte, replacement byte) {
+	for i, c := range name {
+		if !safeNameChars[c] {
+			name[i] = replacement
+		}
+	}
+}
+
+// appendHead appends metric name and tags placed in the name, see appendHead in format.go
+func (c *Client) appendHead(buf []byte, stat string, tags []Tag) []byte {
+	if c.trans.cardinality != nil && c.trans.cardinality.trackSeries {
+		c.trans.cardinality.observeSeries(c.seriesHash(stat, tags))
+	}
+
+	buf = c.appendName(buf, stat)
+	if c.trans.tagFormat.Placement == TagPlacementName {
+		buf = c.formatTags(buf, tags)
+	}
+
+	return buf
+}
+
+// appendTail appends tags placed after the value, timestamp and terminates the line
+func (c *Client) appendTail(buf []byte, tags []Tag, opts callOptions) []byte {
+	if c.trans.tagFormat.Placement == TagPlacementSuffix {
+		buf = c.formatTags(buf, tags)
+	}
+
+	if opts.timestamp != 0 {
+		buf = appendTimestamp(buf, opts.timestamp, c.trans.tagFormat)
+	}
+
+	return append(buf, '\n')
+}
+
 // Incr increments a counter metric
 //
 // Often used to note a particular event, for example incoming web request.
 func (c *Client) Incr(stat string, count int64, tags ...Tag) {
-	if count != 0 {
-		c.trans.bufLock.Lock()
-		lastLen := len(c.trans.buf)
-
-		c.trans.buf = append(c.trans.buf, []byte(c.metricPrefix)...)
-		c.trans.buf = append(c.trans.buf, []byte(stat)...)
-		if c.trans.tagFormat.Placement == TagPlacementName {
-			c.trans.buf = c.formatTags(c.trans.buf, tags)
-		}
-		c.trans.buf = append(c.trans.buf, ':')
-		c.trans.buf = strconv.AppendInt(c.trans.buf, count, 10)
-		c.trans.buf = append(c.trans.buf, []byte("|c")...)
-		if c.trans.tagFormat.Placement == TagPlacementSuffix {
-			c.trans.buf = c.formatTags(c.trans.buf, tags)
-		}
-		c.trans.buf = append(c.trans.buf, '\n')
+	tags, opts := splitCallOptions(tags)
+	c.incr(stat, count, tags, opts)
+}
+
+func (c *Client) incr(stat string, count int64, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
 
-		c.trans.checkBuf(lastLen)
-		c.trans.bufLock.Unlock()
+	if count == 0 {
+		return
+	}
+
+	rate, ok := c.sample(opts.rate)
+	if ok && c.allowed(stat) {
+		s := c.acquireBuf()
+		lastLen := len(s.buf)
+
+		s.buf = c.appendHead(s.buf, stat, tags)
+		s.buf = appendCounterValue(s.buf, count, rate)
+		s.buf = c.appendTail(s.buf, tags, opts)
+
+		c.commit(s, lastLen)
 	}
 }
 
@@ -188,25 +1117,27 @@ func (c *Client) Decr(stat string, count int64, tags ...Tag) {
 
 // FIncr increments a float counter metric
 func (c *Client) FIncr(stat string, count float64, tags ...Tag) {
-	if count != 0 {
-		c.trans.bufLock.Lock()
-		lastLen := len(c.trans.buf)
-
-		c.trans.buf = append(c.trans.buf, []byte(c.metricPrefix)...)
-		c.trans.buf = append(c.trans.buf, []byte(stat)...)
-		if c.trans.tagFormat.Placement == TagPlacementName {
-			c.trans.buf = c.formatTags(c.trans.buf, tags)
-		}
-		c.trans.buf = append(c.trans.buf, ':')
-		c.trans.buf = strconv.AppendFloat(c.trans.buf, count, 'f', -1, 64)
-		c.trans.buf = append(c.trans.buf, []byte("|c")...)
-		if c.trans.tagFormat.Placement == TagPlacementSuffix {
-			c.trans.buf = c.formatTags(c.trans.buf, tags)
-		}
-		c.trans.buf = append(c.trans.buf, '\n')
+	tags, opts := splitCallOptions(tags)
+	c.fincr(stat, count, tags, opts)
+}
+
+func (c *Client) fincr(stat string, count float64, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
 
-		c.trans.checkBuf(lastLen)
-		c.trans.bufLock.Unlock()
+	if count == 0 {
+		return
+	}
+
+	rate, ok := c.sample(opts.rate)
+	if ok && c.allowed(stat) {
+		s := c.acquireBuf()
+		lastLen := len(s.buf)
+
+		s.buf = c.appendHead(s.buf, stat, tags)
+		s.buf = appendFloatCounterValue(s.buf, count, c.trans.floatPrecision, rate)
+		s.buf = c.appendTail(s.buf, tags, opts)
+
+		c.commit(s, lastLen)
 	}
 }
 
@@ -217,24 +1148,28 @@ func (c *Client) FDecr(stat string, count float64, tags ...Tag) {
 
 // Timing tracks a duration event, the time delta must be given in milliseconds
 func (c *Client) Timing(stat string, delta int64, tags ...Tag) {
-	c.trans.bufLock.Lock()
-	lastLen := len(c.trans.buf)
+	tags, opts := splitCallOptions(tags)
+	c.timing(stat, delta, tags, opts)
+}
 
-	c.trans.buf = append(c.trans.buf, []byte(c.metricPrefix)...)
-	c.trans.buf = append(c.trans.buf, []byte(stat)...)
-	if c.trans.tagFormat.Placement == TagPlacementName {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
+func (c *Client) timing(stat string, delta int64, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
+
+	if (opts.rate != 0 && !sampled(opts.rate)) || !c.allowed(stat) {
+		return
 	}
-	c.trans.buf = append(c.trans.buf, ':')
-	c.trans.buf = strconv.AppendInt(c.trans.buf, delta, 10)
-	c.trans.buf = append(c.trans.buf, []byte("|ms")...)
-	if c.trans.tagFormat.Placement == TagPlacementSuffix {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
+
+	s := c.acquireBuf()
+	lastLen := len(s.buf)
+
+	s.buf = c.appendHead(s.buf, stat, tags)
+	s.buf = appendTimingValue(s.buf, delta)
+	if opts.rate != 0 {
+		s.buf = appendSampleRate(s.buf, opts.rate)
 	}
-	c.trans.buf = append(c.trans.buf, '\n')
+	s.buf = c.appendTail(s.buf, tags, opts)
 
-	c.trans.checkBuf(lastLen)
-	c.trans.bufLock.Unlock()
+	c.commit(s, lastLen)
 }
 
 // PrecisionTiming track a duration event, the time delta has to be a duration
@@ -242,46 +1177,47 @@ func (c *Client) Timing(stat string, delta int64, tags ...Tag) {
 // Usually request processing time, time to run database query, etc. are used with
 // this metric type.
 func (c *Client) PrecisionTiming(stat string, delta time.Duration, tags ...Tag) {
-	c.trans.bufLock.Lock()
-	lastLen := len(c.trans.buf)
+	tags, opts := splitCallOptions(tags)
+	c.precisionTiming(stat, delta, tags, opts)
+}
 
-	c.trans.buf = append(c.trans.buf, []byte(c.metricPrefix)...)
-	c.trans.buf = append(c.trans.buf, []byte(stat)...)
-	if c.trans.tagFormat.Placement == TagPlacementName {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
+func (c *Client) precisionTiming(stat string, delta time.Duration, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
+
+	if (opts.rate != 0 && !sampled(opts.rate)) || !c.allowed(stat) {
+		return
 	}
-	c.trans.buf = append(c.trans.buf, ':')
-	c.trans.buf = strconv.AppendFloat(c.trans.buf, float64(delta)/float64(time.Millisecond), 'f', -1, 64)
-	c.trans.buf = append(c.trans.buf, []byte("|ms")...)
-	if c.trans.tagFormat.Placement == TagPlacementSuffix {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
+
+	s := c.acquireBuf()
+	lastLen := len(s.buf)
+
+	s.buf = c.appendHead(s.buf, stat, tags)
+	s.buf = appendDurationValue(s.buf, delta, c.trans.floatPrecision)
+	if opts.rate != 0 {
+		s.buf = appendSampleRate(s.buf, opts.rate)
 	}
-	c.trans.buf = append(c.trans.buf, '\n')
+	s.buf = c.appendTail(s.buf, tags, opts)
 
-	c.trans.checkBuf(lastLen)
-	c.trans.bufLock.Unlock()
+	c.commit(s, lastLen)
 }
 
-func (c *Client) igauge(stat string, sign []byte, value int64, tags ...Tag) {
-	c.trans.bufLock.Lock()
-	lastLen := len(c.trans.buf)
+func (c *Client) igauge(stat string, sign []byte, value int64, reset bool, tags []Tag, opts callOptions) {
+	s := c.acquireBufFor(stat)
+	lastLen := len(s.buf)
 
-	c.trans.buf = append(c.trans.buf, []byte(c.metricPrefix)...)
-	c.trans.buf = append(c.trans.buf, []byte(stat)...)
-	if c.trans.tagFormat.Placement == TagPlacementName {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
+	// reset to zero is appended together with the value, so that they're never split
+	if reset {
+		s.buf = c.appendIGauge(s.buf, stat, nil, 0, tags, opts)
 	}
-	c.trans.buf = append(c.trans.buf, ':')
-	c.trans.buf = append(c.trans.buf, sign...)
-	c.trans.buf = strconv.AppendInt(c.trans.buf, value, 10)
-	c.trans.buf = append(c.trans.buf, []byte("|g")...)
-	if c.trans.tagFormat.Placement == TagPlacementSuffix {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
-	}
-	c.trans.buf = append(c.trans.buf, '\n')
+	s.buf = c.appendIGauge(s.buf, stat, sign, value, tags, opts)
 
-	c.trans.checkBuf(lastLen)
-	c.trans.bufLock.Unlock()
+	c.commit(s, lastLen)
+}
+
+func (c *Client) appendIGauge(buf []byte, stat string, sign []byte, value int64, tags []Tag, opts callOptions) []byte {
+	buf = c.appendHead(buf, stat, tags)
+	buf = appendGaugeValue(buf, sign, value)
+	return c.appendTail(buf, tags, opts)
 }
 
 // Gauge sets or updates constant value for the interval
@@ -293,83 +1229,156 @@ func (c *Client) igauge(stat string, sign []byte, value int64, tags ...Tag) {
 // underlying protocol, you can't explicitly set a gauge to a negative number without
 // first setting it to zero.
 func (c *Client) Gauge(stat string, value int64, tags ...Tag) {
-	if value < 0 {
-		c.igauge(stat, nil, 0, tags...)
+	tags, opts := splitCallOptions(tags)
+	c.gauge(stat, value, tags, opts)
+}
+
+func (c *Client) gauge(stat string, value int64, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
+
+	if !c.allowed(stat) {
+		return
 	}
 
-	c.igauge(stat, nil, value, tags...)
+	if c.compressed() {
+		c.compressIGauge(stat, value, tags, opts)
+		return
+	}
+
+	if c.trans.gauges != nil {
+		c.trackedGauge(stat, value, tags, opts)
+		return
+	}
+
+	c.igauge(stat, nil, value, value < 0, tags, opts)
 }
 
 // GaugeDelta sends a change for a gauge
 func (c *Client) GaugeDelta(stat string, value int64, tags ...Tag) {
+	tags, opts := splitCallOptions(tags)
+	c.gaugeDelta(stat, value, tags, opts)
+}
+
+func (c *Client) gaugeDelta(stat string, value int64, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
+
+	if !c.allowed(stat) {
+		return
+	}
+
 	// Gauge Deltas are always sent with a leading '+' or '-'. The '-' takes care of itself but the '+' must added by hand
 	if value < 0 {
-		c.igauge(stat, nil, value, tags...)
+		c.igauge(stat, nil, value, false, tags, opts)
 	} else {
-		c.igauge(stat, []byte{'+'}, value, tags...)
+		c.igauge(stat, plusSign, value, false, tags, opts)
 	}
 }
 
-func (c *Client) fgauge(stat string, sign []byte, value float64, tags ...Tag) {
-	c.trans.bufLock.Lock()
-	lastLen := len(c.trans.buf)
+func (c *Client) fgauge(stat string, sign []byte, value float64, reset bool, tags []Tag, opts callOptions) {
+	s := c.acquireBufFor(stat)
+	lastLen := len(s.buf)
 
-	c.trans.buf = append(c.trans.buf, []byte(c.metricPrefix)...)
-	c.trans.buf = append(c.trans.buf, []byte(stat)...)
-	if c.trans.tagFormat.Placement == TagPlacementName {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
-	}
-	c.trans.buf = append(c.trans.buf, ':')
-	c.trans.buf = append(c.trans.buf, sign...)
-	c.trans.buf = strconv.AppendFloat(c.trans.buf, value, 'f', -1, 64)
-	c.trans.buf = append(c.trans.buf, []byte("|g")...)
-	if c.trans.tagFormat.Placement == TagPlacementSuffix {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
+	// reset to zero is appended together with the value, so that they're never split
+	if reset {
+		s.buf = c.appendFGauge(s.buf, stat, nil, 0, tags, opts)
 	}
-	c.trans.buf = append(c.trans.buf, '\n')
+	s.buf = c.appendFGauge(s.buf, stat, sign, value, tags, opts)
+
+	c.commit(s, lastLen)
+}
 
-	c.trans.checkBuf(lastLen)
-	c.trans.bufLock.Unlock()
+func (c *Client) appendFGauge(buf []byte, stat string, sign []byte, value float64, tags []Tag, opts callOptions) []byte {
+	buf = c.appendHead(buf, stat, tags)
+	buf = appendFloatGaugeValue(buf, sign, value, c.trans.floatPrecision)
+	return c.appendTail(buf, tags, opts)
 }
 
 // FGauge sends a floating point value for a gauge
 func (c *Client) FGauge(stat string, value float64, tags ...Tag) {
-	if value < 0 {
-		c.igauge(stat, nil, 0, tags...)
+	tags, opts := splitCallOptions(tags)
+	c.floatGauge(stat, value, tags, opts)
+}
+
+func (c *Client) floatGauge(stat string, value float64, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
+
+	if !c.allowed(stat) {
+		return
 	}
 
-	c.fgauge(stat, nil, value, tags...)
+	if c.compressed() {
+		c.compressFGauge(stat, value, tags, opts)
+		return
+	}
+
+	if c.trans.gauges != nil {
+		c.trackedFGauge(stat, value, tags, opts)
+		return
+	}
+
+	c.fgauge(stat, nil, value, value < 0, tags, opts)
 }
 
 // FGaugeDelta sends a floating point change for a gauge
 func (c *Client) FGaugeDelta(stat string, value float64, tags ...Tag) {
+	tags, opts := splitCallOptions(tags)
+	c.floatGaugeDelta(stat, value, tags, opts)
+}
+
+func (c *Client) floatGaugeDelta(stat string, value float64, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
+
+	if !c.allowed(stat) {
+		return
+	}
+
 	if value < 0 {
-		c.fgauge(stat, nil, value, tags...)
+		c.fgauge(stat, nil, value, false, tags, opts)
 	} else {
-		c.fgauge(stat, []byte{'+'}, value, tags...)
+		c.fgauge(stat, plusSign, value, false, tags, opts)
 	}
 }
 
+// BoolGauge sets gauge to 1 if value is true and to 0 otherwise
+func (c *Client) BoolGauge(stat string, value bool, tags ...Tag) {
+	var v int64
+	if value {
+		v = 1
+	}
+
+	c.Gauge(stat, v, tags...)
+}
+
 // SetAdd adds unique element to a set
 //
 // Statsd server will provide cardinality of the set over aggregation period.
 func (c *Client) SetAdd(stat string, value string, tags ...Tag) {
-	c.trans.bufLock.Lock()
-	lastLen := len(c.trans.buf)
+	tags, opts := splitCallOptions(tags)
+	c.setAdd(stat, value, tags, opts)
+}
 
-	c.trans.buf = append(c.trans.buf, []byte(c.metricPrefix)...)
-	c.trans.buf = append(c.trans.buf, []byte(stat)...)
-	if c.trans.tagFormat.Placement == TagPlacementName {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
+func (c *Client) setAdd(stat string, value string, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
+
+	if hasSetValueDelimiters(value) {
+		if c.trans.newlinePolicy == NewlineDrop {
+			atomic.AddInt64(&c.trans.invalidMetrics, 1)
+			return
+		}
+
+		value = sanitizeSetValue(value)
 	}
-	c.trans.buf = append(c.trans.buf, ':')
-	c.trans.buf = append(c.trans.buf, []byte(value)...)
-	c.trans.buf = append(c.trans.buf, []byte("|s")...)
-	if c.trans.tagFormat.Placement == TagPlacementSuffix {
-		c.trans.buf = c.formatTags(c.trans.buf, tags)
+
+	if !c.allowed(stat) {
+		return
 	}
-	c.trans.buf = append(c.trans.buf, '\n')
 
-	c.trans.checkBuf(lastLen)
-	c.trans.bufLock.Unlock()
+	s := c.acquireBuf()
+	lastLen := len(s.buf)
+
+	s.buf = c.appendHead(s.buf, stat, tags)
+	s.buf = appendSetValue(s.buf, value)
+	s.buf = c.appendTail(s.buf, tags, opts)
+
+	c.commit(s, lastLen)
 }
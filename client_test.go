@@ -25,15 +25,26 @@ SOFTWARE.
 */
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math/rand"
 	"net"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"go.uber.org/goleak"
 )
 
 func setupListener(t *testing.T) (*net.UDPConn, chan []byte) {
@@ -63,6 +74,27 @@ func setupListener(t *testing.T) (*net.UDPConn, chan []byte) {
 	return inSocket, received
 }
 
+// readReported runs flush reporters and returns the packet they've emitted
+//
+// Marker metric is sent after the reporters, so that packet is received even if
+// reporters emit nothing, marker is trimmed from the result.
+func readReported(t *testing.T, client *Client, received <-chan []byte) string {
+	t.Helper()
+
+	client.trans.runReporters()
+	client.Incr("marker", 1)
+	client.Flush()
+
+	select {
+	case packet := <-received:
+		return strings.TrimSuffix(strings.TrimSuffix(string(packet), client.metricPrefix+"marker:1|c"), "\n")
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metrics")
+	}
+
+	return ""
+}
+
 func TestWrongAddress(t *testing.T) {
 	client := NewClient("BOOM:BOOM")
 	if err := client.Close(); err != nil {
@@ -70,205 +102,4438 @@ func TestWrongAddress(t *testing.T) {
 	}
 }
 
-func TestCommands(t *testing.T) {
+// flakyConn fails writes with err while there are failures left
+type flakyConn struct {
+	net.Conn
+
+	failures *int32
+	err      error
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if atomic.AddInt32(c.failures, -1) >= 0 {
+		return 0, c.err
+	}
+
+	return c.Conn.Write(b)
+}
+
+// flakyDial returns option which makes client connections fail first failures writes
+func flakyDial(dials *int32, failures int32, err error) Option {
+	return func(c *ClientOptions) {
+		remaining := failures
+		c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(dials, 1)
+
+			var d net.Dialer
+			conn, dialErr := d.DialContext(ctx, network, addr)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+
+			return &flakyConn{Conn: conn, failures: &remaining, err: err}, nil
+		}
+	}
+}
+
+type capturingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *capturingLogger) Printf(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *capturingLogger) waitFor(t *testing.T, substr string) {
+	for i := 0; i < 100; i++ {
+		l.mu.Lock()
+		for _, msg := range l.messages {
+			if strings.Contains(msg, substr) {
+				l.mu.Unlock()
+				return
+			}
+		}
+		l.mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("message %#v was not logged", substr)
+}
+
+func TestLogger(t *testing.T) {
+	logger := &capturingLogger{}
+
+	client := NewClient("BOOM:BOOM", Logger(logger), SendQueueCapacity(0), ReportInterval(10*time.Millisecond))
+	client.Incr("req.count", 1)
+	client.Flush()
+
+	logger.waitFor(t, "Error connecting to server")
+	logger.waitFor(t, "1 packets lost (overflow)")
+
+	_ = client.Close()
+}
+
+type recordingHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.records = append(h.records, r.Clone())
+
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordingHandler) WithGroup(string) slog.Handler { return h }
+
+// waitFor waits for a record with message msg and returns record's level and attribute keys
+func (h *recordingHandler) waitFor(t *testing.T, msg string) (slog.Level, []string) {
+	for i := 0; i < 100; i++ {
+		h.mu.Lock()
+		for _, r := range h.records {
+			if r.Message == msg {
+				var keys []string
+
+				r.Attrs(func(a slog.Attr) bool {
+					keys = append(keys, a.Key)
+					return true
+				})
+
+				h.mu.Unlock()
+
+				return r.Level, keys
+			}
+		}
+		h.mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("message %#v was not logged", msg)
+
+	return 0, nil
+}
+
+func TestSlogLogger(t *testing.T) {
+	handler := &recordingHandler{}
+	logger := &capturingLogger{}
+
+	client := NewClient("BOOM:BOOM", Logger(logger), SlogLogger(slog.New(handler)),
+		SendQueueCapacity(0), ReportInterval(10*time.Millisecond))
+	client.Incr("req.count", 1)
+	client.Flush()
+
+	level, keys := handler.waitFor(t, "error connecting to statsd server")
+	if level != slog.LevelError || strings.Join(keys, ",") != "addr,error" {
+		t.Errorf("unexpected record: %s %v", level, keys)
+	}
+
+	level, keys = handler.waitFor(t, "statsd packets lost (overflow)")
+	if level != slog.LevelWarn || strings.Join(keys, ",") != "lost,lost_metrics,lost_bytes" {
+		t.Errorf("unexpected record: %s %v", level, keys)
+	}
+
+	_ = client.Close()
+
+	if len(logger.messages) > 0 {
+		t.Errorf("plain logger shouldn't be used: %v", logger.messages)
+	}
+}
+
+type droppedPacket struct {
+	packet string
+	reason DropReason
+}
+
+func TestOnDroppedPacket(t *testing.T) {
+	t.Run("Overflow", func(t *testing.T) {
+		var dropped []droppedPacket
+
+		client := NewClient("BOOM:BOOM", SendQueueCapacity(0), FlushInterval(time.Hour), CopyDroppedPackets(),
+			OnDroppedPacket(func(packet []byte, reason DropReason) {
+				dropped = append(dropped, droppedPacket{string(packet), reason})
+			}))
+
+		client.Incr("req.count", 1)
+		client.Gauge("req.clients", 3)
+		client.Flush()
+
+		expected := []droppedPacket{{"req.count:1|c\nreq.clients:3|g", DropReasonOverflow}}
+		if !reflect.DeepEqual(dropped, expected) {
+			t.Errorf("unexpected dropped packets: %#v != %#v", dropped, expected)
+		}
+
+		_ = client.Close()
+	})
+
+	t.Run("RateLimit", func(t *testing.T) {
+		var dropped int
+
+		client := NewClient("BOOM:BOOM", SendQueueCapacity(0), FlushInterval(time.Hour), DroppedPacketRateLimit(3),
+			OnDroppedPacket(func([]byte, DropReason) {
+				dropped++
+			}))
+
+		for i := 0; i < 10; i++ {
+			client.Incr("req.count", 1)
+			client.Flush()
+		}
+
+		if dropped < 3 || dropped > 6 {
+			t.Errorf("unexpected number of callbacks: %d", dropped)
+		}
+
+		if client.GetLostPackets() != 10 {
+			t.Errorf("unexpected number of lost packets: %d", client.GetLostPackets())
+		}
+
+		_ = client.Close()
+	})
+
+	t.Run("WriteError", func(t *testing.T) {
+		inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+			IP: net.IPv4(127, 0, 0, 1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addr := inSocket.LocalAddr().String()
+		_ = inSocket.Close()
+
+		droppedC := make(chan droppedPacket, 10)
+
+		client := NewClient(addr, FlushInterval(time.Hour), OnDroppedPacket(func(packet []byte, reason DropReason) {
+			droppedC <- droppedPacket{string(packet), reason}
+		}))
+
+		// first write succeeds, ICMP unreachable makes one of the following writes fail
+		for i := 0; i < 10; i++ {
+			client.Incr("req.count", 1)
+			client.Flush()
+
+			select {
+			case d := <-droppedC:
+				expected := droppedPacket{"req.count:1|c", DropReasonWriteError}
+				if d != expected {
+					t.Errorf("unexpected dropped packet: %#v != %#v", d, expected)
+				}
+
+				_ = client.Close()
+
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+
+		t.Error("no write error was reported")
+
+		_ = client.Close()
+	})
+}
+
+func TestBlockWithTimeout(t *testing.T) {
+	t.Run("Timeout", func(t *testing.T) {
+		client := NewClient("BOOM:BOOM", SendQueueCapacity(0), FlushInterval(time.Hour), BlockWithTimeout(50*time.Millisecond))
+
+		for i := 0; i < 3; i++ {
+			client.Incr("req.count", 1)
+
+			start := time.Now()
+			client.Flush()
+			elapsed := time.Since(start)
+
+			if elapsed < 50*time.Millisecond || elapsed > 500*time.Millisecond {
+				t.Errorf("unexpected flush duration: %s", elapsed)
+			}
+
+			if client.GetLostPackets() != int64(i+1) {
+				t.Errorf("unexpected number of lost packets: %d", client.GetLostPackets())
+			}
+		}
+
+		_ = client.Close()
+	})
+
+	t.Run("Delivered", func(t *testing.T) {
+		inSocket, received := setupListener(t)
+
+		client := NewClient(inSocket.LocalAddr().String(), SendQueueCapacity(0), FlushInterval(time.Hour),
+			BlockWithTimeout(time.Second))
+
+		for i := 0; i < 10; i++ {
+			client.Incr("req.count", 1)
+			client.Flush()
+		}
+
+		for i := 0; i < 10; i++ {
+			select {
+			case buf := <-received:
+				if string(buf) != "req.count:1|c" {
+					t.Errorf("unexpected packet: %#v", string(buf))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for packet")
+			}
+		}
+
+		if client.GetLostPackets() != 0 {
+			t.Errorf("unexpected number of lost packets: %d", client.GetLostPackets())
+		}
+
+		_ = client.Close()
+		_ = inSocket.Close()
+	})
+}
+
+func TestMaxMetricsPerSecond(t *testing.T) {
 	inSocket, received := setupListener(t)
 
-	client := NewClient(inSocket.LocalAddr().String(),
-		MetricPrefix("foo."),
-		MaxPacketSize(1400),
-		ReconnectInterval(10*time.Second))
-	clientTagged := NewClient(inSocket.LocalAddr().String(),
-		TagStyle(TagFormatDatadog),
-		DefaultTags(StringTag("host", "example.com"), Int64Tag("weight", 38)))
+	logger := &capturingLogger{}
 
-	compareOutput := func(actions func(), expected []string) func(*testing.T) {
-		return func(t *testing.T) {
-			actions()
+	client := NewClient(inSocket.LocalAddr().String(), MaxMetricsPerSecond(100), Logger(logger),
+		ReportInterval(10*time.Millisecond), SendQueueCapacity(100))
+	clone := client.CloneWithPrefix("clone.")
 
-			for _, exp := range expected {
-				buf := <-received
+	for i := 0; i < 1000; i++ {
+		client.Incr("req.count", 1)
+	}
 
-				if string(buf) != exp {
-					t.Errorf("unexpected part received: %#v != %#v", string(buf), exp)
+	clone.Incr("req.count", 1)
+
+	client.Flush()
+
+	var count, cloneCount int
+
+LOOP:
+	for {
+		select {
+		case buf := <-received:
+			for _, line := range strings.Split(string(buf), "\n") {
+				if strings.HasPrefix(line, "clone.") {
+					cloneCount++
+				} else {
+					count++
 				}
 			}
+		case <-time.After(100 * time.Millisecond):
+			break LOOP
 		}
 	}
 
-	t.Run("Incr", compareOutput(
-		func() { client.Incr("req.count", 30) },
-		[]string{"foo.req.count:30|c"}))
+	if count < 100 || count > 110 {
+		t.Errorf("unexpected number of metrics delivered: %d", count)
+	}
 
-	t.Run("IncrTaggedInflux", compareOutput(
-		func() { client.Incr("req.count", 30, StringTag("app", "service"), IntTag("port", 80)) },
-		[]string{"foo.req.count,app=service,port=80:30|c"}))
+	if cloneCount != 1 {
+		t.Errorf("clone should have independent budget: %d", cloneCount)
+	}
 
-	t.Run("IncrTaggedDatadog", compareOutput(
-		func() { clientTagged.Incr("req.count", 30, StringTag("app", "service"), IntTag("port", 80)) },
-		[]string{"req.count:30|c|#host:example.com,weight:38,app:service,port:80"}))
+	if client.GetRateLimitedMetrics() != int64(1000-count) {
+		t.Errorf("unexpected number of rate limited metrics: %d", client.GetRateLimitedMetrics())
+	}
 
-	t.Run("Decr", compareOutput(
-		func() { client.Decr("req.count", 30) },
-		[]string{"foo.req.count:-30|c"}))
+	logger.waitFor(t, "metrics dropped (rate limit)")
 
-	t.Run("FIncr", compareOutput(
-		func() { client.FIncr("req.count", 0.3) },
-		[]string{"foo.req.count:0.3|c"}))
+	_ = client.Close()
+	_ = inSocket.Close()
+}
 
-	t.Run("FDecr", compareOutput(
-		func() { client.FDecr("req.count", 0.3) },
-		[]string{"foo.req.count:-0.3|c"}))
+func TestCircuitBreaker(t *testing.T) {
+	// reserve TCP port which is not listened on
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	t.Run("Timing", compareOutput(
-		func() { client.Timing("req.duration", 100) },
-		[]string{"foo.req.duration:100|ms"}))
+	addr := l.Addr().String()
+	_ = l.Close()
 
-	t.Run("TimingTaggedInflux", compareOutput(
-		func() { client.Timing("req.duration", 100, StringTag("app", "service"), IntTag("port", 80)) },
-		[]string{"foo.req.duration,app=service,port=80:100|ms"}))
+	logger := &capturingLogger{}
 
-	t.Run("TimingTaggedDatadog", compareOutput(
-		func() { clientTagged.Timing("req.duration", 100, StringTag("app", "service"), IntTag("port", 80)) },
-		[]string{"req.duration:100|ms|#host:example.com,weight:38,app:service,port:80"}))
+	client := NewClient(addr, Network("tcp"), Logger(logger), RetryTimeout(10*time.Millisecond), FlushInterval(time.Hour),
+		CircuitBreaker(50*time.Millisecond, 20*time.Millisecond))
 
-	t.Run("PrecisionTiming", compareOutput(
-		func() { client.PrecisionTiming("req.duration", 157356*time.Microsecond) },
-		[]string{"foo.req.duration:157.356|ms"}))
+	// background goroutines are started with the first metric
+	client.Incr("req.count", 1)
+	client.Flush()
 
-	t.Run("PrecisionTimingTaggedInflux", compareOutput(
-		func() {
-			client.PrecisionTiming("req.duration", 157356*time.Microsecond, StringTag("app", "service"), IntTag("port", 80))
-		},
-		[]string{"foo.req.duration,app=service,port=80:157.356|ms"}))
+	waitState := func(open bool) {
+		for i := 0; i < 100; i++ {
+			if client.IsCircuitOpen() == open {
+				return
+			}
 
-	t.Run("PrecisionTimingTaggedDatadog", compareOutput(
-		func() {
-			clientTagged.PrecisionTiming("req.duration", 157356*time.Microsecond, StringTag("app", "service"), IntTag("port", 80))
-		},
-		[]string{"req.duration:157.356|ms|#host:example.com,weight:38,app:service,port:80"}))
+			time.Sleep(10 * time.Millisecond)
+		}
 
-	t.Run("Gauge", compareOutput(
-		func() { client.Gauge("req.clients", 33); client.Gauge("req.clients", -533) },
-		[]string{"foo.req.clients:33|g\nfoo.req.clients:0|g\nfoo.req.clients:-533|g"}))
+		t.Fatalf("circuit breaker state open = %v not reached", open)
+	}
 
-	t.Run("GaugeTaggedInflux", compareOutput(
-		func() {
-			client.Gauge("req.clients", 33, StringTag("app", "service"), IntTag("port", 80))
-			client.Gauge("req.clients", -533, StringTag("app", "service"), IntTag("port", 80))
-		},
-		[]string{"foo.req.clients,app=service,port=80:33|g\nfoo.req.clients,app=service,port=80:0|g\nfoo.req.clients,app=service,port=80:-533|g"}))
+	// open
+	waitState(true)
+	logger.waitFor(t, "Circuit breaker open")
 
-	t.Run("GaugeDelta", compareOutput(
-		func() { client.GaugeDelta("req.clients", 33); client.GaugeDelta("req.clients", -533) },
-		[]string{"foo.req.clients:+33|g\nfoo.req.clients:-533|g"}))
+	client.Incr("req.count", 1)
 
-	t.Run("GaugeDeltaTaggedDatadog", compareOutput(
-		func() { clientTagged.GaugeDelta("req.clients", 33); clientTagged.GaugeDelta("req.clients", -533) },
-		[]string{"req.clients:+33|g|#host:example.com,weight:38\nreq.clients:-533|g|#host:example.com,weight:38"}))
+	client.trans.shards[0].bufLock.Lock()
+	if len(client.trans.shards[0].buf) != 0 {
+		t.Error("metrics should be discarded while circuit breaker is open")
+	}
+	client.trans.shards[0].bufLock.Unlock()
 
-	t.Run("FGauge", compareOutput(
-		func() { client.FGauge("req.clients", 33.5); client.FGauge("req.clients", -533.3) },
-		[]string{"foo.req.clients:33.5|g\nfoo.req.clients:0|g\nfoo.req.clients:-533.3|g"}))
+	// probes keep failing
+	time.Sleep(100 * time.Millisecond)
 
-	t.Run("FGaugeTaggedInflux", compareOutput(
-		func() {
-			client.FGauge("req.clients", 33.5, StringTag("app", "service"), IntTag("port", 80))
-			client.FGauge("req.clients", -533.3, StringTag("app", "service"), IntTag("port", 80))
-		},
-		[]string{"foo.req.clients,app=service,port=80:33.5|g\nfoo.req.clients,app=service,port=80:0|g\nfoo.req.clients,app=service,port=80:-533.3|g"}))
+	if !client.IsCircuitOpen() {
+		t.Error("circuit breaker should stay open")
+	}
+
+	// probe succeeds
+	l, err = net.Listen("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitState(false)
+	logger.waitFor(t, "Circuit breaker closed")
+
+	client.Incr("req.count", 1)
+
+	client.trans.shards[0].bufLock.Lock()
+	if len(client.trans.shards[0].buf) == 0 {
+		t.Error("metrics should be processed once circuit breaker is closed")
+	}
+	client.trans.shards[0].bufLock.Unlock()
+
+	_ = client.Close()
+	_ = l.Close()
+}
+
+func TestAutoSendLoops(t *testing.T) {
+	expected := runtime.GOMAXPROCS(0)
+	if expected > MaxAutoSendLoopCount {
+		expected = MaxAutoSendLoopCount
+	}
+
+	for _, option := range []Option{AutoSendLoops(), SendLoopCount(0)} {
+		client := NewClient("127.0.0.1:4444", option)
+
+		if client.GetStats().SendLoopCount != expected {
+			t.Errorf("unexpected send loop count: %d != %d", client.GetStats().SendLoopCount, expected)
+		}
+
+		_ = client.Close()
+	}
+}
+
+func TestQueuePressureHint(t *testing.T) {
+	logger := &capturingLogger{}
+
+	client := NewClient("BOOM:BOOM", Logger(logger), SendQueueCapacity(2), FlushInterval(time.Hour),
+		ReportInterval(10*time.Millisecond))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// keep the queue full, as send loop is not connected
+		for i := 0; i < 100; i++ {
+			client.Incr("req.count", 1)
+			client.Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	logger.waitFor(t, "consider increasing SendLoopCount")
+
+	<-done
+
+	if stats := client.GetStats(); stats.SendQueueHighWater != 2 || stats.SendQueueCapacity != 2 {
+		t.Errorf("unexpected stats: %#v", stats)
+	}
+
+	_ = client.Close()
+}
+
+func TestReportHandler(t *testing.T) {
+	// collect accumulates reports until cond is satisfied
+	collect := func(t *testing.T, reports chan Report, cond func(total Report) bool) Report {
+		var total Report
+
+		for {
+			select {
+			case r := <-reports:
+				if r.Interval != 10*time.Millisecond {
+					t.Errorf("unexpected interval: %v", r.Interval)
+				}
+
+				total.LostOverflow += r.LostOverflow
+				total.LostWriteErrors += r.LostWriteErrors
+				total.PacketsSent += r.PacketsSent
+				total.BytesSent += r.BytesSent
+				total.SendQueueLength = r.SendQueueLength
+				total.BufPoolLength = r.BufPoolLength
+
+				if cond(total) {
+					return total
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for report, got so far: %#v", total)
+			}
+		}
+	}
+
+	t.Run("Sent", func(t *testing.T) {
+		inSocket, received := setupListener(t)
+		defer inSocket.Close() //nolint:errcheck
+
+		reports := make(chan Report, 100)
+
+		client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour),
+			ReportInterval(10*time.Millisecond), ReportHandler(func(r Report) { reports <- r }))
+		defer client.Close() //nolint:errcheck
+
+		for i := 0; i < 3; i++ {
+			client.Incr("req.count", 1)
+		}
+		client.Flush()
+
+		<-received
+
+		total := collect(t, reports, func(total Report) bool { return total.PacketsSent > 0 })
+
+		// "req.count:1|c" * 3 joined with newlines
+		if total.PacketsSent != 1 || total.BytesSent != 3*13+2 || total.LostOverflow != 0 || total.LostWriteErrors != 0 {
+			t.Errorf("unexpected report: %#v", total)
+		}
+
+		if total.SendQueueLength != 0 {
+			t.Errorf("unexpected report: %#v", total)
+		}
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		reports := make(chan Report, 100)
+
+		client := NewClient("BOOM:BOOM", Logger(&capturingLogger{}), SendQueueCapacity(2), FlushInterval(time.Hour),
+			ReportInterval(10*time.Millisecond), ReportHandler(func(r Report) { reports <- r }))
+		defer client.Close() //nolint:errcheck
+
+		// send loop is not connected, so only 2 packets fit into the queue
+		for i := 0; i < 5; i++ {
+			client.Incr("req.count", 1)
+			client.Flush()
+		}
+
+		total := collect(t, reports, func(total Report) bool { return total.LostOverflow >= 3 })
+
+		if total.LostOverflow != 3 || total.PacketsSent != 0 || total.SendQueueLength != 2 {
+			t.Errorf("unexpected report: %#v", total)
+		}
+	})
+}
+
+func TestSelfTelemetry(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("app."), FlushInterval(10*time.Millisecond),
+		SelfTelemetry("statsd.", 100*time.Millisecond))
+	defer client.Close() //nolint:errcheck
+
+	for i := 0; i < 3; i++ {
+		client.Incr("req.count", 1)
+	}
+	client.Flush()
+
+	select {
+	case buf := <-received:
+		if string(buf) != "app.req.count:1|c\napp.req.count:1|c\napp.req.count:1|c" {
+			t.Fatalf("unexpected packet: %#v", string(buf))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metrics")
+	}
+
+	var buf []byte
+	select {
+	case buf = <-received:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for telemetry")
+	}
+
+	lines := strings.Split(string(buf), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("unexpected telemetry: %#v", string(buf))
+	}
+
+	clientID := lines[0][strings.Index(lines[0], "client_id="):strings.Index(lines[0], ":")]
+	if len(clientID) != len("client_id=")+8 {
+		t.Fatalf("unexpected client_id: %#v", clientID)
+	}
+
+	expected := []string{
+		"statsd.metrics," + clientID + ":3|c",
+		"statsd.packets_sent," + clientID + ":1|c",
+		"statsd.bytes_sent," + clientID + ":53|c",
+		"statsd.queue_length," + clientID + ":0|g",
+	}
+
+	if strings.Join(lines, " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected telemetry: %v != %v", lines, expected)
+	}
+}
+
+func TestSelfTelemetryUnsampled(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(10*time.Millisecond), DefaultSampleRate(0.0001),
+		SelfTelemetry("statsd.", 100*time.Millisecond))
+	defer client.Close() //nolint:errcheck
+
+	client.trans.start()
+
+	// packets lost for different reasons are reported separately
+	atomic.AddInt64(&client.trans.pendingPackets, 3)
+	client.trans.packetLost([]byte("a:1|c\n"), DropReasonStale)
+	client.trans.packetLost([]byte("a:1|c\n"), DropReasonStale)
+	client.trans.packetLost([]byte("a:1|c\n"), DropReasonOverflow)
+
+	var buf []byte
+	select {
+	case buf = <-received:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for telemetry")
+	}
+
+	lines := strings.Split(string(buf), "\n")
+	for i := range lines {
+		// strip client_id
+		lines[i] = regexp.MustCompile(`,client_id=[0-9a-f]{8}`).ReplaceAllString(lines[i], "")
+	}
+
+	expected := []string{
+		"statsd.packets_dropped,reason=overflow:1|c",
+		"statsd.packets_dropped,reason=stale:2|c",
+		"statsd.queue_length:0|g",
+	}
+
+	if strings.Join(lines, " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected telemetry: %v != %v", lines, expected)
+	}
+}
+
+func TestDropPolicy(t *testing.T) {
+	run := func(policy int, expectedDropped, expectedQueued []string) func(*testing.T) {
+		return func(t *testing.T) {
+			var dropped []string
+
+			// send loop is not connected, so queue is not drained
+			client := NewClient("BOOM:BOOM", Logger(&capturingLogger{}), SendQueueCapacity(2), FlushInterval(time.Hour),
+				DropPolicy(policy), OnDroppedPacket(func(packet []byte, reason DropReason) {
+					dropped = append(dropped, string(packet))
+				}))
+			defer client.Close() //nolint:errcheck
+
+			for _, stat := range []string{"first", "second", "marker"} {
+				client.Incr(stat, 1)
+				client.Flush()
+			}
+
+			if strings.Join(dropped, " ") != strings.Join(expectedDropped, " ") {
+				t.Errorf("unexpected dropped packets: %v != %v", dropped, expectedDropped)
+			}
+
+			if lost := client.GetLostPackets(); lost != 1 {
+				t.Errorf("unexpected lost packets: %d", lost)
+			}
+
+			var queued []string
+			for len(client.trans.sendQueue) > 0 {
+				p := <-client.trans.sendQueue
+				queued = append(queued, string(p.buf[:len(p.buf)-1]))
+			}
+
+			if strings.Join(queued, " ") != strings.Join(expectedQueued, " ") {
+				t.Errorf("unexpected queued packets: %v != %v", queued, expectedQueued)
+			}
+		}
+	}
+
+	t.Run("DropNewest", run(DropNewest, []string{"marker:1|c"}, []string{"first:1|c", "second:1|c"}))
+	t.Run("DropOldest", run(DropOldest, []string{"first:1|c"}, []string{"second:1|c", "marker:1|c"}))
+}
+
+func TestLostMetrics(t *testing.T) {
+	reports := make(chan Report, 100)
+	logger := &capturingLogger{}
+
+	// send loop is not connected, so only single packet fits into the queue
+	client := NewClient("BOOM:BOOM", Logger(logger), SendQueueCapacity(1), FlushInterval(time.Hour),
+		ReportInterval(10*time.Millisecond), ReportHandler(func(r Report) { reports <- r }))
+	defer client.Close() //nolint:errcheck
+
+	client.Incr("first", 1)
+	client.Flush()
+
+	client.Incr("req.count", 1)
+	client.Incr("req.count", 2)
+	client.Flush()
+
+	// "req.count:1|c\nreq.count:2|c"
+	if lost, metrics, size := client.GetLostPackets(), client.GetLostMetrics(), client.GetLostBytes(); lost != 1 || metrics != 2 || size != 27 {
+		t.Errorf("unexpected lost counters: %d packets, %d metrics, %d bytes", lost, metrics, size)
+	}
+
+	for {
+		select {
+		case r := <-reports:
+			if r.LostOverflow == 0 {
+				continue
+			}
+
+			if r.LostOverflow != 1 || r.LostMetrics != 2 || r.LostBytes != 27 {
+				t.Errorf("unexpected report: %#v", r)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for report")
+		}
+
+		break
+	}
+
+	logger.waitFor(t, "1 packets lost (overflow), 2 metrics, 27 bytes")
+}
+
+func TestAdaptiveBufPool(t *testing.T) {
+	inSocket, received := setupListener(t)
+
+	logger := &capturingLogger{}
+
+	client := NewClient(inSocket.LocalAddr().String(), BufPoolCapacity(2), AdaptiveBufPool(10), SendQueueCapacity(100),
+		MaxPacketSize(100), FlushInterval(time.Hour), Logger(logger), ReportInterval(10*time.Millisecond))
+
+	// burst creates lots of packets in flight
+	for i := 0; i < 1000; i++ {
+		client.Incr("req.count", 1)
+	}
+
+	client.Flush()
+
+	stats := client.GetStats()
+	if stats.BufPoolCapacity <= 2 || stats.BufPoolCapacity > 10 {
+		t.Errorf("unexpected pool capacity: %d", stats.BufPoolCapacity)
+	}
+
+	if stats.BufPoolMisses == 0 {
+		t.Error("pool misses should be recorded")
+	}
+
+	logger.waitFor(t, "buffer pool misses")
+
+	// pool is filled as packets are sent
+	for i := 0; i < 100; i++ {
+		if client.GetStats().BufPoolLength == client.GetStats().BufPoolCapacity {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if stats = client.GetStats(); stats.BufPoolLength != stats.BufPoolCapacity {
+		t.Errorf("pool should be filled up: %d != %d", stats.BufPoolLength, stats.BufPoolCapacity)
+	}
+
+	_ = client.Close()
+	_ = inSocket.Close()
+	close(received)
+}
+
+func TestDefaultSampleRate(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), DefaultSampleRate(0.25), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	t.Run("Sampling", func(t *testing.T) {
+		sent := 0
+		for i := 0; i < 10000; i++ {
+			if _, ok := client.sample(0); ok {
+				sent++
+			}
+		}
+
+		if sent < 2200 || sent > 2800 {
+			t.Errorf("unexpected number of sampled counters: %d", sent)
+		}
+	})
+
+	compare := func(client *Client, actions func(*Client), expected string) func(*testing.T) {
+		return func(t *testing.T) {
+			for {
+				actions(client)
+				client.Flush()
+
+				select {
+				case buf := <-received:
+					if string(buf) != expected {
+						t.Errorf("unexpected part received: %#v != %#v", string(buf), expected)
+					}
+					return
+				case <-time.After(50 * time.Millisecond):
+					// counter was sampled out, try again
+				}
+			}
+		}
+	}
+
+	t.Run("Incr", compare(client,
+		func(c *Client) { c.Incr("req.count", 30, StringTag("app", "service")) },
+		"req.count,app=service:30|c|@0.25"))
+	t.Run("FDecr", compare(client,
+		func(c *Client) { c.FDecr("req.count", 0.5) },
+		"req.count:-0.5|c|@0.25"))
+	t.Run("Gauge", compare(client,
+		func(c *Client) { c.Gauge("req.gauge", 10) },
+		"req.gauge:10|g"))
+	t.Run("Timing", compare(client,
+		func(c *Client) { c.Timing("req.duration", 15) },
+		"req.duration:15|ms"))
+
+	datadog := NewClient(inSocket.LocalAddr().String(), DefaultSampleRate(0.25), FlushInterval(time.Hour), TagStyle(TagFormatDatadog))
+	defer datadog.Close() //nolint:errcheck
+
+	t.Run("Datadog", compare(datadog,
+		func(c *Client) { c.Incr("req.count", 1, StringTag("app", "service")) },
+		"req.count:1|c|@0.25|#app:service"))
+
+	t.Run("SetSampleRate", func(t *testing.T) {
+		clone := client.CloneWithPrefix("clone.")
+		clone.SetSampleRate(1)
+
+		if rate := client.GetSampleRate(); rate != 1 {
+			t.Errorf("sample rate should be shared with clones: %v", rate)
+		}
+
+		compare(client, func(c *Client) { c.Incr("req.count", 1) }, "req.count:1|c")(t)
+	})
+}
+
+func TestCommands(t *testing.T) {
+	inSocket, received := setupListener(t)
+
+	client := NewClient(inSocket.LocalAddr().String(),
+		MetricPrefix("foo."),
+		MaxPacketSize(1400),
+		ReconnectInterval(10*time.Second),
+		SynchronousMode(true))
+	clientTagged := NewClient(inSocket.LocalAddr().String(),
+		TagStyle(TagFormatDatadog),
+		DefaultTags(StringTag("host", "example.com"), Int64Tag("weight", 38)))
+
+	compareOutput := func(actions func(), expected []string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions()
+
+			for _, exp := range expected {
+				buf := <-received
+
+				if string(buf) != exp {
+					t.Errorf("unexpected part received: %#v != %#v", string(buf), exp)
+				}
+			}
+		}
+	}
+
+	t.Run("Incr", compareOutput(
+		func() { client.Incr("req.count", 30) },
+		[]string{"foo.req.count:30|c"}))
+
+	t.Run("IncrTaggedInflux", compareOutput(
+		func() { client.Incr("req.count", 30, StringTag("app", "service"), IntTag("port", 80)) },
+		[]string{"foo.req.count,app=service,port=80:30|c"}))
+
+	t.Run("IncrTaggedDatadog", compareOutput(
+		func() { clientTagged.Incr("req.count", 30, StringTag("app", "service"), IntTag("port", 80)) },
+		[]string{"req.count:30|c|#host:example.com,weight:38,app:service,port:80"}))
+
+	t.Run("Decr", compareOutput(
+		func() { client.Decr("req.count", 30) },
+		[]string{"foo.req.count:-30|c"}))
+
+	t.Run("FIncr", compareOutput(
+		func() { client.FIncr("req.count", 0.3) },
+		[]string{"foo.req.count:0.3|c"}))
+
+	t.Run("FDecr", compareOutput(
+		func() { client.FDecr("req.count", 0.3) },
+		[]string{"foo.req.count:-0.3|c"}))
+
+	t.Run("Timing", compareOutput(
+		func() { client.Timing("req.duration", 100) },
+		[]string{"foo.req.duration:100|ms"}))
+
+	t.Run("TimingTaggedInflux", compareOutput(
+		func() { client.Timing("req.duration", 100, StringTag("app", "service"), IntTag("port", 80)) },
+		[]string{"foo.req.duration,app=service,port=80:100|ms"}))
+
+	t.Run("TimingTaggedDatadog", compareOutput(
+		func() { clientTagged.Timing("req.duration", 100, StringTag("app", "service"), IntTag("port", 80)) },
+		[]string{"req.duration:100|ms|#host:example.com,weight:38,app:service,port:80"}))
+
+	t.Run("PrecisionTiming", compareOutput(
+		func() { client.PrecisionTiming("req.duration", 157356*time.Microsecond) },
+		[]string{"foo.req.duration:157.356|ms"}))
+
+	t.Run("PrecisionTimingTaggedInflux", compareOutput(
+		func() {
+			client.PrecisionTiming("req.duration", 157356*time.Microsecond, StringTag("app", "service"), IntTag("port", 80))
+		},
+		[]string{"foo.req.duration,app=service,port=80:157.356|ms"}))
+
+	t.Run("PrecisionTimingTaggedDatadog", compareOutput(
+		func() {
+			clientTagged.PrecisionTiming("req.duration", 157356*time.Microsecond, StringTag("app", "service"), IntTag("port", 80))
+		},
+		[]string{"req.duration:157.356|ms|#host:example.com,weight:38,app:service,port:80"}))
+
+	t.Run("Gauge", compareOutput(
+		func() { client.Gauge("req.clients", 33); client.Gauge("req.clients", -533) },
+		[]string{"foo.req.clients:33|g\nfoo.req.clients:0|g\nfoo.req.clients:-533|g"}))
+
+	t.Run("GaugeTaggedInflux", compareOutput(
+		func() {
+			client.Gauge("req.clients", 33, StringTag("app", "service"), IntTag("port", 80))
+			client.Gauge("req.clients", -533, StringTag("app", "service"), IntTag("port", 80))
+		},
+		[]string{"foo.req.clients,app=service,port=80:33|g\nfoo.req.clients,app=service,port=80:0|g\nfoo.req.clients,app=service,port=80:-533|g"}))
+
+	t.Run("GaugeDelta", compareOutput(
+		func() { client.GaugeDelta("req.clients", 33); client.GaugeDelta("req.clients", -533) },
+		[]string{"foo.req.clients:+33|g\nfoo.req.clients:-533|g"}))
+
+	t.Run("GaugeDeltaTaggedDatadog", compareOutput(
+		func() { clientTagged.GaugeDelta("req.clients", 33); clientTagged.GaugeDelta("req.clients", -533) },
+		[]string{"req.clients:+33|g|#host:example.com,weight:38\nreq.clients:-533|g|#host:example.com,weight:38"}))
+
+	t.Run("FGauge", compareOutput(
+		func() { client.FGauge("req.clients", 33.5); client.FGauge("req.clients", -533.3) },
+		[]string{"foo.req.clients:33.5|g\nfoo.req.clients:0|g\nfoo.req.clients:-533.3|g"}))
+
+	t.Run("FGaugeTaggedInflux", compareOutput(
+		func() {
+			client.FGauge("req.clients", 33.5, StringTag("app", "service"), IntTag("port", 80))
+			client.FGauge("req.clients", -533.3, StringTag("app", "service"), IntTag("port", 80))
+		},
+		[]string{"foo.req.clients,app=service,port=80:33.5|g\nfoo.req.clients,app=service,port=80:0|g\nfoo.req.clients,app=service,port=80:-533.3|g"}))
+
+	t.Run("FGaugeNegativeTaggedInflux", compareOutput(
+		func() { client.FGauge("x", -1.5, StringTag("app", "service")) },
+		[]string{"foo.x,app=service:0|g\nfoo.x,app=service:-1.5|g"}))
+
+	t.Run("FGaugeNegativeTaggedDatadog", compareOutput(
+		func() { clientTagged.FGauge("x", -1.5, StringTag("app", "service")) },
+		[]string{"x:0|g|#host:example.com,weight:38,app:service\nx:-1.5|g|#host:example.com,weight:38,app:service"}))
+
+	t.Run("FGaugeDelta", compareOutput(
+		func() { client.FGaugeDelta("req.clients", 33.5); client.FGaugeDelta("req.clients", -533.3) },
+		[]string{"foo.req.clients:+33.5|g\nfoo.req.clients:-533.3|g"}))
+
+	t.Run("FGaugeDeltaTaggedDatadog", compareOutput(
+		func() { clientTagged.FGaugeDelta("req.clients", 33.5); clientTagged.FGaugeDelta("req.clients", -533.3) },
+		[]string{"req.clients:+33.5|g|#host:example.com,weight:38\nreq.clients:-533.3|g|#host:example.com,weight:38"}))
+
+	t.Run("SetAdd", compareOutput(
+		func() { client.SetAdd("req.user", "bob") },
+		[]string{"foo.req.user:bob|s"}))
+
+	t.Run("SetAddTaggedInflux", compareOutput(
+		func() { client.SetAdd("req.user", "bob", StringTag("app", "service"), IntTag("port", 80)) },
+		[]string{"foo.req.user,app=service,port=80:bob|s"}))
+
+	t.Run("SetAddTaggedDatadog", compareOutput(
+		func() { clientTagged.SetAdd("req.user", "bob", StringTag("app", "service"), IntTag("port", 80)) },
+		[]string{"req.user:bob|s|#host:example.com,weight:38,app:service,port:80"}))
+
+	t.Run("FlushedIncr", compareOutput(
+		func() {
+			client.Incr("req.count", 40)
+			client.Incr("req.count", 20)
+			client.Flush()
+			client.Incr("req.count", 10)
+		},
+		[]string{"foo.req.count:40|c\nfoo.req.count:20|c", "foo.req.count:10|c"}))
+
+	t.Run("SplitIncr", compareOutput(
+		func() {
+			for i := 0; i < 100; i++ {
+				client.Incr("req.count", 30)
+			}
+		},
+		[]string{
+			"foo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c",
+			"foo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c",
+		}))
+
+	_ = client.Close()
+	_ = inSocket.Close()
+	close(received)
+}
+
+func TestClones(t *testing.T) {
+	inSocket, received := setupListener(t)
+
+	client := NewClient(inSocket.LocalAddr().String(),
+		MetricPrefix("foo."),
+		MaxPacketSize(1400),
+		ReconnectInterval(10*time.Second))
+	client2 := client.CloneWithPrefix("bar.")
+	client3 := client2.CloneWithPrefixExtension("blah.")
+
+	compareOutput := func(actions func(), expected []string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions()
+
+			for _, exp := range expected {
+				var buf []byte
+				select {
+				case buf = <-received:
+				case <-time.After(time.Second):
+					t.Errorf("timeout waiting for %v", exp)
+					return
+				}
+
+				if string(buf) != exp {
+					t.Errorf("unexpected part received: %#v != %#v", string(buf), exp)
+				}
+			}
+		}
+	}
+
+	t.Run("Original", compareOutput(
+		func() { client.Incr("req.count", 30) },
+		[]string{"foo.req.count:30|c"}))
+
+	t.Run("CloneWithPrefix", compareOutput(
+		func() { client2.Incr("req.count", 30) },
+		[]string{"bar.req.count:30|c"}))
+
+	t.Run("CloneWithPrefixExtension", compareOutput(
+		func() { client3.Incr("req.count", 30) },
+		[]string{"bar.blah.req.count:30|c"}))
+
+	_ = client.Close()
+	_ = client2.Close()
+	_ = client3.Close()
+	_ = inSocket.Close()
+	close(received)
+}
+
+func TestNameSeparator(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	compare := func(client *Client, actions func(*Client), expected string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions(client)
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != expected {
+					t.Errorf("unexpected part received: %#v != %#v", string(buf), expected)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("timeout waiting for %v", expected)
+			}
+		}
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("app_"), NameSeparator("_"))
+	defer client.Close() //nolint:errcheck
+
+	t.Run("Name", compare(client,
+		func(c *Client) { c.Incr("req.count", 1) },
+		"app_req.count:1|c"))
+	t.Run("CloneWithPrefixParts", compare(client.CloneWithPrefixParts("http", "api"),
+		func(c *Client) { c.Incr("requests", 1) },
+		"app_http_api_requests:1|c"))
+	t.Run("CloneWithPrefixExtension", compare(client.CloneWithPrefixParts("http").CloneWithPrefixExtension("v2-"),
+		func(c *Client) { c.Incr("requests", 1) },
+		"app_http_v2-requests:1|c"))
+
+	okmeter := NewClient(inSocket.LocalAddr().String(), NameSeparator("_"), TagStyle(TagFormatOkmeter))
+	defer okmeter.Close() //nolint:errcheck
+
+	t.Run("Flattening", compare(okmeter,
+		func(c *Client) { c.Incr("requests", 1, StringTag("host", "foo"), IntTag("status", 200)) },
+		"requests_host_is_foo_status_is_200:1|c"))
+
+	t.Run("Default", func(t *testing.T) {
+		def := NewClient(inSocket.LocalAddr().String(), MetricPrefix("app."), TagStyle(TagFormatOkmeter))
+		defer def.Close() //nolint:errcheck
+
+		if def.trans.tagFormat != TagFormatOkmeter {
+			t.Errorf("tag format shouldn't be changed with default separator")
+		}
+
+		compare(def.CloneWithPrefixParts("http"),
+			func(c *Client) { c.Incr("requests", 1, StringTag("host", "foo")) },
+			"app.http.requests.host_is_foo:1|c")(t)
+	})
+}
+
+func TestOkmeterFormat(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	compare := func(client *Client, actions func(*Client), expected []string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions(client)
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != strings.Join(expected, "\n") {
+					t.Errorf("unexpected part received: %#v != %#v", string(buf), strings.Join(expected, "\n"))
+				}
+			case <-time.After(time.Second):
+				t.Errorf("timeout waiting for %v", expected)
+			}
+		}
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("Billing."), TagStyle(TagFormatOkmeter),
+		DefaultTags(StringTag("Host", "web-01.DC1")), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	t.Run("Tags", compare(client,
+		func(c *Client) {
+			c.Incr("Req.Count", 1, StringTag("route", "/api/v1"), IntTag("status", 200))
+			c.Timing("db query", 15, StringTag("Table", "User Accounts"))
+			c.Gauge("queue:depth|g", -2)
+		},
+		[]string{
+			"billing.req.count.host_is_web-01_dc1.route_is__api_v1.status_is_200:1|c",
+			"billing.db_query.host_is_web-01_dc1.table_is_user_accounts:15|ms",
+			"billing.queue_depth_g.host_is_web-01_dc1:0|g",
+			"billing.queue_depth_g.host_is_web-01_dc1:-2|g",
+		}))
+
+	t.Run("Clone", compare(client.CloneWithPrefixParts("HTTP").CloneWithTags(IntTag("shard", -1)),
+		func(c *Client) { c.Incr("requests", 1, WithRate(1), WithTags(StringTag("Method", "GET"))) },
+		[]string{"billing.http.requests.host_is_web-01_dc1.shard_is_-1.method_is_get:1|c"}))
+
+	separator := NewClient(inSocket.LocalAddr().String(), NameSeparator("_"), TagStyle(TagFormatOkmeter))
+	defer separator.Close() //nolint:errcheck
+
+	t.Run("NameSeparator", compare(separator,
+		func(c *Client) { c.Incr("Requests", 1, StringTag("Host", "Foo.Bar")) },
+		[]string{"requests_host_is_foo_bar:1|c"}))
+
+	t.Run("Append", func(t *testing.T) {
+		line := AppendCounter(nil, "App.", "Req", 1, []Tag{StringTag("Route", "/api")}, TagFormatOkmeter)
+		if string(line) != "app.req.route_is__api:1|c\n" {
+			t.Errorf("unexpected line: %#v", string(line))
+		}
+	})
+}
+
+func TestClonePrefixNormalization(t *testing.T) {
+	for _, tt := range []struct {
+		separator string
+		prefix    string
+		extension string
+		expected  string
+	}{
+		{".", "bar.", "blah.", "bar.blah."},
+		{".", "bar", "blah.", "bar.blah."},
+		{".", "bar.", ".blah.", "bar.blah."},
+		{".", "bar", ".blah.", "bar.blah."},
+		{".", "bar..", "..blah.", "bar.blah."},
+		{".", "bar.", "blah", "bar.blah"},
+		{".", "bar.", "v2-", "bar.v2-"},
+		{".", "", "blah.", "blah."},
+		{".", "", ".blah.", "blah."},
+		{".", "bar.", "", "bar."},
+		{".", "bar.", ".", "bar."},
+		{".", "", "", ""},
+		{".", ".", "blah.", "blah."},
+		{"_", "app_", "http_", "app_http_"},
+		{"_", "app", "_http_", "app_http_"},
+		{"::", "app::", "::http::", "app::http::"},
+		{"::", "app", "http::", "app::http::"},
+	} {
+		t.Run(fmt.Sprintf("%s+%s", tt.prefix, tt.extension), func(t *testing.T) {
+			client := NewClient("127.0.0.1:8125", MetricPrefix(tt.prefix), NameSeparator(tt.separator))
+			defer client.Close() //nolint:errcheck
+
+			if prefix := client.CloneWithPrefixExtension(tt.extension).metricPrefix; prefix != tt.expected {
+				t.Errorf("unexpected prefix: %#v != %#v", prefix, tt.expected)
+			}
+		})
+	}
+
+	for _, tt := range []struct {
+		prefix   string
+		parts    []string
+		expected string
+	}{
+		{"app.", []string{"http", "api"}, "app.http.api."},
+		{"app", []string{"http", "api"}, "app.http.api."},
+		{"app.", []string{"http.", ".api"}, "app.http.api."},
+		{"app.", []string{"", ".", "http"}, "app.http."},
+		{"", []string{".http."}, "http."},
+		{"", nil, ""},
+	} {
+		t.Run(fmt.Sprintf("%s+%v", tt.prefix, tt.parts), func(t *testing.T) {
+			client := NewClient("127.0.0.1:8125", MetricPrefix(tt.prefix))
+			defer client.Close() //nolint:errcheck
+
+			if prefix := client.CloneWithPrefixParts(tt.parts...).metricPrefix; prefix != tt.expected {
+				t.Errorf("unexpected prefix: %#v != %#v", prefix, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNewlinePolicy(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	compare := func(client *Client, actions func(*Client), expected string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions(client)
+			client.Incr("marker", 1)
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != expected {
+					t.Errorf("unexpected part received: %#v != %#v", string(buf), expected)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("timeout waiting for %v", expected)
+			}
+		}
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	t.Run("ReplaceLeading", compare(client,
+		func(c *Client) { c.Incr("\nreq.count", 1) },
+		"_req.count:1|c\nmarker:1|c"))
+	t.Run("ReplaceEmbedded", compare(client,
+		func(c *Client) { c.Gauge("req\n.gauge", 1) },
+		"req_.gauge:1|g\nmarker:1|c"))
+	t.Run("ReplaceTrailing", compare(client,
+		func(c *Client) { c.Timing("req.duration\n", 1) },
+		"req.duration_:1|ms\nmarker:1|c"))
+	t.Run("ReplaceSetValue", compare(client,
+		func(c *Client) { c.SetAdd("req.user", "bob\n") },
+		"req.user:bob_|s\nmarker:1|c"))
+	t.Run("ReplaceSetValueDelimiters", compare(client,
+		func(c *Client) { c.SetAdd("req.user", "bob@example.com|admin:1\n") },
+		"req.user:bob@example.com_admin_1_|s\nmarker:1|c"))
+	t.Run("ReplaceSetValueURL", compare(client,
+		func(c *Client) { c.SetAdd("req.url", "https://example.com:8080/") },
+		"req.url:https_//example.com_8080/|s\nmarker:1|c"))
+	t.Run("SetValueUnicode", compare(client,
+		func(c *Client) { c.SetAdd("req.user", "José") },
+		"req.user:José|s\nmarker:1|c"))
+	t.Run("ReplaceSetValueUnicode", compare(client,
+		func(c *Client) { c.SetAdd("req.user", "мир:1") },
+		"req.user:мир_1|s\nmarker:1|c"))
+
+	tagged := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), TagStyle(TagFormatDatadog))
+	defer tagged.Close() //nolint:errcheck
+
+	t.Run("ReplaceSetValueTagged", compare(tagged,
+		func(c *Client) { c.SetAdd("req.user", "bob|#role:admin", StringTag("host", "web1")) },
+		"req.user:bob_#role_admin|s|#host:web1\nmarker:1|c"))
+
+	dropping := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), NewlinePolicy(NewlineDrop))
+	defer dropping.Close() //nolint:errcheck
+
+	t.Run("DropLeading", compare(dropping,
+		func(c *Client) { c.Incr("\nreq.count", 1) },
+		"marker:1|c"))
+	t.Run("DropEmbedded", compare(dropping,
+		func(c *Client) { c.Gauge("req\n.gauge", -1) },
+		"marker:1|c"))
+	t.Run("DropTrailing", compare(dropping,
+		func(c *Client) { c.Timing("req.duration\n", 1) },
+		"marker:1|c"))
+	t.Run("DropSetValue", compare(dropping,
+		func(c *Client) { c.SetAdd("req.user", "bob\n") },
+		"marker:1|c"))
+	t.Run("DropSetValueColon", compare(dropping,
+		func(c *Client) { c.SetAdd("req.user", "bob:1") },
+		"marker:1|c"))
+	t.Run("DropSetValuePipe", compare(dropping,
+		func(c *Client) { c.SetAdd("req.user", "bob|s", StringTag("host", "web1")) },
+		"marker:1|c"))
+	t.Run("KeepSetValueUnicode", compare(dropping,
+		func(c *Client) { c.SetAdd("req.user", "José") },
+		"req.user:José|s\nmarker:1|c"))
+
+	if invalid := dropping.GetInvalidMetrics(); invalid != 6 {
+		t.Errorf("unexpected number of invalid metrics: %d", invalid)
+	}
+
+	if invalid := client.GetInvalidMetrics(); invalid != 0 {
+		t.Errorf("unexpected number of invalid metrics: %d", invalid)
+	}
+}
+
+func TestClonesShareTransport(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), SendLoopCount(2), ReportInterval(time.Second),
+		FlushInterval(time.Hour), DefaultTags(StringTag("host", "foo")))
+	defer client.Close() //nolint:errcheck
+
+	goroutines := runtime.NumGoroutine()
+
+	clones := make([]*Client, 12)
+	for i := range clones {
+		clones[i] = client.CloneWithPrefix(fmt.Sprintf("sub%d.", i)).CloneWithTags(IntTag("sub", i))
+	}
+
+	if n := runtime.NumGoroutine(); n != goroutines {
+		t.Errorf("number of goroutines changed with clones: %d != %d", n, goroutines)
+	}
+
+	expectPacket := func(t *testing.T, expected string) {
+		select {
+		case buf := <-received:
+			if string(buf) != expected {
+				t.Errorf("unexpected part received: %#v != %#v", string(buf), expected)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timeout waiting for %v", expected)
+		}
+	}
+
+	// all the clones share single buffer
+	clones[0].Incr("req.count", 1)
+	clones[11].Incr("req.count", 2)
+	client.Incr("req.count", 3)
+	client.Flush()
+
+	expectPacket(t, "sub0.req.count,host=foo,sub=0:1|c\nsub11.req.count,host=foo,sub=11:2|c\nreq.count,host=foo:3|c")
+
+	// closing the clone detaches it, but doesn't affect the original client
+	if err := clones[0].Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	clones[0].Incr("req.count", 1)
+	clones[1].Incr("req.count", 2)
+	client.Incr("req.count", 3)
+	client.Flush()
+
+	expectPacket(t, "sub1.req.count,host=foo,sub=1:2|c\nreq.count,host=foo:3|c")
+}
+
+func TestNameMapper(t *testing.T) {
+	inSocket, received := setupListener(t)
+
+	mapper := func(name string) string {
+		return strings.ReplaceAll(strings.ToLower(name), "-", "_")
+	}
+
+	appender := func(dst []byte, name string) []byte {
+		dst = append(dst, "team."...)
+		return append(dst, name...)
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(),
+		MetricPrefix("foo."), FlushInterval(time.Hour), NameMapper(mapper))
+	clone := client.CloneWithPrefix("bar.")
+	clientAppender := NewClient(inSocket.LocalAddr().String(),
+		MetricPrefix("foo."), FlushInterval(time.Hour), NameAppender(appender), NameMapper(mapper))
+
+	compareOutput := func(c *Client, actions func(), expected string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions()
+			c.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != expected {
+					t.Errorf("unexpected part received: %#v != %#v", string(buf), expected)
+				}
+			case <-time.After(time.Second):
+				t.Error("timeout waiting for metrics")
+			}
+		}
+	}
+
+	t.Run("AllTypes", compareOutput(client,
+		func() {
+			client.Incr("Req-Count", 1)
+			client.FIncr("Req-Count", 0.5)
+			client.Timing("Req-Duration", 10)
+			client.PrecisionTiming("Req-Duration", time.Millisecond)
+			client.Gauge("Req-Clients", 3)
+			client.GaugeDelta("Req-Clients", 1)
+			client.FGauge("Req-Clients", 3.5)
+			client.FGaugeDelta("Req-Clients", -1.5)
+			client.SetAdd("Req-User", "Bob")
+		},
+		"foo.req_count:1|c\nfoo.req_count:0.5|c\nfoo.req_duration:10|ms\nfoo.req_duration:1|ms\n"+
+			"foo.req_clients:3|g\nfoo.req_clients:+1|g\nfoo.req_clients:3.5|g\nfoo.req_clients:-1.5|g\nfoo.req_user:Bob|s"))
+
+	t.Run("Clone", compareOutput(clone,
+		func() { clone.Incr("Req-Count", 1) },
+		"bar.req_count:1|c"))
+
+	t.Run("Appender", compareOutput(clientAppender,
+		func() { clientAppender.Incr("Req-Count", 1) },
+		"foo.team.Req-Count:1|c"))
+
+	_ = client.Close()
+	_ = clientAppender.Close()
+	_ = inSocket.Close()
+	close(received)
+}
+
+func TestNormalizeNames(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	mapper := func(name string) string {
+		return name + "/total"
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(),
+		MetricPrefix("foo."), FlushInterval(time.Hour), NormalizeNames('_'), TagStyle(TagFormatDatadog))
+	defer client.Close() //nolint:errcheck
+
+	clientMapper := NewClient(inSocket.LocalAddr().String(),
+		MetricPrefix("foo."), FlushInterval(time.Hour), NormalizeNames('_'), NameMapper(mapper))
+	defer clientMapper.Close() //nolint:errcheck
+
+	plain := NewClient(inSocket.LocalAddr().String(),
+		MetricPrefix("foo."), FlushInterval(time.Hour), TagStyle(TagFormatDatadog))
+	defer plain.Close() //nolint:errcheck
+
+	receive := func(t *testing.T, c *Client, actions func(c *Client)) string {
+		actions(c)
+		c.Flush()
+
+		select {
+		case buf := <-received:
+			return string(buf)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics")
+		}
+
+		return ""
+	}
+
+	for _, tt := range []struct {
+		name     string
+		stat     string
+		expected string
+	}{
+		{"Spaces", "req count", "foo.req_count:1|c|#host:a b"},
+		{"Slashes", "api/v1/users", "foo.api_v1_users:1|c|#host:a b"},
+		{"Unicode", "café", "foo.caf__:1|c|#host:a b"},
+		{"Punctuation", "req:count|c", "foo.req_count_c:1|c|#host:a b"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := receive(t, client, func(c *Client) { c.Incr(tt.stat, 1, StringTag("host", "a b")) }); got != tt.expected {
+				t.Errorf("unexpected output: %#v != %#v", got, tt.expected)
+			}
+		})
+	}
+
+	t.Run("Mapper", func(t *testing.T) {
+		if got := receive(t, clientMapper, func(c *Client) { c.Incr("req count", 1) }); got != "foo.req_count_total:1|c" {
+			t.Errorf("unexpected output: %#v", got)
+		}
+	})
+
+	t.Run("Clean", func(t *testing.T) {
+		actions := func(c *Client) {
+			c.Incr("req.count-total_1", 1, StringTag("host", "a"))
+			c.Timing("Req.Duration", 10)
+			c.FGauge("req.clients", 3.5)
+			c.SetAdd("req.user", "Bob Smith")
+		}
+
+		expected := receive(t, plain, actions)
+		if got := receive(t, client, actions); got != expected {
+			t.Errorf("clean names changed: %#v != %#v", got, expected)
+		}
+	})
+}
+
+func TestMaxPacketSize(t *testing.T) {
+	inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(8000), SuppressMTUWarning(), FlushInterval(time.Hour))
+
+	readPacket := func() int {
+		buf := make([]byte, 65536)
+
+		_ = inSocket.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, err := inSocket.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	// each line is 15 bytes including newline
+	for i := 0; i < 600; i++ {
+		client.Incr("req.count", 30)
+	}
+
+	if n := readPacket(); n < 7900 || n > 8000 {
+		t.Errorf("unexpected packet size: %d", n)
+	}
+
+	client.trans.shards[0].bufLock.Lock()
+	if cap(client.trans.shards[0].buf) != 8000+1024 {
+		t.Errorf("buffer was reallocated: %d", cap(client.trans.shards[0].buf))
+	}
+	client.trans.shards[0].bufLock.Unlock()
+
+	client.Flush()
+	_ = readPacket()
+
+	client.SetMaxPacketSize(160)
+
+	for i := 0; i < 15; i++ {
+		client.Incr("req.count", 30)
+	}
+
+	if n := readPacket(); n != 149 {
+		t.Errorf("unexpected packet size: %d", n)
+	}
+
+	_ = client.Close()
+	_ = inSocket.Close()
+}
+
+func TestSetMaxPacketSizeConcurrent(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", Unlocked(true), FlushInterval(time.Hour), SendQueueCapacity(10),
+		Logger(&capturingLogger{}))
+	defer client.Close() //nolint:errcheck
+
+	done := make(chan struct{})
+
+	// packet size is changed while metrics are sent, race detector catches unsynchronized access
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 1000; i++ {
+			client.Incr("req.count", 1)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		client.SetMaxPacketSize(100 + i)
+	}
+
+	<-done
+}
+
+func TestMaxMetricsPerPacket(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	const total = 200
+
+	// byte limit is hit before line limit for some of the packets, so both limits interact
+	client := NewClient(inSocket.LocalAddr().String(), MaxMetricsPerPacket(5), MaxPacketSize(100),
+		SendQueueCapacity(total), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	for i := 0; i < total; i++ {
+		client.Incr("req."+strings.Repeat("x", i%17), 1)
+	}
+	client.Flush()
+
+	lines := 0
+
+	for lines < total {
+		select {
+		case buf := <-received:
+			n := strings.Count(string(buf), "\n") + 1
+			if n > 5 {
+				t.Errorf("too many lines in the packet: %d", n)
+			}
+
+			lines += n
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for metrics, received %d lines", lines)
+		}
+	}
+
+	if lines != total {
+		t.Errorf("unexpected number of lines: %d", lines)
+	}
+}
+
+func TestWriteRetries(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	expectPacket := func(t *testing.T, expected string) {
+		select {
+		case buf := <-received:
+			if string(buf) != expected {
+				t.Errorf("unexpected packet: %#v != %#v", string(buf), expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %#v", expected)
+		}
+	}
+
+	expectNothing := func(t *testing.T) {
+		select {
+		case buf := <-received:
+			t.Errorf("unexpected packet: %#v", string(buf))
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Run("Retried", func(t *testing.T) {
+		var dials int32
+
+		client := NewClient(inSocket.LocalAddr().String(), Logger(&capturingLogger{}), FlushInterval(time.Hour),
+			WriteRetries(2, time.Millisecond), flakyDial(&dials, 2, syscall.ECONNREFUSED))
+		defer client.Close() //nolint:errcheck
+
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		expectPacket(t, "req.count:1|c")
+		expectNothing(t)
+
+		if dials := atomic.LoadInt32(&dials); dials != 1 {
+			t.Errorf("unexpected number of dials: %d", dials)
+		}
+
+		if lost := atomic.LoadInt64(&client.trans.writeErrorsOverall); lost != 0 {
+			t.Errorf("unexpected lost packets: %d", lost)
+		}
+	})
+
+	t.Run("Exhausted", func(t *testing.T) {
+		var dials int32
+
+		logger := &capturingLogger{}
+
+		client := NewClient(inSocket.LocalAddr().String(), Logger(logger), FlushInterval(time.Hour), RetryTimeout(10*time.Millisecond),
+			WriteRetries(2, time.Millisecond), flakyDial(&dials, 3, syscall.ECONNREFUSED))
+		defer client.Close() //nolint:errcheck
+
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		logger.waitFor(t, "Error writing to socket")
+
+		for atomic.LoadInt32(&dials) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		client.Incr("req.count", 2)
+		client.Flush()
+
+		expectPacket(t, "req.count:2|c")
+
+		if lost := atomic.LoadInt64(&client.trans.writeErrorsOverall); lost != 1 {
+			t.Errorf("unexpected lost packets: %d", lost)
+		}
+
+		if lost := client.GetLostPackets(); lost != 0 {
+			t.Errorf("write errors shouldn't be reported as overflow: %d", lost)
+		}
+	})
+
+	t.Run("Transient", func(t *testing.T) {
+		var dials int32
+
+		client := NewClient(inSocket.LocalAddr().String(), Logger(&capturingLogger{}), FlushInterval(time.Hour),
+			flakyDial(&dials, 1, syscall.ENOBUFS))
+		defer client.Close() //nolint:errcheck
+
+		client.Incr("req.count", 1)
+		client.Flush()
+		client.Incr("req.count", 2)
+		client.Flush()
+
+		expectPacket(t, "req.count:2|c")
+		expectNothing(t)
+
+		if dials := atomic.LoadInt32(&dials); dials != 1 {
+			t.Errorf("unexpected number of dials: %d", dials)
+		}
+
+		if lost := atomic.LoadInt64(&client.trans.writeErrorsOverall); lost != 1 {
+			t.Errorf("unexpected lost packets: %d", lost)
+		}
+	})
+}
+
+func TestTeeWriter(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	var tee bytes.Buffer
+
+	client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(100), SendLoopCount(4), SendQueueCapacity(100),
+		FlushInterval(time.Hour), TeeWriter(&tee))
+
+	for i := 0; i < 50; i++ {
+		client.Incr("req.count", int64(i+1))
+	}
+	client.Flush()
+
+	var packets []string
+
+	for lines := 0; lines < 50; {
+		select {
+		case buf := <-received:
+			packets = append(packets, string(buf)+"\n")
+			lines += strings.Count(string(buf), "\n") + 1
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for packets, received %d", len(packets))
+		}
+	}
+
+	// wait for send loops to finish
+	_ = client.Close()
+
+	teed := strings.Split(strings.TrimSuffix(tee.String(), "\n\n"), "\n\n")
+	for i := range teed {
+		teed[i] += "\n"
+	}
+
+	sort.Strings(packets)
+	sort.Strings(teed)
+
+	if !reflect.DeepEqual(packets, teed) {
+		t.Errorf("tee doesn't match received packets: %v != %v", teed, packets)
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	var dump bytes.Buffer
+
+	client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(40), SendLoopCount(2), FlushInterval(time.Hour),
+		TagStyle(TagFormatDatadog), DebugDump(&dump))
+
+	client.Incr("req.count", 1)
+	client.Incr("req.count", 2)
+	client.Incr("req.count", 3, StringTag("color", "\x1b[31mred\xff"))
+	client.Flush()
+
+	var packets []string
+
+	for lines := 0; lines < 3; {
+		select {
+		case buf := <-received:
+			packets = append(packets, string(buf))
+			lines += strings.Count(string(buf), "\n") + 1
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for packets, received %d", len(packets))
+		}
+	}
+
+	// wait for send loops to finish
+	_ = client.Close()
+
+	header := regexp.MustCompile(`^# \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}\S* bytes=(\d+) lines=(\d+)$`)
+
+	var dumped []string
+
+	for _, frame := range strings.SplitAfter(dump.String(), "\n\n") {
+		if frame == "" {
+			continue
+		}
+
+		if !strings.HasSuffix(frame, "\n\n") {
+			t.Fatalf("frame isn't terminated with empty line: %q", frame)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(frame, "\n\n"), "\n")
+
+		m := header.FindStringSubmatch(lines[0])
+		if m == nil {
+			t.Fatalf("unexpected header: %q", lines[0])
+		}
+
+		packet := strings.Join(lines[1:], "\n")
+		unescaped := strings.ReplaceAll(strings.ReplaceAll(packet, `\x1b`, "\x1b"), `\xff`, "\xff")
+
+		if m[1] != strconv.Itoa(len(unescaped)) || m[2] != strconv.Itoa(len(lines)-1) {
+			t.Errorf("header doesn't match packet %q: %q", packet, lines[0])
+		}
+
+		if strings.ContainsAny(packet, "\x1b\xff") {
+			t.Errorf("control characters are not escaped: %q", packet)
+		}
+
+		dumped = append(dumped, unescaped)
+	}
+
+	sort.Strings(packets)
+	sort.Strings(dumped)
+
+	if !reflect.DeepEqual(packets, dumped) {
+		t.Errorf("dump doesn't match received packets: %q != %q", dumped, packets)
+	}
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), SendQueueCapacity(100))
+	clone := client.CloneWithPrefix("clone.")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(c *Client) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				c.Incr("req.count", 1)
+			}
+		}([]*Client{client, clone}[i%2])
+	}
+
+	wg.Wait()
+
+	client.Incr("last", 1)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func(c *Client) {
+			defer wg.Done()
+
+			if err := c.Close(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}([]*Client{client, clone}[i%2])
+	}
+
+	wg.Wait()
+
+	if err := client.Close(); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// buffered metrics are flushed on Close
+	var last string
+
+	for {
+		select {
+		case buf := <-received:
+			last = string(buf)
+
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		break
+	}
+
+	if !strings.HasSuffix(last, "last:1|c") {
+		t.Errorf("last metric wasn't flushed: %#v", last)
+	}
+}
+
+func TestEmitAfterClose(t *testing.T) {
+	inSocket, _ := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(100), FlushInterval(time.Millisecond))
+
+	var wg sync.WaitGroup
+
+	stop := make(chan struct{})
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				client.Incr("req.count", 1)
+				client.Gauge("req.gauge", -1)
+				client.SetAdd("req.set", "value")
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	_ = client.Close()
+
+	// emit some more after Close has returned
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < 100; i++ {
+		client.Incr("req.count", 1)
+	}
+	client.Flush()
+
+	if err := client.FlushAndWait(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestCloseUnreachable(t *testing.T) {
+	var dropped int32
+
+	logger := &capturingLogger{}
+
+	client := NewClient("BOOM:BOOM", Logger(logger), RetryTimeout(time.Hour), FlushInterval(time.Hour),
+		OnDroppedPacket(func(packet []byte, reason DropReason) {
+			if reason == DropReasonClosed {
+				atomic.AddInt32(&dropped, 1)
+			}
+		}))
+
+	for i := 0; i < 3; i++ {
+		client.Incr("req.count", 1)
+		client.Flush()
+	}
+
+	logger.waitFor(t, "Error connecting to server")
+
+	start := time.Now()
+	_ = client.Close()
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Close took too long: %v", elapsed)
+	}
+
+	if lost := client.GetLostPackets(); lost != 3 {
+		t.Errorf("unexpected lost packets: %d", lost)
+	}
+
+	if dropped := atomic.LoadInt32(&dropped); dropped != 3 {
+		t.Errorf("unexpected dropped packets: %d", dropped)
+	}
+}
+
+func TestGaugeResetConcurrent(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(64), SendQueueCapacity(1000), FlushInterval(time.Millisecond))
+
+	const count = 200
+
+	var wg sync.WaitGroup
+
+	for _, value := range []int64{5, -5} {
+		wg.Add(1)
+
+		go func(value int64) {
+			defer wg.Done()
+
+			for i := 0; i < count; i++ {
+				client.Gauge("req.gauge", value)
+			}
+		}(value)
+	}
+
+	wg.Wait()
+	_ = client.Close()
+
+	values := 0
+
+	for values < 2*count {
+		var buf []byte
+
+		select {
+		case buf = <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for metrics, got %d values", values)
+		}
+
+		lines := strings.Split(string(buf), "\n")
+
+		for i, line := range lines {
+			switch line {
+			case "req.gauge:0|g":
+				if i+1 >= len(lines) || lines[i+1] != "req.gauge:-5|g" {
+					t.Fatalf("reset is not followed by the value: %q", lines)
+				}
+			case "req.gauge:-5|g":
+				if i == 0 || lines[i-1] != "req.gauge:0|g" {
+					t.Fatalf("negative value is not preceded by reset: %q", lines)
+				}
+
+				values++
+			case "req.gauge:5|g":
+				values++
+			default:
+				t.Fatalf("unexpected line: %#v", line)
+			}
+		}
+	}
+}
+
+func TestStaggeredReconnects(t *testing.T) {
+	inSocket, _ := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	var (
+		mu                           sync.Mutex
+		dials, inFlight, maxInFlight int
+	)
+
+	dial := func(c *ClientOptions) {
+		c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dials++
+			// skip initial dials which happen at the same time
+			reconnect := dials > 4
+			if reconnect {
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+			}
+			mu.Unlock()
+
+			if reconnect {
+				time.Sleep(5 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}
+
+			var d net.Dialer
+
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(), SendLoopCount(4), ReconnectInterval(100*time.Millisecond), dial)
+	client.Incr("req.count", 1)
+
+	time.Sleep(450 * time.Millisecond)
+
+	_ = client.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if dials < 12 {
+		t.Errorf("not enough reconnects: %d", dials)
+	}
+
+	if maxInFlight != 1 {
+		t.Errorf("reconnects are not staggered: %d concurrent dials", maxInFlight)
+	}
+}
+
+func TestImmediateMode(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	t.Run("Immediate", func(t *testing.T) {
+		client := NewClient(inSocket.LocalAddr().String(), FlushInterval(0))
+		defer client.Close() //nolint:errcheck
+
+		for i := 0; i < 10; i++ {
+			start := time.Now()
+			client.Incr("req.count", 1)
+
+			select {
+			case buf := <-received:
+				// periodic flush happens every DefaultFlushInterval, so metric was sent right away
+				if elapsed := time.Since(start); elapsed > DefaultFlushInterval/5 {
+					t.Errorf("metric was delayed: %v", elapsed)
+				}
+
+				if string(buf) != "req.count:1|c" {
+					t.Errorf("unexpected packet: %#v", string(buf))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for metric")
+			}
+		}
+	})
+
+	t.Run("DisablePeriodicFlush", func(t *testing.T) {
+		client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Millisecond), DisablePeriodicFlush())
+		defer client.Close() //nolint:errcheck
+
+		client.Incr("req.count", 2)
+
+		select {
+		case buf := <-received:
+			t.Fatalf("unexpected packet: %#v", string(buf))
+		case <-time.After(3 * DefaultFlushInterval / 2):
+		}
+
+		client.Flush()
+
+		select {
+		case buf := <-received:
+			if string(buf) != "req.count:2|c" {
+				t.Errorf("unexpected packet: %#v", string(buf))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metric")
+		}
+	})
+}
+
+func TestCloseTimeout(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	// dial fails while server is down
+	var down int32
+
+	dial := func(c *ClientOptions) {
+		c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if atomic.LoadInt32(&down) != 0 {
+				return nil, syscall.ECONNREFUSED
+			}
+
+			var d net.Dialer
+
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+
+	receive := func(t *testing.T, lines int) {
+		for receivedLines := 0; receivedLines < lines; {
+			select {
+			case buf := <-received:
+				receivedLines += strings.Count(string(buf), "\n") + 1
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for metrics, received %d lines", receivedLines)
+			}
+		}
+	}
+
+	t.Run("Healthy", func(t *testing.T) {
+		atomic.StoreInt32(&down, 0)
+
+		client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(100), SendQueueCapacity(100),
+			FlushInterval(time.Hour), CloseTimeout(time.Hour), dial)
+
+		for i := 0; i < 100; i++ {
+			client.Incr("req.count", 1)
+		}
+
+		start := time.Now()
+
+		if err := client.Close(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Close took too long: %v", elapsed)
+		}
+
+		receive(t, 100)
+	})
+
+	t.Run("Down", func(t *testing.T) {
+		atomic.StoreInt32(&down, 1)
+
+		client := NewClient(inSocket.LocalAddr().String(), Logger(&capturingLogger{}), RetryTimeout(10*time.Millisecond),
+			FlushInterval(time.Hour), CloseTimeout(100*time.Millisecond), dial)
+
+		for i := 0; i < 3; i++ {
+			client.Incr("req.count", 1)
+			client.Incr("req.count", 2)
+			client.Flush()
+		}
+
+		start := time.Now()
+
+		err := client.Close()
+		if err == nil || err.Error() != "statsd: 3 packets (6 metrics) abandoned on close" {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 500*time.Millisecond {
+			t.Errorf("unexpected Close duration: %v", elapsed)
+		}
+
+		if err := client.Close(); err != nil {
+			t.Errorf("unexpected error on second Close: %s", err)
+		}
+	})
+
+	t.Run("Recovered", func(t *testing.T) {
+		atomic.StoreInt32(&down, 1)
+
+		client := NewClient(inSocket.LocalAddr().String(), Logger(&capturingLogger{}), RetryTimeout(10*time.Millisecond),
+			FlushInterval(time.Hour), CloseTimeout(time.Second), dial)
+
+		for i := 0; i < 3; i++ {
+			client.Incr("req.count", 1)
+			client.Flush()
+		}
+
+		time.AfterFunc(50*time.Millisecond, func() { atomic.StoreInt32(&down, 0) })
+
+		if err := client.Close(); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+
+		receive(t, 3)
+	})
+}
+
+func TestOversizedMetric(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	logger := &capturingLogger{}
+
+	client := NewClient(inSocket.LocalAddr().String(), Logger(logger), MaxPacketSize(100), FlushInterval(time.Hour),
+		ReportInterval(10*time.Millisecond))
+	defer client.Close() //nolint:errcheck
+
+	for i := 0; i < 3; i++ {
+		client.Incr("req.count", 1)
+		client.Incr(strings.Repeat("x", 5000), 1)
+		client.Incr("req.count", 2)
+		client.Flush()
+
+		select {
+		case buf := <-received:
+			if string(buf) != "req.count:1|c\nreq.count:2|c" {
+				t.Errorf("unexpected packet: %#v", string(buf))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics")
+		}
+	}
+
+	if oversized := client.GetOversizedMetrics(); oversized != 3 {
+		t.Errorf("unexpected number of oversized metrics: %d", oversized)
+	}
+
+	logger.waitFor(t, "metrics dropped (larger than MaxPacketSize)")
+
+	// wait for the buffer to be returned to the pool
+	if err := client.FlushAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	client.trans.shards[0].bufLock.Lock()
+	defer client.trans.shards[0].bufLock.Unlock()
+
+	if cap(client.trans.shards[0].buf) > client.trans.bufferSize() {
+		t.Errorf("buffer capacity grew: %d", cap(client.trans.shards[0].buf))
+	}
+
+	for len(client.trans.bufPool) > 0 {
+		if buf := <-client.trans.bufPool; cap(buf) > client.trans.bufferSize() {
+			t.Errorf("pooled buffer capacity grew: %d", cap(buf))
+		}
+	}
+}
+
+func TestWriteErrorsReport(t *testing.T) {
+	inSocket, received := setupListener(t)
+
+	var (
+		killed  int32
+		reports int64
+	)
+
+	logger := &capturingLogger{}
+
+	client := NewClient(inSocket.LocalAddr().String(), Logger(logger), FlushInterval(time.Hour), RetryTimeout(5*time.Millisecond),
+		ReportInterval(100*time.Millisecond),
+		ReportHandler(func(r Report) {
+			atomic.AddInt64(&reports, r.DialFailures)
+		}),
+		func(c *ClientOptions) {
+			c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if atomic.LoadInt32(&killed) == 1 {
+					return nil, syscall.ECONNREFUSED
+				}
+
+				var d net.Dialer
+
+				return d.DialContext(ctx, network, addr)
+			}
+		})
+	defer client.Close() //nolint:errcheck
+
+	client.Incr("req.count", 1)
+	client.Flush()
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metrics")
+	}
+
+	atomic.StoreInt32(&killed, 1)
+	_ = inSocket.Close()
+
+	for i := 0; i < 500; i++ {
+		if atomic.LoadInt64(&client.trans.writeErrorsOverall) > 0 && atomic.LoadInt64(&client.trans.dialFailuresOverall) > 10 {
+			break
+		}
+
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if atomic.LoadInt64(&client.trans.writeErrorsOverall) == 0 {
+		t.Fatal("no write errors recorded")
+	}
+
+	logger.waitFor(t, "packets lost (write errors)")
+
+	for i := 0; atomic.LoadInt64(&reports) == 0; i++ {
+		if i > 100 {
+			t.Fatal("connection failures are not reported")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	errorLines := 0
+
+	for _, msg := range logger.messages {
+		if strings.Contains(msg, "Error connecting to server") || strings.Contains(msg, "Error writing to socket") {
+			errorLines++
+		}
+	}
+
+	if dialFailures := atomic.LoadInt64(&client.trans.dialFailuresOverall); int64(errorLines) >= dialFailures {
+		t.Errorf("errors are not rate-limited: %d log lines for %d connection failures", errorLines, dialFailures)
+	}
+}
+
+func TestCloseRace(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Millisecond), SendQueueCapacity(1000))
+
+	const (
+		emitters   = 8
+		perEmitter = 1000
+	)
+
+	var (
+		emitted int64
+		wg      sync.WaitGroup
+	)
+
+	for i := 0; i < emitters; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < perEmitter; j++ {
+				client.Incr("req.count", 1)
+				atomic.AddInt64(&emitted, 1)
+
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	for atomic.LoadInt64(&emitted) < emitters*perEmitter/4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wg.Wait()
+
+	delivered := int64(0)
+
+	for {
+		select {
+		case buf := <-received:
+			delivered += int64(bytes.Count(buf, []byte("req.count:1|c")))
+
+			continue
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		break
+	}
+
+	closed, lost := client.GetClosedMetrics(), client.GetLostMetrics()
+
+	if closed == 0 {
+		t.Error("no metrics were emitted after Close")
+	}
+
+	if delivered+closed+lost != emitters*perEmitter {
+		t.Errorf("metrics unaccounted for: delivered %d, discarded on close %d, lost %d, emitted %d",
+			delivered, closed, lost, emitters*perEmitter)
+	}
+}
+
+// blockingConn blocks writes until unblock is closed
+type blockingConn struct {
+	net.Conn
+	unblock chan struct{}
+}
+
+func (c *blockingConn) Write(b []byte) (int, error) {
+	<-c.unblock
+
+	return c.Conn.Write(b)
+}
+
+func TestBufPoolMisses(t *testing.T) {
+	inSocket, _ := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	for _, tt := range []struct {
+		name           string
+		prewarm        bool
+		expectedMisses int64
+	}{
+		{"Cold", false, 10},
+		{"Prewarmed", true, 6},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			unblock := make(chan struct{})
+
+			var reportedMisses int64
+
+			client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), BufPoolCapacity(4), PrewarmBufPool(tt.prewarm),
+				SendLoopCount(1), SendQueueCapacity(100), ReportInterval(10*time.Millisecond),
+				ReportHandler(func(r Report) {
+					atomic.AddInt64(&reportedMisses, r.BufPoolMisses)
+				}),
+				func(c *ClientOptions) {
+					c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+						var d net.Dialer
+
+						conn, err := d.DialContext(ctx, network, addr)
+						if err != nil {
+							return nil, err
+						}
+
+						return &blockingConn{Conn: conn, unblock: unblock}, nil
+					}
+				})
+
+			if stats := client.GetStats(); tt.prewarm && stats.BufPoolLength != 4 {
+				t.Errorf("pool should be prewarmed: %d", stats.BufPoolLength)
+			}
+
+			// burst of packets larger than the pool, none of them is sent while writes are blocked
+			for i := 0; i < 10; i++ {
+				client.Incr("req.count", 1)
+				client.Flush()
+			}
+
+			stats := client.GetStats()
+			if stats.BufPoolMisses != tt.expectedMisses {
+				t.Errorf("unexpected pool misses: %d != %d", stats.BufPoolMisses, tt.expectedMisses)
+			}
+
+			if stats.BuffersAllocated != tt.expectedMisses {
+				t.Errorf("unexpected buffers allocated: %d != %d", stats.BuffersAllocated, tt.expectedMisses)
+			}
+
+			for i := 0; atomic.LoadInt64(&reportedMisses) != tt.expectedMisses; i++ {
+				if i > 100 {
+					t.Fatalf("unexpected reported pool misses: %d", atomic.LoadInt64(&reportedMisses))
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			close(unblock)
+
+			if err := client.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRetainOverflow(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	for _, tt := range []struct {
+		name      string
+		retain    int
+		expected  []string
+		lostCount int64
+	}{
+		{"Retained", 10, []string{"req.count:1|c", "req.count:2|c", "req.count:3|c", "req.count:4|c", "req.count:5|c"}, 0},
+		{"Full", 1, []string{"req.count:1|c", "req.count:2|c", "req.count:3|c"}, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			unblock := make(chan struct{})
+
+			client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), SendLoopCount(1), SendQueueCapacity(1),
+				RetainOverflow(tt.retain),
+				func(c *ClientOptions) {
+					c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+						var d net.Dialer
+
+						conn, err := d.DialContext(ctx, network, addr)
+						if err != nil {
+							return nil, err
+						}
+
+						return &blockingConn{Conn: conn, unblock: unblock}, nil
+					}
+				})
+			defer client.Close() //nolint:errcheck
+
+			client.Incr("req.count", 1)
+			client.Flush()
+
+			// wait for the send loop to pick up first packet, it's blocked writing it
+			for len(client.trans.sendQueue) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			// second packet stays in the queue, the rest overflows the queue
+			for i := 2; i <= 5; i++ {
+				client.Incr("req.count", int64(i))
+				client.Flush()
+			}
+
+			if lost := client.GetLostPackets(); lost != tt.lostCount {
+				t.Errorf("unexpected lost packets: %d != %d", lost, tt.lostCount)
+			}
+
+			close(unblock)
+
+			ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+			defer ctxCancel()
+
+			if err := client.FlushAndWait(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, expected := range tt.expected {
+				select {
+				case buf := <-received:
+					if string(buf) != expected {
+						t.Errorf("unexpected packet: %#v != %#v", string(buf), expected)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("timeout waiting for %#v", expected)
+				}
+			}
+		})
+	}
+}
+
+func TestRetainOverflowClose(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), SendLoopCount(1), SendQueueCapacity(1),
+		RetainOverflow(10), CloseTimeout(500*time.Millisecond), ReconnectInterval(0), RetryTimeout(time.Hour),
+		func(c *ClientOptions) {
+			c.dial = func(context.Context, string, string) (net.Conn, error) {
+				return nil, errors.New("unreachable")
+			}
+		})
+
+	// send loop is waiting to reconnect, so first packet fills the queue and the rest is retained
+	for i := 1; i <= 3; i++ {
+		client.Incr("req.count", int64(i))
+		client.Flush()
+	}
+
+	closeErr := make(chan error)
+
+	go func() {
+		closeErr <- client.Close()
+	}()
+
+	// wait for the final flush to start waiting for space in the queue
+	for atomic.LoadInt32(&client.trans.closed) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// shards are not locked while retained packets are waiting for the queue
+	start := time.Now()
+	client.Flush()
+
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("flush during close was blocked for %s", elapsed)
+	}
+
+	if err := <-closeErr; err == nil || err.Error() != "statsd: 3 packets (3 metrics) abandoned on close" {
+		t.Errorf("unexpected close error: %v", err)
+	}
+}
+
+func TestUnusedClientGoroutines(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	for i := 0; i < 10; i++ {
+		// client is never closed, but it doesn't start any goroutines
+		_ = NewClient("127.0.0.1:8125", SendLoopCount(4), SelfTelemetry("statsd.", time.Second))
+	}
+
+	client := NewClient("127.0.0.1:8125", SendLoopCount(4))
+	clone := client.CloneWithPrefix("foo.")
+
+	client.Flush()
+
+	if err := clone.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// metrics emitted after close don't start goroutines
+	client.Incr("req.count", 1)
+
+	if closed := client.GetClosedMetrics(); closed != 1 {
+		t.Errorf("unexpected number of metrics discarded on close: %d", closed)
+	}
+}
+
+func TestClientLifecycleGoroutines(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), SendLoopCount(4), ReportInterval(time.Second), SelfTelemetry("statsd.", time.Second))
+	client.Incr("req.count", 1)
+
+	if err := client.FlushAndWait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metrics")
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpareBufPool(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", BufPoolCapacity(1))
+	defer client.Close() //nolint:errcheck
+
+	trans := client.trans
+
+	// first buffer goes to the pool, second one to the spare pool
+	trans.releaseBuf(make([]byte, 0, trans.bufferSize()))
+	trans.releaseBuf(make([]byte, 0, trans.bufferSize()))
+
+	// grown buffer is never pooled
+	trans.releaseBuf(make([]byte, 0, 2*trans.bufferSize()))
+
+	if len(trans.bufPool) != 1 {
+		t.Fatalf("unexpected pool length: %d", len(trans.bufPool))
+	}
+
+	// spare pool might be cleaned up by GC at any time, so this is best effort check
+	for i := 0; i < 2; i++ {
+		if buf := trans.spareBuf(); cap(buf) != trans.bufferSize() {
+			t.Errorf("unexpected buffer capacity: %d", cap(buf))
+		}
+	}
+
+	if allocated := atomic.LoadInt64(&trans.buffersAllocated); allocated < 1 || allocated > 2 {
+		t.Errorf("unexpected number of buffers allocated: %d", allocated)
+	}
+}
+
+func TestAllocs(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", MetricPrefix("metricPrefix."), MaxPacketSize(65000), SuppressMTUWarning(), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	tagged := NewClient("127.0.0.1:8125", MetricPrefix("metricPrefix."), MaxPacketSize(65000), SuppressMTUWarning(), FlushInterval(time.Hour),
+		TagStyle(TagFormatDatadog), DefaultTags(StringTag("host", "web1")))
+	defer tagged.Close() //nolint:errcheck
+
+	influx := NewClient("127.0.0.1:8125", MaxPacketSize(65000), SuppressMTUWarning(), FlushInterval(time.Hour), TagStyle(TagFormatInfluxDB))
+	defer influx.Close() //nolint:errcheck
+
+	clone := client.CloneWithPrefixExtension("clone.")
+
+	for _, tt := range []struct {
+		name   string
+		action func()
+	}{
+		{"Incr", func() { client.Incr("foo.bar.counter", 1) }},
+		{"Decr", func() { client.Decr("foo.bar.counter", 1) }},
+		{"FIncr", func() { client.FIncr("foo.bar.counter", 0.5) }},
+		{"FDecr", func() { client.FDecr("foo.bar.counter", 0.5) }},
+		{"Timing", func() { client.Timing("foo.bar.timing", 153) }},
+		{"PrecisionTiming", func() { client.PrecisionTiming("foo.bar.timing", 153*time.Millisecond) }},
+		{"Gauge", func() { client.Gauge("foo.bar.gauge", 42) }},
+		{"GaugeNegative", func() { client.Gauge("foo.bar.gauge", -42) }},
+		{"GaugeDelta", func() { client.GaugeDelta("foo.bar.gauge", 1) }},
+		{"FGauge", func() { client.FGauge("foo.bar.gauge", 4.2) }},
+		{"FGaugeDelta", func() { client.FGaugeDelta("foo.bar.gauge", -0.5) }},
+		{"SetAdd", func() { client.SetAdd("foo.bar.set", "bob") }},
+		{"Clone", func() { clone.Incr("foo.bar.counter", 1) }},
+		{"TaggedIncr", func() { tagged.Incr("foo.bar.counter", 1, StringTag("route", "api"), IntTag("status", 200)) }},
+		{"TaggedTiming", func() { tagged.PrecisionTiming("foo.bar.timing", time.Millisecond, StringTag("route", "api")) }},
+		{"TaggedGauge", func() { tagged.Gauge("foo.bar.gauge", 42, Int64Tag("shard", 3)) }},
+		{"TaggedSetAdd", func() { tagged.SetAdd("foo.bar.set", "bob", StringTag("route", "api")) }},
+		{"InfluxIncr", func() { influx.Incr("foo.bar.counter", 1, StringTag("route", "api"), IntTag("status", 200)) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if allocs := testing.AllocsPerRun(1000, tt.action); allocs != 0 {
+				t.Errorf("unexpected allocations: %v", allocs)
+			}
+		})
+	}
+}
+
+func TestPipelineEquivalence(t *testing.T) {
+	emit := func(c *Client) {
+		for i := 0; i < 200; i++ {
+			c.Incr("req.count", int64(i), StringTag("host", "web1"))
+			c.Decr("req.errors", 1)
+			c.FIncr("req.weight", 0.5)
+			c.Timing("req.time", int64(i))
+			c.PrecisionTiming("req.duration", time.Duration(i)*time.Microsecond, IntTag("code", 200))
+			c.Gauge("conn.active", int64(i-100))
+			c.GaugeDelta("conn.delta", -3)
+			c.FGauge("cpu.load", 1.25)
+			c.SetAdd("users", "user"+strconv.Itoa(i%7))
+		}
+	}
+
+	capture := func(options ...Option) []string {
+		inSocket, received := setupListener(t)
+		defer inSocket.Close() //nolint:errcheck
+
+		_ = inSocket.SetReadBuffer(4 * 1024 * 1024)
+
+		options = append([]Option{MetricPrefix("foo."), MaxPacketSize(400), DisablePeriodicFlush(), TrackGaugeState(10),
+			TagStyle(TagFormatDatadog), SendQueueCapacity(1000)}, options...)
+
+		client := NewClient(inSocket.LocalAddr().String(), options...)
+		emit(client)
+
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if lost := client.GetLostPackets(); lost > 0 {
+			t.Fatalf("some packets were lost during the test, results are not valid: %d", lost)
+		}
+
+		var packets []string
+
+		for {
+			select {
+			case buf := <-received:
+				packets = append(packets, string(buf))
+			case <-time.After(100 * time.Millisecond):
+				return packets
+			}
+		}
+	}
+
+	expected := capture()
+	actual := capture(ExperimentalPipeline(true))
+
+	if len(expected) == 0 {
+		t.Fatal("no packets received")
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("pipeline output differs: %d packets != %d packets", len(actual), len(expected))
+	}
+}
+
+func TestPipelineConcurrent(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	// avoid packet drops by the kernel
+	_ = inSocket.SetReadBuffer(4 * 1024 * 1024)
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), ExperimentalPipeline(true),
+		FlushInterval(10*time.Millisecond), SendQueueCapacity(1000))
+
+	var (
+		totalSent int64
+		wg        sync.WaitGroup
+	)
+
+	workers := 8
+	count := 1000
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < count; j++ {
+				increment := i + j
+				client.Incr("some.counter", int64(increment))
+
+				atomic.AddInt64(&totalSent, int64(increment))
+
+				if j%100 == 0 {
+					runtime.Gosched()
+				}
+
+				if j%300 == 0 {
+					client.Flush()
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lost := client.GetLostPackets(); lost > 0 {
+		t.Fatalf("some packets were lost during the test, results are not valid: %d", lost)
+	}
+
+	var totalReceived int64
+
+	for totalReceived < totalSent {
+		select {
+		case buf := <-received:
+			for _, part := range strings.Split(string(buf), "\n") {
+				i1 := strings.Index(part, ":")
+				i2 := strings.Index(part, "|")
+
+				if i1 == -1 || i2 == -1 {
+					t.Fatalf("non-parsable part: %#v", part)
+				}
+
+				count, err := strconv.ParseInt(part[i1+1:i2], 10, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				totalReceived += count
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("sent %d != received %d", totalSent, totalReceived)
+		}
+	}
+
+	if totalReceived != totalSent {
+		t.Errorf("sent %d != received %d", totalSent, totalReceived)
+	}
+}
+
+func TestPipelineCloseRace(t *testing.T) {
+	for _, emitFirst := range []bool{true, false} {
+		inSocket, received := setupListener(t)
+
+		_ = inSocket.SetReadBuffer(4 * 1024 * 1024)
+
+		client := NewClient(inSocket.LocalAddr().String(), ExperimentalPipeline(true), SendQueueCapacity(1000))
+
+		if emitFirst {
+			client.Incr("counter", 1)
+		}
+
+		var (
+			emitted int64
+			wg      sync.WaitGroup
+			stop    = make(chan struct{})
+		)
+
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					client.Incr("counter", 1)
+					atomic.AddInt64(&emitted, 1)
+				}
+			}()
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		if err := client.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		close(stop)
+		wg.Wait()
+
+		var delivered int64
+
+	RECEIVE:
+		for {
+			select {
+			case buf := <-received:
+				delivered += int64(bytes.Count(buf, []byte("\n")) + 1)
+			case <-time.After(100 * time.Millisecond):
+				break RECEIVE
+			}
+		}
+
+		_ = inSocket.Close()
+
+		if emitFirst {
+			emitted++
+		}
+
+		// every metric is either delivered or accounted as lost
+		if accounted := delivered + client.GetClosedMetrics() + client.GetLostMetrics(); accounted != emitted {
+			t.Errorf("emitFirst=%v: emitted %d != delivered %d + closed %d + lost %d", emitFirst, emitted, delivered,
+				client.GetClosedMetrics(), client.GetLostMetrics())
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	// avoid packet drops by the kernel
+	_ = inSocket.SetReadBuffer(4 * 1024 * 1024)
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), FlushInterval(10*time.Millisecond),
+		SendQueueCapacity(1000))
+
+	var (
+		totalSent int64
+		wg        sync.WaitGroup
+	)
+
+	workers := 8
+	requests := 100
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < requests; j++ {
+				local := client.Local()
+
+				for k := 0; k < 10; k++ {
+					increment := i + j + k
+					local.Incr("some.counter", int64(increment))
+
+					atomic.AddInt64(&totalSent, int64(increment))
+				}
+
+				if j%10 == 0 {
+					runtime.Gosched()
+				}
+
+				local.Release()
+
+				// released handle falls back to the shared buffer
+				local.Incr("some.counter", 1)
+				atomic.AddInt64(&totalSent, 1)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	client.trans.localsLock.Lock()
+	if len(client.trans.locals) != 0 {
+		t.Errorf("released buffers are still registered: %d", len(client.trans.locals))
+	}
+	client.trans.localsLock.Unlock()
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lost := client.GetLostPackets(); lost > 0 {
+		t.Fatalf("some packets were lost during the test, results are not valid: %d", lost)
+	}
+
+	var totalReceived int64
+
+	for totalReceived < totalSent {
+		select {
+		case buf := <-received:
+			for _, part := range strings.Split(string(buf), "\n") {
+				i1 := strings.Index(part, ":")
+				i2 := strings.Index(part, "|")
+
+				if i1 == -1 || i2 == -1 {
+					t.Fatalf("non-parsable part: %#v", part)
+				}
+
+				count, err := strconv.ParseInt(part[i1+1:i2], 10, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				totalReceived += count
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("sent %d != received %d", totalSent, totalReceived)
+		}
+	}
+
+	if totalReceived != totalSent {
+		t.Errorf("sent %d != received %d", totalSent, totalReceived)
+	}
+}
+
+func TestLocalFlush(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), DisablePeriodicFlush())
+
+	local := client.Local()
+	local.Incr("counter", 1)
+	local.Gauge("gauge", 2)
+
+	// gauges go to the shared buffer
+	if len(client.trans.shards[0].buf) == 0 {
+		t.Error("gauge is not in the shared buffer")
+	}
+
+	local.Flush()
+
+	select {
+	case buf := <-received:
+		if string(buf) != "foo.counter:1|c" {
+			t.Errorf("unexpected packet: %q", buf)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("local buffer wasn't flushed")
+	}
+
+	local.Incr("counter", 3)
+	client.Flush()
+
+	var packets []string
+
+	for len(packets) < 2 {
+		select {
+		case buf := <-received:
+			packets = append(packets, string(buf))
+		case <-time.After(time.Second):
+			t.Fatalf("buffers weren't flushed: %q", packets)
+		}
+	}
+
+	sort.Strings(packets)
+
+	if !reflect.DeepEqual(packets, []string{"foo.counter:3|c", "foo.gauge:2|g"}) {
+		t.Errorf("unexpected packets: %q", packets)
+	}
+
+	local.Release()
+	local.Release()
+
+	_ = client.Close()
+}
+
+func TestLocalLeak(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), DisablePeriodicFlush())
+
+	func() {
+		local := client.Local()
+		local.Incr("leaked", 1)
+	}()
+
+	// handle which is not released is released by the finalizer
+	for i := 0; ; i++ {
+		runtime.GC()
+
+		client.trans.localsLock.Lock()
+		n := len(client.trans.locals)
+		client.trans.localsLock.Unlock()
+
+		if n == 0 {
+			break
+		}
+
+		if i > 100 {
+			t.Fatal("leaked handle wasn't finalized")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	client.Flush()
+
+	select {
+	case buf := <-received:
+		if string(buf) != "foo.leaked:1|c" {
+			t.Errorf("unexpected packet: %q", buf)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("leaked buffer wasn't flushed")
+	}
+
+	// handle which is still alive is flushed on close
+	local := client.Local()
+	local.Incr("alive", 1)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case buf := <-received:
+		if string(buf) != "foo.alive:1|c" {
+			t.Errorf("unexpected packet: %q", buf)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("local buffer wasn't flushed on close")
+	}
+
+	local.Incr("closed", 1)
+	local.Release()
+
+	if client.GetLostPackets() != 0 {
+		t.Errorf("unexpected lost packets: %d", client.GetLostPackets())
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	// avoid packet drops by the kernel
+	_ = inSocket.SetReadBuffer(4 * 1024 * 1024)
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), MaxPacketSize(200), SendBatchSize(8),
+		SendQueueCapacity(1000), FlushInterval(10*time.Millisecond))
+
+	// partially filled batch is submitted on flush
+	client.Incr("first", 1)
+
+	select {
+	case buf := <-received:
+		if string(buf) != "foo.first:1|c" {
+			t.Errorf("unexpected packet: %q", buf)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("partial batch wasn't submitted")
+	}
+
+	// packets are sent in order
+	count := 5000
+
+	for i := 0; i < count; i++ {
+		client.Incr("counter", int64(i+1))
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lost := client.GetLostPackets(); lost > 0 {
+		t.Fatalf("some packets were lost during the test, results are not valid: %d", lost)
+	}
+
+	expected := int64(1)
+
+	for expected <= int64(count) {
+		select {
+		case buf := <-received:
+			for _, part := range strings.Split(string(buf), "\n") {
+				value, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(part, "foo.counter:"), "|c"), 10, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if value != expected {
+					t.Fatalf("packets out of order: %d != %d", value, expected)
+				}
+
+				expected++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("received only %d metrics out of %d", expected-1, count)
+		}
+	}
+}
+
+func TestSendBatchOverflow(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	unblock := make(chan struct{})
+
+	var dropped int64
+
+	client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(200), SendBatchSize(4), SendQueueCapacity(8),
+		DisablePeriodicFlush(), OnDroppedPacket(func([]byte, DropReason) { atomic.AddInt64(&dropped, 1) }),
+		func(c *ClientOptions) {
+			c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+
+				conn, err := d.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				return &blockingConn{Conn: conn, unblock: unblock}, nil
+			}
+		})
+
+	// batch queue holds 2 batches, send queue holds 8 packets, rest is dropped
+	for i := 0; i < 200; i++ {
+		client.Incr("counter", 1)
+		client.Flush()
+	}
+
+	if client.GetLostPackets() == 0 {
+		t.Error("expected some packets to be lost")
+	}
+
+	close(unblock)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var delivered int64
+
+RECEIVE:
+	for {
+		select {
+		case <-received:
+			delivered++
+		case <-time.After(100 * time.Millisecond):
+			break RECEIVE
+		}
+	}
+
+	if delivered+client.GetLostPackets() != 200 {
+		t.Errorf("delivered %d + lost %d != 200", delivered, client.GetLostPackets())
+	}
+
+	if atomic.LoadInt64(&dropped) != client.GetLostPackets() {
+		t.Errorf("dropped %d != lost %d", atomic.LoadInt64(&dropped), client.GetLostPackets())
+	}
+}
+
+func TestPacketBoundary(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	for _, mode := range []struct {
+		name string
+		opts []Option
+		wrap func(c *Client) (incr func(stat string, count int64), done func())
+	}{
+		{name: "Shared"},
+		{name: "Pipeline", opts: []Option{ExperimentalPipeline(true)}},
+		{name: "Unlocked", opts: []Option{Unlocked(true)}},
+		{name: "Local", wrap: func(c *Client) (func(string, int64), func()) {
+			l := c.Local()
+			return func(stat string, count int64) { l.Incr(stat, count) }, l.Release
+		}},
+	} {
+		for _, tt := range []struct {
+			name     string
+			size     int
+			stats    []string
+			expected []string
+		}{
+			// "a:1|c\n" is 6 bytes
+			{"Exact", 12, []string{"a", "b", "c", "d", "e"}, []string{"a:1|c\nb:2|c", "c:3|c\nd:4|c", "e:5|c"}},
+			{"Over", 11, []string{"a", "b", "c"}, []string{"a:1|c", "b:2|c", "c:3|c"}},
+			{"Single", 12, []string{"a", "long123", "b"}, []string{"a:1|c", "long123:2|c", "b:3|c"}},
+			{"Oversized", 12, []string{"a", "long1234", "b"}, []string{"a:1|c\nb:3|c"}},
+		} {
+			t.Run(mode.name+"/"+tt.name, func(t *testing.T) {
+				client := NewClient(inSocket.LocalAddr().String(), append([]Option{MaxPacketSize(tt.size), FlushInterval(time.Hour)}, mode.opts...)...)
+				defer client.Close() //nolint:errcheck
+
+				incr, done := func(stat string, count int64) { client.Incr(stat, count) }, func() {}
+				if mode.wrap != nil {
+					incr, done = mode.wrap(client)
+				}
+
+				for i, stat := range tt.stats {
+					incr(stat, int64(i+1))
+				}
+
+				done()
+				client.Flush()
+
+				for _, expected := range tt.expected {
+					select {
+					case buf := <-received:
+						if string(buf) != expected {
+							t.Errorf("unexpected packet: %q != %q", buf, expected)
+						}
+					case <-time.After(time.Second):
+						t.Fatalf("packet %q wasn't delivered", expected)
+					}
+				}
+
+				select {
+				case buf := <-received:
+					t.Errorf("unexpected packet: %q", buf)
+				case <-time.After(10 * time.Millisecond):
+				}
+			})
+		}
+	}
+}
+
+func TestScratchBuffer(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), TagStyle(TagFormatDatadog), DisablePeriodicFlush())
+	defer client.Close() //nolint:errcheck
+
+	var (
+		tags     []Tag
+		expected strings.Builder
+	)
+
+	// line doesn't fit into the initial scratch buffer
+	expected.WriteString("foo.counter:1|c|#")
+
+	for i := 0; i < 30; i++ {
+		tags = append(tags, StringTag(fmt.Sprintf("tag%02d", i), "some-long-tag-value"))
+
+		if i > 0 {
+			expected.WriteByte(',')
+		}
+
+		fmt.Fprintf(&expected, "tag%02d:some-long-tag-value", i)
+	}
+
+	if expected.Len() <= scratchSize {
+		t.Fatalf("line is too short: %d", expected.Len())
+	}
+
+	for _, tt := range []struct {
+		name string
+		emit func()
+		line string
+	}{
+		{"Long", func() { client.Incr("counter", 1, tags...) }, expected.String()},
+		{"Short", func() { client.FGauge("gauge", 1.5) }, "foo.gauge:1.5|g"},
+		{"Gauge", func() { client.Gauge("gauge", 2, tags[:1]...) }, "foo.gauge:2|g|#tag00:some-long-tag-value"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.emit()
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != tt.line {
+					t.Errorf("unexpected line: %q != %q", buf, tt.line)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("metric wasn't delivered")
+			}
+		})
+	}
+}
+
+func TestAutoScaleSendLoops(t *testing.T) {
+	for _, closeScaled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("closeScaled=%v", closeScaled), func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			inSocket, _ := setupListener(t)
+			defer inSocket.Close() //nolint:errcheck
+
+			unblock := make(chan struct{})
+
+			client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(100), SendQueueCapacity(10),
+				AutoScaleSendLoops(1, 3), DisablePeriodicFlush(), ReportInterval(0),
+				func(c *ClientOptions) {
+					c.scaleInterval = 10 * time.Millisecond
+					c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+						var d net.Dialer
+
+						conn, err := d.DialContext(ctx, network, addr)
+						if err != nil {
+							return nil, err
+						}
+
+						return &blockingConn{Conn: conn, unblock: unblock}, nil
+					}
+				})
+
+			if loops := client.GetStats().SendLoopCount; loops != 1 {
+				t.Fatalf("unexpected number of send loops: %d", loops)
+			}
+
+			waitForLoops := func(expected int, timeout time.Duration, emit bool) {
+				deadline := time.Now().Add(timeout)
+
+				for client.GetStats().SendLoopCount != expected {
+					if time.Now().After(deadline) {
+						t.Fatalf("send loops %d != %d", client.GetStats().SendLoopCount, expected)
+					}
+
+					if emit {
+						// keep the queue full
+						for i := 0; i < 20; i++ {
+							client.Incr("counter", 1)
+							client.Flush()
+						}
+					}
+
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+
+			// writes are blocked, so burst fills the queue and send loops are scaled up
+			waitForLoops(3, 5*time.Second, true)
+
+			close(unblock)
+
+			if !closeScaled {
+				// once writes are unblocked, queue is drained and additional send loops are retired
+				waitForLoops(1, 10*time.Second, false)
+			}
+
+			if err := client.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUnlocked(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), FlushInterval(10*time.Millisecond), UnlockedDebug())
+
+	client.Incr("counter", 1)
+	client.Gauge("gauge", -3)
+	client.Gauge("gauge", 5)
+
+	// flush loop can't flush emitter buffer, request is served on next metric
+	time.Sleep(50 * time.Millisecond)
+
+	select {
+	case buf := <-received:
+		t.Fatalf("unexpected packet: %q", buf)
+	default:
+	}
+
+	client.Incr("counter", 2)
+
+	select {
+	case buf := <-received:
+		if expected := "foo.counter:1|c\nfoo.gauge:0|g\nfoo.gauge:-3|g\nfoo.gauge:5|g\nfoo.counter:2|c"; string(buf) != expected {
+			t.Errorf("unexpected packet: %q != %q", buf, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("flush request wasn't served")
+	}
+
+	client.CloneWithPrefix("bar.").Timing("timing", 7)
+	client.Flush()
+
+	select {
+	case buf := <-received:
+		if expected := "bar.timing:7|ms"; string(buf) != expected {
+			t.Errorf("unexpected packet: %q != %q", buf, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("metric wasn't delivered")
+	}
+
+	client.Incr("counter", 3)
+	_ = client.Close()
+
+	select {
+	case buf := <-received:
+		if expected := "foo.counter:3|c"; string(buf) != expected {
+			t.Errorf("unexpected packet: %q != %q", buf, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("metric wasn't flushed on close")
+	}
+}
+
+func TestUnlockedDebug(t *testing.T) {
+	client := NewClient("127.0.0.1:4444", UnlockedDebug(), DisablePeriodicFlush())
+	defer client.Close() //nolint:errcheck
+
+	// simulate another goroutine in the middle of sending metric
+	s := client.trans.acquireUnlocked()
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("concurrent use wasn't detected")
+			}
+		}()
+
+		client.Incr("counter", 1)
+	}()
+
+	client.trans.commitUnlocked(len(s.buf))
+
+	// client is usable once emitter is done
+	client.Incr("counter", 1)
+}
+
+func TestMinFlushSize(t *testing.T) {
+	t.Run("Coalesce", func(t *testing.T) {
+		inSocket, received := setupListener(t)
+		defer inSocket.Close() //nolint:errcheck
+
+		client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), FlushInterval(10*time.Millisecond),
+			MinFlushSize(100, time.Hour))
+		defer client.Close() //nolint:errcheck
+
+		for i := 1; i <= 3; i++ {
+			client.Incr("counter", int64(i))
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		select {
+		case buf := <-received:
+			t.Fatalf("small buffer was flushed: %q", buf)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		var expected []string
+
+		for i := 1; i <= 7; i++ {
+			expected = append(expected, fmt.Sprintf("foo.counter:%d|c", i))
+
+			if i > 3 {
+				client.Incr("counter", int64(i))
+			}
+		}
+
+		select {
+		case buf := <-received:
+			if string(buf) != strings.Join(expected, "\n") {
+				t.Errorf("unexpected packet: %q", buf)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("buffer wasn't flushed")
+		}
+	})
+
+	t.Run("MaxDelay", func(t *testing.T) {
+		inSocket, received := setupListener(t)
+		defer inSocket.Close() //nolint:errcheck
+
+		client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), FlushInterval(10*time.Millisecond),
+			MinFlushSize(1000, 50*time.Millisecond))
+		defer client.Close() //nolint:errcheck
+
+		start := time.Now()
+		client.Incr("counter", 1)
+
+		select {
+		case buf := <-received:
+			if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+				t.Errorf("buffer was flushed too early: %s", elapsed)
+			}
+
+			if string(buf) != "foo.counter:1|c" {
+				t.Errorf("unexpected packet: %q", buf)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("latency bound wasn't applied")
+		}
+
+		// explicit flush ignores the threshold
+		client.Incr("counter", 2)
+		client.Flush()
+
+		select {
+		case buf := <-received:
+			if string(buf) != "foo.counter:2|c" {
+				t.Errorf("unexpected packet: %q", buf)
+			}
+		case <-time.After(40 * time.Millisecond):
+			t.Fatal("explicit flush was delayed")
+		}
+	})
+}
+
+func TestOnFlush(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	type flushed struct {
+		packetLen, metrics int
+	}
+
+	var (
+		mu      sync.Mutex
+		flushes []flushed
+	)
+
+	client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(40), FlushInterval(time.Hour),
+		OnFlush(func(packetLen, metrics int) {
+			mu.Lock()
+			flushes = append(flushes, flushed{packetLen, metrics})
+			mu.Unlock()
+		}))
+	defer client.Close() //nolint:errcheck
+
+	for i := 0; i < 10; i++ {
+		client.Incr("counter", 1)
+		client.Gauge("gauge", 2)
+	}
+
+	client.Flush()
+
+	var packets []flushed
+
+	for {
+		select {
+		case buf := <-received:
+			packets = append(packets, flushed{len(buf), bytes.Count(buf, []byte("\n")) + 1})
+
+			continue
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		break
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(packets) < 2 {
+		t.Fatalf("expected several packets: %v", packets)
+	}
+
+	if !reflect.DeepEqual(flushes, packets) {
+		t.Errorf("hook invocations don't match packets: %v != %v", flushes, packets)
+	}
+}
+
+func TestOnFlushBatch(t *testing.T) {
+	var flushed, dropped int
+
+	// batch queue fits single batch, send queue fits two packets
+	client := NewClient("127.0.0.1:8125", PassiveMode(), SendBatchSize(2), SendQueueCapacity(2),
+		OnFlush(func(int, int) { flushed++ }),
+		OnDroppedPacket(func(_ []byte, reason DropReason) {
+			if reason == DropReasonOverflow {
+				dropped++
+			}
+		}))
+	defer client.Close() //nolint:errcheck
+
+	// each Flush submits partially filled batch
+	for i := 1; i <= 5; i++ {
+		client.Incr("counter", int64(i))
+		client.Flush()
+	}
+
+	// packets which didn't fit into the queues are reported only as dropped
+	if flushed != 3 || dropped != 2 {
+		t.Errorf("unexpected flushed/dropped: %d/%d", flushed, dropped)
+	}
+}
+
+func TestOnFlushPanic(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	logger := &capturingLogger{}
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), Logger(logger),
+		ReportInterval(10*time.Millisecond), OnFlush(func(int, int) { panic("boom") }))
+	defer client.Close() //nolint:errcheck
+
+	for i := 1; i <= 2; i++ {
+		client.Incr("counter", int64(i))
+		client.Flush()
+
+		select {
+		case buf := <-received:
+			if expected := fmt.Sprintf("counter:%d|c", i); string(buf) != expected {
+				t.Errorf("unexpected packet: %q != %q", buf, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("metric wasn't delivered")
+		}
+	}
+
+	logger.waitFor(t, "OnFlush callback panicked")
+}
+
+func TestGetAndResetLostPackets(t *testing.T) {
+	var reported int64
+
+	client := NewClient("BOOM:BOOM", SendQueueCapacity(0), FlushInterval(time.Hour), Logger(&capturingLogger{}),
+		ReportInterval(time.Millisecond), ReportHandler(func(r Report) {
+			atomic.AddInt64(&reported, r.LostOverflow)
+		}))
+	defer client.Close() //nolint:errcheck
+
+	const drops = 2000
+
+	var (
+		wg                    sync.WaitGroup
+		polledPackets, polled int64
+	)
+
+	stop := make(chan struct{})
+
+	// two pollers race with each other and with report loop
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				atomic.AddInt64(&polledPackets, client.GetAndResetLostPackets())
+				atomic.AddInt64(&polled, client.GetAndResetLostMetrics())
+
+				select {
+				case <-stop:
+					return
+				default:
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < drops; i++ {
+		client.Incr("req.count", 1)
+		client.Gauge("req.clients", 3)
+		client.Flush()
+
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	polledPackets += client.GetAndResetLostPackets()
+	polled += client.GetAndResetLostMetrics()
+
+	if polledPackets != drops || polled != 2*drops {
+		t.Errorf("unexpected polled counters: %d packets, %d metrics", polledPackets, polled)
+	}
+
+	if client.GetAndResetLostPackets() != 0 || client.GetAndResetWriteErrors() != 0 {
+		t.Error("counters were not reset")
+	}
+
+	if client.GetLostPackets() != drops {
+		t.Errorf("lifetime counter was reset: %d", client.GetLostPackets())
+	}
+
+	// report loop counts are not affected by polling
+	for i := 0; i < 100 && atomic.LoadInt64(&reported) < drops; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if reported := atomic.LoadInt64(&reported); reported != drops {
+		t.Errorf("unexpected number of packets reported: %d", reported)
+	}
+}
+
+// partialConn writes half of the packet and fails
+type partialConn struct {
+	net.Conn
+}
+
+func (partialConn) Write(b []byte) (int, error) {
+	return len(b) / 2, syscall.EPIPE
+}
+
+func (partialConn) Close() error {
+	return nil
+}
+
+func TestSentCounters(t *testing.T) {
+	t.Run("Delivered", func(t *testing.T) {
+		inSocket, received := setupListener(t)
+		defer inSocket.Close() //nolint:errcheck
+
+		client := NewClient(inSocket.LocalAddr().String(), MaxPacketSize(100), SendLoopCount(2), FlushInterval(time.Hour),
+			SendQueueCapacity(100))
+		defer client.Close() //nolint:errcheck
+
+		for i := 0; i < 100; i++ {
+			client.Incr("req.count", int64(i+1))
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		if err := client.FlushAndWait(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		stats := client.GetStats()
+
+		var packets, size int64
+
+		for size < stats.BytesSent {
+			select {
+			case buf := <-received:
+				packets++
+				size += int64(len(buf))
+			case <-time.After(time.Second):
+				t.Fatalf("received %d bytes out of %d sent", size, stats.BytesSent)
+			}
+		}
+
+		if packets < 2 || packets != stats.PacketsSent || size != stats.BytesSent {
+			t.Errorf("counters don't match received packets: %d packets, %d bytes != %d packets, %d bytes",
+				stats.PacketsSent, stats.BytesSent, packets, size)
+		}
+	})
+
+	t.Run("PartialWrite", func(t *testing.T) {
+		client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), Logger(&capturingLogger{}),
+			func(c *ClientOptions) {
+				c.dial = func(context.Context, string, string) (net.Conn, error) {
+					return partialConn{}, nil
+				}
+			})
+		defer client.Close() //nolint:errcheck
+
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		for i := 0; i < 100 && client.GetStats().BytesSent == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// "req.count:1|c" is 13 bytes
+		if stats := client.GetStats(); stats.BytesSent != 6 || stats.PacketsSent != 0 {
+			t.Errorf("unexpected counters: %d packets, %d bytes", stats.PacketsSent, stats.BytesSent)
+		}
+	})
+}
+
+func TestMTUWarning(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	for _, tt := range []struct {
+		name        string
+		opts        []Option
+		warnings    int
+		recommended int
+	}{
+		{"UDPDefault", nil, 0, 1432},
+		{"UDPLarge", []Option{MaxPacketSize(65000)}, 1, 1432},
+		{"UDPSuppressed", []Option{MaxPacketSize(65000), SuppressMTUWarning()}, 0, 1432},
+		{"TCP", []Option{MaxPacketSize(65000), Network("tcp")}, 0, 0},
+		{"Unixgram", []Option{MaxPacketSize(4096), Network("unixgram")}, 0, MaxUnixgramPacketSize},
+		{"UnixgramLarge", []Option{MaxPacketSize(65000), Network("unixgram")}, 1, MaxUnixgramPacketSize},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &capturingLogger{}
+
+			client := NewClient(inSocket.LocalAddr().String(), append([]Option{Logger(logger), SendLoopCount(2),
+				ReconnectInterval(5 * time.Millisecond), FlushInterval(time.Hour)}, tt.opts...)...)
+
+			if client.GetStats().RecommendedMaxPacketSize != tt.recommended {
+				t.Errorf("unexpected recommendation: %d != %d", client.GetStats().RecommendedMaxPacketSize, tt.recommended)
+			}
+
+			if tt.name[:3] == "UDP" {
+				// send loops connect (and reconnect) and check socket type again
+				for i := 0; i < 3; i++ {
+					client.Incr("counter", 1)
+					client.Flush()
+
+					select {
+					case <-received:
+					case <-time.After(time.Second):
+						t.Fatal("metric wasn't delivered")
+					}
+
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			_ = client.Close()
+
+			logger.mu.Lock()
+			defer logger.mu.Unlock()
+
+			warnings := 0
+			for _, msg := range logger.messages {
+				if strings.Contains(msg, "MaxPacketSize") {
+					warnings++
+				}
+			}
+
+			if warnings != tt.warnings {
+				t.Errorf("unexpected number of warnings: %d != %d (%v)", warnings, tt.warnings, logger.messages)
+			}
+		})
+	}
+}
+
+func TestSynchronousMode(t *testing.T) {
+	inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), SynchronousMode(true), FlushInterval(time.Hour), SendLoopCount(2))
+	defer client.Close() //nolint:errcheck
+
+	buf := make([]byte, 1500)
+
+	for i := 0; i < 10; i++ {
+		client.Incr("req.count", int64(i+1))
+		client.Flush()
+
+		// packet is already written once Flush returns
+		if sent := client.GetStats().PacketsSent; sent != int64(i+1) {
+			t.Fatalf("packet wasn't delivered synchronously: %d != %d", sent, i+1)
+		}
+
+		_ = inSocket.SetReadDeadline(time.Now().Add(time.Second))
+
+		n, err := inSocket.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if expected := fmt.Sprintf("req.count:%d|c", i+1); string(buf[:n]) != expected {
+			t.Errorf("unexpected packet %q != %q", string(buf[:n]), expected)
+		}
+	}
+
+	if err = client.FlushAndWait(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	t.Run("WriteError", func(t *testing.T) {
+		var dials int32
+
+		client := NewClient(inSocket.LocalAddr().String(), SynchronousMode(true), FlushInterval(time.Hour),
+			SendLoopCount(1), RetryTimeout(time.Hour), flakyDial(&dials, 1, errors.New("boom")), Logger(&capturingLogger{}))
+		defer client.Close() //nolint:errcheck
+
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		if err := client.FlushAndWait(context.Background()); err == nil || err.Error() != "boom" {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		// send loop waits for reconnect, flush doesn't block
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		if err := client.FlushAndWait(context.Background()); err == nil || err.Error() != "statsd: packet dropped: boom" {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		if err := client.FlushAndWait(context.Background()); err != nil {
+			t.Errorf("error should be reported once: %v", err)
+		}
+
+		if stats := client.GetStats(); stats.WriteErrors != 2 {
+			t.Errorf("unexpected write errors: %d", stats.WriteErrors)
+		}
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		client := NewClient("BOOM:BOOM", SynchronousMode(true), FlushInterval(time.Hour), SendLoopCount(1),
+			RetryTimeout(time.Hour), Logger(&capturingLogger{}))
+
+		client.Incr("req.count", 1)
+		client.Flush()
+
+		if err := client.FlushAndWait(context.Background()); err == nil || !strings.HasPrefix(err.Error(), "statsd: packet dropped: ") {
+			t.Errorf("unexpected error: %v", err)
+		}
+
+		client.Incr("req.count", 1)
+
+		if err := client.Close(); err != nil {
+			t.Errorf("unexpected error on close: %s", err)
+		}
+	})
+}
+
+func TestRateTracker(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(10*time.Second), MetricPrefix("web."))
+	defer client.Close() //nolint:errcheck
+
+	now := time.Unix(1500000000, 0)
+	client.trans.now = func() time.Time { return now }
+
+	tick := func(d time.Duration) string {
+		now = now.Add(d)
+
+		return readReported(t, client, received)
+	}
+
+	r := client.NewRateTracker("req.rate", StringTag("route", "api"))
+
+	t.Run("FirstPartialWindow", func(t *testing.T) {
+		// window shorter than half of flush interval is carried over
+		r.Mark(3)
+
+		if packet := tick(time.Second); packet != "" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+
+		r.Mark(27)
+
+		if packet := tick(9 * time.Second); packet != "web.req.rate,route=api:3|g" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+	})
+
+	t.Run("Steady", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 50; j++ {
+				r.Mark(1)
+			}
+
+			if packet := tick(10 * time.Second); packet != "web.req.rate,route=api:5|g" {
+				t.Errorf("unexpected packet %q", packet)
+			}
+		}
+	})
+
+	t.Run("Bursty", func(t *testing.T) {
+		r.Mark(100)
+
+		if packet := tick(8 * time.Second); packet != "web.req.rate,route=api:12.5|g" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+
+		if packet := tick(10 * time.Second); packet != "web.req.rate,route=api:0|g" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+
+		// ticks might be delayed, rate is computed over the real window
+		r.Mark(1000)
+
+		if packet := tick(20 * time.Second); packet != "web.req.rate,route=api:50|g" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		r.Mark(10)
+		r.Stop()
+		r.Stop()
+
+		if packet := tick(10 * time.Second); packet != "" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+	})
+}
+
+func TestRateTrackerClose(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(10*time.Millisecond))
+
+	r := client.NewRateTracker("req.rate")
+	r.Mark(5)
+
+	// last window is reported on close
+	time.Sleep(30 * time.Millisecond)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []string
+
+	for {
+		select {
+		case packet := <-received:
+			packets = append(packets, string(packet))
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		break
+	}
+
+	if len(packets) == 0 || !strings.HasPrefix(packets[0], "req.rate:") {
+		t.Errorf("unexpected packets %q", packets)
+	}
+}
+
+func TestBoolGauge(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), MetricPrefix("svc."))
+	defer client.Close() //nolint:errcheck
+
+	read := func() string {
+		client.Flush()
+
+		select {
+		case packet := <-received:
+			return string(packet)
+		case <-time.After(time.Second):
+			t.Fatal("packet not received")
+		}
+
+		return ""
+	}
+
+	t.Run("Transitions", func(t *testing.T) {
+		client.BoolGauge("leader", true)
+		client.BoolGauge("leader", false)
+		client.BoolGauge("leader", false)
+		client.BoolGauge("leader", true, StringTag("zone", "a"))
+
+		// values are never negative, so there are no reset lines
+		if packet := read(); packet != "svc.leader:1|g\nsvc.leader:0|g\nsvc.leader:0|g\nsvc.leader,zone=a:1|g" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+	})
+
+	t.Run("Local", func(t *testing.T) {
+		l := client.Local()
+		l.BoolGauge("leader", false)
+		l.Release()
+
+		if packet := read(); packet != "svc.leader:0|g" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+	})
+
+	t.Run("Func", func(t *testing.T) {
+		var open atomic.Bool
+
+		g := client.RegisterBoolGaugeFunc("circuit_open", open.Load, StringTag("peer", "db"))
+
+		client.trans.runReporters()
+
+		open.Store(true)
+		client.trans.runReporters()
+		client.trans.runReporters()
+
+		open.Store(false)
+		client.trans.runReporters()
+
+		if packet := read(); packet != "svc.circuit_open,peer=db:0|g\nsvc.circuit_open,peer=db:1|g\nsvc.circuit_open,peer=db:1|g\nsvc.circuit_open,peer=db:0|g" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+
+		g.Stop()
+		client.trans.runReporters()
+		client.Incr("marker", 1)
+
+		if packet := read(); packet != "svc.marker:1|c" {
+			t.Errorf("unexpected packet %q", packet)
+		}
+	})
+}
+
+func TestBoolGaugeFuncFlush(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(10*time.Millisecond))
+	defer client.Close() //nolint:errcheck
+
+	g := client.RegisterBoolGaugeFunc("leader", func() bool { return true })
+	defer g.Stop()
+
+	// gauge is evaluated by the flush loop
+	select {
+	case packet := <-received:
+		if !strings.HasPrefix(string(packet), "leader:1|g") {
+			t.Errorf("unexpected packet %q", string(packet))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("gauge wasn't reported")
+	}
+}
+
+func TestFlushAndWait(t *testing.T) {
+	inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), MaxPacketSize(100))
+
+	expected := make([]string, 10)
+	for i := range expected {
+		client.Incr("req.count", int64(i+1))
+		expected[i] = fmt.Sprintf("req.count:%d|c", i+1)
+	}
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+
+	if err = client.FlushAndWait(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// all the packets should be already in the socket buffer, no waiting
+	var lines []string
+
+	buf := make([]byte, 1500)
+
+	for {
+		_ = inSocket.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+		n, err := inSocket.Read(buf)
+		if err != nil {
+			break
+		}
+
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+
+	if strings.Join(lines, " ") != strings.Join(expected, " ") {
+		t.Errorf("unexpected lines received: %#v != %#v", lines, expected)
+	}
+
+	_ = client.Close()
+	_ = inSocket.Close()
+}
+
+func TestFlushAndWaitTimeout(t *testing.T) {
+	client := NewClient("BOOM:BOOM", FlushInterval(time.Hour))
+	client.Incr("req.count", 1)
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer ctxCancel()
+
+	start := time.Now()
+
+	if err := client.FlushAndWait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Errorf("FlushAndWait took too long: %s", time.Since(start))
+	}
+
+	_ = client.Close()
+}
+
+func TestFlushAndWaitLost(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), SendLoopCount(1), ReconnectInterval(0),
+		func(c *ClientOptions) {
+			c.dial = func(context.Context, string, string) (net.Conn, error) {
+				return partialConn{}, nil
+			}
+		})
+	defer client.Close() //nolint:errcheck
+
+	client.Incr("req.count", 1)
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+
+	err := client.FlushAndWait(ctx)
+	if !errors.Is(err, ErrFlushIncomplete) || err.Error() != "statsd: packets lost during flush: 0 packets lost, 1 write errors" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// errors are reported only for the packets lost during the call
+	if err = client.FlushAndWait(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBufferShards(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	// avoid packet drops by the kernel
+	_ = inSocket.SetReadBuffer(4 * 1024 * 1024)
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), BufferShards(4), FlushInterval(10*time.Millisecond),
+		SendQueueCapacity(1000))
+
+	if len(client.trans.shards) != 4 {
+		t.Fatalf("unexpected number of shards: %d", len(client.trans.shards))
+	}
+
+	// same gauge always goes through the same shard
+	s := client.trans.shardFor("some.gauge")
 
-	t.Run("FGaugeDelta", compareOutput(
-		func() { client.FGaugeDelta("req.clients", 33.5); client.FGaugeDelta("req.clients", -533.3) },
-		[]string{"foo.req.clients:+33.5|g\nfoo.req.clients:-533.3|g"}))
+	for i := 0; i < 10; i++ {
+		if client.trans.shardFor("some.gauge") != s {
+			t.Fatal("gauge shard changed")
+		}
+	}
 
-	t.Run("FGaugeDeltaTaggedDatadog", compareOutput(
-		func() { clientTagged.FGaugeDelta("req.clients", 33.5); clientTagged.FGaugeDelta("req.clients", -533.3) },
-		[]string{"req.clients:+33.5|g|#host:example.com,weight:38\nreq.clients:-533.3|g|#host:example.com,weight:38"}))
+	var (
+		totalSent int64
+		wg        sync.WaitGroup
+	)
 
-	t.Run("SetAdd", compareOutput(
-		func() { client.SetAdd("req.user", "bob") },
-		[]string{"foo.req.user:bob|s"}))
+	workers := 8
+	count := 1000
 
-	t.Run("SetAddTaggedInflux", compareOutput(
-		func() { client.SetAdd("req.user", "bob", StringTag("app", "service"), IntTag("port", 80)) },
-		[]string{"foo.req.user,app=service,port=80:bob|s"}))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
 
-	t.Run("SetAddTaggedDatadog", compareOutput(
-		func() { clientTagged.SetAdd("req.user", "bob", StringTag("app", "service"), IntTag("port", 80)) },
-		[]string{"req.user:bob|s|#host:example.com,weight:38,app:service,port:80"}))
+		go func(i int) {
+			defer wg.Done()
 
-	t.Run("FlushedIncr", compareOutput(
-		func() {
-			client.Incr("req.count", 40)
-			client.Incr("req.count", 20)
-			time.Sleep(150 * time.Millisecond)
-			client.Incr("req.count", 10)
-		},
-		[]string{"foo.req.count:40|c\nfoo.req.count:20|c", "foo.req.count:10|c"}))
+			for j := 0; j < count; j++ {
+				increment := i + j
+				client.Incr("some.counter", int64(increment))
 
-	t.Run("SplitIncr", compareOutput(
-		func() {
-			for i := 0; i < 100; i++ {
-				client.Incr("req.count", 30)
+				atomic.AddInt64(&totalSent, int64(increment))
+
+				if j%100 == 0 {
+					runtime.Gosched()
+				}
 			}
-		},
-		[]string{
-			"foo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c",
-			"foo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c\nfoo.req.count:30|c",
-		}))
+		}(i)
+	}
 
-	_ = client.Close()
-	_ = inSocket.Close()
-	close(received)
-}
+	wg.Wait()
 
-func TestClones(t *testing.T) {
-	inSocket, received := setupListener(t)
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
 
-	client := NewClient(inSocket.LocalAddr().String(),
-		MetricPrefix("foo."),
-		MaxPacketSize(1400),
-		ReconnectInterval(10*time.Second))
-	client2 := client.CloneWithPrefix("bar.")
-	client3 := client2.CloneWithPrefixExtension("blah.")
+	if lost := client.GetLostPackets(); lost > 0 {
+		t.Fatalf("some packets were lost during the test, results are not valid: %d", lost)
+	}
 
-	compareOutput := func(actions func(), expected []string) func(*testing.T) {
-		return func(t *testing.T) {
-			actions()
+	var totalReceived int64
 
-			for _, exp := range expected {
-				var buf []byte
-				select {
-				case buf = <-received:
-				case <-time.After(time.Second):
-					t.Errorf("timeout waiting for %v", exp)
-					return
+	for totalReceived < totalSent {
+		select {
+		case buf := <-received:
+			for _, part := range strings.Split(string(buf), "\n") {
+				i1 := strings.Index(part, ":")
+				i2 := strings.Index(part, "|")
+
+				if i1 == -1 || i2 == -1 {
+					t.Fatalf("non-parsable part: %#v", part)
 				}
 
-				if string(buf) != exp {
-					t.Errorf("unexpected part received: %#v != %#v", string(buf), exp)
+				count, err := strconv.ParseInt(part[i1+1:i2], 10, 64)
+				if err != nil {
+					t.Fatal(err)
 				}
+
+				totalReceived += count
 			}
+		case <-time.After(time.Second):
+			t.Fatalf("sent %d != received %d", totalSent, totalReceived)
 		}
 	}
 
-	t.Run("Original", compareOutput(
-		func() { client.Incr("req.count", 30) },
-		[]string{"foo.req.count:30|c"}))
-
-	t.Run("CloneWithPrefix", compareOutput(
-		func() { client2.Incr("req.count", 30) },
-		[]string{"bar.req.count:30|c"}))
-
-	t.Run("CloneWithPrefixExtension", compareOutput(
-		func() { client3.Incr("req.count", 30) },
-		[]string{"bar.blah.req.count:30|c"}))
-
-	_ = client.Close()
-	_ = client2.Close()
-	_ = client3.Close()
-	_ = inSocket.Close()
-	close(received)
+	if totalReceived != totalSent {
+		t.Errorf("sent %d != received %d", totalSent, totalReceived)
+	}
 }
 
 func TestConcurrent(t *testing.T) {
@@ -387,6 +4652,364 @@ func BenchmarkSimple(b *testing.B) {
 	_ = inSocket.Close()
 }
 
+func BenchmarkParallel(b *testing.B) {
+	for _, shards := range []int{1, 0} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+				IP: net.IPv4(127, 0, 0, 1),
+			})
+			if err != nil {
+				b.Error(err)
+			}
+
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					_, err := inSocket.Read(buf)
+					if err != nil {
+						return
+					}
+				}
+			}()
+
+			c := NewClient(inSocket.LocalAddr().String(), MetricPrefix("metricPrefix"), MaxPacketSize(1432),
+				FlushInterval(100*time.Millisecond), SendLoopCount(2), BufferShards(shards))
+
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					c.Incr("foo.bar.counter", 1)
+					c.Gauge("foo.bar.gauge", 42)
+					c.PrecisionTiming("foo.bar.timing", 153*time.Millisecond)
+				}
+			})
+
+			_ = c.Close()
+			_ = inSocket.Close()
+		})
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	for _, pipeline := range []bool{false, true} {
+		for _, producers := range []int{1, 8, 32} {
+			mode := "mutex"
+			if pipeline {
+				mode = "pipeline"
+			}
+
+			b.Run(fmt.Sprintf("mode=%s/producers=%d", mode, producers), func(b *testing.B) {
+				inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+					IP: net.IPv4(127, 0, 0, 1),
+				})
+				if err != nil {
+					b.Error(err)
+				}
+
+				go func() {
+					buf := make([]byte, 1500)
+					for {
+						_, err := inSocket.Read(buf)
+						if err != nil {
+							return
+						}
+					}
+				}()
+
+				c := NewClient(inSocket.LocalAddr().String(), MetricPrefix("metricPrefix"), MaxPacketSize(1432),
+					FlushInterval(100*time.Millisecond), SendLoopCount(2), ExperimentalPipeline(pipeline))
+
+				// RunParallel starts parallelism*GOMAXPROCS goroutines
+				b.SetParallelism((producers + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+				b.ResetTimer()
+
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						c.Incr("foo.bar.counter", 1)
+						c.Gauge("foo.bar.gauge", 42)
+						c.PrecisionTiming("foo.bar.timing", 153*time.Millisecond)
+					}
+				})
+
+				_ = c.Close()
+				_ = inSocket.Close()
+			})
+		}
+	}
+}
+
+func BenchmarkLocal(b *testing.B) {
+	for _, mode := range []string{"shared", "local", "local-per-request"} {
+		b.Run(mode, func(b *testing.B) {
+			inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+				IP: net.IPv4(127, 0, 0, 1),
+			})
+			if err != nil {
+				b.Error(err)
+			}
+
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					_, err := inSocket.Read(buf)
+					if err != nil {
+						return
+					}
+				}
+			}()
+
+			c := NewClient(inSocket.LocalAddr().String(), MetricPrefix("metricPrefix"), MaxPacketSize(1432),
+				FlushInterval(100*time.Millisecond), SendLoopCount(2))
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				switch mode {
+				case "shared":
+					for pb.Next() {
+						c.Incr("foo.bar.counter", 1)
+						c.PrecisionTiming("foo.bar.timing", 153*time.Millisecond)
+					}
+				case "local":
+					local := c.Local()
+					defer local.Release()
+
+					for pb.Next() {
+						local.Incr("foo.bar.counter", 1)
+						local.PrecisionTiming("foo.bar.timing", 153*time.Millisecond)
+					}
+				case "local-per-request":
+					for pb.Next() {
+						local := c.Local()
+						local.Incr("foo.bar.counter", 1)
+						local.PrecisionTiming("foo.bar.timing", 153*time.Millisecond)
+						local.Release()
+					}
+				}
+			})
+
+			_ = c.Close()
+			_ = inSocket.Close()
+		})
+	}
+}
+
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (discardConn) Close() error {
+	return nil
+}
+
+func BenchmarkSendBatch(b *testing.B) {
+	for _, batchSize := range []int{1, 16} {
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			// packets are discarded, so that benchmark measures handoff to the send loop
+			c := NewClient("127.0.0.1:8125", MetricPrefix("metricPrefix"), MaxPacketSize(200),
+				FlushInterval(100*time.Millisecond), SendBatchSize(batchSize), BlockWithTimeout(time.Second),
+				func(c *ClientOptions) {
+					c.dial = func(context.Context, string, string) (net.Conn, error) {
+						return discardConn{}, nil
+					}
+				})
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				c.Incr("foo.bar.counter", 1)
+				c.Gauge("foo.bar.gauge", 42)
+				c.PrecisionTiming("foo.bar.timing", 153*time.Millisecond)
+			}
+
+			_ = c.Close()
+		})
+	}
+}
+
+func BenchmarkContention(b *testing.B) {
+	inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		b.Error(err)
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, err := inSocket.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	c := NewClient(inSocket.LocalAddr().String(), MetricPrefix("metricPrefix"), MaxPacketSize(1432),
+		FlushInterval(100*time.Millisecond), SendLoopCount(2), TagStyle(TagFormatDatadog))
+
+	tags := []Tag{StringTag("host", "web1.example.com"), StringTag("service", "frontend"), IntTag("shard", 42),
+		StringTag("region", "eu-central-1"), StringTag("version", "v1.2.3")}
+
+	// RunParallel starts parallelism*GOMAXPROCS goroutines
+	b.SetParallelism((16 + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Incr("foo.bar.counter", 1, tags...)
+			c.FGauge("foo.bar.gauge", 42.12345, tags...)
+			c.PrecisionTiming("foo.bar.timing", 153*time.Millisecond, tags...)
+		}
+	})
+
+	_ = c.Close()
+	_ = inSocket.Close()
+}
+
+func BenchmarkUnlocked(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"locked", nil},
+		{"unlocked", []Option{Unlocked(true)}},
+		{"debug", []Option{UnlockedDebug()}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			// packets are discarded, so that benchmark measures emitting path
+			opts := append([]Option{MetricPrefix("metricPrefix"), MaxPacketSize(1432),
+				FlushInterval(100 * time.Millisecond), SendLoopCount(1), BlockWithTimeout(time.Second),
+				func(c *ClientOptions) {
+					c.dial = func(context.Context, string, string) (net.Conn, error) {
+						return discardConn{}, nil
+					}
+				}}, tt.opts...)
+
+			c := NewClient("127.0.0.1:4444", opts...)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				c.Incr("foo.bar.counter", 1)
+				c.Gauge("foo.bar.gauge", 42)
+				c.PrecisionTiming("foo.bar.timing", 153*time.Millisecond)
+			}
+
+			b.StopTimer()
+			_ = c.Close()
+		})
+	}
+}
+
+func BenchmarkSmallPackets(b *testing.B) {
+	// packets are discarded, so that benchmark measures packet assembly
+	c := NewClient("127.0.0.1:8125", MetricPrefix("metricPrefix"), MaxPacketSize(128),
+		FlushInterval(100*time.Millisecond), SendLoopCount(1), BlockWithTimeout(time.Second),
+		func(c *ClientOptions) {
+			c.dial = func(context.Context, string, string) (net.Conn, error) {
+				return discardConn{}, nil
+			}
+		})
+
+	tags := []Tag{StringTag("host", "web1.example.com"), StringTag("service", "frontend")}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.Incr("foo.bar.counter", 1, tags...)
+		c.Gauge("foo.bar.gauge", 42, tags...)
+		c.PrecisionTiming("foo.bar.timing", 153*time.Millisecond, tags...)
+	}
+
+	b.StopTimer()
+	_ = c.Close()
+}
+
+func BenchmarkBurst(b *testing.B) {
+	inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		b.Error(err)
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, err := inSocket.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// buffer pool is much smaller than the burst
+	c := NewClient(inSocket.LocalAddr().String(), MetricPrefix("metricPrefix"), MaxPacketSize(1432),
+		FlushInterval(time.Hour), SendLoopCount(2), BufPoolCapacity(2), SendQueueCapacity(64))
+
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 32; j++ {
+			c.Incr("foo.bar.counter", 1)
+			c.Flush()
+		}
+
+		_ = c.FlushAndWait(ctx)
+	}
+
+	b.StopTimer()
+
+	_ = c.Close()
+	_ = inSocket.Close()
+}
+
+func BenchmarkIncr(b *testing.B) {
+	inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		b.Error(err)
+	}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, err := inSocket.Read(buf)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	c := NewClient(inSocket.LocalAddr().String(), MetricPrefix("metricPrefix."), MaxPacketSize(1432),
+		FlushInterval(100*time.Millisecond), SendLoopCount(2), PrewarmBufPool(true))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		c.Incr("foo.bar.counter", 1)
+	}
+
+	b.StopTimer()
+
+	_ = c.Close()
+	_ = inSocket.Close()
+}
+
 func BenchmarkSimpleUnixSocket(b *testing.B) {
 	socket := fmt.Sprintf("/tmp/go-statsd-%d", time.Now().UnixNano())
 	inSocket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
@@ -477,7 +5100,7 @@ func BenchmarkTagged(b *testing.B) {
 	}()
 
 	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("metricPrefix"), MaxPacketSize(1432),
-		FlushInterval(100*time.Millisecond), SendLoopCount(2), DefaultTags(StringTag("host", "foo")),
+		FlushInterval(100*time.Millisecond), SendLoopCount(2), DefaultTags(StringTag("host", "foo"), IntTag("shard", 3)),
 		SendQueueCapacity(10), BufPoolCapacity(40))
 
 	b.ResetTimer()
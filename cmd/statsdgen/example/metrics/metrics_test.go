@@ -0,0 +1,87 @@
+package metrics_test
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smira/go-statsd"
+	"github.com/smira/go-statsd/cmd/statsdgen/example/metrics"
+	"github.com/smira/go-statsd/statsdtest"
+)
+
+func TestCatalog(t *testing.T) {
+	server := statsdtest.NewServer(t, "udp")
+
+	client := statsd.NewClient(server.Addr(), statsd.TagStyle(statsd.TagFormatInfluxDB), statsd.FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	m := metrics.New(client)
+
+	api := m.ReqCount.With(metrics.Route("api"))
+	api.Incr(2, metrics.Status(200))
+	api.Incr(1, metrics.Status(200))
+	m.ReqLatency.PrecisionTiming(1500*time.Microsecond, metrics.Route("api"))
+	m.BackendInflight.Gauge(3, metrics.Backend("db"))
+	m.BackendInflight.GaugeDelta(-1, metrics.Backend("db"))
+	m.UsersUnique.SetAdd("alice")
+	m.PanicCount.Incr(1)
+
+	client.Flush()
+	server.WaitFor("panics", time.Second)
+
+	statsdtest.AssertIncr(t, server, "req.count", 3, statsd.StringTag("route", "api"), statsd.IntTag("status", 200))
+	statsdtest.AssertTiming(t, server, "req.latency", 1, statsd.StringTag("route", "api"))
+	statsdtest.AssertGauge(t, server, "backend.inflight", 2, statsd.StringTag("backend", "db"))
+	statsdtest.AssertSetContains(t, server, "users.unique", "alice")
+	statsdtest.AssertIncr(t, server, "panics", 1)
+}
+
+func TestCatalogAllocs(t *testing.T) {
+	client := statsd.NewClient("127.0.0.1:4444", statsd.TagStyle(statsd.TagFormatInfluxDB), statsd.FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	m := metrics.New(client)
+	api := m.ReqCount.With(metrics.Route("api"), metrics.Method("GET"))
+
+	// bound tags are prebuilt, so there are no allocations per call
+	if allocs := testing.AllocsPerRun(1000, func() { api.Incr(1) }); allocs != 0 {
+		t.Errorf("unexpected allocations: %v", allocs)
+	}
+}
+
+func Example() {
+	client := statsd.NewClient("localhost:8125", statsd.TagStyle(statsd.TagFormatInfluxDB))
+	defer client.Close() //nolint:errcheck
+
+	m := metrics.New(client)
+
+	start := time.Now()
+
+	// only tags declared for the metric are accepted
+	m.ReqCount.Incr(1, metrics.Route("api.one"), metrics.Method("GET"), metrics.Status(200))
+	m.ReqLatency.PrecisionTiming(time.Since(start), metrics.Route("api.one"))
+}
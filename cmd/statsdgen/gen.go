@@ -0,0 +1,398 @@
+package main
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Catalog is a list of metric declarations
+type Catalog struct {
+	// Tags maps tag name to the tag type
+	Tags    map[string]string `yaml:"tags"`
+	Metrics []MetricDecl      `yaml:"metrics"`
+}
+
+// MetricDecl declares single metric
+type MetricDecl struct {
+	Name        string   `yaml:"name"`
+	Type        string   `yaml:"type"`
+	Tags        []string `yaml:"tags"`
+	Description string   `yaml:"description"`
+	GoName      string   `yaml:"go_name"`
+}
+
+type method struct {
+	Name    string
+	Doc     string
+	Arg     string
+	ArgType string
+}
+
+// methods of the generated handles per metric type
+var methods = map[string][]method{
+	"counter": {
+		{"Incr", "increments the counter", "count", "int64"},
+		{"Decr", "decrements the counter", "count", "int64"},
+		{"FIncr", "increments the counter by floating point value", "count", "float64"},
+	},
+	"timing": {
+		{"Timing", "tracks a duration event (in milliseconds)", "delta", "int64"},
+		{"PrecisionTiming", "tracks a duration event", "delta", "time.Duration"},
+	},
+	"gauge": {
+		{"Gauge", "sets the gauge value", "value", "int64"},
+		{"GaugeDelta", "sends a change for the gauge", "value", "int64"},
+		{"FGauge", "sets floating point gauge value", "value", "float64"},
+		{"FGaugeDelta", "sends a floating point change for the gauge", "value", "float64"},
+	},
+	"set": {
+		{"SetAdd", "adds unique element to the set", "value", "string"},
+	},
+}
+
+// tagTypes maps tag type to Go type and statsd constructor
+var tagTypes = map[string][2]string{
+	"string": {"string", "StringTag"},
+	"int":    {"int64", "Int64Tag"},
+}
+
+var (
+	metricNameRe = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+	tagNameRe    = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+	wordRe       = regexp.MustCompile(`[A-Za-z0-9]+`)
+)
+
+type tagData struct {
+	Name        string
+	Ident       string
+	GoType      string
+	Constructor string
+}
+
+type metricData struct {
+	Name        string
+	Type        string
+	Description string
+	Ident       string
+	// Method is unexported method of the tags allowed for the metric
+	Method  string
+	Tags    []tagData
+	Methods []method
+}
+
+type fileData struct {
+	Source   string
+	Package  string
+	Header   string
+	NeedTime bool
+	Tags     []tagData
+	Metrics  []metricData
+}
+
+func parseCatalog(source []byte) (*Catalog, error) {
+	var catalog Catalog
+
+	decoder := yaml.NewDecoder(bytes.NewReader(source))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(&catalog); err != nil {
+		return nil, err
+	}
+
+	return &catalog, nil
+}
+
+// ident converts name like "req.latency_ms" to Go identifier ReqLatencyMs
+func ident(name string) string {
+	var sb strings.Builder
+
+	for _, word := range wordRe.FindAllString(name, -1) {
+		sb.WriteString(strings.ToUpper(word[:1]))
+		sb.WriteString(word[1:])
+	}
+
+	return sb.String()
+}
+
+func lowerFirst(s string) string {
+	return strings.ToLower(s[:1]) + s[1:]
+}
+
+func generate(catalog *Catalog, pkg, source, header string) ([]byte, error) {
+	data := fileData{
+		Source:  source,
+		Package: pkg,
+		Header:  strings.TrimSpace(header),
+	}
+
+	// every exported identifier in the generated file, to catch collisions
+	idents := map[string]string{"Metrics": "catalog", "New": "constructor"}
+
+	declare := func(id, what string) error {
+		if !token.IsIdentifier(id) || !token.IsExported(id) {
+			return fmt.Errorf("%s: %q is not a valid exported Go identifier, set go_name", what, id)
+		}
+
+		if prev, exists := idents[id]; exists {
+			return fmt.Errorf("%s: Go identifier %s collides with %s", what, id, prev)
+		}
+
+		idents[id] = what
+
+		return nil
+	}
+
+	tags := map[string]tagData{}
+
+	for _, name := range sortedKeys(catalog.Tags) {
+		what := fmt.Sprintf("tag %q", name)
+
+		if !tagNameRe.MatchString(name) {
+			return nil, fmt.Errorf("%s: invalid tag name", what)
+		}
+
+		typ, ok := tagTypes[catalog.Tags[name]]
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported tag type %q", what, catalog.Tags[name])
+		}
+
+		tag := tagData{
+			Name:        name,
+			Ident:       ident(name),
+			GoType:      typ[0],
+			Constructor: typ[1],
+		}
+
+		if err := declare(tag.Ident, what); err != nil {
+			return nil, err
+		}
+
+		if err := declare(tag.Ident+"Tag", what); err != nil {
+			return nil, err
+		}
+
+		tags[name] = tag
+		data.Tags = append(data.Tags, tag)
+	}
+
+	names := map[string]struct{}{}
+
+	for i, decl := range catalog.Metrics {
+		what := fmt.Sprintf("metric %q", decl.Name)
+
+		if !metricNameRe.MatchString(decl.Name) {
+			return nil, fmt.Errorf("metric #%d: invalid metric name %q", i+1, decl.Name)
+		}
+
+		if _, exists := names[decl.Name]; exists {
+			return nil, fmt.Errorf("%s: duplicate metric", what)
+		}
+
+		names[decl.Name] = struct{}{}
+
+		metric := metricData{
+			Name:        decl.Name,
+			Type:        decl.Type,
+			Description: strings.Join(strings.Fields(decl.Description), " "),
+			Ident:       decl.GoName,
+			Methods:     methods[decl.Type],
+		}
+
+		if metric.Methods == nil {
+			return nil, fmt.Errorf("%s: unsupported metric type %q", what, decl.Type)
+		}
+
+		if metric.Ident == "" {
+			metric.Ident = ident(decl.Name)
+		}
+
+		for _, id := range []string{metric.Ident, metric.Ident + "Metric", metric.Ident + "MetricTag"} {
+			if err := declare(id, what); err != nil {
+				return nil, err
+			}
+		}
+
+		metric.Method = lowerFirst(metric.Ident) + "MetricTag"
+
+		seen := map[string]struct{}{}
+
+		for _, name := range decl.Tags {
+			tag, ok := tags[name]
+			if !ok {
+				return nil, fmt.Errorf("%s: tag %q is not declared", what, name)
+			}
+
+			if _, exists := seen[name]; exists {
+				return nil, fmt.Errorf("%s: duplicate tag %q", what, name)
+			}
+
+			seen[name] = struct{}{}
+
+			metric.Tags = append(metric.Tags, tag)
+		}
+
+		if decl.Type == "timing" {
+			data.NeedTime = true
+		}
+
+		data.Metrics = append(data.Metrics, metric)
+	}
+
+	var buf bytes.Buffer
+
+	if err := fileTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error formatting generated code: %w", err)
+	}
+
+	return formatted, nil
+}
+
+func tagNames(tags []tagData) string {
+	names := make([]string, len(tags))
+	for i := range tags {
+		names[i] = tags[i].Name
+	}
+
+	return strings.Join(names, ", ")
+}
+
+var fileTemplate = template.Must(template.New("file").Funcs(template.FuncMap{
+	"tagNames": tagNames,
+}).Parse(`// Code generated by statsdgen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+{{if .Header}}
+{{.Header}}
+{{end}}
+{{if .NeedTime -}}
+import (
+	"time"
+
+	"github.com/smira/go-statsd"
+)
+{{- else -}}
+import "github.com/smira/go-statsd"
+{{- end}}
+
+// Metrics is a catalog of the metrics
+type Metrics struct {
+{{- range .Metrics}}
+	// {{.Ident}} is {{.Type}} {{.Name}}{{if .Description}}: {{.Description}}{{end}}
+	{{.Ident}} {{.Ident}}Metric
+{{- end}}
+}
+
+// New creates the catalog of the metrics sent via the client
+func New(client *statsd.Client) *Metrics {
+	return &Metrics{
+{{- range .Metrics}}
+		{{.Ident}}: {{.Ident}}Metric{m: client.Metric({{printf "%q" .Name}})},
+{{- end}}
+	}
+}
+{{range .Tags}}
+// {{.Ident}}Tag is a value of the tag {{.Name}}
+type {{.Ident}}Tag struct {
+	tag statsd.Tag
+}
+
+// {{.Ident}} creates the tag {{.Name}}
+func {{.Ident}}(value {{.GoType}}) {{.Ident}}Tag {
+	return {{.Ident}}Tag{tag: statsd.{{.Constructor}}({{printf "%q" .Name}}, value)}
+}
+{{end}}
+{{- range $m := .Metrics}}
+// {{$m.Ident}}Metric is {{$m.Type}} {{$m.Name}}
+type {{$m.Ident}}Metric struct {
+	m statsd.MetricBuilder
+}
+{{if $m.Tags}}
+// {{$m.Ident}}MetricTag is a tag allowed for {{$m.Name}} ({{tagNames $m.Tags}})
+type {{$m.Ident}}MetricTag interface {
+	{{$m.Method}}() statsd.Tag
+}
+{{range $m.Tags}}
+func (t {{.Ident}}Tag) {{$m.Method}}() statsd.Tag {
+	return t.tag
+}
+{{end}}
+func {{$m.Method}}s(dst []statsd.Tag, tags []{{$m.Ident}}MetricTag) []statsd.Tag {
+	for _, tag := range tags {
+		dst = append(dst, tag.{{$m.Method}}())
+	}
+
+	return dst
+}
+
+// With returns the handle with the tags bound, tags are sent with every metric
+func (m {{$m.Ident}}Metric) With(tags ...{{$m.Ident}}MetricTag) {{$m.Ident}}Metric {
+	m.m = m.m.Tags({{$m.Method}}s(nil, tags)...)
+
+	return m
+}
+{{range $m.Methods}}
+// {{.Name}} {{.Doc}}
+func (m {{$m.Ident}}Metric) {{.Name}}({{.Arg}} {{.ArgType}}, tags ...{{$m.Ident}}MetricTag) {
+	var buf [{{len $m.Tags}}]statsd.Tag
+
+	m.m.Tags({{$m.Method}}s(buf[:0], tags)...).{{.Name}}({{.Arg}})
+}
+{{end}}
+{{- else}}
+{{range $m.Methods}}
+// {{.Name}} {{.Doc}}
+func (m {{$m.Ident}}Metric) {{.Name}}({{.Arg}} {{.ArgType}}) {
+	m.m.{{.Name}}({{.Arg}})
+}
+{{end}}
+{{- end}}
+{{- end}}
+`))
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
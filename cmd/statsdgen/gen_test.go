@@ -0,0 +1,237 @@
+package main
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestGenerateGolden(t *testing.T) {
+	sources, err := filepath.Glob("testdata/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, source := range sources {
+		name := strings.TrimSuffix(filepath.Base(source), ".yaml")
+
+		t.Run(name, func(t *testing.T) {
+			golden := filepath.Join("testdata", name+".golden")
+
+			generated := generateFile(t, source, "metrics", "")
+
+			if *update {
+				if err := os.WriteFile(golden, generated, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(generated, expected) {
+				t.Errorf("generated code doesn't match %s (run go test -update):\n%s", golden, generated)
+			}
+		})
+	}
+}
+
+func TestGenerateExample(t *testing.T) {
+	header, err := os.ReadFile("example/metrics/header.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generated := generateFile(t, "example/metrics/metrics.yaml", "metrics", string(header))
+
+	expected, err := os.ReadFile("example/metrics/metrics_gen.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(generated, expected) {
+		t.Error("example/metrics/metrics_gen.go is stale, run go generate")
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{"UnknownField", "metrics:\n  - name: a\n    type: counter\n    tag: [x]\n", "field tag not found"},
+		{"MetricType", "metrics:\n  - name: a\n    type: histogram\n", `metric "a": unsupported metric type "histogram"`},
+		{"MetricName", "metrics:\n  - name: 'a:b'\n    type: counter\n", `metric #1: invalid metric name "a:b"`},
+		{"DuplicateMetric", "metrics:\n  - name: a\n    type: counter\n  - name: a\n    type: gauge\n", `metric "a": duplicate metric`},
+		{"TagType", "tags:\n  route: bool\n", `tag "route": unsupported tag type "bool"`},
+		{"UndeclaredTag", "metrics:\n  - name: a\n    type: counter\n    tags: [route]\n", `metric "a": tag "route" is not declared`},
+		{"DuplicateTag", "tags:\n  route: string\nmetrics:\n  - name: a\n    type: counter\n    tags: [route, route]\n", `metric "a": duplicate tag "route"`},
+		{"Identifier", "metrics:\n  - name: 1xx\n    type: counter\n", `metric "1xx": "1xx" is not a valid exported Go identifier, set go_name`},
+		{"Collision", "metrics:\n  - name: req.count\n    type: counter\n  - name: req_count\n    type: counter\n", `metric "req_count": Go identifier ReqCount collides with metric "req.count"`},
+		{"TagCollision", "tags:\n  req.count: string\nmetrics:\n  - name: req_count\n    type: counter\n", `metric "req_count": Go identifier ReqCount collides with tag "req.count"`},
+		{"Reserved", "metrics:\n  - name: new\n    type: counter\n", `metric "new": Go identifier New collides with constructor`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			catalog, err := parseCatalog([]byte(tc.source))
+			if err == nil {
+				_, err = generate(catalog, "metrics", "metrics.yaml", "")
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("unexpected error %v, expected %q", err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestGenerateTypeCheck(t *testing.T) {
+	generated := generateFile(t, "testdata/basic.yaml", "metrics", "")
+
+	// importer caches packages, so statsd is type-checked once
+	fset := token.NewFileSet()
+	imp := importer.ForCompiler(fset, "source", nil)
+
+	for _, tc := range []struct {
+		name     string
+		code     string
+		expected string
+	}{
+		{"Valid", `m.ReqCount.With(Route("api")).Incr(1, HttpStatus(200)); m.Uptime.Gauge(1, Host("a"))`, ""},
+		{"TagNotAllowed", `m.ReqCount.Incr(1, Host("a"))`, "HostTag does not implement ReqCountMetricTag"},
+		{"TagNotAllowedWith", `m.Uptime.With(Route("api"))`, "RouteTag does not implement UptimeMetricTag"},
+		{"NotTag", `m.ReqCount.Incr(1, m.Uptime)`, "UptimeMetric does not implement ReqCountMetricTag"},
+		{"WrongMethod", `m.ReqCount.Gauge(1)`, "m.ReqCount.Gauge undefined"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := typeCheck(fset, imp, generated, "package metrics\n\nfunc use(m *Metrics) { "+tc.code+" }\n")
+
+			if tc.expected == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("unexpected error %v, expected %q", err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "metrics_gen.go")
+
+	if err := run("testdata/basic.yaml", out, "", ""); err == nil {
+		t.Error("error expected without package")
+	}
+
+	if err := run("testdata/basic.yaml", out, "metrics", "testdata/missing.txt"); err == nil {
+		t.Error("error expected for missing header")
+	}
+
+	if err := run("testdata/basic.yaml", out, "metrics", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	generated, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(generated, []byte("// Code generated by statsdgen from basic.yaml. DO NOT EDIT.\n\npackage metrics\n\nimport")) {
+		t.Errorf("unexpected generated file:\n%s", generated)
+	}
+
+	header := filepath.Join(t.TempDir(), "header.txt")
+	if err = os.WriteFile(header, []byte("/*\nLicense\n*/\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = run("testdata/basic.yaml", out, "metrics", header); err != nil {
+		t.Fatal(err)
+	}
+
+	if generated, err = os.ReadFile(out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(generated, []byte("// Code generated by statsdgen from basic.yaml. DO NOT EDIT.\n\npackage metrics\n\n/*\nLicense\n*/\n\nimport")) {
+		t.Errorf("unexpected generated file:\n%s", generated)
+	}
+}
+
+// typeCheck checks generated code along with the code using it
+func typeCheck(fset *token.FileSet, imp types.Importer, generated []byte, code string) error {
+	var files []*ast.File
+
+	for name, src := range map[string]string{"metrics_gen.go": string(generated), "use.go": code} {
+		f, err := parser.ParseFile(fset, name, src, 0)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, f)
+	}
+
+	conf := types.Config{Importer: imp}
+
+	_, err := conf.Check("metrics", fset, files, nil)
+
+	return err
+}
+
+func generateFile(t *testing.T, source, pkg, header string) []byte {
+	t.Helper()
+
+	contents, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := parseCatalog(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generated, err := generate(catalog, pkg, filepath.Base(source), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return generated
+}
@@ -0,0 +1,10 @@
+module github.com/smira/go-statsd/cmd/statsdgen
+
+go 1.21
+
+require (
+	github.com/smira/go-statsd v0.0.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+replace github.com/smira/go-statsd => ../../
@@ -0,0 +1,103 @@
+// Command statsdgen generates typed metric catalogs for go-statsd
+//
+// Metrics are declared in the YAML file:
+//
+//	tags:
+//	  route: string
+//	  status: int
+//	metrics:
+//	  - name: req.count
+//	    type: counter
+//	    tags: [route, status]
+//	    description: number of handled requests
+//
+// Metric types are counter, timing, gauge and set, tag types are string and int.
+// Generated file contains catalog struct Metrics with a field per metric
+// (ReqCount), constructor New and tag constructors (Route, Status):
+//
+//	m := metrics.New(client)
+//	m.ReqCount.Incr(1, metrics.Route("api.one"))
+//
+// Each metric accepts only the tags declared for it, so unknown tags are
+// compile errors. Go identifiers are derived from the names, they could be
+// overridden with go_name. Typical usage is via go:generate:
+//
+//	//go:generate go run github.com/smira/go-statsd/cmd/statsdgen -in metrics.yaml -out metrics_gen.go
+//
+// Comment (e.g. license) could be placed into the generated file with -header.
+package main
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	in := flag.String("in", "metrics.yaml", "metric declarations")
+	out := flag.String("out", "metrics_gen.go", "generated file")
+	pkg := flag.String("package", os.Getenv("GOPACKAGE"), "package of the generated file (defaults to $GOPACKAGE)")
+	header := flag.String("header", "", "file with the comment (e.g. license) placed after the package clause")
+	flag.Parse()
+
+	if err := run(*in, *out, *pkg, *header); err != nil {
+		fmt.Fprintf(os.Stderr, "statsdgen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(in, out, pkg, headerFile string) error {
+	if pkg == "" {
+		return fmt.Errorf("package is not set, use -package or run via go:generate")
+	}
+
+	source, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+
+	catalog, err := parseCatalog(source)
+	if err != nil {
+		return fmt.Errorf("%s: %w", in, err)
+	}
+
+	var header []byte
+
+	if headerFile != "" {
+		if header, err = os.ReadFile(headerFile); err != nil {
+			return err
+		}
+	}
+
+	generated, err := generate(catalog, pkg, filepath.Base(in), string(header))
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(out, generated, 0o644) //nolint:gosec
+}
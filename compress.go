@@ -0,0 +1,142 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sync"
+)
+
+// gaugeWindow keeps the last value of each gauge until the flush, see CompressGauges
+type gaugeWindow struct {
+	lock sync.Mutex
+
+	// index of the gauge in entries by key (name and tags)
+	index map[string]int
+	// gauges in the order of the first update in the window, backing
+	// array is reused across the windows
+	entries []gaugeLine
+
+	// scratch buffer to build keys
+	key []byte
+}
+
+type gaugeLine struct {
+	// metric name, used to pick the shard
+	stat string
+	// formatted line(s) of the last value
+	line []byte
+}
+
+func newGaugeWindow(enabled bool) *gaugeWindow {
+	if !enabled {
+		return nil
+	}
+
+	return &gaugeWindow{
+		index: make(map[string]int),
+	}
+}
+
+// compressed returns true if gauges are compressed, high priority lane is never compressed
+func (c *Client) compressed() bool {
+	return c.trans.gaugeWindow != nil && !c.high
+}
+
+// storeGauge replaces pending value of the gauge with formatted line(s)
+func (c *Client) storeGauge(stat string, tags []Tag, line []byte) {
+	w := c.trans.gaugeWindow
+
+	w.lock.Lock()
+	w.key = c.formatTags(c.appendName(w.key[:0], stat), tags)
+
+	if i, ok := w.index[string(w.key)]; ok {
+		w.entries[i].line = append(w.entries[i].line[:0], line...)
+	} else {
+		n := len(w.entries)
+		if n < cap(w.entries) {
+			w.entries = w.entries[:n+1]
+		} else {
+			w.entries = append(w.entries, gaugeLine{})
+		}
+
+		w.entries[n].stat = stat
+		w.entries[n].line = append(w.entries[n].line[:0], line...)
+		w.index[string(w.key)] = n
+	}
+
+	w.lock.Unlock()
+}
+
+// compressIGauge stores integer gauge to be sent on flush
+func (c *Client) compressIGauge(stat string, value int64, tags []Tag, opts callOptions) {
+	chunk := c.trans.getChunk()
+
+	// reset to zero is kept together with the value, so that pair stays idempotent
+	if value < 0 {
+		chunk.buf = c.appendIGauge(chunk.buf, stat, nil, 0, tags, opts)
+	}
+	chunk.buf = c.appendIGauge(chunk.buf, stat, nil, value, tags, opts)
+
+	c.storeGauge(stat, tags, chunk.buf)
+	c.trans.putChunk(chunk)
+}
+
+// compressFGauge stores floating point gauge to be sent on flush
+func (c *Client) compressFGauge(stat string, value float64, tags []Tag, opts callOptions) {
+	chunk := c.trans.getChunk()
+
+	if value < 0 {
+		chunk.buf = c.appendFGauge(chunk.buf, stat, nil, 0, tags, opts)
+	}
+	chunk.buf = c.appendFGauge(chunk.buf, stat, nil, value, tags, opts)
+
+	c.storeGauge(stat, tags, chunk.buf)
+	c.trans.putChunk(chunk)
+}
+
+// flushGauges appends last values of the gauges updated in the window to the buffers
+func (t *transport) flushGauges() {
+	w := t.gaugeWindow
+	if w == nil {
+		return
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for i := range w.entries {
+		e := &w.entries[i]
+
+		s := t.acquireBufFor(e.stat)
+		lastLen := len(s.buf)
+		s.buf = append(s.buf, e.line...)
+		t.commit(s, lastLen)
+
+		e.stat = ""
+	}
+
+	w.entries = w.entries[:0]
+	clear(w.index)
+}
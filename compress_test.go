@@ -0,0 +1,130 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressGauges(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), CompressGauges(true),
+		MetricPrefix("app."), TagStyle(TagFormatDatadog))
+	defer client.Close() //nolint:errcheck
+
+	receive := func() []string {
+		ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+		defer ctxCancel()
+
+		if err := client.FlushAndWait(ctx); err != nil {
+			t.Fatal(err)
+		}
+
+		var lines []string
+
+		for {
+			select {
+			case buf := <-received:
+				lines = append(lines, strings.Split(string(buf), "\n")...)
+			case <-time.After(50 * time.Millisecond):
+				return lines
+			}
+		}
+	}
+
+	clone := client.CloneWithPrefix("other.")
+
+	for i := 0; i < 200; i++ {
+		client.Gauge("queue.depth", int64(i))
+		client.Gauge("queue.depth", int64(2*i), StringTag("queue", "high"))
+		clone.Gauge("queue.depth", int64(3*i))
+		client.FGauge("cpu.load", float64(i)/4)
+		client.Gauge("balance", int64(100-i))
+
+		if i%100 == 0 {
+			client.GaugeDelta("connections", 1)
+			client.FGaugeDelta("temperature", -0.5)
+		}
+	}
+
+	// deltas are sent as is, gauges are sent once in the order of the first update
+	expected := []string{
+		"app.connections:+1|g",
+		"app.temperature:-0.5|g",
+		"app.connections:+1|g",
+		"app.temperature:-0.5|g",
+		"app.queue.depth:199|g",
+		"app.queue.depth:398|g|#queue:high",
+		"other.queue.depth:597|g",
+		"app.cpu.load:49.75|g",
+		"app.balance:0|g",
+		"app.balance:-99|g",
+	}
+
+	if lines := receive(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("unexpected metrics: %q != %q", lines, expected)
+	}
+
+	// gauges which were not updated in the window are not sent again
+	client.Gauge("balance", 5)
+	client.Gauge("balance", 7)
+
+	if lines := receive(); !reflect.DeepEqual(lines, []string{"app.balance:7|g"}) {
+		t.Errorf("unexpected metrics: %q", lines)
+	}
+
+	if lines := receive(); len(lines) != 0 {
+		t.Errorf("unexpected metrics: %q", lines)
+	}
+
+	// values pending on close are flushed
+	client.Gauge("balance", 9)
+	client.Gauge("balance", 10)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := receive(); !reflect.DeepEqual(lines, []string{"app.balance:10|g"}) {
+		t.Errorf("unexpected metrics: %q", lines)
+	}
+}
+
+func TestCompressGaugesAllocs(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour), CompressGauges(true))
+	defer client.Close() //nolint:errcheck
+
+	tag := StringTag("queue", "high")
+
+	if allocs := testing.AllocsPerRun(1000, func() { client.Gauge("queue.depth", 42, tag) }); allocs != 0 {
+		t.Errorf("unexpected allocations: %v", allocs)
+	}
+}
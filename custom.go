@@ -0,0 +1,117 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrInvalidMetricType is returned by RegisterMetricType for suffixes which can't be used as metric type
+var ErrInvalidMetricType = errors.New("statsd: invalid metric type suffix")
+
+// RegisterMetricType registers custom metric type to be sent with Custom
+//
+// Suffix is the metric type as it appears in the line after '|' (e.g. "kv"
+// for "name:value|kv"), it shouldn't be empty or contain '|', ':' or newlines.
+// Suffix is validated once on registration and then appended to the metrics as is.
+// Registered types are shared by the client and its clones.
+func (c *Client) RegisterMetricType(suffix string) error {
+	if suffix == "" || hasSetValueDelimiters(suffix) {
+		return ErrInvalidMetricType
+	}
+
+	t := c.trans
+
+	t.customTypesLock.Lock()
+	defer t.customTypesLock.Unlock()
+
+	var old map[string][]byte
+	if p := t.customTypes.Load(); p != nil {
+		old = *p
+	}
+
+	if _, exists := old[suffix]; exists {
+		return nil
+	}
+
+	types := make(map[string][]byte, len(old)+1)
+	for k, v := range old {
+		types[k] = v
+	}
+
+	types[suffix] = append([]byte{'|'}, suffix...)
+	t.customTypes.Store(&types)
+
+	return nil
+}
+
+// customType returns "|suffix" for the registered type or nil if type is not registered
+func (t *transport) customType(suffix string) []byte {
+	p := t.customTypes.Load()
+	if p == nil {
+		return nil
+	}
+
+	return (*p)[suffix]
+}
+
+// Custom sends metric of the custom type registered with RegisterMetricType
+//
+//	client.Custom("cache.state", []byte("hit=3"), "kv") // cache.state:hit=3|kv
+//
+// Value is appended as is, so it shouldn't contain '|', ':' or newlines. Metrics with
+// such values or with type which is not registered are dropped and counted in
+// GetInvalidMetrics. Call options are accepted, but custom metrics are never sampled.
+func (c *Client) Custom(stat string, value []byte, typeSuffix string, tags ...Tag) {
+	tags, opts := splitCallOptions(tags)
+	c.custom(stat, value, typeSuffix, tags, opts)
+}
+
+func (c *Client) custom(stat string, value []byte, typeSuffix string, tags []Tag, opts callOptions) {
+	c = c.routeFor(stat)
+
+	suffix := c.trans.customType(typeSuffix)
+	if suffix == nil || bytes.ContainsAny(value, "\n:|") {
+		atomic.AddInt64(&c.trans.invalidMetrics, 1)
+		return
+	}
+
+	if !c.allowed(stat) {
+		return
+	}
+
+	s := c.acquireBuf()
+	lastLen := len(s.buf)
+
+	s.buf = c.appendHead(s.buf, stat, tags)
+	s.buf = append(s.buf, ':')
+	s.buf = append(s.buf, value...)
+	s.buf = append(s.buf, suffix...)
+	s.buf = c.appendTail(s.buf, tags, opts)
+
+	c.commit(s, lastLen)
+}
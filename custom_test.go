@@ -0,0 +1,128 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCustom(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("web."), TagStyle(TagFormatDatadog),
+		DefaultTags(StringTag("app", "api")), FlushInterval(time.Hour), MaxPacketSize(80))
+	defer client.Close() //nolint:errcheck
+
+	for _, suffix := range []string{"kv", "t", "kv"} {
+		if err := client.RegisterMetricType(suffix); err != nil {
+			t.Fatalf("unexpected error registering %q: %s", suffix, err)
+		}
+	}
+
+	for _, suffix := range []string{"", "k|v", "k:v", "k\nv"} {
+		if err := client.RegisterMetricType(suffix); err != ErrInvalidMetricType {
+			t.Errorf("unexpected error registering %q: %v", suffix, err)
+		}
+	}
+
+	receive := func(t *testing.T, expected []string) {
+		t.Helper()
+
+		select {
+		case buf := <-received:
+			if string(buf) != strings.Join(expected, "\n") {
+				t.Errorf("unexpected packet: %#v != %#v", string(buf), strings.Join(expected, "\n"))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics")
+		}
+	}
+
+	t.Run("Mixed", func(t *testing.T) {
+		client.Incr("req", 1)
+		client.Custom("cache", []byte("hit=3"), "kv")
+		client.Timing("lat", 5)
+		client.Flush()
+
+		receive(t, []string{"web.req:1|c|#app:api", "web.cache:hit=3|kv|#app:api", "web.lat:5|ms|#app:api"})
+	})
+
+	t.Run("TagsAndOptions", func(t *testing.T) {
+		client.CloneWithPrefix("rpc.").Custom("trace", []byte("12"), "t", StringTag("op", "get"),
+			WithRate(0.000001), WithTimestamp(time.Unix(1700000000, 0)))
+		client.Metric("trace").Tags(StringTag("op", "put")).Custom([]byte("3"), "t")
+		client.Flush()
+
+		receive(t, []string{"rpc.trace:12|t|#app:api,op:get|T1700000000", "web.trace:3|t|#app:api,op:put"})
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		invalid := client.GetInvalidMetrics()
+
+		client.Custom("cache", []byte("hit=3"), "unknown")
+		client.Custom("cache", []byte("hit:3"), "kv")
+		client.Custom("cache", []byte("hit|3"), "kv")
+		client.Custom("cache", []byte("hit\n3"), "kv")
+		client.Incr("req", 2)
+		client.Flush()
+
+		receive(t, []string{"web.req:2|c|#app:api"})
+
+		if dropped := client.GetInvalidMetrics() - invalid; dropped != 4 {
+			t.Errorf("unexpected number of invalid metrics: %d", dropped)
+		}
+	})
+
+	t.Run("Split", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			client.Custom("cache.state", []byte("hits=1000,misses=20"), "kv")
+		}
+		client.Flush()
+
+		// two metrics don't fit into MaxPacketSize, so every metric goes into its own packet
+		for i := 0; i < 3; i++ {
+			receive(t, []string{"web.cache.state:hits=1000,misses=20|kv|#app:api"})
+		}
+	})
+}
+
+func TestCustomAllocs(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", MaxPacketSize(65000), SuppressMTUWarning(), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	if err := client.RegisterMetricType("kv"); err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte("hits=1000,misses=20,evictions=1,expired=0")
+	tag := StringTag("cache", "users")
+
+	if allocs := testing.AllocsPerRun(1000, func() { client.Custom("cache.state", value, "kv", tag) }); allocs != 0 {
+		t.Errorf("unexpected allocations: %v", allocs)
+	}
+}
@@ -0,0 +1,149 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables used by NewClientFromEnv
+const (
+	EnvAddr          = "STATSD_ADDR"
+	EnvPrefix        = "STATSD_PREFIX"
+	EnvTagFormat     = "STATSD_TAG_FORMAT"
+	EnvTags          = "STATSD_TAGS"
+	EnvMaxPacketSize = "STATSD_MAX_PACKET_SIZE"
+	EnvFlushInterval = "STATSD_FLUSH_INTERVAL"
+	EnvSendLoops     = "STATSD_SEND_LOOPS"
+)
+
+// DefaultEnvAddr is statsd server address used by NewClientFromEnv if STATSD_ADDR is not set
+const DefaultEnvAddr = "localhost:8125"
+
+// NewClientFromEnv creates new statsd client configured from environment variables
+//
+// Following variables are supported:
+//
+//   - STATSD_ADDR: server address in "host:port" format (defaults to DefaultEnvAddr)
+//   - STATSD_PREFIX: metric prefix, see MetricPrefix
+//   - STATSD_TAG_FORMAT: one of "influx", "datadog", "graphite", "okmeter"
+//   - STATSD_TAGS: default tags, comma-separated list of "name:value" or "name=value" pairs
+//   - STATSD_MAX_PACKET_SIZE: maximum packet size in bytes
+//   - STATSD_FLUSH_INTERVAL: flush interval as Go duration, e.g. "100ms"
+//   - STATSD_SEND_LOOPS: number of send goroutines
+//
+// Options passed explicitly override settings from the environment.
+// Error is returned if any of the variables can't be parsed.
+func NewClientFromEnv(options ...Option) (*Client, error) {
+	addr, envOptions, err := optionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(addr, append(envOptions, options...)...), nil
+}
+
+func optionsFromEnv() (addr string, options []Option, err error) {
+	addr = DefaultEnvAddr
+	if value, ok := os.LookupEnv(EnvAddr); ok {
+		addr = value
+	}
+
+	if value, ok := os.LookupEnv(EnvPrefix); ok {
+		options = append(options, MetricPrefix(value))
+	}
+
+	if value, ok := os.LookupEnv(EnvTagFormat); ok {
+		var format *TagFormat
+
+		switch strings.ToLower(value) {
+		case "influx", "influxdb":
+			format = TagFormatInfluxDB
+		case "datadog":
+			format = TagFormatDatadog
+		case "graphite":
+			format = TagFormatGraphite
+		case "okmeter":
+			format = TagFormatOkmeter
+		default:
+			return "", nil, fmt.Errorf("%s: unknown tag format %q", EnvTagFormat, value)
+		}
+
+		options = append(options, TagStyle(format))
+	}
+
+	if value, ok := os.LookupEnv(EnvTags); ok {
+		var tags []Tag
+
+		for _, pair := range strings.Split(value, ",") {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+
+			idx := strings.IndexAny(pair, ":=")
+			if idx <= 0 {
+				return "", nil, fmt.Errorf("%s: tag %q should be in name:value format", EnvTags, pair)
+			}
+
+			tags = append(tags, StringTag(pair[:idx], pair[idx+1:]))
+		}
+
+		options = append(options, DefaultTags(tags...))
+	}
+
+	if value, ok := os.LookupEnv(EnvMaxPacketSize); ok {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return "", nil, fmt.Errorf("%s: invalid packet size %q", EnvMaxPacketSize, value)
+		}
+
+		options = append(options, MaxPacketSize(size))
+	}
+
+	if value, ok := os.LookupEnv(EnvFlushInterval); ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", EnvFlushInterval, err)
+		}
+
+		options = append(options, FlushInterval(interval))
+	}
+
+	if value, ok := os.LookupEnv(EnvSendLoops); ok {
+		loops, err := strconv.Atoi(value)
+		if err != nil || loops <= 0 {
+			return "", nil, fmt.Errorf("%s: invalid send loop count %q", EnvSendLoops, value)
+		}
+
+		options = append(options, SendLoopCount(loops))
+	}
+
+	return addr, options, nil
+}
@@ -0,0 +1,164 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		env      map[string]string
+		options  []Option
+		addr     string
+		expected ClientOptions
+		err      string
+	}{
+		{
+			name:     "Empty",
+			addr:     DefaultEnvAddr,
+			expected: ClientOptions{},
+		},
+		{
+			name: "All",
+			env: map[string]string{
+				EnvAddr:          "statsd:9125",
+				EnvPrefix:        "app.",
+				EnvTagFormat:     "datadog",
+				EnvTags:          "env:prod, region=us-east-1",
+				EnvMaxPacketSize: "8000",
+				EnvFlushInterval: "250ms",
+				EnvSendLoops:     "4",
+			},
+			addr: "statsd:9125",
+			expected: ClientOptions{
+				MetricPrefix:  "app.",
+				TagFormat:     TagFormatDatadog,
+				DefaultTags:   []Tag{StringTag("env", "prod"), StringTag("region", "us-east-1")},
+				MaxPacketSize: 8000,
+				FlushInterval: 250 * time.Millisecond,
+				SendLoopCount: 4,
+			},
+		},
+		{
+			name: "Override",
+			env: map[string]string{
+				EnvPrefix:    "app.",
+				EnvTagFormat: "graphite",
+			},
+			options: []Option{MetricPrefix("web."), SendLoopCount(2)},
+			addr:    DefaultEnvAddr,
+			expected: ClientOptions{
+				MetricPrefix:  "web.",
+				TagFormat:     TagFormatGraphite,
+				SendLoopCount: 2,
+			},
+		},
+		{
+			name: "BadTagFormat",
+			env:  map[string]string{EnvTagFormat: "prometheus"},
+			err:  `STATSD_TAG_FORMAT: unknown tag format "prometheus"`,
+		},
+		{
+			name: "BadTags",
+			env:  map[string]string{EnvTags: "env"},
+			err:  `STATSD_TAGS: tag "env" should be in name:value format`,
+		},
+		{
+			name: "BadPacketSize",
+			env:  map[string]string{EnvMaxPacketSize: "large"},
+			err:  `STATSD_MAX_PACKET_SIZE: invalid packet size "large"`,
+		},
+		{
+			name: "BadFlushInterval",
+			env:  map[string]string{EnvFlushInterval: "100"},
+			err:  `STATSD_FLUSH_INTERVAL: time: missing unit in duration "100"`,
+		},
+		{
+			name: "BadSendLoops",
+			env:  map[string]string{EnvSendLoops: "-1"},
+			err:  `STATSD_SEND_LOOPS: invalid send loop count "-1"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{EnvAddr, EnvPrefix, EnvTagFormat, EnvTags, EnvMaxPacketSize, EnvFlushInterval, EnvSendLoops} {
+				if value, ok := tc.env[name]; ok {
+					t.Setenv(name, value)
+				} else {
+					// make sure variable is unset for the duration of the test
+					t.Setenv(name, "")
+					os.Unsetenv(name) //nolint:errcheck
+				}
+			}
+
+			addr, options, err := optionsFromEnv()
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("unexpected error: %v != %v", err, tc.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if addr != tc.addr {
+				t.Errorf("unexpected addr: %#v != %#v", addr, tc.addr)
+			}
+
+			var opts ClientOptions
+			for _, option := range append(options, tc.options...) {
+				option(&opts)
+			}
+
+			if !reflect.DeepEqual(opts, tc.expected) {
+				t.Errorf("unexpected options: %#v != %#v", opts, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNewClientFromEnv(t *testing.T) {
+	t.Setenv(EnvFlushInterval, "forever")
+
+	if _, err := NewClientFromEnv(); err == nil {
+		t.Fatal("error expected")
+	}
+
+	t.Setenv(EnvFlushInterval, "10ms")
+
+	client, err := NewClientFromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_ = client.Close()
+}
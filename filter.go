@@ -0,0 +1,140 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import "strings"
+
+// globPattern is a compiled glob pattern
+//
+// Pattern is split into literal parts by '*', every '*' matches
+// any sequence of characters except for the name separator, so that `cache.*.debug`
+// matches `cache.users.debug`, but not `cache.users.hits.debug`.
+type globPattern struct {
+	parts []string
+	sep   string
+}
+
+func compileGlob(pattern, sep string) globPattern {
+	return globPattern{parts: strings.Split(pattern, "*"), sep: sep}
+}
+
+func (p globPattern) match(name string) bool {
+	// first part should be a prefix
+	if !strings.HasPrefix(name, p.parts[0]) {
+		return false
+	}
+
+	return p.matchParts(name[len(p.parts[0]):], p.parts[1:])
+}
+
+// matchParts matches name against wildcard followed by parts[0], wildcard, parts[1], ...
+func (p globPattern) matchParts(name string, parts []string) bool {
+	if len(parts) == 0 {
+		return name == ""
+	}
+
+	for i := 0; i <= len(name); i++ {
+		if strings.HasPrefix(name[i:], parts[0]) && p.matchParts(name[i+len(parts[0]):], parts[1:]) {
+			return true
+		}
+
+		// wildcard doesn't match separator
+		if i < len(name) && strings.HasPrefix(name[i:], p.sep) {
+			break
+		}
+	}
+
+	return false
+}
+
+// patternList matches names against a list of patterns
+//
+// Patterns without wildcards are matched with a map lookup.
+type patternList struct {
+	exact map[string]struct{}
+	globs []globPattern
+}
+
+func compilePatterns(patterns []string, sep string) *patternList {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	l := &patternList{
+		exact: make(map[string]struct{}),
+	}
+
+	for _, pattern := range patterns {
+		if strings.IndexByte(pattern, '*') == -1 {
+			l.exact[pattern] = struct{}{}
+		} else {
+			l.globs = append(l.globs, compileGlob(pattern, sep))
+		}
+	}
+
+	return l
+}
+
+func (l *patternList) match(name string) bool {
+	if _, ok := l.exact[name]; ok {
+		return true
+	}
+
+	for i := range l.globs {
+		if l.globs[i].match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// metricFilter implements allow/deny lists
+type metricFilter struct {
+	allow, deny *patternList
+}
+
+func newMetricFilter(allow, deny []string, sep string) *metricFilter {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil
+	}
+
+	return &metricFilter{
+		allow: compilePatterns(allow, sep),
+		deny:  compilePatterns(deny, sep),
+	}
+}
+
+// allowed returns true if metric should be sent
+//
+// Metric is allowed if allow list is empty or metric matches allow list, and
+// metric doesn't match deny list.
+func (f *metricFilter) allowed(name string) bool {
+	if f.allow != nil && !f.allow.match(name) {
+		return false
+	}
+
+	return f.deny == nil || !f.deny.match(name)
+}
@@ -0,0 +1,203 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGlobPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		expected      bool
+	}{
+		{"cache.*.debug", "cache.users.debug", true},
+		{"cache.*.debug", "cache..debug", true},
+		{"cache.*.debug", "cache.users.hits.debug", false},
+		{"cache.*.debug", "cache.users.debugx", false},
+		{"cache.*", "cache.users", true},
+		{"cache.*", "cache.users.hits", false},
+		{"*.debug", "cache.debug", true},
+		{"*.debug", "debug", false},
+		{"cache.user*", "cache.users", true},
+		{"cache.*s.*", "cache.users.hits", true},
+		{"cache.*s.*", "cache.user.hits", false},
+		{"*", "cache", true},
+		{"*", "", true},
+		{"cache", "cache", true},
+	} {
+		if compileGlob(tc.pattern, ".").match(tc.name) != tc.expected {
+			t.Errorf("pattern %#v on %#v: expected %v", tc.pattern, tc.name, tc.expected)
+		}
+	}
+}
+
+func TestGlobSeparator(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		sep      string
+		name     string
+		expected bool
+	}{
+		{"cache_*_debug", "_", "cache_users_debug", true},
+		{"cache_*_debug", "_", "cache_users_hits_debug", false},
+		{"cache.*", "_", "cache.users.hits", true},
+		{"cache_*", "_", "cache_users.hits", true},
+		{"cache::*::debug", "::", "cache::users:x::debug", true},
+		{"cache::*::debug", "::", "cache::users::x::debug", false},
+	} {
+		if compileGlob(tc.pattern, tc.sep).match(tc.name) != tc.expected {
+			t.Errorf("pattern %#v (separator %#v) on %#v: expected %v", tc.pattern, tc.sep, tc.name, tc.expected)
+		}
+	}
+}
+
+func TestMetricFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		allow, deny []string
+		allowed     []string
+		denied      []string
+	}{
+		{
+			name:    "Deny",
+			deny:    []string{"cache.*.debug", "noisy"},
+			allowed: []string{"cache.users.hits", "noisy.metric", "req.count"},
+			denied:  []string{"cache.users.debug", "noisy"},
+		},
+		{
+			name:    "Allow",
+			allow:   []string{"req.*", "app"},
+			allowed: []string{"req.count", "app"},
+			denied:  []string{"cache.users.hits", "req.count.total", "application"},
+		},
+		{
+			name:    "Precedence",
+			allow:   []string{"req.*"},
+			deny:    []string{"req.debug"},
+			allowed: []string{"req.count"},
+			denied:  []string{"req.debug", "cache.hits"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newMetricFilter(tc.allow, tc.deny, ".")
+
+			for _, name := range tc.allowed {
+				if !f.allowed(name) {
+					t.Errorf("metric %#v should be allowed", name)
+				}
+			}
+
+			for _, name := range tc.denied {
+				if f.allowed(name) {
+					t.Errorf("metric %#v should be denied", name)
+				}
+			}
+		})
+	}
+}
+
+func TestFilteredMetrics(t *testing.T) {
+	inSocket, received := setupListener(t)
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), FlushInterval(time.Hour),
+		DenyMetrics("cache.*.debug"))
+
+	client.Incr("cache.users.debug", 1)
+	client.Incr("cache.users.hits", 1)
+	client.Timing("cache.users.debug", 1)
+	client.Gauge("cache.items.debug", -1)
+	client.SetAdd("cache.items.debug", "foo")
+	client.Flush()
+
+	select {
+	case buf := <-received:
+		if string(buf) != "foo.cache.users.hits:1|c" {
+			t.Errorf("unexpected output: %#v", string(buf))
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for metrics")
+	}
+
+	if client.GetFilteredMetrics() != 4 {
+		t.Errorf("unexpected number of filtered metrics: %d", client.GetFilteredMetrics())
+	}
+
+	_ = client.Close()
+	_ = inSocket.Close()
+	close(received)
+}
+
+func TestFilteredMetricsSeparator(t *testing.T) {
+	inSocket, received := setupListener(t)
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), NameSeparator("_"),
+		DenyMetrics("cache_*_debug"))
+
+	client.Incr("cache_users_debug", 1)
+	client.Incr("cache_users_hits_debug", 1)
+	client.Flush()
+
+	select {
+	case buf := <-received:
+		if string(buf) != "cache_users_hits_debug:1|c" {
+			t.Errorf("unexpected output: %#v", string(buf))
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for metrics")
+	}
+
+	if client.GetFilteredMetrics() != 1 {
+		t.Errorf("unexpected number of filtered metrics: %d", client.GetFilteredMetrics())
+	}
+
+	_ = client.Close()
+	_ = inSocket.Close()
+	close(received)
+}
+
+func BenchmarkMetricFilter(b *testing.B) {
+	patterns := make([]string, 50)
+	for i := range patterns {
+		if i%2 == 0 {
+			patterns[i] = fmt.Sprintf("service%d.*.debug", i)
+		} else {
+			patterns[i] = fmt.Sprintf("service%d.requests", i)
+		}
+	}
+
+	f := newMetricFilter(nil, patterns, ".")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if !f.allowed("service.requests.count") {
+			b.Fatal("should be allowed")
+		}
+	}
+}
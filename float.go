@@ -0,0 +1,146 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"strconv"
+	"time"
+)
+
+// appendFloat appends floating point value with configured precision
+//
+// Value is rounded to the nearest number with floatPrecision digits after
+// the decimal point, trailing zeros are trimmed. Non-zero values which would
+// be rounded to zero are formatted with full precision instead.
+func (t *transport) appendFloat(buf []byte, value float64) []byte {
+	return appendFloatPrecision(buf, value, t.floatPrecision)
+}
+
+// appendFloatPrecision appends floating point value rounded to precision digits,
+// negative precision means minimal number of digits to represent the value exactly
+func appendFloatPrecision(buf []byte, value float64, precision int) []byte {
+	if precision < 0 {
+		return strconv.AppendFloat(buf, value, 'f', -1, 64)
+	}
+
+	start := len(buf)
+	buf = strconv.AppendFloat(buf, value, 'f', precision, 64)
+
+	if precision > 0 {
+		for buf[len(buf)-1] == '0' {
+			buf = buf[:len(buf)-1]
+		}
+
+		if buf[len(buf)-1] == '.' {
+			buf = buf[:len(buf)-1]
+		}
+	}
+
+	if formatted := string(buf[start:]); value != 0 && (formatted == "0" || formatted == "-0") {
+		buf = strconv.AppendFloat(buf[:start], value, 'f', -1, 64)
+	}
+
+	return buf
+}
+
+// maxFastDuration is upper bound of durations formatted with fixed-point arithmetic
+//
+// Below the bound float64 milliseconds are precise enough to be rounded
+// the same way as the exact number of nanoseconds (except for the ties).
+const maxFastDuration = time.Hour
+
+// pow10 is powers of 10 up to nanoseconds in a millisecond
+var pow10 = [...]int64{1, 10, 100, 1000, 10000, 100000, 1000000}
+
+// appendDuration appends duration in milliseconds with configured precision
+//
+// Result is the same as with appendFloat(float64(d)/float64(time.Millisecond)), but
+// if precision is fixed (up to nanoseconds), duration is formatted with integer
+// arithmetic. Exact ties are handed over to appendFloat, as float64 value might be
+// slightly off the tie and rounded either way.
+func (t *transport) appendDuration(buf []byte, d time.Duration) []byte {
+	return appendDurationPrecision(buf, d, t.floatPrecision)
+}
+
+// appendDurationPrecision appends duration in milliseconds rounded to precision digits
+func appendDurationPrecision(buf []byte, d time.Duration, precision int) []byte {
+	if precision < 0 || precision >= len(pow10) || d <= -maxFastDuration || d >= maxFastDuration {
+		return appendFloatPrecision(buf, float64(d)/float64(time.Millisecond), precision)
+	}
+
+	ns := int64(d)
+	neg := ns < 0
+	if neg {
+		ns = -ns
+	}
+
+	unit := pow10[len(pow10)-1-precision]
+	q, r := ns/unit, ns%unit
+
+	if unit > 1 {
+		if half := unit / 2; r == half {
+			return appendFloatPrecision(buf, float64(d)/float64(time.Millisecond), precision)
+		} else if r > half {
+			q++
+		}
+	}
+
+	if q == 0 {
+		if ns != 0 {
+			// value is rounded to zero, so it's formatted with full precision
+			return appendFloatPrecision(buf, float64(d)/float64(time.Millisecond), precision)
+		}
+
+		return append(buf, '0')
+	}
+
+	if neg {
+		buf = append(buf, '-')
+	}
+
+	scale := pow10[precision]
+	buf = appendInt(buf, q/scale)
+
+	frac := q % scale
+	if frac == 0 {
+		return buf
+	}
+
+	digits := precision
+	for frac%10 == 0 {
+		frac /= 10
+		digits--
+	}
+
+	buf = append(buf, '.')
+	buf = append(buf, "000000"[:digits]...)
+
+	for i := len(buf) - 1; frac > 0; i-- {
+		buf[i] = byte('0' + frac%10)
+		frac /= 10
+	}
+
+	return buf
+}
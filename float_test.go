@@ -0,0 +1,168 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAppendFloat(t *testing.T) {
+	// variables to avoid constant folding
+	a, b := 0.1, 0.2
+
+	for _, tc := range []struct {
+		precision int
+		value     float64
+		expected  string
+	}{
+		{-1, a + b, "0.30000000000000004"},
+		{-1, 0.0005, "0.0005"},
+		{0, 2.5, "2"},
+		{0, 3.5, "4"},
+		{0, 0.4, "0.4"},
+		{0, -7.0, "-7"},
+		{2, a + b, "0.3"},
+		{2, 10, "10"},
+		{2, 1.005, "1"},
+		{2, 1.006, "1.01"},
+		{2, 0.0005, "0.0005"},
+		{2, -0.0005, "-0.0005"},
+		{2, 0, "0"},
+		{3, 123.4567, "123.457"},
+		{3, -a - b, "-0.3"},
+		{3, 0.0005, "0.001"},
+		{3, 100.1, "100.1"},
+	} {
+		trans := &transport{floatPrecision: tc.precision}
+
+		if formatted := string(trans.appendFloat([]byte("x:"), tc.value)); formatted != "x:"+tc.expected {
+			t.Errorf("precision %d, value %v: unexpected result %#v != %#v", tc.precision, tc.value, formatted, "x:"+tc.expected)
+		}
+	}
+}
+
+func TestFloatPrecision(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FloatPrecision(2), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	a, b := 0.1, 0.2
+
+	client.FGauge("gauge", a+b)
+	client.FGaugeDelta("gauge", 1.0/3)
+	client.FIncr("counter", 2.0/3)
+	client.FDecr("counter", 0.0001)
+	client.PrecisionTiming("timing", 1234567*time.Nanosecond)
+	client.Flush()
+
+	expected := "gauge:0.3|g\ngauge:+0.33|g\ncounter:0.67|c\ncounter:-0.0001|c\ntiming:1.23|ms"
+
+	select {
+	case buf := <-received:
+		if string(buf) != expected {
+			t.Errorf("unexpected packet: %#v != %#v", string(buf), expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metrics")
+	}
+}
+
+func TestAppendDuration(t *testing.T) {
+	for _, tc := range []struct {
+		precision int
+		value     time.Duration
+		expected  string
+	}{
+		{-1, 1234567 * time.Nanosecond, "1.234567"},
+		{0, 2500 * time.Microsecond, "2"},
+		{0, 3500 * time.Microsecond, "4"},
+		{0, 400 * time.Microsecond, "0.4"},
+		{2, 1234567 * time.Nanosecond, "1.23"},
+		{2, 10 * time.Millisecond, "10"},
+		{2, 1006 * time.Microsecond, "1.01"},
+		{2, 500 * time.Nanosecond, "0.0005"},
+		{2, -500 * time.Nanosecond, "-0.0005"},
+		{2, 0, "0"},
+		{3, 123456700 * time.Nanosecond, "123.457"},
+		{3, -1050 * time.Microsecond, "-1.05"},
+		{3, 1001 * time.Microsecond, "1.001"},
+		{6, 1000001 * time.Nanosecond, "1.000001"},
+		{3, 2 * time.Hour, "7200000"},
+	} {
+		trans := &transport{floatPrecision: tc.precision}
+
+		if formatted := string(trans.appendDuration([]byte("x:"), tc.value)); formatted != "x:"+tc.expected {
+			t.Errorf("precision %d, value %v: unexpected result %#v != %#v", tc.precision, tc.value, formatted, "x:"+tc.expected)
+		}
+	}
+}
+
+func FuzzAppendDuration(f *testing.F) {
+	for _, seed := range []int64{0, 1, -1, 500, 1500, 2500, 1234567, -1234567, 999999999, int64(time.Hour) - 1} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, ns int64) {
+		for precision := -1; precision <= 7; precision++ {
+			trans := &transport{floatPrecision: precision}
+
+			expected := string(trans.appendFloat(nil, float64(ns)/float64(time.Millisecond)))
+
+			if formatted := string(trans.appendDuration(nil, time.Duration(ns))); formatted != expected {
+				t.Errorf("precision %d, value %dns: %#v != %#v", precision, ns, formatted, expected)
+			}
+		}
+	})
+}
+
+func BenchmarkPrecisionTiming(b *testing.B) {
+	for _, precision := range []int{-1, 3} {
+		b.Run(fmt.Sprintf("precision=%d", precision), func(b *testing.B) {
+			c := NewClient("127.0.0.1:8125", FloatPrecision(precision), FlushInterval(100*time.Millisecond),
+				SendLoopCount(1), BlockWithTimeout(time.Second),
+				func(c *ClientOptions) {
+					c.dial = func(context.Context, string, string) (net.Conn, error) {
+						return discardConn{}, nil
+					}
+				})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				c.PrecisionTiming("foo.bar.timing", time.Duration(i%1000000)*time.Microsecond+153*time.Nanosecond)
+			}
+
+			b.StopTimer()
+			_ = c.Close()
+		})
+	}
+}
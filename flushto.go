@@ -0,0 +1,349 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// FlushTo writes buffered metrics to w bypassing the send queue
+//
+// Each packet (up to MaxPacketSize, split at line boundaries) is written with
+// a single Write call exactly as it would be sent to the socket: metrics are
+// separated by newlines, without the trailing newline. Packets which are already
+// waiting in the send queue are written first. FlushTo returns number of bytes written.
+//
+// FlushTo is intended to be used with PassiveMode, so that delivery is controlled
+// by the caller. Writing stops on first error, packet which failed to be written
+// is dropped (and counted as write error), the rest is kept for the next call
+// (except for the rest of the send batch, see SendBatchSize).
+// With Route only the metrics of the default destination are written, other
+// destinations are written with FlushRouteTo.
+//
+// In Unlocked mode FlushTo should be called from the goroutine sending metrics.
+func (c *Client) FlushTo(w io.Writer) (n int, err error) {
+	t := c.trans
+
+	if t.passive {
+		// flush loop is not running in PassiveMode
+		t.runReporters()
+	}
+
+	t.flushGauges()
+
+	if t.pipeline != nil && t.passive {
+		// packer is not running in PassiveMode
+		t.drainPipeline()
+	}
+
+	if n, err = t.writeQueued(w); err != nil {
+		return
+	}
+
+	var written int
+
+	t.localsLock.Lock()
+	defer t.localsLock.Unlock()
+
+	for _, s := range t.shards {
+		s.bufLock.Lock()
+		written, err = t.writeBuf(w, s)
+		s.bufLock.Unlock()
+
+		if n += written; err != nil {
+			return
+		}
+	}
+
+	for s := range t.locals {
+		s.bufLock.Lock()
+		written, err = t.writeBuf(w, s)
+		s.bufLock.Unlock()
+
+		if n += written; err != nil {
+			return
+		}
+	}
+
+	if t.unlocked != nil {
+		written, err = t.writeBuf(w, &t.unlocked.shard)
+		n += written
+	}
+
+	return
+}
+
+// ErrUnknownRoute is returned by FlushRouteTo if client has no destination with the address
+var ErrUnknownRoute = errors.New("statsd: unknown route destination")
+
+// FlushRouteTo writes buffered metrics of the destination addr (see Route) to w
+//
+// It works the same way as FlushTo, metrics of the default destination are
+// written if addr is the client address.
+func (c *Client) FlushRouteTo(addr string, w io.Writer) (int, error) {
+	if addr == c.trans.addr {
+		return c.FlushTo(w)
+	}
+
+	if c.router != nil {
+		for _, dest := range c.router.clients {
+			if dest.trans.addr == addr {
+				if c.trans.passive {
+					// reporters are registered with the default destination, but their metrics might be routed
+					c.trans.runReporters()
+				}
+
+				return dest.FlushTo(w)
+			}
+		}
+	}
+
+	return 0, ErrUnknownRoute
+}
+
+// abandonBuffered drops metrics left in the buffers and queues on close in PassiveMode
+//
+// It should be called with all the shards locked once queue is marked as closed.
+func (t *transport) abandonBuffered() {
+	bufs := make([]*bufShard, 0, len(t.shards)+len(t.locals)+1)
+	bufs = append(bufs, t.shards...)
+
+	for s := range t.locals {
+		bufs = append(bufs, s)
+	}
+
+	if t.unlocked != nil {
+		bufs = append(bufs, &t.unlocked.shard)
+	}
+
+	for _, s := range bufs {
+		if len(s.buf) > 0 {
+			atomic.AddInt64(&t.abandonedPackets, 1)
+			atomic.AddInt64(&t.abandonedMetrics, int64(bytes.Count(s.buf, newline)))
+			t.dropClosed(s, len(s.buf))
+		}
+	}
+
+	if t.batchSize > 1 {
+		t.batchLock.Lock()
+		if t.batch != nil {
+			for _, buf := range t.batch.packets {
+				t.abandonPacket(buf)
+			}
+
+			t.releaseBatch(t.batch)
+			t.batch = nil
+			t.staged = t.staged[:0]
+		}
+		t.batchLock.Unlock()
+	}
+
+	t.retainLock.Lock()
+	for _, p := range t.retained {
+		t.abandonPacket(p.buf)
+	}
+	t.retained = nil
+	t.retainLock.Unlock()
+
+	for {
+		select {
+		case p := <-t.highQueue:
+			t.abandonPacket(p.buf)
+		case p := <-t.sendQueue:
+			t.abandonPacket(p.buf)
+		case batch := <-t.batchQueue:
+			for _, buf := range batch.packets {
+				t.abandonPacket(buf)
+			}
+
+			t.releaseBatch(batch)
+		default:
+			return
+		}
+	}
+}
+
+// writeQueued writes packets waiting in the queues to w (high priority lane first)
+func (t *transport) writeQueued(w io.Writer) (n int, err error) {
+	t.submitBatch()
+
+	// queues are closed once client is closed
+	high, queue, batches := t.highQueue, t.sendQueue, t.batchQueue
+
+	var written int
+
+	for {
+		select {
+		case p, ok := <-high:
+			if !ok {
+				high = nil
+				continue
+			}
+
+			written, err = t.writeQueuedPacket(w, p.buf)
+		default:
+			select {
+			case p, ok := <-queue:
+				if !ok {
+					queue = nil
+					continue
+				}
+
+				written, err = t.writeQueuedPacket(w, p.buf)
+			case batch, ok := <-batches:
+				if !ok {
+					batches = nil
+					continue
+				}
+
+				written, err = t.writeBatch(w, batch)
+			default:
+				if queue == nil {
+					return
+				}
+
+				// retained packets are moved to the send queue once it's drained
+				t.retryRetained()
+
+				if len(queue) == 0 {
+					return
+				}
+
+				continue
+			}
+		}
+
+		n += written
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeBatch writes packets of the batch to w, if write fails, rest of the batch is lost
+func (t *transport) writeBatch(w io.Writer, batch *packetBatch) (n int, err error) {
+	defer t.releaseBatch(batch)
+
+	for i, buf := range batch.packets {
+		var written int
+
+		written, err = t.writeQueuedPacket(w, buf)
+		n += written
+
+		if err != nil {
+			for _, rest := range batch.packets[i+1:] {
+				t.packetLost(rest, DropReasonWriteError)
+				t.releaseBuf(rest)
+			}
+
+			return
+		}
+	}
+
+	return
+}
+
+// writeQueuedPacket writes packet from the queue (with trailing newline) to w and releases the buffer
+func (t *transport) writeQueuedPacket(w io.Writer, buf []byte) (n int, err error) {
+	if len(buf) > 0 {
+		n, err = t.writePacket(w, buf)
+	}
+
+	t.packetDone()
+	t.releaseBuf(buf)
+
+	return
+}
+
+// writeBuf writes the shard buffer to w split into packets at line boundaries
+//
+// On error, the rest of the buffer (after the packet which failed) is kept.
+func (t *transport) writeBuf(w io.Writer, s *bufShard) (n int, err error) {
+	var start int
+
+	for start < len(s.buf) {
+		end := start + packetEnd(s.buf[start:], t.packetSize())
+
+		var written int
+		written, err = t.writePacket(w, s.buf[start:end])
+		n += written
+		start = end
+
+		if err != nil {
+			break
+		}
+	}
+
+	s.discard(start)
+
+	return
+}
+
+// packetEnd returns length of the longest prefix of the buffer which fits
+// into the packet and ends at the line boundary (including the newline)
+func packetEnd(buf []byte, maxPacketSize int) int {
+	limit := len(buf)
+	if limit > maxPacketSize+1 {
+		limit = maxPacketSize + 1
+	}
+
+	if i := bytes.LastIndexByte(buf[:limit], '\n'); i >= 0 {
+		return i + 1
+	}
+
+	// line is longer than the packet, it's written as is
+	if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+		return i + 1
+	}
+
+	return len(buf)
+}
+
+// writePacket writes packet (with trailing newline) to w without the newline
+func (t *transport) writePacket(w io.Writer, buf []byte) (int, error) {
+	t.teePacket(buf)
+	t.dumpPacket(buf)
+
+	n, err := w.Write(buf[:len(buf)-1])
+	atomic.AddInt64(&t.sentBytesPeriod, int64(n))
+	atomic.AddInt64(&t.sentBytesOverall, int64(n))
+
+	if err != nil {
+		atomic.AddInt64(&t.writeErrorsPeriod, 1)
+		atomic.AddInt64(&t.writeErrorsOverall, 1)
+		t.packetDropped(buf, DropReasonWriteError)
+
+		return n, err
+	}
+
+	atomic.AddInt64(&t.sentPacketsPeriod, 1)
+	atomic.AddInt64(&t.sentPacketsOverall, 1)
+
+	return n, nil
+}
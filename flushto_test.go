@@ -0,0 +1,360 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// packetRecorder records every Write as a packet, it fails writes once failAfter packets are written
+type packetRecorder struct {
+	packets   []string
+	failAfter int
+}
+
+func (r *packetRecorder) Write(p []byte) (int, error) {
+	if r.failAfter > 0 && len(r.packets) >= r.failAfter {
+		return 0, errors.New("write failed")
+	}
+
+	r.packets = append(r.packets, string(p))
+
+	return len(p), nil
+}
+
+func TestFlushTo(t *testing.T) {
+	t.Run("Chunks", func(t *testing.T) {
+		client := NewClient("127.0.0.1:8125", PassiveMode(), MaxPacketSize(100))
+		defer client.Close() //nolint:errcheck
+
+		for i := 1; i <= 5; i++ {
+			client.Incr("req.count", int64(i))
+		}
+
+		// packet size is reduced, so the buffer is split into packets: two lines fit exactly
+		client.SetMaxPacketSize(len("req.count:1|c\nreq.count:2|c"))
+
+		var r packetRecorder
+
+		n, err := client.FlushTo(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"req.count:1|c\nreq.count:2|c", "req.count:3|c\nreq.count:4|c", "req.count:5|c"}
+		if !reflect.DeepEqual(r.packets, expected) {
+			t.Errorf("unexpected packets: %q", r.packets)
+		}
+
+		if n != 27+27+13 {
+			t.Errorf("unexpected bytes written: %d", n)
+		}
+
+		// buffer is reset
+		r.packets = nil
+
+		if n, err = client.FlushTo(&r); n != 0 || err != nil || len(r.packets) != 0 {
+			t.Errorf("unexpected second flush: %d %v %q", n, err, r.packets)
+		}
+
+		// line longer than the packet goes as is
+		client.Incr("req.count", 1)
+		client.Incr("req.time", 2)
+		client.SetMaxPacketSize(5)
+
+		if _, err = client.FlushTo(&r); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected = []string{"req.count:1|c", "req.time:2|c"}; !reflect.DeepEqual(r.packets, expected) {
+			t.Errorf("unexpected packets: %q", r.packets)
+		}
+
+		if stats := client.GetStats(); stats.PacketsSent != 5 || stats.LostPackets != 0 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	})
+
+	t.Run("Queued", func(t *testing.T) {
+		client := NewClient("127.0.0.1:8125", PassiveMode(), MaxPacketSize(30), SendQueueCapacity(10),
+			PriorityLanes(10))
+		defer client.Close() //nolint:errcheck
+
+		// full buffers are handed to the send queue, and wait there for FlushTo
+		for i := 1; i <= 5; i++ {
+			client.Incr("req.count", int64(i))
+		}
+
+		client.WithPriority(PriorityHigh).Incr("billing", 1)
+		client.WithPriority(PriorityHigh).Flush()
+
+		var r packetRecorder
+
+		if _, err := client.FlushTo(&r); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{
+			"billing:1|c",
+			"req.count:1|c\nreq.count:2|c",
+			"req.count:3|c\nreq.count:4|c",
+			"req.count:5|c",
+		}
+		if !reflect.DeepEqual(r.packets, expected) {
+			t.Errorf("unexpected packets: %q", r.packets)
+		}
+	})
+
+	t.Run("WriteError", func(t *testing.T) {
+		client := NewClient("127.0.0.1:8125", PassiveMode(), MaxPacketSize(30), SendQueueCapacity(10))
+		defer client.Close() //nolint:errcheck
+
+		for i := 1; i <= 7; i++ {
+			client.Incr("req.count", int64(i))
+		}
+
+		r := packetRecorder{failAfter: 1}
+
+		n, err := client.FlushTo(&r)
+		if err == nil || n != 27 {
+			t.Errorf("unexpected result: %d %v", n, err)
+		}
+
+		if stats := client.GetStats(); stats.WriteErrors != 1 {
+			t.Errorf("unexpected write errors: %d", stats.WriteErrors)
+		}
+
+		// packet which failed is dropped, the rest is written on the next call
+		r.failAfter = 0
+
+		if _, err = client.FlushTo(&r); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"req.count:1|c\nreq.count:2|c", "req.count:5|c\nreq.count:6|c", "req.count:7|c"}
+		if !reflect.DeepEqual(r.packets, expected) {
+			t.Errorf("unexpected packets: %q", r.packets)
+		}
+	})
+}
+
+func TestPassiveMode(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	client := NewClient("127.0.0.1:8125", PassiveMode(), SendLoopCount(4), ReportInterval(time.Second),
+		SelfTelemetry("statsd.", time.Second))
+
+	client.Incr("req.count", 1)
+	client.Gauge("queue.depth", 5)
+	client.Flush()
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines were started: %d > %d", after, before)
+	}
+
+	var r packetRecorder
+
+	if _, err := client.FlushTo(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"req.count:1|c\nqueue.depth:5|g"}; !reflect.DeepEqual(r.packets, expected) {
+		t.Errorf("unexpected packets: %q", r.packets)
+	}
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is left after close
+	if n, err := client.FlushTo(&r); n != 0 || err != nil {
+		t.Errorf("unexpected flush after close: %d %v", n, err)
+	}
+}
+
+func TestPassiveModeClose(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", PassiveMode(), MaxPacketSize(30), SendQueueCapacity(10),
+		ExperimentalPipeline(true))
+
+	// two packets are queued, the last metric stays in the buffer
+	for i := 1; i <= 5; i++ {
+		client.Incr("req.count", int64(i))
+	}
+
+	client.Flush()
+	client.Incr("req.count", 6)
+
+	err := client.Close()
+	if err == nil || err.Error() != "statsd: 4 packets (6 metrics) abandoned on close" {
+		t.Errorf("unexpected close error: %v", err)
+	}
+
+	if lost := client.GetLostPackets(); lost != 4 {
+		t.Errorf("unexpected lost packets: %d", lost)
+	}
+
+	// nothing is left after close, metrics emitted after close are discarded
+	client.Incr("req.count", 7)
+
+	var r packetRecorder
+
+	if n, err := client.FlushTo(&r); n != 0 || err != nil || len(r.packets) != 0 {
+		t.Errorf("unexpected flush after close: %d %v %q", n, err, r.packets)
+	}
+
+	if closed := client.GetClosedMetrics(); closed != 1 {
+		t.Errorf("unexpected closed metrics: %d", closed)
+	}
+}
+
+func TestPassiveModePipeline(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", PassiveMode(), ExperimentalPipeline(true), MaxPacketSize(30),
+		SendQueueCapacity(10))
+	defer client.Close() //nolint:errcheck
+
+	for i := 1; i <= 5; i++ {
+		client.Incr("req.count", int64(i))
+	}
+
+	var r packetRecorder
+
+	if _, err := client.FlushTo(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"req.count:1|c\nreq.count:2|c", "req.count:3|c\nreq.count:4|c", "req.count:5|c"}
+	if !reflect.DeepEqual(r.packets, expected) {
+		t.Errorf("unexpected packets: %q", r.packets)
+	}
+
+	// pipeline queue is drained by Flush as well
+	client.Incr("req.count", 6)
+	client.Flush()
+
+	if client.trans.pipeline.pop() != nil {
+		t.Error("pipeline queue is not drained")
+	}
+
+	r.packets = nil
+
+	if _, err := client.FlushTo(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected = []string{"req.count:6|c"}; !reflect.DeepEqual(r.packets, expected) {
+		t.Errorf("unexpected packets: %q", r.packets)
+	}
+}
+
+func TestPassiveModeReporters(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", PassiveMode())
+
+	h := client.NewBucketedHistogram("req.latency", []float64{10, 100})
+	defer h.Stop()
+
+	h.Observe(5)
+	h.Observe(50)
+
+	var r packetRecorder
+
+	if _, err := client.FlushTo(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"req.latency.le_10:1|c\nreq.latency.le_100:2|c\nreq.latency.sum:55|c\nreq.latency.count:2|c"}
+	if !reflect.DeepEqual(r.packets, expected) {
+		t.Errorf("unexpected packets: %q", r.packets)
+	}
+
+	// last window is reported on close, and it's abandoned as it wasn't written
+	h.Observe(7)
+
+	if err := client.Close(); err == nil || err.Error() != "statsd: 1 packets (4 metrics) abandoned on close" {
+		t.Errorf("unexpected close error: %v", err)
+	}
+}
+
+func TestFlushRouteTo(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", PassiveMode(), Route("billing.", "127.0.0.1:8126"))
+	defer client.Close() //nolint:errcheck
+
+	client.Incr("req.count", 1)
+	client.Incr("billing.charge", 2)
+
+	var def, billing packetRecorder
+
+	if _, err := client.FlushTo(&def); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.FlushRouteTo("127.0.0.1:8126", &billing); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"req.count:1|c"}; !reflect.DeepEqual(def.packets, expected) {
+		t.Errorf("unexpected default packets: %q", def.packets)
+	}
+
+	if expected := []string{"billing.charge:2|c"}; !reflect.DeepEqual(billing.packets, expected) {
+		t.Errorf("unexpected routed packets: %q", billing.packets)
+	}
+
+	client.Incr("req.count", 3)
+
+	def.packets = nil
+
+	if _, err := client.FlushRouteTo("127.0.0.1:8125", &def); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"req.count:3|c"}; !reflect.DeepEqual(def.packets, expected) {
+		t.Errorf("unexpected default packets: %q", def.packets)
+	}
+
+	if _, err := client.FlushRouteTo("127.0.0.1:8127", &def); !errors.Is(err, ErrUnknownRoute) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFlushToClosed(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour))
+
+	client.Incr("req.count", 1)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// queues are closed, so there's nothing to write
+	var r packetRecorder
+
+	if n, err := client.FlushTo(&r); n != 0 || err != nil || len(r.packets) != 0 {
+		t.Errorf("unexpected flush after close: %d %v %q", n, err, r.packets)
+	}
+}
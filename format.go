@@ -0,0 +1,314 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import "time"
+
+// Metric line layout is shared by Client and Append* functions:
+//
+//	<prefix><name>[tags]:<value>|<type>[|@<rate>][tags][|T<timestamp>]\n
+//
+// Tags are placed either after the name or after the value according to
+// TagFormat.Placement. Client formats the name and tags on its own (to apply
+// name cache, default tags and mappers), while the value part is always
+// appended by the helpers below.
+
+// appendCounterValue appends counter value with the sample rate
+func appendCounterValue(buf []byte, count int64, rate float64) []byte {
+	buf = append(buf, ':')
+	buf = appendInt(buf, count)
+	buf = append(buf, counterSuffix...)
+	return appendSampleRate(buf, rate)
+}
+
+// appendFloatCounterValue appends float counter value with the sample rate
+func appendFloatCounterValue(buf []byte, count float64, precision int, rate float64) []byte {
+	buf = append(buf, ':')
+	buf = appendFloatPrecision(buf, count, precision)
+	buf = append(buf, counterSuffix...)
+	return appendSampleRate(buf, rate)
+}
+
+// appendTimingValue appends timing value in milliseconds
+func appendTimingValue(buf []byte, delta int64) []byte {
+	buf = append(buf, ':')
+	buf = appendInt(buf, delta)
+	return append(buf, timingSuffix...)
+}
+
+// appendDurationValue appends timing value as duration converted to milliseconds
+func appendDurationValue(buf []byte, delta time.Duration, precision int) []byte {
+	buf = append(buf, ':')
+	buf = appendDurationPrecision(buf, delta, precision)
+	return append(buf, timingSuffix...)
+}
+
+// appendGaugeValue appends gauge value, sign is '+' for positive deltas
+func appendGaugeValue(buf []byte, sign []byte, value int64) []byte {
+	buf = append(buf, ':')
+	buf = append(buf, sign...)
+	buf = appendInt(buf, value)
+	return append(buf, gaugeSuffix...)
+}
+
+// appendFloatGaugeValue appends float gauge value, sign is '+' for positive deltas
+func appendFloatGaugeValue(buf []byte, sign []byte, value float64, precision int) []byte {
+	buf = append(buf, ':')
+	buf = append(buf, sign...)
+	buf = appendFloatPrecision(buf, value, precision)
+	return append(buf, gaugeSuffix...)
+}
+
+// appendSetValue appends set element
+func appendSetValue(buf []byte, value string) []byte {
+	buf = append(buf, ':')
+	buf = append(buf, value...)
+	return append(buf, setSuffix...)
+}
+
+// appendTags appends tags list in the style (with the leading separator)
+func appendTags(buf []byte, tags []Tag, style *TagFormat) []byte {
+	first := true
+
+	for i := range tags {
+		if style.omits(&tags[i]) {
+			continue
+		}
+
+		if first {
+			buf = append(buf, style.FirstSeparator...)
+			first = false
+		} else {
+			buf = append(buf, style.OtherSeparator)
+		}
+
+		buf = tags[i].Append(buf, style)
+	}
+
+	return buf
+}
+
+// appendHead appends prefixed name and tags placed in the name
+func appendHead(dst []byte, prefix, name string, tags []Tag, style *TagFormat) []byte {
+	start := len(dst)
+	dst = append(dst, prefix...)
+	dst = append(dst, name...)
+
+	style.sanitizeName(dst[start:])
+
+	if style.Placement == TagPlacementName {
+		dst = appendTags(dst, tags, style)
+	}
+
+	return dst
+}
+
+// appendTail appends tags placed after the value, timestamp and terminates the line
+func appendTail(dst []byte, tags []Tag, style *TagFormat, opts callOptions) []byte {
+	if style.Placement == TagPlacementSuffix {
+		dst = appendTags(dst, tags, style)
+	}
+
+	dst = appendTimestamp(dst, opts.timestamp, style)
+
+	return append(dst, '\n')
+}
+
+func styleOrDefault(style *TagFormat) *TagFormat {
+	if style == nil {
+		return TagFormatInfluxDB
+	}
+
+	return style
+}
+
+// AppendCounter appends counter line to dst in the format used by Client
+//
+// Append* functions allow reusing zero-allocation serialization without
+// the buffering and delivery machinery. Line is terminated with '\n', name and
+// tag values are appended as is (no normalization or escaping is applied), unless
+// format restricts them (TagFormatOkmeter, TagFormatGraphite).
+// If style is nil, TagFormatInfluxDB is used. Floating point values are
+// formatted with DefaultFloatPrecision. Call options are honored, but WithRate
+// only adds the rate annotation, sampling is up to the caller.
+func AppendCounter(dst []byte, prefix, name string, value int64, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendCounterValue(dst, value, opts.sampleRate())
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendFloatCounter appends float counter line to dst, see AppendCounter
+func AppendFloatCounter(dst []byte, prefix, name string, value float64, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendFloatCounterValue(dst, value, DefaultFloatPrecision, opts.sampleRate())
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendTiming appends timing line (value in milliseconds) to dst, see AppendCounter
+func AppendTiming(dst []byte, prefix, name string, value int64, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendTimingValue(dst, value)
+	dst = appendSampleRate(dst, opts.sampleRate())
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendPrecisionTiming appends timing line with the duration converted to milliseconds, see AppendCounter
+func AppendPrecisionTiming(dst []byte, prefix, name string, value time.Duration, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendDurationValue(dst, value, DefaultFloatPrecision)
+	dst = appendSampleRate(dst, opts.sampleRate())
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendGauge appends gauge line to dst, see AppendCounter
+//
+// As with Client.Gauge, negative value is preceded by the line which resets
+// the gauge to zero, as otherwise it would be treated as a delta.
+func AppendGauge(dst []byte, prefix, name string, value int64, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	if value < 0 {
+		dst = appendHead(dst, prefix, name, tags, style)
+		dst = appendGaugeValue(dst, nil, 0)
+		dst = appendTail(dst, tags, style, opts)
+	}
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendGaugeValue(dst, nil, value)
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendGaugeDelta appends gauge change line to dst, see AppendCounter
+func AppendGaugeDelta(dst []byte, prefix, name string, value int64, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendGaugeValue(dst, deltaSign(value < 0), value)
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendFloatGauge appends float gauge line to dst, see AppendGauge
+func AppendFloatGauge(dst []byte, prefix, name string, value float64, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	if value < 0 {
+		dst = appendHead(dst, prefix, name, tags, style)
+		dst = appendFloatGaugeValue(dst, nil, 0, DefaultFloatPrecision)
+		dst = appendTail(dst, tags, style, opts)
+	}
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendFloatGaugeValue(dst, nil, value, DefaultFloatPrecision)
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendFloatGaugeDelta appends float gauge change line to dst, see AppendCounter
+func AppendFloatGaugeDelta(dst []byte, prefix, name string, value float64, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendFloatGaugeValue(dst, deltaSign(value < 0), value, DefaultFloatPrecision)
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendSet appends set element line to dst, see AppendCounter
+//
+// Value is appended as is, it shouldn't contain newlines or '|'.
+func AppendSet(dst []byte, prefix, name string, value string, tags []Tag, style *TagFormat) []byte {
+	style = styleOrDefault(style)
+	tags, opts := splitCallOptions(tags)
+
+	dst = appendHead(dst, prefix, name, tags, style)
+	dst = appendSetValue(dst, value)
+	return appendTail(dst, tags, style, opts)
+}
+
+// AppendGraphitePath appends Graphite metric path with tags (name;tag=value) to dst
+//
+// Path could be used with Graphite plaintext protocol, see AppendGraphitePlaintext.
+// TagFormatGraphite restrictions are applied, and whitespace is replaced with '_',
+// as it separates fields of the plaintext protocol.
+func AppendGraphitePath(dst []byte, prefix, name string, tags []Tag) []byte {
+	start := len(dst)
+	dst = appendHead(dst, prefix, name, tags, TagFormatGraphite)
+	replaceWhitespace(dst[start:])
+
+	return dst
+}
+
+// replaceWhitespace replaces whitespace with '_' in place
+func replaceWhitespace(buf []byte) {
+	for i, c := range buf {
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			buf[i] = '_'
+		}
+	}
+}
+
+// AppendGraphitePlaintext appends Graphite plaintext protocol line to dst
+//
+//	<path> <value> <timestamp>\n
+//
+// Path is formatted with AppendGraphitePath, value is formatted with DefaultFloatPrecision.
+// If timestamp is zero, current time is used.
+func AppendGraphitePlaintext(dst []byte, prefix, name string, value float64, timestamp time.Time, tags []Tag) []byte {
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	dst = AppendGraphitePath(dst, prefix, name, tags)
+	dst = append(dst, ' ')
+	dst = appendFloatPrecision(dst, value, DefaultFloatPrecision)
+	dst = append(dst, ' ')
+	dst = appendInt(dst, timestamp.Unix())
+
+	return append(dst, '\n')
+}
+
+// deltaSign returns explicit sign for non-negative gauge deltas
+func deltaSign(negative bool) []byte {
+	if negative {
+		return nil
+	}
+
+	return plusSign
+}
@@ -0,0 +1,491 @@
+package statsd_test
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smira/go-statsd"
+	"github.com/smira/go-statsd/statsdparse"
+	"github.com/smira/go-statsd/statsdtest"
+)
+
+var tagStyles = map[string]*statsd.TagFormat{
+	"InfluxDB": statsd.TagFormatInfluxDB,
+	"Datadog":  statsd.TagFormatDatadog,
+	"Graphite": statsd.TagFormatGraphite,
+	"Okmeter":  statsd.TagFormatOkmeter,
+}
+
+// TestAppendEquivalence checks that Append* functions produce the same lines as the client
+func TestAppendEquivalence(t *testing.T) {
+	tags := []statsd.Tag{statsd.StringTag("host", "example"), statsd.IntTag("port", 80), statsd.Int64Tag("weight", -38)}
+
+	for name, style := range tagStyles {
+		t.Run(name, func(t *testing.T) {
+			server := statsdtest.NewServer(t, "udp")
+
+			var tee bytes.Buffer
+
+			client := statsd.NewClient(server.Addr(), statsd.SynchronousMode(true), statsd.TagStyle(style),
+				statsd.MetricPrefix("app."), statsd.TeeWriter(&tee))
+			defer client.Close() //nolint:errcheck
+
+			for _, test := range []struct {
+				emit     func(tags ...statsd.Tag)
+				expected func(dst []byte, tags []statsd.Tag) []byte
+			}{
+				{
+					func(tags ...statsd.Tag) { client.Incr("req", 3, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendCounter(dst, "app.", "req", 3, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.Decr("req", 3, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendCounter(dst, "app.", "req", -3, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.FIncr("bytes", 0.1, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendFloatCounter(dst, "app.", "bytes", 0.1, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.Timing("lat", 120, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendTiming(dst, "app.", "lat", 120, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.PrecisionTiming("lat", 1234567*time.Nanosecond, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendPrecisionTiming(dst, "app.", "lat", 1234567*time.Nanosecond, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.Gauge("workers", 5, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendGauge(dst, "app.", "workers", 5, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.Gauge("workers", -5, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendGauge(dst, "app.", "workers", -5, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.GaugeDelta("workers", 5, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendGaugeDelta(dst, "app.", "workers", 5, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.GaugeDelta("workers", -5, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendGaugeDelta(dst, "app.", "workers", -5, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.FGauge("load", -0.25, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendFloatGauge(dst, "app.", "load", -0.25, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.FGaugeDelta("load", 1e-7, tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendFloatGaugeDelta(dst, "app.", "load", 1e-7, tags, style)
+					},
+				},
+				{
+					func(tags ...statsd.Tag) { client.SetAdd("users", "alice", tags...) },
+					func(dst []byte, tags []statsd.Tag) []byte {
+						return statsd.AppendSet(dst, "app.", "users", "alice", tags, style)
+					},
+				},
+			} {
+				for _, tags := range [][]statsd.Tag{nil, tags} {
+					tee.Reset()
+
+					test.emit(tags...)
+					client.Flush()
+
+					// tee writes empty line after each packet
+					expected := append(test.expected(nil, tags), '\n')
+					if tee.String() != string(expected) {
+						t.Errorf("client output differs: %q != %q", tee.String(), string(expected))
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestGraphiteSanitization documents Graphite 1.1 restrictions applied to names and tags
+func TestGraphiteSanitization(t *testing.T) {
+	server := statsdtest.NewServer(t, "udp")
+
+	var tee bytes.Buffer
+
+	defaultTags := []statsd.Tag{statsd.StringTag("dc", ""), statsd.StringTag("env", "~prod")}
+
+	client := statsd.NewClient(server.Addr(), statsd.SynchronousMode(true), statsd.TagStyle(statsd.TagFormatGraphite),
+		statsd.MetricPrefix("app;"), statsd.DefaultTags(defaultTags...), statsd.TeeWriter(&tee))
+	defer client.Close() //nolint:errcheck
+
+	for _, test := range []struct {
+		name     string
+		stat     string
+		tags     []statsd.Tag
+		expected string
+	}{
+		{"Plain", "req", []statsd.Tag{statsd.StringTag("route", "api"), statsd.IntTag("port", -80)},
+			"app_req;env=_prod;route=api;port=-80:1|c"},
+		{"NameSeparator", "req;route=evil", nil,
+			"app_req_route=evil;env=_prod:1|c"},
+		{"ValueSeparator", "req", []statsd.Tag{statsd.StringTag("route", "a;b;;")},
+			"app_req;env=_prod;route=a_b__:1|c"},
+		{"TagName", "req", []statsd.Tag{statsd.StringTag("a!b^c=d;e", "v")},
+			"app_req;env=_prod;a_b_c_d_e=v:1|c"},
+		{"Tilde", "req~1", []statsd.Tag{statsd.StringTag("~q", "~~x"), statsd.StringTag("q", "a~b")},
+			"app_req~1;env=_prod;~q=_~x;q=a~b:1|c"},
+		{"Empty", "req", []statsd.Tag{statsd.StringTag("route", ""), statsd.StringTag("", "v"), statsd.IntTag("port", 0)},
+			"app_req;env=_prod;port=0:1|c"},
+		{"Unicode", "запрос", []statsd.Tag{statsd.StringTag("маршрут", "✓ ok")},
+			"app_запрос;env=_prod;маршрут=✓ ok:1|c"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tee.Reset()
+
+			client.Incr(test.stat, 1, test.tags...)
+			client.Flush()
+
+			// tee writes empty line after each packet
+			if tee.String() != test.expected+"\n\n" {
+				t.Errorf("unexpected client output: %q != %q", tee.String(), test.expected+"\n\n")
+			}
+
+			line := statsd.AppendCounter(nil, "app;", test.stat, 1, append(defaultTags, test.tags...), statsd.TagFormatGraphite)
+			if string(line) != test.expected+"\n" {
+				t.Errorf("unexpected Append output: %q != %q", string(line), test.expected+"\n")
+			}
+		})
+	}
+
+	t.Run("OmittedOnly", func(t *testing.T) {
+		line := statsd.AppendCounter(nil, "", "req", 1, []statsd.Tag{statsd.StringTag("dc", "")}, statsd.TagFormatGraphite)
+		if string(line) != "req:1|c\n" {
+			t.Errorf("unexpected output: %q", string(line))
+		}
+	})
+}
+
+func TestAppendGraphitePlaintext(t *testing.T) {
+	tags := []statsd.Tag{statsd.StringTag("route", "/api v1"), statsd.StringTag("dc", ""), statsd.StringTag("q", "~x;y")}
+
+	if path := statsd.AppendGraphitePath(nil, "app.", "req count", tags); string(path) != "app.req_count;route=/api_v1;q=_x_y" {
+		t.Errorf("unexpected path: %q", string(path))
+	}
+
+	line := statsd.AppendGraphitePlaintext([]byte("prev\n"), "app.", "load", 0.25, time.Unix(1700000000, 0), tags[:1])
+	if string(line) != "prev\napp.load;route=/api_v1 0.25 1700000000\n" {
+		t.Errorf("unexpected line: %q", string(line))
+	}
+
+	line = statsd.AppendGraphitePlaintext(nil, "", "load", -1, time.Time{}, nil)
+	if !strings.HasPrefix(string(line), "load -1 ") || !strings.HasSuffix(string(line), "\n") {
+		t.Errorf("unexpected line: %q", string(line))
+	}
+}
+
+func TestAppendDefaultStyle(t *testing.T) {
+	dst := []byte("prev\n")
+	dst = statsd.AppendCounter(dst, "", "req", 1, []statsd.Tag{statsd.StringTag("host", "example")}, nil)
+
+	if string(dst) != "prev\nreq,host=example:1|c\n" {
+		t.Errorf("unexpected output %q", string(dst))
+	}
+}
+
+func TestAppendAllocs(t *testing.T) {
+	dst := make([]byte, 0, 1024)
+	tags := []statsd.Tag{statsd.StringTag("host", "example"), statsd.IntTag("port", 80)}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		dst = statsd.AppendCounter(dst[:0], "app.", "req", 1, tags, statsd.TagFormatDatadog)
+		dst = statsd.AppendFloatGauge(dst, "app.", "load", -0.25, tags, statsd.TagFormatInfluxDB)
+		dst = statsd.AppendPrecisionTiming(dst, "app.", "lat", time.Millisecond, tags, statsd.TagFormatOkmeter)
+		dst = statsd.AppendSet(dst, "app.", "users", "alice", tags, statsd.TagFormatGraphite)
+	})
+
+	if allocs != 0 {
+		t.Errorf("unexpected allocations: %v", allocs)
+	}
+}
+
+// fuzzStyles selects tag style by the fuzzed byte
+var fuzzStyles = []*statsd.TagFormat{statsd.TagFormatInfluxDB, statsd.TagFormatDatadog, statsd.TagFormatGraphite, statsd.TagFormatOkmeter}
+
+// fuzzSafe checks that the fuzzed string doesn't contain statsd separators, so the line could be parsed back
+func fuzzSafe(s string) bool {
+	return !strings.ContainsAny(s, ":|\n,;#=.@") && !strings.Contains(s, "_is_")
+}
+
+// fuzzPreserved checks that the fuzzed strings are not rewritten by the format restrictions
+func fuzzPreserved(style *statsd.TagFormat, name, tagKey, tagValue string) bool {
+	switch style {
+	case statsd.TagFormatOkmeter:
+		for _, s := range []string{name, tagKey, tagValue} {
+			if strings.TrimLeft(s, "abcdefghijklmnopqrstuvwxyz0123456789_-") != "" {
+				return false
+			}
+		}
+	case statsd.TagFormatGraphite:
+		return tagValue != "" && !strings.HasPrefix(tagValue, "~") && !strings.ContainsAny(tagKey, "!^")
+	}
+
+	return true
+}
+
+// checkAppend verifies append semantics and parses the lines back
+func checkAppend(t *testing.T, dst, out []byte, style *statsd.TagFormat, name, tagKey, tagValue string) []statsdparse.Metric {
+	t.Helper()
+
+	if !bytes.HasPrefix(out, dst) {
+		t.Fatalf("existing contents of dst were modified: %q", out)
+	}
+
+	out = out[len(dst):]
+	if !bytes.HasSuffix(out, []byte{'\n'}) {
+		t.Fatalf("line is not terminated: %q", out)
+	}
+
+	if !fuzzSafe(name) || name == "" || !fuzzSafe(tagKey) || tagKey == "" || !fuzzSafe(tagValue) ||
+		!fuzzPreserved(style, name, tagKey, tagValue) {
+		return nil
+	}
+
+	var metrics []statsdparse.Metric
+
+	for _, line := range bytes.Split(out[:len(out)-1], []byte{'\n'}) {
+		metric, err := statsdparse.ParseFormat(line, style)
+		if err != nil {
+			t.Fatalf("error parsing %q: %s", line, err)
+		}
+
+		if metric.Name != "app."+name {
+			t.Fatalf("name mismatch %q != %q", metric.Name, "app."+name)
+		}
+
+		if !(len(metric.Tags) == 1 && string(metric.Tags[0].Append(nil, statsd.TagFormatInfluxDB)) == tagKey+"="+tagValue) {
+			t.Fatalf("tags mismatch %q", line)
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics
+}
+
+func fuzzSeeds(f *testing.F, values ...interface{}) {
+	for i, value := range values {
+		f.Add(byte(i), "req", "host", "example", value)
+	}
+}
+
+func FuzzAppendCounter(f *testing.F) {
+	fuzzSeeds(f, int64(1), int64(-1), int64(math.MaxInt64), int64(math.MinInt64))
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value int64) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+
+		metrics := checkAppend(t, dst, statsd.AppendCounter(dst, "app.", name, value, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style),
+			style, name, tagKey, tagValue)
+		if metrics != nil && (len(metrics) != 1 || metrics[0].Type != statsdparse.Counter || metrics[0].Value != float64(value)) {
+			t.Errorf("value mismatch: %v != %d", metrics, value)
+		}
+	})
+}
+
+func FuzzAppendFloatCounter(f *testing.F) {
+	fuzzSeeds(f, 0.1, -1.5, math.MaxFloat64, math.SmallestNonzeroFloat64)
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value float64) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+
+		metrics := checkAppend(t, dst, statsd.AppendFloatCounter(dst, "app.", name, value, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style),
+			style, name, tagKey, tagValue)
+		if metrics != nil && !math.IsNaN(value) && (len(metrics) != 1 || metrics[0].Type != statsdparse.Counter || metrics[0].Value != value) {
+			t.Errorf("value mismatch: %v != %v", metrics, value)
+		}
+	})
+}
+
+func FuzzAppendTiming(f *testing.F) {
+	fuzzSeeds(f, int64(0), int64(120), int64(math.MinInt64))
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value int64) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+
+		metrics := checkAppend(t, dst, statsd.AppendTiming(dst, "app.", name, value, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style),
+			style, name, tagKey, tagValue)
+		if metrics != nil && (len(metrics) != 1 || metrics[0].Type != statsdparse.Timing || metrics[0].Value != float64(value)) {
+			t.Errorf("value mismatch: %v != %d", metrics, value)
+		}
+	})
+}
+
+func FuzzAppendPrecisionTiming(f *testing.F) {
+	fuzzSeeds(f, int64(time.Millisecond), int64(1234567), int64(-1), int64(math.MaxInt64))
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value int64) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+		d := time.Duration(value)
+
+		metrics := checkAppend(t, dst, statsd.AppendPrecisionTiming(dst, "app.", name, d, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style),
+			style, name, tagKey, tagValue)
+		if expected := float64(d) / float64(time.Millisecond); metrics != nil &&
+			(len(metrics) != 1 || metrics[0].Type != statsdparse.Timing || metrics[0].Value != expected) {
+			t.Errorf("value mismatch: %v != %v", metrics, expected)
+		}
+	})
+}
+
+// checkGauge verifies gauge lines: negative values are preceded by the reset to zero
+func checkGauge(t *testing.T, metrics []statsdparse.Metric, value float64, delta bool) {
+	t.Helper()
+
+	if metrics == nil || math.IsNaN(value) {
+		return
+	}
+
+	expected := 1
+	if !delta && value < 0 {
+		expected = 2
+	}
+
+	if len(metrics) != expected {
+		t.Fatalf("unexpected number of lines: %v", metrics)
+	}
+
+	if expected == 2 && (metrics[0].Value != 0 || metrics[0].Delta) {
+		t.Errorf("gauge is not reset: %v", metrics)
+	}
+
+	last := metrics[len(metrics)-1]
+	if last.Type != statsdparse.Gauge || last.Value != value || (last.Delta != (delta || value < 0) && !math.Signbit(value)) {
+		t.Errorf("value mismatch: %v != %v", last, value)
+	}
+}
+
+func FuzzAppendGauge(f *testing.F) {
+	fuzzSeeds(f, int64(0), int64(5), int64(-5), int64(math.MinInt64))
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value int64) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+
+		checkGauge(t, checkAppend(t, dst, statsd.AppendGauge(dst, "app.", name, value, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style),
+			style, name, tagKey, tagValue), float64(value), false)
+	})
+}
+
+func FuzzAppendGaugeDelta(f *testing.F) {
+	fuzzSeeds(f, int64(0), int64(5), int64(-5))
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value int64) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+
+		checkGauge(t, checkAppend(t, dst, statsd.AppendGaugeDelta(dst, "app.", name, value, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style),
+			style, name, tagKey, tagValue), float64(value), true)
+	})
+}
+
+func FuzzAppendFloatGauge(f *testing.F) {
+	fuzzSeeds(f, 0.0, 0.25, -0.25, math.Inf(-1))
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value float64) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+
+		checkGauge(t, checkAppend(t, dst, statsd.AppendFloatGauge(dst, "app.", name, value, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style),
+			style, name, tagKey, tagValue), value, false)
+	})
+}
+
+func FuzzAppendFloatGaugeDelta(f *testing.F) {
+	fuzzSeeds(f, 0.0, 0.25, -0.25)
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value float64) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+
+		checkGauge(t, checkAppend(t, dst, statsd.AppendFloatGaugeDelta(dst, "app.", name, value, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style),
+			style, name, tagKey, tagValue), value, true)
+	})
+}
+
+func FuzzAppendSet(f *testing.F) {
+	fuzzSeeds(f, "alice", "bob smith", "")
+
+	f.Fuzz(func(t *testing.T, sel byte, name, tagKey, tagValue string, value string) {
+		style := fuzzStyles[int(sel)%len(fuzzStyles)]
+		dst := []byte("prev\n")
+
+		out := statsd.AppendSet(dst, "app.", name, value, []statsd.Tag{statsd.StringTag(tagKey, tagValue)}, style)
+		if value == "" || strings.ContainsAny(value, "|\n") {
+			return
+		}
+
+		metrics := checkAppend(t, dst, out, style, name, tagKey, tagValue)
+		if metrics != nil && (len(metrics) != 1 || metrics[0].Type != statsdparse.Set || metrics[0].SetValue != value) {
+			t.Errorf("value mismatch: %v != %q", metrics, value)
+		}
+	})
+}
+
+func ExampleAppendCounter() {
+	buf := statsd.AppendCounter(nil, "app.", "requests", 1, []statsd.Tag{statsd.StringTag("route", "/api")}, statsd.TagFormatDatadog)
+	buf = statsd.AppendPrecisionTiming(buf, "app.", "latency", 1500*time.Microsecond, nil, nil)
+
+	fmt.Print(string(buf))
+	// Output:
+	// app.requests:1|c|#route:/api
+	// app.latency:1.5|ms
+}
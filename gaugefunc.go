@@ -0,0 +1,113 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import "time"
+
+// flushReporter is invoked by the flush loop right before every periodic flush
+type flushReporter interface {
+	report(now time.Time)
+}
+
+// GaugeFunc is a gauge which value is evaluated on every flush
+type GaugeFunc struct {
+	client *Client
+	stat   string
+	fn     func() bool
+	tags   []Tag
+}
+
+// RegisterBoolGaugeFunc registers gauge stat which is reported as 1 or 0 on every flush
+//
+// Function is called from the flush loop, so it should be fast and it should not block,
+// see DisablePeriodicFlush.
+func (c *Client) RegisterBoolGaugeFunc(stat string, fn func() bool, tags ...Tag) *GaugeFunc {
+	g := &GaugeFunc{
+		client: c.reporterClient(),
+		stat:   stat,
+		fn:     fn,
+		tags:   append([]Tag(nil), tags...),
+	}
+
+	c.trans.register(g)
+
+	// background goroutines are started lazily, so make sure flush loop is running
+	c.trans.start()
+
+	return g
+}
+
+// Stop unregisters the gauge
+func (g *GaugeFunc) Stop() {
+	g.client.trans.unregister(g)
+}
+
+func (g *GaugeFunc) report(time.Time) {
+	g.client.BoolGauge(g.stat, g.fn(), g.tags...)
+}
+
+// reporterClient clones the client to be used from the flush loop
+func (c *Client) reporterClient() *Client {
+	clone := c.clone()
+	// reporters are called from the flush loop, not from the emitter goroutine
+	clone.unlocked = false
+
+	return clone
+}
+
+func (t *transport) register(r flushReporter) {
+	t.reportersLock.Lock()
+	t.reporters = append(t.reporters, r)
+	t.reportersLock.Unlock()
+}
+
+func (t *transport) unregister(r flushReporter) {
+	t.reportersLock.Lock()
+	defer t.reportersLock.Unlock()
+
+	for i := range t.reporters {
+		if t.reporters[i] == r {
+			t.reporters = append(t.reporters[:i:i], t.reporters[i+1:]...)
+			return
+		}
+	}
+}
+
+// runReporters invokes all the registered reporters, it's called from the flush loop (or from FlushTo in PassiveMode)
+func (t *transport) runReporters() {
+	t.reportersLock.Lock()
+	reporters := t.reporters
+	t.reportersLock.Unlock()
+
+	if len(reporters) == 0 {
+		return
+	}
+
+	now := t.now()
+
+	for _, r := range reporters {
+		r.report(now)
+	}
+}
@@ -0,0 +1,127 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"container/list"
+	"math"
+	"sync"
+)
+
+// gaugeState remembers last values of gauges with LRU eviction
+//
+// State lock is held until formatted gauge is copied to the buffer, so
+// that gauge values are delivered in the same order as state is updated.
+type gaugeState struct {
+	lock sync.Mutex
+
+	maxGauges int
+	lru       *list.List
+	entries   map[string]*list.Element
+
+	// scratch buffer to build keys
+	key []byte
+}
+
+type gaugeEntry struct {
+	key   string
+	value int64
+}
+
+func newGaugeState(maxGauges int) *gaugeState {
+	if maxGauges <= 0 {
+		return nil
+	}
+
+	return &gaugeState{
+		maxGauges: maxGauges,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element, maxGauges),
+	}
+}
+
+// store records last gauge value
+func (s *gaugeState) store(key []byte, value int64) {
+	if elem, ok := s.entries[string(key)]; ok {
+		elem.Value.(*gaugeEntry).value = value //nolint:errcheck,forcetypeassert
+		s.lru.MoveToFront(elem)
+
+		return
+	}
+
+	if s.lru.Len() >= s.maxGauges {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*gaugeEntry).key) //nolint:errcheck,forcetypeassert
+	}
+
+	entry := &gaugeEntry{key: string(key), value: value}
+	s.entries[entry.key] = s.lru.PushFront(entry)
+}
+
+// trackedGauge sends gauge value updating gauge state
+//
+// Negative value is always sent as reset to zero followed by the value (never as a delta
+// from the previous value), so that gauge doesn't drift on the server if packets are lost.
+func (c *Client) trackedGauge(stat string, value int64, tags []Tag, opts callOptions) {
+	s := c.acquireBufFor(stat)
+	lastLen := len(s.buf)
+
+	state := c.trans.gauges
+	state.lock.Lock()
+	// scratch buffers (high priority lane, pipeline) are copied after the line is formatted,
+	// so state lock is held until commit to keep updates of the same gauge in order
+	defer state.lock.Unlock()
+
+	state.key = c.formatTags(c.appendName(state.key[:0], stat), tags)
+	state.store(state.key, value)
+
+	if value < 0 {
+		s.buf = c.appendIGauge(s.buf, stat, nil, 0, tags, opts)
+	}
+	s.buf = c.appendIGauge(s.buf, stat, nil, value, tags, opts)
+
+	c.commit(s, lastLen)
+}
+
+// trackedFGauge is trackedGauge for floating point values
+func (c *Client) trackedFGauge(stat string, value float64, tags []Tag, opts callOptions) {
+	s := c.acquireBufFor(stat)
+	lastLen := len(s.buf)
+
+	state := c.trans.gauges
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	state.key = c.formatTags(c.appendName(state.key[:0], stat), tags)
+	state.store(state.key, int64(math.Float64bits(value)))
+
+	if value < 0 {
+		s.buf = c.appendFGauge(s.buf, stat, nil, 0, tags, opts)
+	}
+	s.buf = c.appendFGauge(s.buf, stat, nil, value, tags, opts)
+
+	c.commit(s, lastLen)
+}
@@ -0,0 +1,98 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrackGaugeState(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	compare := func(client *Client, actions func(*Client), expected []string) func(*testing.T) {
+		return func(t *testing.T) {
+			actions(client)
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != strings.Join(expected, "\n") {
+					t.Errorf("unexpected packet: %#v != %#v", string(buf), strings.Join(expected, "\n"))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for metrics")
+			}
+		}
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(), TrackGaugeState(2), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	t.Run("Negative", compare(client,
+		func(c *Client) {
+			for _, value := range []int64{-1, -3, -3, -2} {
+				c.Gauge("gauge", value)
+			}
+		},
+		// negative values are never sent as deltas, so lost packet doesn't skew the gauge
+		[]string{"gauge:0|g", "gauge:-1|g", "gauge:0|g", "gauge:-3|g", "gauge:0|g", "gauge:-3|g", "gauge:0|g", "gauge:-2|g"}))
+
+	t.Run("Float", compare(client,
+		func(c *Client) {
+			for _, value := range []float64{-1.5, -3, 2.5} {
+				c.FGauge("fgauge", value)
+			}
+		},
+		[]string{"fgauge:0|g", "fgauge:-1.5|g", "fgauge:0|g", "fgauge:-3|g", "fgauge:2.5|g"}))
+
+	t.Run("Transitions", compare(client,
+		func(c *Client) {
+			for _, value := range []int64{5, -4, 0, -1} {
+				c.Gauge("gauge", value)
+			}
+		},
+		[]string{"gauge:5|g", "gauge:0|g", "gauge:-4|g", "gauge:0|g", "gauge:0|g", "gauge:-1|g"}))
+
+	t.Run("Tags", compare(client,
+		func(c *Client) {
+			c.Gauge("tagged", -1, StringTag("host", "a"))
+			c.Gauge("tagged", -1, StringTag("host", "b"))
+			c.Gauge("tagged", -2, StringTag("host", "a"))
+		},
+		[]string{"tagged,host=a:0|g", "tagged,host=a:-1|g", "tagged,host=b:0|g", "tagged,host=b:-1|g",
+			"tagged,host=a:0|g", "tagged,host=a:-2|g"}))
+
+	// with 2 gauges tracked, "gauge" was evicted
+	t.Run("Eviction", compare(client,
+		func(c *Client) { c.Gauge("gauge", -2) },
+		[]string{"gauge:0|g", "gauge:-2|g"}))
+
+	if tracked := client.trans.gauges.lru.Len(); tracked != 2 {
+		t.Errorf("unexpected number of tracked gauges: %d", tracked)
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/smira/go-statsd
 
-go 1.20
+go 1.21
+
+require go.uber.org/goleak v1.3.0
@@ -0,0 +1,99 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Health describes state of the connection to statsd server
+type Health struct {
+	// Connected is true if at least one send loop has a connection
+	Connected bool
+	// LastDialError is the last error connecting to the server
+	LastDialError error
+	// LastWriteError is the last error writing to the socket
+	LastWriteError error
+	// LastSuccessfulWrite is time of the last packet successfully written
+	LastSuccessfulWrite time.Time
+	// ConsecutiveFailures is number of dial and write failures since the last successful write
+	ConsecutiveFailures int
+}
+
+// Health returns state of the connection to statsd server
+//
+// As statsd uses UDP, successful write doesn't guarantee delivery, but
+// failures (e.g. address can't be resolved or ICMP port unreachable was
+// received) are reported.
+func (c *Client) Health() Health {
+	h := Health{
+		Connected:           atomic.LoadInt32(&c.trans.connectedLoops) > 0,
+		ConsecutiveFailures: int(atomic.LoadInt64(&c.trans.consecutiveFailures)),
+	}
+
+	if lastWrite := atomic.LoadInt64(&c.trans.lastSuccessfulWrite); lastWrite != 0 {
+		h.LastSuccessfulWrite = time.Unix(0, lastWrite)
+	}
+
+	c.trans.healthLock.Lock()
+	h.LastDialError = c.trans.lastDialError
+	h.LastWriteError = c.trans.lastWriteError
+	c.trans.healthLock.Unlock()
+
+	return h
+}
+
+func (t *transport) healthConnected() {
+	atomic.AddInt32(&t.connectedLoops, 1)
+}
+
+func (t *transport) healthDisconnected() {
+	atomic.AddInt32(&t.connectedLoops, -1)
+}
+
+func (t *transport) healthDialFailed(err error) {
+	t.healthLock.Lock()
+	t.lastDialError = err
+	t.healthLock.Unlock()
+
+	atomic.AddInt64(&t.consecutiveFailures, 1)
+}
+
+func (t *transport) healthWriteFailed(err error) {
+	t.healthLock.Lock()
+	t.lastWriteError = err
+	t.healthLock.Unlock()
+
+	atomic.AddInt64(&t.consecutiveFailures, 1)
+}
+
+func (t *transport) healthWriteSucceeded() {
+	atomic.StoreInt64(&t.lastSuccessfulWrite, time.Now().UnixNano())
+
+	if atomic.LoadInt64(&t.consecutiveFailures) != 0 {
+		atomic.StoreInt64(&t.consecutiveFailures, 0)
+	}
+}
@@ -0,0 +1,138 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// switchableConn fails writes while server is down
+type switchableConn struct {
+	net.Conn
+
+	down *int32
+}
+
+func (c *switchableConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(c.down) != 0 {
+		return 0, syscall.ECONNREFUSED
+	}
+
+	return c.Conn.Write(b)
+}
+
+func TestHealth(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	var down int32
+
+	dial := func(c *ClientOptions) {
+		c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if atomic.LoadInt32(&down) != 0 {
+				return nil, syscall.EHOSTUNREACH
+			}
+
+			var d net.Dialer
+
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			return &switchableConn{Conn: conn, down: &down}, nil
+		}
+	}
+
+	client := NewClient(inSocket.LocalAddr().String(), Logger(&capturingLogger{}), RetryTimeout(10*time.Millisecond),
+		FlushInterval(time.Hour), dial)
+	defer client.Close() //nolint:errcheck
+
+	waitFor := func(t *testing.T, cond func(h Health) bool) Health {
+		for i := 0; i < 100; i++ {
+			if h := client.Health(); cond(h) {
+				return h
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		t.Fatalf("unexpected health: %#v", client.Health())
+
+		return Health{}
+	}
+
+	send := func() {
+		client.Incr("req.count", 1)
+		client.Flush()
+	}
+
+	start := time.Now()
+
+	t.Run("Up", func(t *testing.T) {
+		send()
+		<-received
+
+		h := waitFor(t, func(h Health) bool { return h.Connected && !h.LastSuccessfulWrite.IsZero() })
+
+		if h.LastSuccessfulWrite.Before(start) || h.ConsecutiveFailures != 0 || h.LastDialError != nil || h.LastWriteError != nil {
+			t.Errorf("unexpected health: %#v", h)
+		}
+	})
+
+	t.Run("Down", func(t *testing.T) {
+		atomic.StoreInt32(&down, 1)
+
+		send()
+
+		h := waitFor(t, func(h Health) bool { return !h.Connected && h.ConsecutiveFailures > 1 })
+
+		if h.LastWriteError != syscall.ECONNREFUSED || h.LastDialError != syscall.EHOSTUNREACH {
+			t.Errorf("unexpected health: %#v", h)
+		}
+	})
+
+	t.Run("Recovered", func(t *testing.T) {
+		lastWrite := client.Health().LastSuccessfulWrite
+
+		atomic.StoreInt32(&down, 0)
+
+		waitFor(t, func(h Health) bool { return h.Connected })
+
+		send()
+		<-received
+
+		h := waitFor(t, func(h Health) bool { return h.ConsecutiveFailures == 0 })
+
+		if !h.LastSuccessfulWrite.After(lastWrite) {
+			t.Errorf("unexpected health: %#v", h)
+		}
+	})
+}
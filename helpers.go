@@ -0,0 +1,228 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Job outcomes reported by MeasureJob (OutcomePanic is reported by Measure as well)
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomePanic   = "panic"
+)
+
+// Operation outcomes reported by Measure
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+)
+
+// Error classes returned by ClassifyError
+const (
+	ErrorClassTimeout  = "timeout"
+	ErrorClassCanceled = "canceled"
+	ErrorClassOther    = "other"
+)
+
+// MeasureJob runs fn and reports its execution
+//
+// Following metrics are sent:
+//
+//   - `<name>.runs` counter tagged with `outcome` (success, failure or panic)
+//   - `<name>.duration` PrecisionTiming
+//
+// Suffixes are joined with NameSeparator. Both metrics carry tags passed in. Error returned by fn is returned as is,
+// if fn panics, metrics are recorded and panic is propagated.
+func (c *Client) MeasureJob(name string, tags []Tag, fn func() error) (err error) {
+	start := time.Now()
+	outcome := OutcomePanic
+
+	defer func() {
+		names := c.trans.jobNamesFor(name)
+
+		c.PrecisionTiming(names.duration, time.Since(start), tags...)
+		// limit capacity so that append never touches caller's backing array
+		c.Incr(names.runs, 1, append(tags[:len(tags):len(tags)], StringTag("outcome", outcome))...)
+	}()
+
+	err = fn()
+
+	if err != nil {
+		outcome = OutcomeFailure
+	} else {
+		outcome = OutcomeSuccess
+	}
+
+	return err
+}
+
+// jobNames are names of the metrics reported by MeasureJob
+type jobNames struct {
+	duration string
+	runs     string
+}
+
+// maxJobNames is a number of job names cached by MeasureJob
+const maxJobNames = 1024
+
+// jobNamesFor returns names of the metrics reported by MeasureJob for the job
+//
+// Names are built once per job, so that MeasureJob doesn't allocate them on every call.
+// Lookups are lock-free, map is replaced on every insert, as job names are few.
+func (t *transport) jobNamesFor(name string) *jobNames {
+	if cached := t.jobNames.Load(); cached != nil {
+		if names := (*cached)[name]; names != nil {
+			return names
+		}
+	}
+
+	names := &jobNames{
+		duration: joinPrefix(name, "duration", t.nameSeparator),
+		runs:     joinPrefix(name, "runs", t.nameSeparator),
+	}
+
+	t.jobNamesLock.Lock()
+	defer t.jobNamesLock.Unlock()
+
+	var old map[string]*jobNames
+	if cached := t.jobNames.Load(); cached != nil {
+		old = *cached
+	}
+
+	if len(old) >= maxJobNames {
+		// too many jobs, names are built on every call
+		return names
+	}
+
+	entries := make(map[string]*jobNames, len(old)+1)
+	for k, v := range old {
+		entries[k] = v
+	}
+
+	entries[name] = names
+	t.jobNames.Store(&entries)
+
+	return names
+}
+
+// Measure runs op and reports its outcome
+//
+// Following metrics are sent:
+//
+//   - `<stat>.duration` PrecisionTiming
+//   - `<stat>.count` counter tagged with `outcome` (ok, error or panic)
+//   - `<stat>.errors` counter tagged with `class`, only if op returns an error
+//
+// Suffixes are joined with NameSeparator. Error class is returned by the ErrorClassifier
+// option, ClassifyError by default.
+// All the metrics carry tags passed in. Error returned by op is returned as is,
+// if op panics, metrics are recorded and panic is propagated.
+func (c *Client) Measure(stat string, tags []Tag, op func() error) (err error) {
+	start := time.Now()
+	outcome := OutcomePanic
+
+	defer func() {
+		sep := c.trans.nameSeparator
+
+		c.PrecisionTiming(joinPrefix(stat, "duration", sep), time.Since(start), tags...)
+
+		// limit capacity so that append never touches caller's backing array
+		tags = tags[:len(tags):len(tags)]
+		c.Incr(joinPrefix(stat, "count", sep), 1, append(tags, StringTag("outcome", outcome))...)
+
+		if outcome == OutcomeError {
+			c.Incr(joinPrefix(stat, "errors", sep), 1, append(tags, StringTag("class", c.classifyError(err)))...)
+		}
+	}()
+
+	err = op()
+
+	if err != nil {
+		outcome = OutcomeError
+	} else {
+		outcome = OutcomeOK
+	}
+
+	return err
+}
+
+func (c *Client) classifyError(err error) string {
+	var class string
+
+	if c.trans.errorClassifier != nil {
+		class = c.trans.errorClassifier(err)
+	} else {
+		class = ClassifyError(err)
+	}
+
+	if class == "" {
+		return ErrorClassOther
+	}
+
+	return class
+}
+
+// ClassifyError is default error classifier used by Measure
+//
+// Context deadline and errors reporting timeout (e.g. network errors) are classified
+// as ErrorClassTimeout, context cancellation as ErrorClassCanceled, and everything
+// else as ErrorClassOther.
+func ClassifyError(err error) string {
+	var timeout interface{ Timeout() bool }
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return ErrorClassTimeout
+	default:
+		return ErrorClassOther
+	}
+}
+
+// TimeRemaining reports time left until the context deadline as PrecisionTiming
+//
+// It's an early warning of the timeout pressure: reported when the request is
+// handled, values close to zero mean request was about to time out. Deadline which
+// has already passed is reported as zero, nothing is sent if context has no deadline.
+func (c *Client) TimeRemaining(stat string, ctx context.Context, tags ...Tag) { //nolint:revive
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	c.PrecisionTiming(stat, remaining, tags...)
+}
@@ -0,0 +1,280 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeasureJob(t *testing.T) {
+	inSocket, received := setupListener(t)
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), FlushInterval(time.Hour))
+
+	errFailed := errors.New("failed")
+
+	compareOutput := func(fn func() error, expectedErr error, expectedPanic bool, expected string) func(*testing.T) {
+		return func(t *testing.T) {
+			var err error
+
+			func() {
+				defer func() {
+					r := recover()
+					if (r != nil) != expectedPanic {
+						t.Errorf("unexpected panic status: %v", r)
+					}
+				}()
+
+				err = client.MeasureJob("job", []Tag{StringTag("type", "cron")}, fn)
+			}()
+
+			client.Flush()
+
+			if err != expectedErr {
+				t.Errorf("unexpected error: %v != %v", err, expectedErr)
+			}
+
+			select {
+			case buf := <-received:
+				if !regexp.MustCompile(expected).Match(buf) {
+					t.Errorf("unexpected output: %#v doesn't match %#v", string(buf), expected)
+				}
+			case <-time.After(time.Second):
+				t.Error("timeout waiting for metrics")
+			}
+		}
+	}
+
+	t.Run("Success", compareOutput(
+		func() error { return nil }, nil, false,
+		`^foo\.job\.duration,type=cron:[0-9.]+\|ms\nfoo\.job\.runs,type=cron,outcome=success:1\|c$`))
+
+	t.Run("Failure", compareOutput(
+		func() error { return errFailed }, errFailed, false,
+		`^foo\.job\.duration,type=cron:[0-9.]+\|ms\nfoo\.job\.runs,type=cron,outcome=failure:1\|c$`))
+
+	t.Run("Panic", compareOutput(
+		func() error { panic("boom") }, nil, true,
+		`^foo\.job\.duration,type=cron:[0-9.]+\|ms\nfoo\.job\.runs,type=cron,outcome=panic:1\|c$`))
+
+	t.Run("TagsNotModified", func(t *testing.T) {
+		tags := make([]Tag, 1, 2)
+		tags[0] = StringTag("type", "cron")
+
+		_ = client.MeasureJob("job", tags, func() error { return nil })
+		client.Flush()
+
+		if tags[:2][1] != (Tag{}) {
+			t.Errorf("caller's tags were modified: %#v", tags[:2])
+		}
+
+		<-received
+	})
+
+	_ = client.Close()
+	_ = inSocket.Close()
+	close(received)
+}
+
+func TestMeasureJobAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not stable with race detector")
+	}
+
+	client := NewClient("127.0.0.1:4444", MaxPacketSize(65000), SuppressMTUWarning(), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	tags := []Tag{StringTag("type", "cron")}
+	fn := func() error { return nil }
+
+	// the only allocation is the tag slice with the outcome appended
+	if allocs := testing.AllocsPerRun(100, func() { _ = client.MeasureJob("job", tags, fn) }); allocs > 1 {
+		t.Errorf("unexpected allocations: %v", allocs)
+	}
+
+	for i := 0; i < maxJobNames+10; i++ {
+		_ = client.MeasureJob(strconv.Itoa(i), nil, fn)
+	}
+
+	if cached := len(*client.trans.jobNames.Load()); cached != maxJobNames {
+		t.Errorf("unexpected number of cached job names: %d", cached)
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	errBusy := errors.New("busy")
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), FlushInterval(time.Hour),
+		ErrorClassifier(func(err error) string {
+			if err == errBusy {
+				return "busy"
+			}
+
+			return ClassifyError(err)
+		}))
+	defer client.Close() //nolint:errcheck
+
+	compareOutput := func(op func() error, expectedErr error, expectedPanic bool, expected string) func(*testing.T) {
+		return func(t *testing.T) {
+			var err error
+
+			func() {
+				defer func() {
+					r := recover()
+					if (r != nil) != expectedPanic {
+						t.Errorf("unexpected panic status: %v", r)
+					}
+				}()
+
+				err = client.Measure("op", []Tag{StringTag("db", "main")}, op)
+			}()
+
+			if err != expectedErr {
+				t.Errorf("unexpected error: %v != %v", err, expectedErr)
+			}
+
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if !regexp.MustCompile(expected).Match(buf) {
+					t.Errorf("unexpected output: %#v doesn't match %#v", string(buf), expected)
+				}
+			case <-time.After(time.Second):
+				t.Error("timeout waiting for metrics")
+			}
+		}
+	}
+
+	t.Run("OK", compareOutput(
+		func() error { return nil }, nil, false,
+		`^foo\.op\.duration,db=main:[0-9.]+\|ms\nfoo\.op\.count,db=main,outcome=ok:1\|c$`))
+
+	t.Run("Classified", compareOutput(
+		func() error { return errBusy }, errBusy, false,
+		`^foo\.op\.duration,db=main:[0-9.]+\|ms\nfoo\.op\.count,db=main,outcome=error:1\|c\nfoo\.op\.errors,db=main,class=busy:1\|c$`))
+
+	t.Run("Default", compareOutput(
+		func() error { return context.DeadlineExceeded }, context.DeadlineExceeded, false,
+		`^foo\.op\.duration,db=main:[0-9.]+\|ms\nfoo\.op\.count,db=main,outcome=error:1\|c\nfoo\.op\.errors,db=main,class=timeout:1\|c$`))
+
+	t.Run("Panic", compareOutput(
+		func() error { panic("boom") }, nil, true,
+		`^foo\.op\.duration,db=main:[0-9.]+\|ms\nfoo\.op\.count,db=main,outcome=panic:1\|c$`))
+}
+
+func TestMeasureSeparator(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", PassiveMode(), MetricPrefix("foo_"), NameSeparator("_"))
+	defer client.Close() //nolint:errcheck
+
+	_ = client.MeasureJob("job", nil, func() error { return nil })
+	_ = client.Measure("op", nil, func() error { return errors.New("failed") })
+
+	var r packetRecorder
+
+	if _, err := client.FlushTo(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `^foo_job_duration:[0-9.]+\|ms\nfoo_job_runs,outcome=success:1\|c\n` +
+		`foo_op_duration:[0-9.]+\|ms\nfoo_op_count,outcome=error:1\|c\nfoo_op_errors,class=other:1\|c$`
+	if len(r.packets) != 1 || !regexp.MustCompile(expected).MatchString(r.packets[0]) {
+		t.Errorf("unexpected packets: %q", r.packets)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for _, tt := range []struct {
+		err      error
+		expected string
+	}{
+		{context.DeadlineExceeded, ErrorClassTimeout},
+		{fmt.Errorf("query: %w", context.Canceled), ErrorClassCanceled},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, ErrorClassTimeout},
+		{errors.New("failed"), ErrorClassOther},
+	} {
+		if class := ClassifyError(tt.err); class != tt.expected {
+			t.Errorf("unexpected class for %v: %q != %q", tt.err, class, tt.expected)
+		}
+	}
+}
+
+func TestTimeRemaining(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	past, cancelPast := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelPast()
+
+	near, cancelNear := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancelNear()
+
+	client.TimeRemaining("deadline.none", context.Background())
+	client.TimeRemaining("deadline.past", past, StringTag("route", "api"))
+	client.TimeRemaining("deadline.near", near)
+	client.Flush()
+
+	select {
+	case buf := <-received:
+		lines := strings.Split(string(buf), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("unexpected output: %#v", string(buf))
+		}
+
+		if lines[0] != "foo.deadline.past,route=api:0|ms" {
+			t.Errorf("unexpected past deadline: %#v", lines[0])
+		}
+
+		if !strings.HasPrefix(lines[1], "foo.deadline.near:") || !strings.HasSuffix(lines[1], "|ms") {
+			t.Fatalf("unexpected near deadline: %#v", lines[1])
+		}
+
+		remaining, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimPrefix(lines[1], "foo.deadline.near:"), "|ms"), 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if remaining <= 0 || remaining > 500 {
+			t.Errorf("unexpected remaining time: %v ms", remaining)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metrics")
+	}
+}
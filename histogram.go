@@ -0,0 +1,141 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// BucketedHistogram computes histogram with fixed buckets client-side
+//
+// Every flush interval histogram emits a counter per bucket (stat.le_<bound>) with
+// the number of observations which are less or equal to the bound, and counters
+// stat.sum and stat.count. Buckets are cumulative, observations above the last bound
+// are accounted only in stat.count. Counters are not emitted if there were no
+// observations, as statsd server doesn't need zero increments. Suffixes are joined
+// with NameSeparator.
+type BucketedHistogram struct {
+	client *Client
+	bounds []float64
+	names  []string
+	tags   []Tag
+
+	sumName   string
+	countName string
+
+	// buckets[i] counts observations in (bounds[i-1], bounds[i]]
+	buckets []int64
+	count   int64
+	// sum is float64 stored as bits
+	sum uint64
+}
+
+// NewBucketedHistogram creates histogram reporting buckets with upper bounds as counters
+//
+// Histogram is reported on every periodic flush, see DisablePeriodicFlush.
+func (c *Client) NewBucketedHistogram(stat string, bounds []float64, tags ...Tag) *BucketedHistogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+
+	sep := c.trans.nameSeparator
+
+	h := &BucketedHistogram{
+		client:    c.reporterClient(),
+		bounds:    bounds,
+		names:     make([]string, len(bounds)),
+		tags:      append([]Tag(nil), tags...),
+		sumName:   joinPrefix(stat, "sum", sep),
+		countName: joinPrefix(stat, "count", sep),
+		buckets:   make([]int64, len(bounds)),
+	}
+
+	for i, bound := range bounds {
+		// bound might contain '.', which is usually a name separator
+		h.names[i] = joinPrefix(stat, "le_", sep) + strings.ReplaceAll(strconv.FormatFloat(bound, 'f', -1, 64), ".", "_")
+	}
+
+	c.trans.register(h)
+
+	return h
+}
+
+// Observe records value in the histogram
+func (h *BucketedHistogram) Observe(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+
+	if i := sort.SearchFloat64s(h.bounds, value); i < len(h.buckets) {
+		atomic.AddInt64(&h.buckets[i], 1)
+	}
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+value)) {
+			break
+		}
+	}
+
+	atomic.AddInt64(&h.count, 1)
+
+	// background goroutines are started lazily, so make sure flush loop is running
+	h.client.trans.start()
+}
+
+// ObserveDuration records duration in milliseconds in the histogram
+func (h *BucketedHistogram) ObserveDuration(d time.Duration) {
+	h.Observe(float64(d) / float64(time.Millisecond))
+}
+
+// Stop unregisters histogram, observations which were not reported yet are discarded
+func (h *BucketedHistogram) Stop() {
+	h.client.trans.unregister(h)
+}
+
+// report emits counters for the observations since the last flush
+//
+// Counters are swapped one by one, so observation which happens concurrently
+// might be split between two flush intervals.
+func (h *BucketedHistogram) report(time.Time) {
+	count := atomic.SwapInt64(&h.count, 0)
+	if count == 0 {
+		return
+	}
+
+	var cumulative int64
+
+	for i := range h.buckets {
+		cumulative += atomic.SwapInt64(&h.buckets[i], 0)
+		h.client.Incr(h.names[i], cumulative, h.tags...)
+	}
+
+	h.client.FIncr(h.sumName, math.Float64frombits(atomic.SwapUint64(&h.sum, 0)), h.tags...)
+	h.client.Incr(h.countName, count, h.tags...)
+}
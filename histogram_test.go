@@ -0,0 +1,171 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketedHistogramBuckets(t *testing.T) {
+	client := NewClient("127.0.0.1:4444", FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	h := client.NewBucketedHistogram("latency", []float64{25, 5, 10})
+	defer h.Stop()
+
+	for _, tc := range []struct {
+		value  float64
+		bucket int
+	}{
+		{-1, 0},
+		{0, 0},
+		{5, 0},
+		{5.0001, 1},
+		{10, 1},
+		{24.999, 2},
+		{25, 2},
+		{25.0001, 3},
+		{1e9, 3},
+	} {
+		before := append([]int64(nil), h.buckets...)
+
+		h.Observe(tc.value)
+
+		for i := range h.buckets {
+			expected := before[i]
+			if i == tc.bucket {
+				expected++
+			}
+
+			if h.buckets[i] != expected {
+				t.Errorf("value %v: unexpected bucket %d count %d != %d", tc.value, i, h.buckets[i], expected)
+			}
+		}
+	}
+
+	if h.count != 9 {
+		t.Errorf("unexpected count %d", h.count)
+	}
+}
+
+func TestBucketedHistogramFlush(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), MetricPrefix("web."))
+	defer client.Close() //nolint:errcheck
+
+	h := client.NewBucketedHistogram("req.latency_ms", []float64{0.5, 10, 50, 100}, StringTag("route", "api"))
+
+	for _, value := range []float64{0.25, 7, 10, 60, 200} {
+		h.Observe(value)
+	}
+
+	h.ObserveDuration(1500 * time.Microsecond)
+
+	expected := []string{
+		"web.req.latency_ms.le_0_5,route=api:1|c",
+		"web.req.latency_ms.le_10,route=api:4|c",
+		"web.req.latency_ms.le_50,route=api:4|c",
+		"web.req.latency_ms.le_100,route=api:5|c",
+		"web.req.latency_ms.sum,route=api:278.75|c",
+		"web.req.latency_ms.count,route=api:6|c",
+	}
+
+	if packet := readReported(t, client, received); packet != strings.Join(expected, "\n") {
+		t.Errorf("unexpected packet: %#v != %#v", packet, strings.Join(expected, "\n"))
+	}
+
+	// nothing is reported without observations
+	if packet := readReported(t, client, received); packet != "" {
+		t.Errorf("unexpected packet: %#v", packet)
+	}
+
+	h.Observe(200)
+
+	expected = []string{
+		"web.req.latency_ms.sum,route=api:200|c",
+		"web.req.latency_ms.count,route=api:1|c",
+	}
+
+	if packet := readReported(t, client, received); packet != strings.Join(expected, "\n") {
+		t.Errorf("unexpected packet: %#v != %#v", packet, strings.Join(expected, "\n"))
+	}
+
+	h.Observe(1)
+	h.Stop()
+
+	if packet := readReported(t, client, received); packet != "" {
+		t.Errorf("unexpected packet: %#v", packet)
+	}
+}
+
+func TestBucketedHistogramSeparator(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), NameSeparator("_"))
+	defer client.Close() //nolint:errcheck
+
+	h := client.NewBucketedHistogram("req_latency", []float64{0.5})
+	defer h.Stop()
+
+	h.Observe(0.25)
+
+	if packet := readReported(t, client, received); packet != "req_latency_le_0_5:1|c\nreq_latency_sum:0.25|c\nreq_latency_count:1|c" {
+		t.Errorf("unexpected packet: %q", packet)
+	}
+}
+
+func TestBucketedHistogramAllocs(t *testing.T) {
+	client := NewClient("127.0.0.1:4444", FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	h := client.NewBucketedHistogram("latency", []float64{5, 10, 25, 50, 100, 250, 500, 1000})
+	defer h.Stop()
+
+	if allocs := testing.AllocsPerRun(1000, func() { h.Observe(42) }); allocs != 0 {
+		t.Errorf("unexpected allocations in Observe: %v", allocs)
+	}
+}
+
+func BenchmarkBucketedHistogramObserve(b *testing.B) {
+	client := NewClient("127.0.0.1:4444", FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	h := client.NewBucketedHistogram("latency", []float64{5, 10, 25, 50, 100, 250, 500, 1000})
+	defer h.Stop()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			h.Observe(float64(i % 1200))
+		}
+	})
+}
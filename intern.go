@@ -0,0 +1,110 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// nameEntry is metric name with prefix applied
+type nameEntry struct {
+	stat string
+	name []byte
+	// set on lookup, cleared by eviction scan
+	used uint32
+}
+
+// nameCache maps metric names to the formatted name (prefix and rewritten name)
+//
+// Lookups are lock-free: map is immutable and replaced on every insert, so
+// the cache is meant for a small set of hot names. LRU is approximated with
+// CLOCK (second chance) policy, so that hit doesn't require a lock: entry
+// used since the last scan is skipped by eviction.
+type nameCache struct {
+	entries atomic.Pointer[map[string]*nameEntry]
+
+	lock  sync.Mutex
+	max   int
+	clock []*nameEntry
+	hand  int
+}
+
+func newNameCache(max int) *nameCache {
+	cache := &nameCache{max: max}
+	entries := make(map[string]*nameEntry)
+	cache.entries.Store(&entries)
+
+	return cache
+}
+
+// lookup returns formatted name or nil if it's not cached
+func (cache *nameCache) lookup(stat string) []byte {
+	e := (*cache.entries.Load())[stat]
+	if e == nil {
+		return nil
+	}
+
+	// avoid writes to the shared cache line if entry is already marked
+	if atomic.LoadUint32(&e.used) == 0 {
+		atomic.StoreUint32(&e.used, 1)
+	}
+
+	return e.name
+}
+
+// store adds formatted name to the cache evicting least recently used entry if cache is full
+func (cache *nameCache) store(stat string, name []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	old := *cache.entries.Load()
+	if _, exists := old[stat]; exists {
+		return
+	}
+
+	e := &nameEntry{stat: stat, name: append([]byte(nil), name...)}
+
+	entries := make(map[string]*nameEntry, len(old)+1)
+	for k, v := range old {
+		entries[k] = v
+	}
+
+	if len(cache.clock) < cache.max {
+		cache.clock = append(cache.clock, e)
+	} else {
+		for atomic.LoadUint32(&cache.clock[cache.hand].used) != 0 {
+			atomic.StoreUint32(&cache.clock[cache.hand].used, 0)
+			cache.hand = (cache.hand + 1) % len(cache.clock)
+		}
+
+		delete(entries, cache.clock[cache.hand].stat)
+		cache.clock[cache.hand] = e
+		cache.hand = (cache.hand + 1) % len(cache.clock)
+	}
+
+	entries[stat] = e
+	cache.entries.Store(&entries)
+}
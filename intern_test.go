@@ -0,0 +1,154 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInternNames(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	emit := func(client *Client) string {
+		for i := 0; i < 3; i++ {
+			client.Incr("requests", 1)
+			client.Gauge("queue depth", int64(i))
+			client.Timing("latency", 10, StringTag("route", "/"))
+			client.CloneWithPrefix("other.").Incr("requests", 2)
+			client.Incr("requests\nbroken", 1)
+		}
+
+		client.Flush()
+
+		select {
+		case buf := <-received:
+			return string(buf)
+		case <-time.After(time.Second):
+			t.Fatal("metrics weren't delivered")
+		}
+
+		return ""
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Plain", nil},
+		{"Normalize", []Option{NormalizeNames('_')}},
+		{"Mapper", []Option{NameMapper(strings.ToUpper)}},
+	} {
+		for _, max := range []int{1, 2, 100} {
+			t.Run(fmt.Sprintf("%s/max=%d", tt.name, max), func(t *testing.T) {
+				opts := append([]Option{MetricPrefix("app."), TagStyle(TagFormatDatadog), FlushInterval(time.Hour)}, tt.opts...)
+
+				plain := NewClient(inSocket.LocalAddr().String(), opts...)
+				defer plain.Close() //nolint:errcheck
+
+				cached := NewClient(inSocket.LocalAddr().String(), append(opts, InternNames(max))...)
+				defer cached.Close() //nolint:errcheck
+
+				if expected, actual := emit(plain), emit(cached); actual != expected {
+					t.Errorf("unexpected output: %q != %q", actual, expected)
+				}
+
+				// names which are not rewritten bypass the cache
+				if cachedNames := len(*cached.names.entries.Load()); (cachedNames == 0) != (tt.name == "Plain") {
+					t.Errorf("unexpected number of cached names: %d", cachedNames)
+				}
+			})
+		}
+	}
+}
+
+func TestNameCacheEviction(t *testing.T) {
+	cache := newNameCache(3)
+
+	for _, stat := range []string{"a", "b", "c"} {
+		cache.store(stat, []byte("p."+stat))
+	}
+
+	// "a" and "c" are used, so "b" is evicted
+	cache.lookup("a")
+	cache.lookup("c")
+	cache.store("d", []byte("p.d"))
+
+	for stat, expected := range map[string]string{"a": "p.a", "b": "", "c": "p.c", "d": "p.d"} {
+		if name := string(cache.lookup(stat)); name != expected {
+			t.Errorf("unexpected name for %q: %q != %q", stat, name, expected)
+		}
+	}
+
+	// all entries are used now, eviction clears marks and evicts the entry after "b"
+	cache.store("e", []byte("p.e"))
+
+	if len(*cache.entries.Load()) != 3 {
+		t.Errorf("cache exceeds the limit: %d", len(*cache.entries.Load()))
+	}
+
+	if cache.lookup("e") == nil || cache.lookup("c") != nil {
+		t.Errorf("unexpected eviction: %v", *cache.entries.Load())
+	}
+
+	// cached name is not aliased with the buffer it was formatted in
+	buf := []byte("p.f")
+	cache.store("f", buf)
+	buf[0] = 'x'
+
+	if name := string(cache.lookup("f")); name != "p.f" {
+		t.Errorf("cached name is aliased: %q", name)
+	}
+}
+
+func BenchmarkInternNames(b *testing.B) {
+	names := []string{"http.requests", "http.latency", "db.queries", "db.errors", "cache.hits"}
+
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Plain", nil},
+		{"Normalize", []Option{NormalizeNames('_')}},
+	} {
+		for _, max := range []int{0, 20} {
+			b.Run(fmt.Sprintf("%s/intern=%d", bc.name, max), func(b *testing.B) {
+				c := NewClient("127.0.0.1:8125", append([]Option{MetricPrefix("service.frontend."), InternNames(max)}, bc.opts...)...)
+				defer c.Close() //nolint:errcheck
+
+				buf := make([]byte, 0, 128)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					buf = c.appendName(buf[:0], names[i%len(names)])
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestAppendInt(t *testing.T) {
+	values := []int64{math.MinInt64, math.MinInt64 + 1, -1000, -256, -255, -11, -10, math.MaxInt64, math.MaxInt64 - 1}
+	for v := int64(-300); v <= 300; v++ {
+		values = append(values, v)
+	}
+
+	for _, v := range values {
+		if actual, expected := string(appendInt([]byte("x:"), v)), "x:"+strconv.FormatInt(v, 10); actual != expected {
+			t.Errorf("unexpected formatting: %q != %q", actual, expected)
+		}
+	}
+}
+
+func BenchmarkAppendInt(b *testing.B) {
+	buf := make([]byte, 0, 32)
+
+	for _, bc := range []struct {
+		name  string
+		value int64
+	}{
+		{"One", 1},
+		{"Small", 153},
+		{"Negative", -3},
+		{"Large", 1234567},
+	} {
+		b.Run(bc.name+"/strconv", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				buf = strconv.AppendInt(buf[:0], bc.value, 10)
+			}
+		})
+
+		b.Run(bc.name+"/appendInt", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				buf = appendInt(buf[:0], bc.value)
+			}
+		})
+	}
+}
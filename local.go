@@ -0,0 +1,244 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Local is a handle to the buffer owned by a single goroutine
+//
+// Metrics sent via Local are appended to its own buffer, so goroutines
+// emitting metrics don't contend with each other. Local buffer is handed
+// to the send queue when it's full, on periodic flush, on Flush and on Release.
+//
+// Local is not safe for concurrent use: create a handle per goroutine
+// (e.g. per request) and call Release when goroutine is done with it.
+//
+// Gauges are sent via the shared buffer of the client, so that values
+// of the same gauge reported from different goroutines are delivered in order.
+type Local struct {
+	c *Client
+}
+
+// Local creates new handle with the buffer owned by the calling goroutine
+//
+// Handle inherits metric prefix and tags of the client. Local should be
+// released with Release, if handle is garbage collected without being released,
+// its metrics are flushed by the finalizer.
+func (c *Client) Local() *Local {
+	clone := c.clone()
+	clone.limiter = c.limiter
+	// prefix of the handle is the same, so handles created per request share the name cache
+	clone.names = c.names
+
+	if atomic.LoadInt32(&c.detached) != 0 {
+		clone.detached = 1
+	}
+
+	// buffer size might be changed by SetMaxPacketSize, which holds the lock
+	c.trans.localsLock.Lock()
+	s := c.trans.localPool.Get().(*bufShard) //nolint:errcheck,forcetypeassert
+	c.trans.locals[s] = struct{}{}
+	c.trans.localsLock.Unlock()
+
+	clone.local = s
+
+	l := &Local{c: clone}
+	runtime.SetFinalizer(l, (*Local).release)
+
+	return l
+}
+
+// acquireBuf locks the local buffer if client is bound to a Local handle,
+// otherwise shared buffer (or emitter buffer in Unlocked mode) is returned
+//
+// Metrics of the high priority lane are always formatted into the scratch buffer.
+func (c *Client) acquireBuf() *bufShard {
+	if c.high {
+		return c.trans.acquireHigh()
+	}
+
+	if c.local != nil {
+		c.local.bufLock.Lock()
+		return c.local
+	}
+
+	if c.unlocked {
+		return c.trans.acquireUnlocked()
+	}
+
+	return c.trans.acquireBuf()
+}
+
+// acquireBufFor returns buffer for the metric which should go through the shard picked by name
+func (c *Client) acquireBufFor(stat string) *bufShard {
+	if c.high {
+		return c.trans.acquireHigh()
+	}
+
+	if c.unlocked {
+		return c.trans.acquireUnlocked()
+	}
+
+	return c.trans.acquireBufFor(stat)
+}
+
+// commit finishes appending metric to the buffer returned by acquireBuf
+func (c *Client) commit(s *bufShard, lastLen int) {
+	if c.high {
+		c.trans.commitChunk(s)
+		return
+	}
+
+	if s == c.local {
+		c.trans.checkBuf(s, lastLen)
+		s.bufLock.Unlock()
+
+		return
+	}
+
+	if c.unlocked {
+		c.trans.commitUnlocked(lastLen)
+		return
+	}
+
+	c.trans.commit(s, lastLen)
+}
+
+// Release moves buffered metrics to the shared buffer of the client and
+// returns the buffer to the client
+//
+// Metrics sent via released handle go to the shared buffer of the client.
+func (l *Local) Release() {
+	runtime.SetFinalizer(l, nil)
+	l.release()
+}
+
+func (l *Local) release() {
+	s := l.c.local
+	if s == nil {
+		return
+	}
+
+	l.c.local = nil
+
+	t := l.c.trans
+
+	// once buffer is unregistered, it's not flushed concurrently
+	t.localsLock.Lock()
+	delete(t.locals, s)
+	t.localsLock.Unlock()
+
+	if len(s.buf) > 0 {
+		// leftovers are moved to the shared buffer, so that short-lived handles don't produce small packets
+		shared := t.acquireBuf()
+		lastLen := len(shared.buf)
+		shared.buf = append(shared.buf, s.buf...)
+		t.commit(shared, lastLen)
+
+		s.buf = s.buf[:0]
+	}
+
+	s.bufLines = 0
+	t.localPool.Put(s)
+}
+
+// Flush hands buffered metrics to the send queue
+func (l *Local) Flush() {
+	s := l.c.local
+	if s == nil {
+		return
+	}
+
+	s.bufLock.Lock()
+
+	if len(s.buf) > 0 {
+		l.c.trans.flushBuf(s, len(s.buf))
+	}
+
+	s.bufLock.Unlock()
+}
+
+// Incr increments a counter metric, see Client.Incr
+func (l *Local) Incr(stat string, count int64, tags ...Tag) {
+	l.c.Incr(stat, count, tags...)
+}
+
+// Decr decrements a counter metric, see Client.Decr
+func (l *Local) Decr(stat string, count int64, tags ...Tag) {
+	l.c.Decr(stat, count, tags...)
+}
+
+// FIncr increments a float counter metric, see Client.FIncr
+func (l *Local) FIncr(stat string, count float64, tags ...Tag) {
+	l.c.FIncr(stat, count, tags...)
+}
+
+// FDecr decrements a float counter metric, see Client.FDecr
+func (l *Local) FDecr(stat string, count float64, tags ...Tag) {
+	l.c.FDecr(stat, count, tags...)
+}
+
+// Timing tracks a duration event, see Client.Timing
+func (l *Local) Timing(stat string, delta int64, tags ...Tag) {
+	l.c.Timing(stat, delta, tags...)
+}
+
+// PrecisionTiming tracks a duration event, see Client.PrecisionTiming
+func (l *Local) PrecisionTiming(stat string, delta time.Duration, tags ...Tag) {
+	l.c.PrecisionTiming(stat, delta, tags...)
+}
+
+// Gauge sets or updates constant value for the interval, see Client.Gauge
+func (l *Local) Gauge(stat string, value int64, tags ...Tag) {
+	l.c.Gauge(stat, value, tags...)
+}
+
+// GaugeDelta sends a change for a gauge, see Client.GaugeDelta
+func (l *Local) GaugeDelta(stat string, value int64, tags ...Tag) {
+	l.c.GaugeDelta(stat, value, tags...)
+}
+
+// FGauge sends a floating point value for a gauge, see Client.FGauge
+func (l *Local) FGauge(stat string, value float64, tags ...Tag) {
+	l.c.FGauge(stat, value, tags...)
+}
+
+// FGaugeDelta sends a floating point change for a gauge, see Client.FGaugeDelta
+func (l *Local) FGaugeDelta(stat string, value float64, tags ...Tag) {
+	l.c.FGaugeDelta(stat, value, tags...)
+}
+
+// BoolGauge sets gauge to 1 or 0, see Client.BoolGauge
+func (l *Local) BoolGauge(stat string, value bool, tags ...Tag) {
+	l.c.BoolGauge(stat, value, tags...)
+}
+
+// SetAdd adds unique element to a set, see Client.SetAdd
+func (l *Local) SetAdd(stat string, value string, tags ...Tag) {
+	l.c.SetAdd(stat, value, tags...)
+}
@@ -25,10 +25,15 @@ SOFTWARE.
 */
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"log/slog"
 	"net"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 // flushLoop makes sure metrics are flushed every flushInterval
@@ -44,38 +49,117 @@ func (t *transport) flushLoop(flushInterval time.Duration) {
 	for {
 		select {
 		case <-t.shutdown:
-			t.bufLock.Lock()
-			if len(t.buf) > 0 {
-				t.flushBuf(len(t.buf))
+			// report the last window before the final flush
+			t.runReporters()
+			t.flushGauges()
+
+			if t.pipeline != nil {
+				// pack metrics which are still in the pipeline
+				t.stopPipeline(true)
+			}
+
+			t.lockShards()
+			for _, s := range t.shards {
+				if len(s.buf) > 0 {
+					t.flushBuf(s, len(s.buf))
+				}
 			}
-			t.bufLock.Unlock()
 
+			for s := range t.locals {
+				if len(s.buf) > 0 {
+					t.flushBuf(s, len(s.buf))
+				}
+			}
+
+			// emitter should be stopped before Close in Unlocked mode
+			if t.unlocked != nil && len(t.unlocked.shard.buf) > 0 {
+				t.flushBuf(&t.unlocked.shard, len(t.unlocked.shard.buf))
+			}
+
+			t.submitBatch()
+
+			t.retainLock.Lock()
+			retained := t.retained
+			t.retained = nil
+			t.retainLock.Unlock()
+
+			// metrics which are still being emitted concurrently are dropped in checkBuf
+			t.queueClosed = true
+			t.unlockShards()
+
+			// send loops keep draining the queue until it's closed, so wait for space for retained packets
+			// without holding shard locks
+			for _, p := range retained {
+				t.enqueueRetained(p)
+			}
+
+			// high priority queue is closed first, so that it's drained once send queue is closed
+			if t.highQueue != nil {
+				close(t.highQueue)
+			}
 			close(t.sendQueue)
+			if t.batchQueue != nil {
+				close(t.batchQueue)
+			}
+
 			return
 		case <-flushC:
-			t.bufLock.Lock()
-			if len(t.buf) > 0 {
-				t.flushBuf(len(t.buf))
+			t.runReporters()
+
+			if t.unlocked != nil {
+				t.requestUnlockedFlush()
 			}
-			t.bufLock.Unlock()
+
+			t.flush(true)
 		}
 	}
 }
 
+// enqueueRetained sends retained packet to the queue on shutdown, packet is
+// abandoned if there's no space in the queue once CloseTimeout expires
+func (t *transport) enqueueRetained(p queuedPacket) {
+	select {
+	case t.sendQueue <- p:
+		return
+	default:
+	}
+
+	select {
+	case t.sendQueue <- p:
+	case <-t.closeExpired:
+		t.abandonPacket(p.buf)
+	}
+}
+
 // sendLoop handles packet delivery over UDP and periodic reconnects
-func (t *transport) sendLoop(addr string, network string, reconnectInterval, retryTimeout time.Duration, log SomeLogger) {
+//
+// When there are several send loops, their reconnects are staggered evenly over the reconnectInterval,
+// loop index is used to calculate the offset.
+//
+// Send loops started by the scaling supervisor are retired by closing stop channel,
+// stop is nil for the other send loops.
+func (t *transport) sendLoop(index int, addr string, network string, reconnectInterval, retryTimeout time.Duration, log SomeLogger,
+	stop <-chan struct{}) {
 	var (
-		sock       net.Conn
-		err        error
-		reconnectC <-chan time.Time
+		sock           net.Conn
+		err            error
+		reconnectTimer *time.Timer
+		reconnectC     <-chan time.Time
+
+		// set to nil once closed
+		queue   = t.sendQueue
+		batches = t.batchQueue
+		high    = t.highQueue
 	)
 
 	defer t.shutdownWg.Done()
 
 	if reconnectInterval > 0 {
-		reconnectTicker := time.NewTicker(reconnectInterval)
-		defer reconnectTicker.Stop()
-		reconnectC = reconnectTicker.C
+		offset := reconnectInterval * time.Duration(index) / time.Duration(t.sendLoopCount)
+
+		reconnectTimer = time.NewTimer(reconnectInterval + offset)
+		defer reconnectTimer.Stop()
+		reconnectC = reconnectTimer.C
 	}
 
 RECONNECT:
@@ -87,65 +171,374 @@ RECONNECT:
 
 		go func() {
 			select {
-			case <-t.shutdown:
+			case <-t.closeExpired:
 				ctxCancel()
 			case <-ctx.Done():
 			}
 		}()
 
-		var d net.Dialer
-		return d.DialContext(ctx, network, addr)
+		return t.dial(ctx, network, addr)
 	}()
 
 	if err != nil {
-		log.Printf("[STATSD] Error connecting to server: %s", err)
+		atomic.AddInt64(&t.dialFailuresPeriod, 1)
+		atomic.AddInt64(&t.dialFailuresOverall, 1)
+		if t.shouldLogError() {
+			if t.slogger != nil {
+				t.slogger.LogAttrs(context.Background(), slog.LevelError, "error connecting to statsd server",
+					slog.String("addr", addr), slog.Any("error", err))
+			} else {
+				log.Printf("[STATSD] Error connecting to server: %s", err)
+			}
+		}
+		t.healthDialFailed(err)
+		t.deliveryFailed(log)
 		goto WAIT
 	}
 
+	atomic.AddInt64(&t.connectsOverall, 1)
+	t.connected(log)
+	t.healthConnected()
+
+	if network := socketNetwork(sock); network != "" {
+		t.checkPacketSize(network, log)
+	}
+
 	for {
+		// high priority packets are sent before anything else
+		if err = t.sendHigh(sock, &high, addr, log); err != nil {
+			goto WAIT
+		}
+
 		select {
-		case buf, ok := <-t.sendQueue:
+		case p, ok := <-high:
+			if !ok {
+				high = nil
+				continue
+			}
+
+			if err = t.sendQueued(sock, p, addr, log); err != nil {
+				goto WAIT
+			}
+		case p, ok := <-queue:
 			// Get a buffer from the queue
 			if !ok {
-				_ = sock.Close() // nolint: gosec
-				return
+				queue = nil
+				if batches == nil {
+					if err = t.sendHigh(sock, &high, addr, log); err != nil {
+						goto WAIT
+					}
+
+					t.healthDisconnected()
+					_ = sock.Close() // nolint: gosec
+					return
+				}
+
+				continue
 			}
 
-			if len(buf) > 0 {
-				// cut off \n in the end
-				_, err := sock.Write(buf[0 : len(buf)-1])
-				if err != nil {
-					log.Printf("[STATSD] Error writing to socket: %s", err)
+			if err = t.sendQueued(sock, p, addr, log); err != nil {
+				goto WAIT
+			}
+		case packet := <-t.syncQueue:
+			if err = t.sendPacket(sock, packet.buf, addr, log, packet.done); err != nil {
+				goto WAIT
+			}
+		case batch, ok := <-batches:
+			if !ok {
+				batches = nil
+				if queue == nil {
+					if err = t.sendHigh(sock, &high, addr, log); err != nil {
+						goto WAIT
+					}
+
+					t.healthDisconnected()
 					_ = sock.Close() // nolint: gosec
-					goto WAIT
+					return
 				}
+
+				continue
 			}
 
-			// return buffer to the pool
-			select {
-			case t.bufPool <- buf:
-			default:
-				// pool is full, let GC handle the buf
+			if t.stale(batch.enqueued) {
+				for _, buf := range batch.packets {
+					t.packetStale(buf)
+				}
+
+				t.releaseBatch(batch)
+				continue
 			}
+
+			for i, buf := range batch.packets {
+				if err = t.sendPacket(sock, buf, addr, log, nil); err != nil {
+					// connection is broken, rest of the batch is lost
+					for _, rest := range batch.packets[i+1:] {
+						t.packetLost(rest, DropReasonWriteError)
+						t.releaseBuf(rest)
+					}
+
+					t.releaseBatch(batch)
+					goto WAIT
+				}
+			}
+
+			t.releaseBatch(batch)
+		case <-stop:
+			t.healthDisconnected()
+			_ = sock.Close() // nolint: gosec
+			return
 		case <-reconnectC:
+			reconnectTimer.Reset(reconnectInterval)
+			t.healthDisconnected()
 			_ = sock.Close() // nolint: gosec
 			goto RECONNECT
 		}
 	}
 
 WAIT:
-	// Wait for a while
-	select {
-	case <-time.After(retryTimeout):
-		goto RECONNECT
-	case <-t.shutdown:
+	// Wait for a while, but return promptly on shutdown (once CloseTimeout expires)
+	retryTimer := time.NewTimer(t.retryInterval(retryTimeout))
+
+WAITING:
+	for {
+		select {
+		case <-retryTimer.C:
+			goto RECONNECT
+		case <-stop:
+			retryTimer.Stop()
+			return
+		case <-t.closeExpired:
+			retryTimer.Stop()
+			break WAITING
+		case packet := <-t.syncQueue:
+			// synchronous flush shouldn't wait for the reconnect
+			t.rejectSync(packet, err)
+		}
 	}
 
-	// drain send queue waiting for flush loops to terminate
-	for range t.sendQueue { //nolint:revive
+	// drain send queue waiting for flush loops to terminate, packets
+	// can't be delivered as there's no connection
+	for queue != nil || batches != nil || high != nil {
+		select {
+		case p, ok := <-queue:
+			if !ok {
+				queue = nil
+				continue
+			}
+
+			t.abandonPacket(p.buf)
+		case p, ok := <-high:
+			if !ok {
+				high = nil
+				continue
+			}
+
+			t.abandonPacket(p.buf)
+		case batch, ok := <-batches:
+			if !ok {
+				batches = nil
+				continue
+			}
+
+			for _, buf := range batch.packets {
+				t.abandonPacket(buf)
+			}
+
+			t.releaseBatch(batch)
+		case packet := <-t.syncQueue:
+			t.rejectSync(packet, err)
+		}
 	}
 }
 
+// sendPacket writes packet to the socket
+//
+// It returns error if connection is broken and should be re-established.
+// If done is not nil (SynchronousMode), write result is sent to it.
+func (t *transport) sendPacket(sock net.Conn, buf []byte, addr string, log SomeLogger, done chan<- error) error {
+	if len(buf) > 0 {
+		t.teePacket(buf)
+		t.dumpPacket(buf)
+
+		// cut off \n in the end
+		n, err := t.write(sock, buf[0:len(buf)-1])
+		if n > 0 {
+			// stream sockets might write part of the packet before failing
+			atomic.AddInt64(&t.sentBytesPeriod, int64(n))
+			atomic.AddInt64(&t.sentBytesOverall, int64(n))
+		}
+
+		if err != nil && isTransientWriteError(err) {
+			// socket is fine, packet is lost
+			t.healthWriteFailed(err)
+			t.packetDone()
+			atomic.AddInt64(&t.writeErrorsPeriod, 1)
+			atomic.AddInt64(&t.writeErrorsOverall, 1)
+			t.packetDropped(buf, DropReasonWriteError)
+			t.releaseBuf(buf)
+			complete(done, err)
+
+			return nil
+		}
+
+		if err != nil {
+			t.packetDone()
+			atomic.AddInt64(&t.writeErrorsPeriod, 1)
+			atomic.AddInt64(&t.writeErrorsOverall, 1)
+			t.packetDropped(buf, DropReasonWriteError)
+			if t.shouldLogError() {
+				if t.slogger != nil {
+					t.slogger.LogAttrs(context.Background(), slog.LevelError, "error writing to statsd socket",
+						slog.String("addr", addr), slog.Any("error", err))
+				} else {
+					log.Printf("[STATSD] Error writing to socket: %s", err)
+				}
+			}
+			t.healthWriteFailed(err)
+			t.deliveryFailed(log)
+			t.healthDisconnected()
+			_ = sock.Close() // nolint: gosec
+			t.releaseBuf(buf)
+			complete(done, err)
+
+			return err
+		}
+
+		t.packetDelivered()
+		t.healthWriteSucceeded()
+		atomic.AddInt64(&t.sentPacketsPeriod, 1)
+		atomic.AddInt64(&t.sentPacketsOverall, 1)
+	}
+
+	t.packetDone()
+
+	t.releaseBuf(buf)
+	complete(done, nil)
+
+	return nil
+}
+
+// abandonPacket drops packet which can't be delivered on shutdown
+func (t *transport) abandonPacket(buf []byte) {
+	if len(buf) > 0 {
+		atomic.AddInt64(&t.abandonedPackets, 1)
+		atomic.AddInt64(&t.abandonedMetrics, int64(bytes.Count(buf, newline)))
+		t.packetLost(buf, DropReasonClosed)
+	} else {
+		t.packetDone()
+	}
+
+	t.releaseBuf(buf)
+}
+
+// write sends packet to the socket retrying failed writes up to writeRetries times
+//
+// It returns number of bytes written over all the attempts.
+func (t *transport) write(sock net.Conn, packet []byte) (written int, err error) {
+	for attempt := 0; ; attempt++ {
+		var n int
+
+		n, err = sock.Write(packet)
+		written += n
+
+		if err == nil || attempt >= t.writeRetries {
+			return written, err
+		}
+
+		select {
+		case <-time.After(t.writeRetryBackoff):
+		case <-t.closeExpired:
+			return written, err
+		}
+	}
+}
+
+// shouldLogError returns true if connection or write error should be logged
+//
+// Errors are logged at most once per ReportInterval, all of them are
+// summarized in the periodic report.
+func (t *transport) shouldLogError() bool {
+	if t.errorLogInterval <= 0 {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&t.lastErrorLog)
+
+	if last != 0 && now-last < int64(t.errorLogInterval) {
+		return false
+	}
+
+	return atomic.CompareAndSwapInt64(&t.lastErrorLog, last, now)
+}
+
+// teePacket mirrors packet (with trailing newline) to the TeeWriter
+func (t *transport) teePacket(buf []byte) {
+	if t.tee == nil {
+		return
+	}
+
+	t.teeLock.Lock()
+	_, _ = t.tee.Write(buf)
+	_, _ = t.tee.Write(newline)
+	t.teeLock.Unlock()
+}
+
+// dumpPacket writes packet (with trailing newline) to the DebugDump writer framed with the header line
+//
+// Control characters and invalid UTF-8 are escaped, so that dump is safe to be
+// written to the terminal.
+func (t *transport) dumpPacket(buf []byte) {
+	if t.dump == nil {
+		return
+	}
+
+	t.dumpLock.Lock()
+	defer t.dumpLock.Unlock()
+
+	out := append(t.dumpBuf[:0], "# "...)
+	out = time.Now().AppendFormat(out, "2006-01-02T15:04:05.000000Z07:00")
+	out = append(out, " bytes="...)
+	out = appendInt(out, int64(len(buf)-1))
+	out = append(out, " lines="...)
+	out = appendInt(out, int64(bytes.Count(buf, newline)))
+	out = append(out, '\n')
+
+	for i := 0; i < len(buf); {
+		r, size := utf8.DecodeRune(buf[i:])
+
+		switch {
+		case r == '\n':
+			out = append(out, '\n')
+		case r == utf8.RuneError && size == 1, r < 0x20, r >= 0x7f && r < 0xa0:
+			for _, b := range buf[i : i+size] {
+				out = append(out, '\\', 'x', hexDigits[b>>4], hexDigits[b&0xf])
+			}
+		default:
+			out = append(out, buf[i:i+size]...)
+		}
+
+		i += size
+	}
+
+	out = append(out, '\n')
+	t.dumpBuf = out
+
+	_, _ = t.dump.Write(out)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// isTransientWriteError returns true if write failed due to temporary lack of resources,
+// so there's no need to reconnect
+func isTransientWriteError(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS)
+}
+
+// queuePressureIntervals is number of consecutive report intervals with send queue
+// close to its capacity after which hint is logged
+const queuePressureIntervals = 3
+
 // reportLoop reports periodically number of packets lost
 func (t *transport) reportLoop(reportInterval time.Duration, log SomeLogger) {
 	defer t.shutdownWg.Done()
@@ -153,14 +546,112 @@ func (t *transport) reportLoop(reportInterval time.Duration, log SomeLogger) {
 	reportTicker := time.NewTicker(reportInterval)
 	defer reportTicker.Stop()
 
+	// number of consecutive report intervals send queue was close to its capacity
+	queuePressure := 0
+
 	for {
 		select {
 		case <-t.shutdown:
 			return
 		case <-reportTicker.C:
 			lostPeriod := atomic.SwapInt64(&t.lostPacketsPeriod, 0)
+			lostMetrics := atomic.SwapInt64(&t.lostMetricsPeriod, 0)
+			lostBytes := atomic.SwapInt64(&t.lostBytesPeriod, 0)
+			writeErrors := atomic.SwapInt64(&t.writeErrorsPeriod, 0)
+			dialFailures := atomic.SwapInt64(&t.dialFailuresPeriod, 0)
+			poolMisses := atomic.SwapInt64(&t.poolMissesPeriod, 0)
+
+			if t.reportHandler != nil {
+				t.reportHandler(Report{
+					Interval:        reportInterval,
+					LostOverflow:    lostPeriod,
+					LostMetrics:     lostMetrics,
+					LostBytes:       lostBytes,
+					LostWriteErrors: writeErrors,
+					DialFailures:    dialFailures,
+					PacketsSent:     atomic.SwapInt64(&t.sentPacketsPeriod, 0),
+					BytesSent:       atomic.SwapInt64(&t.sentBytesPeriod, 0),
+					SendQueueLength: len(t.sendQueue),
+					BufPoolLength:   len(t.bufPool),
+					BufPoolMisses:   poolMisses,
+				})
+			}
+
 			if lostPeriod > 0 {
-				log.Printf("[STATSD] %d packets lost (overflow)", lostPeriod)
+				if t.slogger != nil {
+					t.slogger.LogAttrs(context.Background(), slog.LevelWarn, "statsd packets lost (overflow)",
+						slog.Int64("lost", lostPeriod), slog.Int64("lost_metrics", lostMetrics), slog.Int64("lost_bytes", lostBytes))
+				} else {
+					log.Printf("[STATSD] %d packets lost (overflow), %d metrics, %d bytes", lostPeriod, lostMetrics, lostBytes)
+				}
+			}
+
+			if writeErrors > 0 || dialFailures > 0 {
+				if t.slogger != nil {
+					t.slogger.LogAttrs(context.Background(), slog.LevelWarn, "statsd packets lost (write errors)",
+						slog.Int64("lost", writeErrors), slog.Int64("dial_failures", dialFailures))
+				} else {
+					log.Printf("[STATSD] %d packets lost (write errors), %d connection failures", writeErrors, dialFailures)
+				}
+			}
+
+			rateLimitedPeriod := atomic.SwapInt64(&t.rateLimitedPeriod, 0)
+			if rateLimitedPeriod > 0 {
+				if t.slogger != nil {
+					t.slogger.LogAttrs(context.Background(), slog.LevelWarn, "statsd metrics dropped (rate limit)",
+						slog.Int64("dropped", rateLimitedPeriod))
+				} else {
+					log.Printf("[STATSD] %d metrics dropped (rate limit)", rateLimitedPeriod)
+				}
+			}
+
+			oversizedPeriod := atomic.SwapInt64(&t.oversizedPeriod, 0)
+			if oversizedPeriod > 0 {
+				if t.slogger != nil {
+					t.slogger.LogAttrs(context.Background(), slog.LevelWarn, "statsd metrics dropped (larger than MaxPacketSize)",
+						slog.Int64("dropped", oversizedPeriod))
+				} else {
+					log.Printf("[STATSD] %d metrics dropped (larger than MaxPacketSize)", oversizedPeriod)
+				}
+			}
+
+			if hookPanics := atomic.SwapInt64(&t.flushHookPanics, 0); hookPanics > 0 {
+				if t.slogger != nil {
+					t.slogger.LogAttrs(context.Background(), slog.LevelError, "statsd OnFlush callback panicked",
+						slog.Int64("panics", hookPanics))
+				} else {
+					log.Printf("[STATSD] OnFlush callback panicked %d times", hookPanics)
+				}
+			}
+
+			if poolMisses > 0 && t.bufPoolMax > t.bufPoolMin {
+				if t.slogger != nil {
+					t.slogger.LogAttrs(context.Background(), slog.LevelInfo, "statsd buffer pool misses",
+						slog.Int64("misses", poolMisses), slog.Int64("pool_capacity", atomic.LoadInt64(&t.bufPoolCapacity)),
+						slog.Int64("queue_high_water", atomic.LoadInt64(&t.queueHighWaterPeriod)))
+				} else {
+					log.Printf("[STATSD] %d buffer pool misses, pool capacity %d, send queue high water %d",
+						poolMisses, atomic.LoadInt64(&t.bufPoolCapacity), atomic.LoadInt64(&t.queueHighWaterPeriod))
+				}
+			}
+
+			highWater := atomic.SwapInt64(&t.queueHighWaterPeriod, 0)
+			if capacity := int64(cap(t.sendQueue)); capacity > 0 && highWater*10 >= capacity*9 {
+				queuePressure++
+			} else {
+				queuePressure = 0
+			}
+
+			if queuePressure == queuePressureIntervals {
+				queuePressure = 0
+
+				if t.slogger != nil {
+					t.slogger.LogAttrs(context.Background(), slog.LevelWarn, "statsd send queue is close to its capacity, consider increasing SendLoopCount",
+						slog.Int("send_loops", int(atomic.LoadInt32(&t.sendLoopsActive))), slog.Int("queue_capacity", cap(t.sendQueue)))
+				} else {
+					log.Printf("[STATSD] Send queue is close to its capacity, consider increasing SendLoopCount (now %d)",
+						atomic.LoadInt32(&t.sendLoopsActive))
+				}
 			}
 		}
 	}
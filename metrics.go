@@ -0,0 +1,433 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MetricType is statsd metric type, values match statsd protocol suffixes
+type MetricType string
+
+// Metric types for SendMetrics
+const (
+	MetricCounter MetricType = "c"
+	MetricTiming  MetricType = "ms"
+	MetricGauge   MetricType = "g"
+	MetricSet     MetricType = "s"
+)
+
+// Metric is a single metric sent with SendMetrics
+//
+// Fields match the metric parsed by statsdparse package.
+type Metric struct {
+	Name string
+	Type MetricType
+	// Value is counter increment, timing in milliseconds or gauge value
+	Value float64
+	// Delta is set for gauge changes (GaugeDelta), otherwise gauge is set to the value
+	Delta bool
+	// SetValue is the element added to the set
+	SetValue string
+	// Tags might include call options, e.g. WithRate
+	Tags []Tag
+	// Timestamp is optional, it overrides WithTimestamp in tags, see SendMetricsAt
+	Timestamp time.Time
+}
+
+// ErrTimestampsNotSupported is returned by SendMetricsAt if tag format can't carry metric timestamps
+var ErrTimestampsNotSupported = errors.New("statsd: metric timestamps are not supported by the tag format")
+
+// RejectedMetricsError is returned by SendMetrics if some of the metrics were rejected
+type RejectedMetricsError struct {
+	// Rejected is number of metrics which were invalid or didn't fit into the packet
+	Rejected int
+}
+
+func (e *RejectedMetricsError) Error() string {
+	return fmt.Sprintf("statsd: %d metrics rejected", e.Rejected)
+}
+
+// SendMetrics sends batch of metrics, e.g. converted from another monitoring system
+//
+// Whole batch is appended to the buffer under a single lock, metrics are
+// packed into packets the same way as with per-metric calls. Metrics are
+// sampled, filtered and rate limited the same way as well, such metrics are
+// not reported as rejected.
+//
+// Metrics of unknown type, with NaN or infinite values, newlines in the name or
+// delimiters in the set value (with NewlineDrop policy) are rejected and counted as invalid
+// (see GetInvalidMetrics), metrics which don't fit into the packet are rejected and
+// counted as oversized (see GetOversizedMetrics). If any metric is rejected,
+// *RejectedMetricsError with the number of rejected metrics is returned.
+//
+// Metric timestamps are sent only in the formats which support them (Datadog),
+// see SendMetricsAt for the backfill of the historical values.
+//
+// In Unlocked and pipeline modes (and with Route) metrics are sent one by one, as well as
+// gauges with Local handle, gauge state tracking or multiple shards (to keep
+// the order of gauge values), oversized metrics are not reported as rejected then.
+func (c *Client) SendMetrics(metrics []Metric) error {
+	return c.sendMetrics(metrics, 0)
+}
+
+// SendMetricsAt sends batch of metrics recorded at the given time, e.g. to backfill historical values
+//
+// Metric timestamp overrides ts, zero ts means that metrics without timestamp are
+// recorded at the current time. Metrics are encoded according to the tag format:
+//
+//   - with TagFormatDatadog timestamp is sent as DogStatsD |T field, metrics are sent as with SendMetrics;
+//   - with TagFormatGraphite metrics are sent with Graphite plaintext protocol
+//     (path value timestamp), as statsd protocol can't carry timestamps, so the client
+//     should send metrics directly to carbon (e.g. UDP plaintext listener). Counters,
+//     timings and gauges are sent as is (sample rates are ignored), sets and gauge deltas
+//     can't be represented, so they're rejected as invalid.
+//
+// For other formats ErrTimestampsNotSupported is returned and nothing is sent.
+// Metrics are appended to the buffer in the order of the batch.
+func (c *Client) SendMetricsAt(metrics []Metric, ts time.Time) error {
+	var timestamp int64
+	if !ts.IsZero() {
+		timestamp = ts.Unix()
+	}
+
+	switch {
+	case supportsTimestamps(c.trans.tagFormat):
+		return c.sendMetrics(metrics, timestamp)
+	case c.trans.tagFormat.sanitize == sanitizeGraphite:
+		if timestamp == 0 {
+			timestamp = time.Now().Unix()
+		}
+
+		return c.sendPlaintextMetrics(metrics, timestamp)
+	default:
+		return ErrTimestampsNotSupported
+	}
+}
+
+// sendMetrics sends metrics, timestamp is used for metrics without timestamp if non-zero
+func (c *Client) sendMetrics(metrics []Metric, timestamp int64) error {
+	var rejected int
+
+	if c.sendsOneByOne() {
+		for i := range metrics {
+			if !c.sendMetric(&metrics[i], timestamp) {
+				rejected++
+			}
+		}
+	} else {
+		rejected = c.appendMetrics(metrics, timestamp)
+	}
+
+	return rejectedError(rejected)
+}
+
+// sendsOneByOne returns true if metrics can't be appended to the buffer under a single lock
+func (c *Client) sendsOneByOne() bool {
+	// high priority lane buffer is always locked, metrics of the batch might go to different destinations with Route
+	return c.router != nil || (!c.high && (c.unlocked || c.trans.pipeline != nil))
+}
+
+// rejectedError returns *RejectedMetricsError if any metric was rejected
+func rejectedError(rejected int) error {
+
+	if rejected > 0 {
+		return &RejectedMetricsError{Rejected: rejected}
+	}
+
+	return nil
+}
+
+// lockMetricsBuf locks the buffer to append batch of metrics to
+func (c *Client) lockMetricsBuf() *bufShard {
+	s := c.local
+	if c.high {
+		s = c.trans.highShard
+	} else if s == nil {
+		s = c.trans.pickShard()
+	}
+
+	s.bufLock.Lock()
+
+	return s
+}
+
+// appendMetrics appends metrics to the shard buffer under a single lock, returns number of rejected metrics
+func (c *Client) appendMetrics(metrics []Metric, timestamp int64) (rejected int) {
+	t := c.trans
+	// gauges should go through the shard picked by name, see shardFor
+	separateGauges := t.gauges != nil || (!c.high && (c.local != nil || len(t.shards) > 1 || t.gaugeWindow != nil))
+
+	s := c.lockMetricsBuf()
+
+	for i := range metrics {
+		m := &metrics[i]
+		if separateGauges && m.Type == MetricGauge {
+			continue
+		}
+
+		setValue, ok := c.validMetric(m)
+		if !ok {
+			rejected++
+			continue
+		}
+
+		lastLen := len(s.buf)
+
+		var emitted bool
+		if s.buf, emitted = c.appendMetric(s.buf, m, setValue, timestamp); emitted && !t.checkBuf(s, lastLen) {
+			rejected++
+		}
+	}
+
+	s.bufLock.Unlock()
+
+	if separateGauges {
+		for i := range metrics {
+			if metrics[i].Type == MetricGauge && !c.sendMetric(&metrics[i], timestamp) {
+				rejected++
+			}
+		}
+	}
+
+	return
+}
+
+// validMetric checks the metric, invalid metrics are counted
+//
+// Set value is returned sanitized according to the newline policy.
+func (c *Client) validMetric(m *Metric) (setValue string, ok bool) {
+	switch m.Type {
+	case MetricCounter, MetricTiming, MetricGauge:
+		ok = !math.IsNaN(m.Value) && !math.IsInf(m.Value, 0)
+	case MetricSet:
+		setValue, ok = m.SetValue, true
+
+		if hasSetValueDelimiters(setValue) {
+			if c.trans.newlinePolicy == NewlineDrop {
+				ok = false
+			} else {
+				setValue = sanitizeSetValue(setValue)
+			}
+		}
+	}
+
+	if ok && c.trans.newlinePolicy == NewlineDrop && strings.IndexByte(m.Name, '\n') >= 0 {
+		ok = false
+	}
+
+	if !ok {
+		atomic.AddInt64(&c.trans.invalidMetrics, 1)
+	}
+
+	return
+}
+
+// metricOptions splits call options out of metric tags and applies metric timestamp,
+// timestamp is used if it's not set for the metric
+func metricOptions(m *Metric, timestamp int64) ([]Tag, callOptions) {
+	tags, opts := splitCallOptions(m.Tags)
+	if !m.Timestamp.IsZero() {
+		opts.timestamp = m.Timestamp.Unix()
+	} else if opts.timestamp == 0 {
+		opts.timestamp = timestamp
+	}
+
+	return tags, opts
+}
+
+// appendMetric formats valid metric, emitted is false if metric was sampled out or not allowed
+func (c *Client) appendMetric(buf []byte, m *Metric, setValue string, timestamp int64) (_ []byte, emitted bool) {
+	tags, opts := metricOptions(m, timestamp)
+
+	rate := opts.rate
+	switch m.Type {
+	case MetricCounter:
+		if m.Value == 0 {
+			return buf, false
+		}
+
+		if rate, emitted = c.sample(rate); !emitted {
+			return buf, false
+		}
+	case MetricTiming:
+		if rate != 0 && !sampled(rate) {
+			return buf, false
+		}
+	}
+
+	if !c.allowed(m.Name) {
+		return buf, false
+	}
+
+	switch m.Type {
+	case MetricCounter:
+		buf = c.appendHead(buf, m.Name, tags)
+		buf = appendFloatCounterValue(buf, m.Value, c.trans.floatPrecision, rate)
+	case MetricTiming:
+		buf = c.appendHead(buf, m.Name, tags)
+		buf = append(buf, ':')
+		buf = c.trans.appendFloat(buf, m.Value)
+		buf = append(buf, timingSuffix...)
+		if rate != 0 {
+			buf = appendSampleRate(buf, rate)
+		}
+	case MetricGauge:
+		var sign []byte
+		if m.Delta && m.Value >= 0 {
+			sign = plusSign
+		}
+
+		// reset to zero is appended together with the value, so that they're never split
+		if !m.Delta && m.Value < 0 {
+			buf = c.appendFGauge(buf, m.Name, nil, 0, tags, opts)
+		}
+
+		buf = c.appendHead(buf, m.Name, tags)
+		buf = appendFloatGaugeValue(buf, sign, m.Value, c.trans.floatPrecision)
+	case MetricSet:
+		buf = c.appendHead(buf, m.Name, tags)
+		buf = appendSetValue(buf, setValue)
+	}
+
+	return c.appendTail(buf, tags, opts), true
+}
+
+// sendMetric sends metric with the per-metric methods, returns false if metric is invalid
+func (c *Client) sendMetric(m *Metric, timestamp int64) bool {
+	setValue, ok := c.validMetric(m)
+	if !ok {
+		return false
+	}
+
+	tags, opts := metricOptions(m, timestamp)
+
+	switch m.Type {
+	case MetricCounter:
+		c.fincr(m.Name, m.Value, tags, opts)
+	case MetricTiming:
+		c.precisionTiming(m.Name, time.Duration(m.Value*float64(time.Millisecond)), tags, opts)
+	case MetricGauge:
+		value := int64(m.Value)
+
+		switch {
+		case float64(value) != m.Value && m.Delta:
+			c.floatGaugeDelta(m.Name, m.Value, tags, opts)
+		case float64(value) != m.Value:
+			c.floatGauge(m.Name, m.Value, tags, opts)
+		case m.Delta:
+			c.gaugeDelta(m.Name, value, tags, opts)
+		default:
+			// integer gauges are tracked with TrackGaugeState
+			c.gauge(m.Name, value, tags, opts)
+		}
+	case MetricSet:
+		c.setAdd(m.Name, setValue, tags, opts)
+	}
+
+	return true
+}
+
+// sendPlaintextMetrics sends metrics with Graphite plaintext protocol, see SendMetricsAt
+func (c *Client) sendPlaintextMetrics(metrics []Metric, timestamp int64) error {
+	var rejected int
+
+	if c.sendsOneByOne() {
+		for i := range metrics {
+			if !c.validPlaintextMetric(&metrics[i]) {
+				rejected++
+				continue
+			}
+
+			routed := c.routeFor(metrics[i].Name)
+
+			s := routed.acquireBuf()
+			lastLen := len(s.buf)
+
+			s.buf, _ = routed.appendPlaintextMetric(s.buf, &metrics[i], timestamp)
+
+			routed.commit(s, lastLen)
+		}
+
+		return rejectedError(rejected)
+	}
+
+	s := c.lockMetricsBuf()
+
+	for i := range metrics {
+		if !c.validPlaintextMetric(&metrics[i]) {
+			rejected++
+			continue
+		}
+
+		lastLen := len(s.buf)
+
+		var emitted bool
+		if s.buf, emitted = c.appendPlaintextMetric(s.buf, &metrics[i], timestamp); emitted && !c.trans.checkBuf(s, lastLen) {
+			rejected++
+		}
+	}
+
+	s.bufLock.Unlock()
+
+	return rejectedError(rejected)
+}
+
+// validPlaintextMetric checks that metric could be sent with Graphite plaintext protocol
+func (c *Client) validPlaintextMetric(m *Metric) bool {
+	if m.Type == MetricSet || (m.Type == MetricGauge && m.Delta) {
+		atomic.AddInt64(&c.trans.invalidMetrics, 1)
+		return false
+	}
+
+	_, ok := c.validMetric(m)
+
+	return ok
+}
+
+// appendPlaintextMetric formats valid metric as Graphite plaintext line, emitted is false if metric is not allowed
+func (c *Client) appendPlaintextMetric(buf []byte, m *Metric, timestamp int64) (_ []byte, emitted bool) {
+	if !c.allowed(m.Name) {
+		return buf, false
+	}
+
+	tags, opts := metricOptions(m, timestamp)
+
+	start := len(buf)
+	buf = c.appendHead(buf, m.Name, tags)
+	replaceWhitespace(buf[start:])
+
+	buf = append(buf, ' ')
+	buf = c.trans.appendFloat(buf, m.Value)
+	buf = append(buf, ' ')
+	buf = appendInt(buf, opts.timestamp)
+
+	return append(buf, '\n'), true
+}
@@ -0,0 +1,278 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendMetrics(t *testing.T) {
+	metrics := []Metric{
+		{Name: "req", Type: MetricCounter, Value: 2, Tags: []Tag{StringTag("route", "api")}},
+		{Name: "req", Type: MetricCounter, Value: 0.5, Timestamp: time.Unix(1700000000, 0)},
+		// zero counter is skipped like with Incr
+		{Name: "req", Type: MetricCounter},
+		{Name: "lat", Type: MetricTiming, Value: 1.5, Tags: []Tag{WithRate(1)}},
+		{Name: "depth", Type: MetricGauge, Value: 3},
+		{Name: "depth", Type: MetricGauge, Value: -2},
+		{Name: "depth", Type: MetricGauge, Value: 0.5, Delta: true},
+		{Name: "depth", Type: MetricGauge, Value: -1, Delta: true},
+		{Name: "users", Type: MetricSet, SetValue: "bob", Tags: []Tag{WithTimestamp(time.Unix(1, 0))}},
+	}
+
+	expected := []string{
+		"web.req:2|c|#app:api,route:api",
+		"web.req:0.5|c|#app:api|T1700000000",
+		"web.lat:1.5|ms|#app:api",
+		"web.depth:3|g|#app:api",
+		"web.depth:0|g|#app:api",
+		"web.depth:-2|g|#app:api",
+		"web.depth:+0.5|g|#app:api",
+		"web.depth:-1|g|#app:api",
+		"web.users:bob|s|#app:api|T1",
+	}
+
+	for _, tt := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Shared", nil},
+		{"Unlocked", []Option{Unlocked(true)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			inSocket, received := setupListener(t)
+			defer inSocket.Close() //nolint:errcheck
+
+			client := NewClient(inSocket.LocalAddr().String(), append([]Option{MetricPrefix("web."), TagStyle(TagFormatDatadog),
+				DefaultTags(StringTag("app", "api")), FlushInterval(time.Hour)}, tt.opts...)...)
+			defer client.Close() //nolint:errcheck
+
+			if err := client.SendMetrics(metrics); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != strings.Join(expected, "\n") {
+					t.Errorf("unexpected packet: %#v != %#v", string(buf), strings.Join(expected, "\n"))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for metrics")
+			}
+		})
+	}
+}
+
+func TestSendMetricsRejected(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), MaxPacketSize(40),
+		NewlinePolicy(NewlineDrop))
+	defer client.Close() //nolint:errcheck
+
+	err := client.SendMetrics([]Metric{
+		{Name: "req", Type: MetricCounter, Value: 1},
+		{Name: "req", Type: "kv", Value: 1},
+		{Name: "req", Type: MetricGauge, Value: math.NaN()},
+		{Name: "req", Type: MetricTiming, Value: math.Inf(1)},
+		{Name: "req\nfoo", Type: MetricCounter, Value: 1},
+		{Name: "users", Type: MetricSet, SetValue: "a|b"},
+		{Name: strings.Repeat("long.", 10), Type: MetricCounter, Value: 1},
+		{Name: "users", Type: MetricSet, SetValue: "bob"},
+	})
+
+	var rejectedErr *RejectedMetricsError
+	if !errors.As(err, &rejectedErr) || rejectedErr.Rejected != 6 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if invalid := client.GetInvalidMetrics(); invalid != 5 {
+		t.Errorf("unexpected number of invalid metrics: %d", invalid)
+	}
+
+	if oversized := client.GetOversizedMetrics(); oversized != 1 {
+		t.Errorf("unexpected number of oversized metrics: %d", oversized)
+	}
+
+	client.Flush()
+
+	select {
+	case buf := <-received:
+		if string(buf) != "req:1|c\nusers:bob|s" {
+			t.Errorf("unexpected packet: %#v", string(buf))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metrics")
+	}
+}
+
+func TestSendMetricsAt(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+
+	metrics := []Metric{
+		{Name: "jobs.done", Type: MetricCounter, Value: 30, Tags: []Tag{StringTag("queue", "nightly")}},
+		{Name: "jobs.time", Type: MetricTiming, Value: 1.5, Timestamp: time.Unix(1699990000, 0)},
+		{Name: "jobs depth", Type: MetricGauge, Value: -2},
+		{Name: "jobs.depth", Type: MetricGauge, Value: 1, Delta: true},
+		{Name: "jobs.users", Type: MetricSet, SetValue: "bob"},
+	}
+
+	for _, tt := range []struct {
+		name     string
+		format   *TagFormat
+		expected []string
+		rejected int
+	}{
+		{
+			name:   "Datadog",
+			format: TagFormatDatadog,
+			expected: []string{
+				"batch.jobs.done:30|c|#queue:nightly|T1700000000",
+				"batch.jobs.time:1.5|ms|T1699990000",
+				"batch.jobs depth:0|g|T1700000000",
+				"batch.jobs depth:-2|g|T1700000000",
+				"batch.jobs.depth:+1|g|T1700000000",
+				"batch.jobs.users:bob|s|T1700000000",
+			},
+		},
+		{
+			name:   "Graphite",
+			format: TagFormatGraphite,
+			expected: []string{
+				"batch.jobs.done;queue=nightly 30 1700000000",
+				"batch.jobs.time 1.5 1699990000",
+				"batch.jobs_depth -2 1700000000",
+			},
+			rejected: 2,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			inSocket, received := setupListener(t)
+			defer inSocket.Close() //nolint:errcheck
+
+			client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("batch."), TagStyle(tt.format), FlushInterval(time.Hour))
+			defer client.Close() //nolint:errcheck
+
+			err := client.SendMetricsAt(metrics, ts)
+
+			var rejectedErr *RejectedMetricsError
+			if tt.rejected == 0 && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			} else if tt.rejected > 0 && (!errors.As(err, &rejectedErr) || rejectedErr.Rejected != tt.rejected) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			client.Flush()
+
+			select {
+			case buf := <-received:
+				if string(buf) != strings.Join(tt.expected, "\n") {
+					t.Errorf("unexpected packet: %#v != %#v", string(buf), strings.Join(tt.expected, "\n"))
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for metrics")
+			}
+		})
+	}
+
+	t.Run("Unsupported", func(t *testing.T) {
+		for _, format := range []*TagFormat{TagFormatInfluxDB, TagFormatOkmeter} {
+			client := NewClient("127.0.0.1:8125", TagStyle(format), FlushInterval(time.Hour))
+
+			if err := client.SendMetricsAt(metrics, ts); err != ErrTimestampsNotSupported {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			if emitted := atomic.LoadInt64(&client.trans.emittedOverall); emitted != 0 {
+				t.Errorf("unexpected number of emitted metrics: %d", emitted)
+			}
+
+			_ = client.Close()
+		}
+	})
+}
+
+func BenchmarkSendMetrics(b *testing.B) {
+	metrics := make([]Metric, 0, 1000)
+	for i := 0; i < cap(metrics)/4; i++ {
+		tags := []Tag{StringTag("job", "node"), IntTag("shard", i)}
+
+		metrics = append(metrics,
+			Metric{Name: "foo.bar.counter", Type: MetricCounter, Value: 1, Tags: tags},
+			Metric{Name: "foo.bar.timing", Type: MetricTiming, Value: 153, Tags: tags},
+			Metric{Name: "foo.bar.gauge", Type: MetricGauge, Value: 42, Tags: tags},
+			Metric{Name: "foo.bar.set", Type: MetricSet, SetValue: "bob", Tags: tags},
+		)
+	}
+
+	for _, mode := range []string{"loop", "batch"} {
+		b.Run(mode, func(b *testing.B) {
+			// packets are discarded, so that benchmark measures formatting and locking
+			c := NewClient("127.0.0.1:8125", MetricPrefix("metricPrefix"), MaxPacketSize(1432), TagStyle(TagFormatDatadog),
+				FlushInterval(100*time.Millisecond), BlockWithTimeout(time.Second),
+				func(c *ClientOptions) {
+					c.dial = func(context.Context, string, string) (net.Conn, error) {
+						return discardConn{}, nil
+					}
+				})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if mode == "batch" {
+					_ = c.SendMetrics(metrics)
+					continue
+				}
+
+				for j := range metrics {
+					m := &metrics[j]
+
+					switch m.Type {
+					case MetricCounter:
+						c.FIncr(m.Name, m.Value, m.Tags...)
+					case MetricTiming:
+						c.PrecisionTiming(m.Name, time.Duration(m.Value*float64(time.Millisecond)), m.Tags...)
+					case MetricGauge:
+						c.FGauge(m.Name, m.Value, m.Tags...)
+					case MetricSet:
+						c.SetAdd(m.Name, m.SetValue, m.Tags...)
+					}
+				}
+			}
+
+			_ = c.Close()
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync/atomic"
+)
+
+// MaxUnixgramPacketSize is recommended maximum packet size for unix datagram sockets
+//
+// Larger datagrams might exceed socket send buffer (or system datagram size limit).
+const MaxUnixgramPacketSize = 8192
+
+// recommendedPacketSize returns maximum packet size which is safe for the network
+//
+// Zero size means there is no limit (stream sockets), known is false if network
+// is not recognized.
+func recommendedPacketSize(network string) (size int64, known bool) {
+	switch network {
+	case "udp", "udp4", "udp6":
+		// typical Ethernet MTU minus IP and UDP headers
+		return DefaultMaxPacketSize, true
+	case "unixgram":
+		return MaxUnixgramPacketSize, true
+	case "tcp", "tcp4", "tcp6", "unix":
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// socketNetwork returns network of the connected socket, or empty string if it's unknown
+func socketNetwork(sock net.Conn) string {
+	switch conn := sock.(type) {
+	case *net.UDPConn:
+		return "udp"
+	case *net.TCPConn:
+		return "tcp"
+	case *net.UnixConn:
+		if addr := conn.RemoteAddr(); addr != nil {
+			return addr.Network()
+		}
+	}
+
+	return ""
+}
+
+// checkPacketSize records packet size recommended for the network and warns (once)
+// if MaxPacketSize exceeds it
+func (t *transport) checkPacketSize(network string, log SomeLogger) {
+	recommended, known := recommendedPacketSize(network)
+	if !known {
+		return
+	}
+
+	atomic.StoreInt64(&t.recommendedPacketSize, recommended)
+
+	packetSize := atomic.LoadInt64(&t.packetSizeLimit)
+
+	if t.suppressMTUWarning || recommended == 0 || packetSize <= recommended {
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&t.mtuWarned, 0, 1) {
+		return
+	}
+
+	if t.slogger != nil {
+		t.slogger.LogAttrs(context.Background(), slog.LevelWarn, "statsd MaxPacketSize exceeds safe packet size, packets might be fragmented or dropped",
+			slog.Int64("max_packet_size", packetSize), slog.Int64("recommended", recommended), slog.String("network", network))
+	} else {
+		log.Printf("[STATSD] MaxPacketSize %d exceeds %d recommended for %s, packets might be fragmented or dropped",
+			packetSize, recommended, network)
+	}
+}
@@ -25,6 +25,10 @@ SOFTWARE.
 */
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
 	"time"
 )
 
@@ -40,7 +44,28 @@ const (
 	DefaultBufPoolCapacity   = 20
 	DefaultSendQueueCapacity = 10
 	DefaultSendLoopCount     = 1
+	MaxAutoSendLoopCount     = 8
 	DefaultNetwork           = "udp"
+	DefaultNameSeparator     = "."
+	DefaultFloatPrecision    = -1
+	DefaultBufferShards      = 1
+	DefaultSendBatchSize     = 1
+)
+
+// Drop policies
+const (
+	// DropNewest drops packet being enqueued when send queue is full
+	DropNewest = iota
+	// DropOldest drops oldest packet in the send queue to make room for the new one
+	DropOldest
+)
+
+// Newline policies
+const (
+	// NewlineReplace replaces newlines in metric names and set values (and ':', '|' in set values) with '_'
+	NewlineReplace = iota
+	// NewlineDrop drops metrics with newlines in names or set values (or ':', '|' in set values)
+	NewlineDrop
 )
 
 // SomeLogger defines logging interface that allows using 3rd party loggers
@@ -57,23 +82,60 @@ type ClientOptions struct {
 	// AddrNetwork is network type for the address. Defaults to udp.
 	AddrNetwork string
 
+	// Routes send metrics with the name prefix to different destinations, see Route
+	Routes []MetricRoute
+
 	// MetricPrefix is metricPrefix to prepend to every metric being sent
 	//
 	// If not set defaults to empty string
 	MetricPrefix string
 
+	// NameSeparator separates parts of metric name joined by the client
+	//
+	// Default value is DefaultNameSeparator
+	NameSeparator string
+
 	// MaxPacketSize is maximum UDP packet size
 	//
 	// Safe value is 1432 bytes, if your network supports jumbo frames,
 	// this value could be raised up to 8960 bytes
 	MaxPacketSize int
 
+	// SuppressMTUWarning disables warning about MaxPacketSize exceeding safe packet size
+	SuppressMTUWarning bool
+
+	// MaxMetricsPerPacket limits number of metrics (lines) in a single packet
+	//
+	// Default value is zero which means packets are limited only by MaxPacketSize
+	MaxMetricsPerPacket int
+
 	// FlushInterval controls flushing incomplete UDP packets which makes
 	// sure metric is not delayed longer than FlushInterval
 	//
-	// Default value is 100ms, setting FlushInterval to zero disables flushing
+	// Default value is 100ms, setting FlushInterval to zero enables immediate
+	// mode: each metric is sent to the send queue right away
 	FlushInterval time.Duration
 
+	// MinFlushSize is minimum size of the buffer (in bytes) flushed by periodic flush
+	//
+	// Smaller buffers are kept until the oldest metric in the buffer waits longer
+	// than MaxFlushDelay. Default value is zero (every periodic flush sends the buffer).
+	MinFlushSize int
+
+	// MaxFlushDelay bounds the delay of metrics kept by MinFlushSize
+	MaxFlushDelay time.Duration
+
+	// FloatPrecision is number of digits after the decimal point for
+	// floating point values
+	//
+	// Default value is DefaultFloatPrecision, which means minimal number
+	// of digits necessary to represent the value exactly
+	FloatPrecision int
+
+	// DisablePeriodicFlush disables flushing incomplete packets, so metrics
+	// are sent only when packet is full or on explicit Flush
+	DisablePeriodicFlush bool
+
 	// ReconnectInterval controls UDP socket reconnects
 	//
 	// Reconnecting is important to follow DNS changes, e.g. in
@@ -92,8 +154,12 @@ type ClientOptions struct {
 	// ReportInterval instructs client to report number of packets lost
 	// each interval via Logger
 	//
+	// Connection and write errors are logged at most once per interval,
+	// number of packets lost due to write errors and number of failed connection
+	// attempts are included into the report.
+	//
 	// By default lost packets are reported every minute, setting to zero
-	// disables reporting
+	// disables reporting (and every error is logged)
 	ReportInterval time.Duration
 
 	// Logger is used by statsd client to report errors and lost packets
@@ -101,14 +167,71 @@ type ClientOptions struct {
 	// If not set, default logger to stderr with metricPrefix `[STATSD] ` is being used
 	Logger SomeLogger
 
+	// ReportHandler is called each ReportInterval with client statistics
+	// for the period
+	//
+	// Handler is called in addition to logging lost packets via Logger.
+	ReportHandler func(r Report)
+
+	// TelemetryPrefix is prefix of client own metrics
+	TelemetryPrefix string
+
+	// TelemetryInterval controls how often client own metrics are emitted
+	//
+	// Default value is zero which disables self telemetry
+	TelemetryInterval time.Duration
+
+	// SlogLogger enables structured logging via log/slog
+	//
+	// If set, Logger is not used.
+	SlogLogger *slog.Logger
+
 	// BufPoolCapacity controls size of pre-allocated buffer cache
 	//
 	// Each buffer is MaxPacketSize. Cache allows to avoid allocating
-	// new buffers during high load
+	// new buffers during high load. Buffers are allocated on demand,
+	// unless PrewarmBufPool is set. Buffers released while the cache
+	// is full are kept in a secondary pool until next garbage collection.
 	//
 	// Default value is DefaultBufPoolCapacity
 	BufPoolCapacity int
 
+	// BufPoolMaxCapacity enables adaptive buffer pool which grows from
+	// BufPoolCapacity up to BufPoolMaxCapacity when pool is exhausted
+	//
+	// Default value is zero, so pool has fixed capacity
+	BufPoolMaxCapacity int
+
+	// PrewarmBufPool fills buffer pool with BufPoolCapacity buffers
+	// when client is created
+	PrewarmBufPool bool
+
+	// MaxBufferedBytes limits memory held by the buffers: buffers metrics
+	// are appended to, buffer pool and packets waiting to be sent
+	//
+	// Default value is zero, so memory is bounded only by the capacities
+	MaxBufferedBytes int64
+
+	// BufferShards is number of buffers metrics are appended to
+	//
+	// Default value is DefaultBufferShards, if set to zero, GOMAXPROCS is used.
+	BufferShards int
+
+	// ExperimentalPipeline enables lock-free pipeline to assemble packets
+	//
+	// Default value is false.
+	ExperimentalPipeline bool
+
+	// Unlocked disables locking of the buffer, client should be used from a single goroutine
+	//
+	// Default value is false.
+	Unlocked bool
+
+	// UnlockedDebug enables detection of concurrent use of the client in Unlocked mode
+	//
+	// Default value is false.
+	UnlockedDebug bool
+
 	// SendQueueCapacity controls length of the queue of packet ready to be sent
 	//
 	// Packets might stay in the queue during short load bursts or while
@@ -117,12 +240,36 @@ type ClientOptions struct {
 	// Default value is DefaultSendQueueCapacity
 	SendQueueCapacity int
 
+	// PriorityLanes is capacity of the send queue of the high priority lane
+	//
+	// Default value is 0 (priority lanes are disabled), see WithPriority
+	PriorityLanes int
+
+	// MaxPacketAge is maximum time packet could wait in the send queue
+	//
+	// Default value is 0 (packets are sent regardless of their age)
+	MaxPacketAge time.Duration
+
+	// SendBatchSize is number of packets handed to the send loop at once
+	//
+	// Default value is DefaultSendBatchSize (batching is disabled)
+	SendBatchSize int
+
 	// SendLoopCount controls number of goroutines sending UDP packets
 	//
 	// Default value is 1, so packets are sent from single goroutine, this
 	// value might need to be bumped under high load
+	//
+	// Zero value means number of goroutines is derived from GOMAXPROCS
+	// (capped at MaxAutoSendLoopCount)
 	SendLoopCount int
 
+	// SendLoopMax is maximum number of goroutines sending UDP packets
+	//
+	// If greater than SendLoopCount, additional send loops are started
+	// under send queue pressure, see AutoScaleSendLoops.
+	SendLoopMax int
+
 	// TagFormat controls formatting of StatsD tags
 	//
 	// If tags are not used, value of this setting isn't used.
@@ -133,6 +280,167 @@ type ClientOptions struct {
 
 	// DefaultTags is a list of tags to be applied to every metric
 	DefaultTags []Tag
+
+	// BuildInfoTags adds tags describing the binary build (version, vcs_sha, vcs_dirty)
+	// to the default tags
+	BuildInfoTags bool
+
+	// NameMapper rewrites metric name before it is serialized
+	//
+	// Mapping is applied to the metric name as passed to the client,
+	// metric prefix is prepended after the mapping and it's not affected.
+	NameMapper func(name string) string
+
+	// NameAppender is zero-allocation form of NameMapper: it appends
+	// rewritten metric name to dst
+	//
+	// If both NameAppender and NameMapper are set, NameAppender is used.
+	NameAppender func(dst []byte, name string) []byte
+
+	// NormalizeNames is a replacement for bytes in metric names outside of
+	// [a-zA-Z0-9._-] set
+	//
+	// Zero value disables normalization.
+	NormalizeNames byte
+
+	// InternNames is maximum number of formatted metric names cached by the client
+	//
+	// Default value is zero (cache is disabled).
+	InternNames int
+
+	// TagMapper rewrites or drops tags before they are serialized
+	//
+	// Mapper is called for default and per-metric tags, it returns new
+	// tag name and value, and false if tag should be dropped.
+	TagMapper func(name, value string) (string, string, bool)
+
+	// AllowMetrics is a list of metric name patterns to be sent
+	//
+	// If set, only metrics matching one of the patterns are sent.
+	AllowMetrics []string
+
+	// DenyMetrics is a list of metric name patterns to be dropped
+	//
+	// Deny list takes precedence over AllowMetrics.
+	DenyMetrics []string
+
+	// OnDroppedPacket is called for every packet dropped
+	//
+	// Packet contents are only valid for the duration of the callback,
+	// unless CopyDroppedPackets is set.
+	OnDroppedPacket func(packet []byte, reason DropReason)
+
+	// DroppedPacketRateLimit limits number of OnDroppedPacket calls per second
+	//
+	// Default value is zero which means no limit
+	DroppedPacketRateLimit int
+
+	// CopyDroppedPackets makes packet passed to OnDroppedPacket a copy
+	// which could be retained after the callback returns
+	CopyDroppedPackets bool
+
+	// OnFlush is called for every packet handed to the send queue
+	OnFlush func(packetLen int, metrics int)
+
+	// ErrorClassifier maps errors reported by Measure to the error class
+	//
+	// Default value is nil, so ClassifyError is used
+	ErrorClassifier func(err error) string
+
+	// BlockTimeout controls how long client waits for the space in the send
+	// queue before dropping the packet
+	//
+	// Default value is zero, so packets are dropped immediately
+	BlockTimeout time.Duration
+
+	// MaxMetricsPerSecond limits rate of metrics being sent
+	//
+	// Default value is zero which means no limit
+	MaxMetricsPerSecond int
+
+	// DefaultSampleRate is sample rate applied to all counters
+	//
+	// Default value is 1, so counters are not sampled
+	DefaultSampleRate float64
+
+	// CircuitOpenAfter is duration of persistent delivery failures after
+	// which circuit breaker opens
+	//
+	// Default value is zero which disables circuit breaker
+	CircuitOpenAfter time.Duration
+
+	// CircuitProbeInterval controls how often connection is attempted
+	// while circuit breaker is open
+	CircuitProbeInterval time.Duration
+
+	// DropPolicy controls which packet is dropped when send queue is full
+	//
+	// Default value is DropNewest
+	DropPolicy int
+
+	// RetainOverflow is maximum number of packets which are kept locally
+	// (instead of being dropped) when send queue is full
+	//
+	// Default value is zero, so packets are not retained
+	RetainOverflow int
+
+	// TrackGaugeState is maximum number of gauges which last value is tracked
+	//
+	// Default value is zero which disables tracking
+	TrackGaugeState int
+
+	// CompressGauges sends only the last value of each gauge per flush interval
+	//
+	// Default value is false
+	CompressGauges bool
+
+	// TrackCardinality is maximum number of distinct metric names tracked, see Client.Cardinality
+	//
+	// Default value is zero which disables tracking
+	TrackCardinality int
+
+	// TrackSeriesCardinality enables tracking of distinct metric names with tags (with TrackCardinality)
+	//
+	// Default value is false
+	TrackSeriesCardinality bool
+
+	// NewlinePolicy controls handling of newlines in metric names and set values
+	//
+	// Default value is NewlineReplace
+	NewlinePolicy int
+
+	// CloseTimeout controls how long Close keeps trying to deliver queued
+	// packets when statsd server is not reachable
+	//
+	// Default value is zero, so queued packets are abandoned right away
+	CloseTimeout time.Duration
+
+	// TeeWriter receives copy of every packet sent to the socket
+	TeeWriter io.Writer
+
+	// DebugDump receives human-readable dump of every packet sent to the socket
+	DebugDump io.Writer
+
+	// WriteRetries is number of times failed packet write is retried
+	// before packet is dropped
+	//
+	// Default value is zero, so packet is dropped on first write failure
+	WriteRetries int
+
+	// WriteRetryBackoff is delay between write retries
+	WriteRetryBackoff time.Duration
+
+	// SynchronousMode makes every flush wait for the packet to be written
+	SynchronousMode bool
+
+	// PassiveMode disables background goroutines, metrics are delivered with Client.FlushTo
+	PassiveMode bool
+
+	// scaleInterval overrides DefaultScaleInterval (for tests)
+	scaleInterval time.Duration
+
+	// dial is used to establish connection (for tests)
+	dial func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 // Option is type for option transport
@@ -153,6 +461,20 @@ func MetricPrefix(prefix string) Option {
 	}
 }
 
+// NameSeparator sets separator for metric name hierarchy
+//
+// Separator is used when the client joins name parts itself: in
+// CloneWithPrefixParts and when tags are flattened into the metric name
+// (TagFormatOkmeter, only single-character separators are supported there).
+// Metric names and prefixes passed by the caller are not modified.
+//
+// Default value is DefaultNameSeparator.
+func NameSeparator(sep string) Option {
+	return func(c *ClientOptions) {
+		c.NameSeparator = sep
+	}
+}
+
 // MaxPacketSize control maximum UDP packet size
 //
 // Default value is DefaultMaxPacketSize
@@ -162,16 +484,97 @@ func MaxPacketSize(packetSize int) Option {
 	}
 }
 
+// SuppressMTUWarning disables warning about MaxPacketSize exceeding packet size safe for the transport
+//
+// Client warns once if MaxPacketSize is larger than 1432 bytes for UDP (typical Ethernet MTU)
+// or MaxUnixgramPacketSize for unix datagram sockets, as such packets might be fragmented or dropped.
+// Suppress the warning if larger packets are known to be safe (e.g. with jumbo frames).
+func SuppressMTUWarning() Option {
+	return func(c *ClientOptions) {
+		c.SuppressMTUWarning = true
+	}
+}
+
+// MaxMetricsPerPacket limits number of metrics (lines) in a single packet
+//
+// Buffer is flushed once it reaches n metrics, in addition to MaxPacketSize
+// limit. Some aggregators parse packets with fewer lines more efficiently.
+//
+// Default value is zero which means no limit.
+func MaxMetricsPerPacket(n int) Option {
+	return func(c *ClientOptions) {
+		c.MaxMetricsPerPacket = n
+	}
+}
+
 // FlushInterval controls flushing incomplete UDP packets which makes
 // sure metric is not delayed longer than FlushInterval
 //
-// Default value is 100ms, setting FlushInterval to zero disables flushing
+// Default value is 100ms.
+//
+// Setting FlushInterval to zero enables immediate mode: every metric is
+// sent to the send queue as soon as it's emitted. If send queue is full,
+// metrics are batched in the buffer until there's room in the queue (or
+// packet is full), leftovers are flushed every DefaultFlushInterval.
+//
+// Previously zero FlushInterval disabled flushing, use DisablePeriodicFlush
+// for that behavior.
 func FlushInterval(interval time.Duration) Option {
 	return func(c *ClientOptions) {
 		c.FlushInterval = interval
 	}
 }
 
+// MinFlushSize makes periodic flush skip buffers smaller than bytes
+//
+// With low metric rate every flush interval produces a tiny packet, MinFlushSize
+// coalesces such metrics into bigger packets. Buffer is still flushed once the
+// oldest metric in it has been waiting longer than maxDelay, so metric is delayed
+// at most by maxDelay plus FlushInterval.
+//
+// Explicit Flush, FlushAndWait and Close always send the buffer.
+func MinFlushSize(bytes int, maxDelay time.Duration) Option {
+	return func(c *ClientOptions) {
+		c.MinFlushSize = bytes
+		c.MaxFlushDelay = maxDelay
+	}
+}
+
+// FloatPrecision limits number of digits after the decimal point in floating
+// point values of PrecisionTiming, FGauge, FGaugeDelta, FIncr and FDecr
+//
+// Values are rounded to the nearest, trailing zeros are trimmed (with
+// precision 2, 0.30000000000000004 is sent as 0.3). Non-zero values which
+// would be rounded to zero (e.g. 0.0005 with precision 2) are sent with full
+// precision, so that they're not lost.
+//
+// Default value is DefaultFloatPrecision (-1): minimal number of digits
+// necessary to represent the value exactly.
+//
+// With precision up to 6 (nanoseconds), PrecisionTiming formats durations
+// with integer arithmetic, which is considerably faster.
+func FloatPrecision(digits int) Option {
+	return func(c *ClientOptions) {
+		c.FloatPrecision = digits
+	}
+}
+
+// DisablePeriodicFlush disables flushing incomplete packets
+//
+// Metrics are sent only when packet reaches MaxPacketSize, or when
+// Flush is called explicitly.
+//
+// Periodic reporters (RegisterBoolGaugeFunc, NewRateTracker, NewWindowGauge,
+// NewBucketedHistogram and NewQuantileTimer) report on every periodic flush and
+// when client is closed, so nothing is reported with periodic flush disabled.
+// Reporters inherit prefix and default tags of the client, they should be
+// stopped with Stop once no longer needed.
+func DisablePeriodicFlush() Option {
+	return func(c *ClientOptions) {
+		c.DisablePeriodicFlush = true
+	}
+}
+
 // ReconnectInterval controls UDP socket reconnects
 //
 // Reconnecting is important to follow DNS changes, e.g. in
@@ -198,14 +601,50 @@ func RetryTimeout(timeout time.Duration) Option {
 // ReportInterval instructs client to report number of packets lost
 // each interval via Logger
 //
+// Connection and write errors are logged at most once per interval,
+// number of packets lost due to write errors and number of failed connection
+// attempts are included into the report.
+//
 // By default lost packets are reported every minute, setting to zero
-// disables reporting
+// disables reporting (and every error is logged)
 func ReportInterval(interval time.Duration) Option {
 	return func(c *ClientOptions) {
 		c.ReportInterval = interval
 	}
 }
 
+// ReportHandler sets callback which receives client statistics each ReportInterval
+//
+// Report is structured form of lost packets logging, so it could be fed
+// into monitoring without parsing log output. Handler is called from the
+// report goroutine, so it shouldn't block for long.
+func ReportHandler(handler func(r Report)) Option {
+	return func(c *ClientOptions) {
+		c.ReportHandler = handler
+	}
+}
+
+// SelfTelemetry enables emission of client own metrics each interval
+//
+// Telemetry is sent via the client itself, metric names are prefixed with
+// prefix (client MetricPrefix is not applied), and metrics are tagged
+// with random client_id shared by the client and its clones:
+//
+//	<prefix>metrics                        counter, metrics emitted
+//	<prefix>packets_sent                   counter, packets written to the socket
+//	<prefix>bytes_sent                     counter, bytes written to the socket
+//	<prefix>packets_dropped,reason=...     counter, packets dropped (overflow, stale, closed, write_error)
+//	<prefix>queue_length                   gauge, current length of the send queue
+//
+// Telemetry is not subject to AllowMetrics/DenyMetrics, rate limiting
+// and sampling.
+func SelfTelemetry(prefix string, interval time.Duration) Option {
+	return func(c *ClientOptions) {
+		c.TelemetryPrefix = prefix
+		c.TelemetryInterval = interval
+	}
+}
+
 // Logger is used by statsd client to report errors and lost packets
 //
 // If not set, default logger to stderr with metricPrefix `[STATSD] ` is being used
@@ -215,10 +654,23 @@ func Logger(logger SomeLogger) Option {
 	}
 }
 
+// SlogLogger enables structured logging of client errors and lost packets
+//
+// When set, errors are logged at Error level, lost packets are reported
+// at Warn level, and details (address, error, number of lost packets) are
+// passed as attributes. Logger set via Logger option is not used in that case.
+func SlogLogger(logger *slog.Logger) Option {
+	return func(c *ClientOptions) {
+		c.SlogLogger = logger
+	}
+}
+
 // BufPoolCapacity controls size of pre-allocated buffer cache
 //
 // Each buffer is MaxPacketSize. Cache allows to avoid allocating
-// new buffers during high load
+// new buffers during high load. Buffers are allocated on demand,
+// unless PrewarmBufPool is set. Buffers released while the cache
+// is full are kept in a secondary pool until next garbage collection.
 //
 // Default value is DefaultBufPoolCapacity
 func BufPoolCapacity(capacity int) Option {
@@ -227,6 +679,109 @@ func BufPoolCapacity(capacity int) Option {
 	}
 }
 
+// AdaptiveBufPool enables adaptive buffer pool: pool starts with BufPoolCapacity
+// buffers and grows up to maxCapacity buffers if new buffers have to be allocated
+// repeatedly as pool is exhausted
+//
+// Pool never shrinks below BufPoolCapacity. Number of pool misses and current
+// pool capacity are available via GetStats and they're reported each ReportInterval.
+func AdaptiveBufPool(maxCapacity int) Option {
+	return func(c *ClientOptions) {
+		c.BufPoolMaxCapacity = maxCapacity
+	}
+}
+
+// PrewarmBufPool fills buffer pool with BufPoolCapacity buffers when client
+// is created, so that buffers are not allocated during the first load burst
+//
+// Number of pool misses and buffers allocated after client creation are
+// available via GetStats.
+func PrewarmBufPool(prewarm bool) Option {
+	return func(c *ClientOptions) {
+		c.PrewarmBufPool = prewarm
+	}
+}
+
+// MaxBufferedBytes sets hard limit on memory held by the buffers: buffers
+// metrics are appended to, buffer pool and packets waiting in the send queue
+//
+// BufPoolCapacity and SendQueueCapacity are numbers of packets, so memory
+// they take depends on MaxPacketSize. With the limit, new buffer is not allocated
+// if it doesn't fit into the budget: overflow policy applies right away, packet is
+// dropped (or client waits up to BlockTimeout for a buffer to be released).
+//
+// Each buffer takes MaxPacketSize plus 1KiB. Buffers of Local handles are not
+// counted. Memory held is available via Client.GetBufferedBytes.
+func MaxBufferedBytes(n int64) Option {
+	return func(c *ClientOptions) {
+		c.MaxBufferedBytes = n
+	}
+}
+
+// BufferShards sets number of buffers metrics are appended to
+//
+// With single buffer (default), all the goroutines emitting metrics
+// contend for one lock. With several shards, each goroutine tends to
+// stick to one of the shards, so the lock contention is reduced. Gauges
+// are distributed across shards by metric name, so that values of the
+// same gauge are delivered in order.
+//
+// Each shard is flushed independently, so metrics are grouped into packets
+// differently, and each shard holds up to MaxPacketSize bytes of metrics.
+//
+// If shards is zero, GOMAXPROCS is used.
+func BufferShards(shards int) Option {
+	return func(c *ClientOptions) {
+		c.BufferShards = shards
+	}
+}
+
+// ExperimentalPipeline enables lock-free pipeline to assemble packets
+//
+// Goroutines emitting metrics don't contend for the buffer lock: each metric
+// is formatted into its own chunk and pushed to the lock-free queue, and
+// background goroutine packs chunks into packets. Packets on the wire are
+// the same as with the default (single shard) buffer, BufferShards is ignored.
+//
+// Pipeline is experimental and might be changed or removed in the future.
+func ExperimentalPipeline(enabled bool) Option {
+	return func(c *ClientOptions) {
+		c.ExperimentalPipeline = enabled
+	}
+}
+
+// Unlocked enables single-threaded mode: metrics are appended to the buffer
+// without locking
+//
+// Unlocked mode is NOT safe for concurrent use: all the metrics (including
+// metrics sent via clones of the client) should be sent from a single goroutine,
+// Flush and FlushAndWait should be called from the same goroutine,
+// and Close should be called from that goroutine or after it stops sending metrics.
+// Local handles and self-telemetry still use locked buffers.
+//
+// Flush loop doesn't touch the buffer, periodic flush is performed by the goroutine
+// sending metrics on the next metric after the flush interval. If the goroutine might
+// stay idle, it should call Flush itself to deliver buffered metrics.
+//
+// Unlocked mode takes precedence over ExperimentalPipeline.
+func Unlocked(enabled bool) Option {
+	return func(c *ClientOptions) {
+		c.Unlocked = enabled
+	}
+}
+
+// UnlockedDebug enables Unlocked mode with detection of concurrent use
+//
+// Client panics if metric is sent while another goroutine is sending metric.
+// Detection costs atomic operation per metric, and it doesn't catch every
+// misuse, so it's intended for tests and debugging.
+func UnlockedDebug() Option {
+	return func(c *ClientOptions) {
+		c.Unlocked = true
+		c.UnlockedDebug = true
+	}
+}
+
 // SendQueueCapacity controls length of the queue of packet ready to be sent
 //
 // Packets might stay in the queue during short load bursts or while
@@ -239,16 +794,92 @@ func SendQueueCapacity(capacity int) Option {
 	}
 }
 
+// PriorityLanes enables the high priority lane with the send queue of the given capacity
+//
+// Metrics sent via the client returned by WithPriority(PriorityHigh) are buffered
+// separately and put into their own send queue, which send loops drain before the
+// normal send queue. On overload the normal lane is shed first, e.g. debug timers are
+// dropped while critical counters are still delivered: once the high priority queue is
+// full, its packets evict the oldest packets of the normal send queue. Drops are reported per lane
+// with GetLostPacketsByPriority.
+//
+// Default value is 0 (priority lanes are disabled)
+func PriorityLanes(highQueueCapacity int) Option {
+	return func(c *ClientOptions) {
+		c.PriorityLanes = highQueueCapacity
+	}
+}
+
+// MaxPacketAge sets maximum time packet could wait in the send queue
+//
+// After a long outage, packets queued before it would be aggregated by the statsd
+// server into the current interval producing spikes. With MaxPacketAge send loops
+// drop packets older than maxAge instead of writing them, dropped packets are reported
+// with GetStalePackets and OnDroppedPacket (DropReasonStale).
+//
+// Default value is 0 (packets are sent regardless of their age)
+func MaxPacketAge(maxAge time.Duration) Option {
+	return func(c *ClientOptions) {
+		c.MaxPacketAge = maxAge
+	}
+}
+
+// SendBatchSize sets number of packets handed to the send loop at once
+//
+// With small MaxPacketSize, handing packets to the send loop one by one
+// dominates the cost of sending. With batching enabled, ready packets are
+// accumulated and submitted as a batch with a single channel operation.
+// Partially filled batch is submitted on every flush, so FlushInterval
+// still bounds the latency.
+//
+// Batches are queued separately from the send queue, up to
+// SendQueueCapacity/batchSize batches. If batch doesn't fit, its packets
+// go through the send queue one by one, so DropPolicy, BlockWithTimeout
+// and RetainOverflow apply as usual.
+//
+// Packets within a batch are sent in order.
+func SendBatchSize(batchSize int) Option {
+	return func(c *ClientOptions) {
+		c.SendBatchSize = batchSize
+	}
+}
+
 // SendLoopCount controls number of goroutines sending UDP packets
 //
 // Default value is 1, so packets are sent from single goroutine, this
-// value might need to be bumped under high load
+// value might need to be bumped under high load. If send queue is
+// persistently close to its capacity, client logs a hint to increase the value.
+//
+// Setting SendLoopCount to zero is the same as AutoSendLoops.
 func SendLoopCount(threads int) Option {
 	return func(c *ClientOptions) {
 		c.SendLoopCount = threads
 	}
 }
 
+// AutoScaleSendLoops scales number of goroutines sending UDP packets
+// between minLoops and maxLoops
+//
+// Supervisor goroutine checks send queue length every DefaultScaleInterval.
+// When the queue stays at least half full for several checks, one more send
+// loop is started. When the queue stays nearly empty for several seconds,
+// most recently started send loop is retired. Reconnects of the additional
+// send loops are staggered the same way as for the first minLoops loops.
+//
+// Current number of send loops is reported in Stats.SendLoopCount.
+func AutoScaleSendLoops(minLoops, maxLoops int) Option {
+	return func(c *ClientOptions) {
+		c.SendLoopCount = minLoops
+		c.SendLoopMax = maxLoops
+	}
+}
+
+// AutoSendLoops derives number of goroutines sending UDP packets from
+// runtime.GOMAXPROCS, capped at MaxAutoSendLoopCount
+func AutoSendLoops() Option {
+	return SendLoopCount(0)
+}
+
 // TagStyle controls formatting of StatsD tags
 //
 // There are two predefined formats: for InfluxDB and Datadog, default
@@ -266,9 +897,444 @@ func DefaultTags(tags ...Tag) Option {
 	}
 }
 
+// BuildInfoTags adds tags describing the binary build to the default tags
+//
+// Build information is read with debug.ReadBuildInfo when the client is created:
+// `version` tag is the main module version, `vcs_sha` and `vcs_dirty` tags are
+// VCS revision and modification flag. Tags which are not available (e.g. binary
+// was built with go run or without VCS stamping) are omitted. Tags passed with
+// DefaultTags take precedence over the build tags with the same name.
+func BuildInfoTags(enabled bool) Option {
+	return func(c *ClientOptions) {
+		c.BuildInfoTags = enabled
+	}
+}
+
 // Network sets the network to use Dialing the statsd server
 func Network(network string) Option {
 	return func(c *ClientOptions) {
 		c.AddrNetwork = network
 	}
 }
+
+// NameMapper rewrites metric name before it is serialized
+//
+// This allows to apply naming policies (e.g. lowercase names) without
+// changing every call site. Mapping is applied to the metric name only,
+// metric prefix is prepended to the result of the mapping.
+//
+// NameMapper allocates a string per metric, so if performance is
+// critical, use NameAppender.
+func NameMapper(mapper func(name string) string) Option {
+	return func(c *ClientOptions) {
+		c.NameMapper = mapper
+	}
+}
+
+// NameAppender is zero-allocation form of NameMapper: appender should
+// append rewritten metric name to dst and return the result
+//
+// Metric prefix is already appended to dst when appender is called.
+func NameAppender(appender func(dst []byte, name string) []byte) Option {
+	return func(c *ClientOptions) {
+		c.NameAppender = appender
+	}
+}
+
+// NormalizeNames replaces bytes in metric names outside of [a-zA-Z0-9._-]
+// set (e.g. spaces, slashes or unicode) with replacement
+//
+// Normalization is applied to the result of NameMapper (NameAppender),
+// metric prefix is not affected. Every byte of multi-byte unicode characters
+// is replaced. Names which are already clean are sent as is.
+func NormalizeNames(replacement byte) Option {
+	return func(c *ClientOptions) {
+		c.NormalizeNames = replacement
+	}
+}
+
+// InternNames enables cache of up to max formatted metric names
+//
+// Formatted name (metric prefix and the name rewritten by NameMapper, NameAppender
+// and NormalizeNames) is cached on first use and copied to the buffer afterwards.
+// Cache pays off when a small set of hot names is rewritten on every call,
+// plain names (without NameMapper, NameAppender and NormalizeNames) bypass the cache.
+// Cache should hold the whole hot set, as inserts are expensive: least recently
+// used names are evicted (approximately) when cache is full.
+//
+// Clones created with CloneWithPrefix and similar methods get their own cache,
+// Local handles share the cache of the client.
+func InternNames(max int) Option {
+	return func(c *ClientOptions) {
+		c.InternNames = max
+	}
+}
+
+// TagMapper rewrites or drops tags before they are serialized
+//
+// Mapper is called for every tag (default and per-metric ones) with tag
+// name and value, it should return new tag name and value, and false if
+// the tag should be dropped. Integer tag values are converted to strings
+// before being passed to the mapper.
+//
+// Tag mapping comes with a performance penalty, as mapper is called for every
+// tag of every metric.
+func TagMapper(mapper func(name, value string) (string, string, bool)) Option {
+	return func(c *ClientOptions) {
+		c.TagMapper = mapper
+	}
+}
+
+// AllowMetrics sets a list of metric name patterns to be sent, all the
+// other metrics are dropped
+//
+// Patterns are matched against metric name without the prefix.
+// Wildcard `*` matches any part of the name not containing NameSeparator, so
+// `cache.*.hits` matches `cache.users.hits`, but not `cache.users.all.hits`.
+//
+// Dropped metrics are counted, see GetFilteredMetrics.
+func AllowMetrics(patterns ...string) Option {
+	return func(c *ClientOptions) {
+		c.AllowMetrics = patterns
+	}
+}
+
+// DenyMetrics sets a list of metric name patterns to be dropped
+//
+// Patterns have the same syntax as for AllowMetrics, deny list takes
+// precedence over allow list.
+//
+// Dropped metrics are counted, see GetFilteredMetrics.
+func DenyMetrics(patterns ...string) Option {
+	return func(c *ClientOptions) {
+		c.DenyMetrics = patterns
+	}
+}
+
+// OnDroppedPacket sets callback which is called for every packet dropped
+//
+// Packet is dropped either when send queue is full (DropReasonOverflow),
+// when it can't be written to the socket (DropReasonWriteError), or
+// when it waited in the queue longer than MaxPacketAge (DropReasonStale).
+// Packet contains newline-separated metrics.
+//
+// Callback is called synchronously from the delivery pipeline (overflow
+// callbacks are called with buffer lock held), so it should be fast and it
+// shouldn't send metrics via the same client. Packet contents are only valid
+// for the duration of the callback, use CopyDroppedPackets to retain them.
+//
+// During outages packets might be dropped at high rate, use DroppedPacketRateLimit
+// to limit number of callback invocations.
+func OnDroppedPacket(callback func(packet []byte, reason DropReason)) Option {
+	return func(c *ClientOptions) {
+		c.OnDroppedPacket = callback
+	}
+}
+
+// OnFlush sets callback which is called for every packet flushed from the buffer
+//
+// Callback receives packet size (as sent on the wire) and number of metrics
+// (lines) in the packet. It's called once packet is accepted by the send queue
+// (including packets retained by RetainOverflow, and with SendBatchSize once the batch
+// is queued), packets dropped by the overflow policy are reported via OnDroppedPacket instead.
+// Packet is sent asynchronously, so callback doesn't confirm delivery.
+//
+// Callback is called synchronously with buffer lock held, so it should be fast
+// and it shouldn't send metrics via the same client. Panics in the callback are
+// recovered and logged in the periodic report.
+func OnFlush(callback func(packetLen int, metrics int)) Option {
+	return func(c *ClientOptions) {
+		c.OnFlush = callback
+	}
+}
+
+// ErrorClassifier sets function which maps errors reported by Measure to the error class
+//
+// Error class is sent as a tag of the `<stat>.errors` counter, so classifier should
+// return small set of values (e.g. "timeout", "canceled", "other"). Empty class is
+// reported as ErrorClassOther. By default ClassifyError is used.
+func ErrorClassifier(classifier func(err error) string) Option {
+	return func(c *ClientOptions) {
+		c.ErrorClassifier = classifier
+	}
+}
+
+// DroppedPacketRateLimit limits number of OnDroppedPacket calls per second
+//
+// Default value is zero which means no limit
+func DroppedPacketRateLimit(perSecond int) Option {
+	return func(c *ClientOptions) {
+		c.DroppedPacketRateLimit = perSecond
+	}
+}
+
+// CopyDroppedPackets makes packet passed to OnDroppedPacket a copy, so
+// that callback could retain it
+func CopyDroppedPackets() Option {
+	return func(c *ClientOptions) {
+		c.CopyDroppedPackets = true
+	}
+}
+
+// BlockWithTimeout changes overflow policy: when send queue is full, client waits
+// up to timeout for the queue space before dropping the packet
+//
+// While client waits, all the goroutines sending metrics are blocked, so timeout
+// should be kept low. By default packets are dropped immediately on overflow.
+func BlockWithTimeout(timeout time.Duration) Option {
+	return func(c *ClientOptions) {
+		c.BlockTimeout = timeout
+	}
+}
+
+// MaxMetricsPerSecond limits rate of metrics being sent by the client
+//
+// Metrics over the limit are dropped, number of dropped metrics is
+// available via GetRateLimitedMetrics and it's reported each ReportInterval.
+// Bursts of up to one second worth of metrics are allowed.
+//
+// Each client (including clones) has its own independent budget.
+//
+// Default value is zero which means no limit.
+func MaxMetricsPerSecond(limit int) Option {
+	return func(c *ClientOptions) {
+		c.MaxMetricsPerSecond = limit
+	}
+}
+
+// CircuitBreaker stops processing metrics during sustained outages
+//
+// If connection or write failures persist for openAfter, circuit breaker
+// opens: metrics are discarded right away without being serialized, and
+// client attempts to reconnect every probeInterval. As soon as connection
+// succeeds, circuit breaker closes and metrics are processed again.
+//
+// State of the circuit breaker is available via IsCircuitOpen, transitions
+// are logged.
+//
+// By default circuit breaker is disabled.
+func CircuitBreaker(openAfter, probeInterval time.Duration) Option {
+	return func(c *ClientOptions) {
+		c.CircuitOpenAfter = openAfter
+		c.CircuitProbeInterval = probeInterval
+	}
+}
+
+// DefaultSampleRate enables client-side sampling of counters
+//
+// With sample rate below 1, only given fraction of Incr/Decr/FIncr/FDecr
+// calls is sent, and sample rate is added to the metric (`|@0.25`), so that
+// statsd server could scale counter value. Gauges, timings and sets
+// are not affected.
+//
+// Sample rate could be changed at runtime with SetSampleRate.
+//
+// Default value is 1, so counters are not sampled.
+func DefaultSampleRate(rate float64) Option {
+	return func(c *ClientOptions) {
+		c.DefaultSampleRate = rate
+	}
+}
+
+// DropPolicy controls which packet is dropped when send queue is full
+//
+// With DropNewest (default) packet being enqueued is dropped, so queued
+// packets are preserved. With DropOldest the oldest queued packet is dropped
+// instead, so that freshest data is delivered first after an outage.
+//
+// In both cases enqueueing never blocks (unless BlockWithTimeout is used),
+// and dropped packets are reported as lost.
+func DropPolicy(policy int) Option {
+	return func(c *ClientOptions) {
+		c.DropPolicy = policy
+	}
+}
+
+// RetainOverflow keeps up to maxPackets packets locally when send queue is full,
+// so that they're retried on next flush instead of being dropped
+//
+// Retained packets are enqueued before any newer packet, so the order of metrics
+// is preserved. Packet is dropped (according to DropPolicy) and reported as lost
+// only if maxPackets packets are already retained.
+//
+// Retained packets are not returned to the buffer pool until they're sent,
+// so retaining might increase memory usage by up to maxPackets buffers.
+//
+// Default is not to retain packets.
+func RetainOverflow(maxPackets int) Option {
+	return func(c *ClientOptions) {
+		c.RetainOverflow = maxPackets
+	}
+}
+
+// TrackGaugeState enables tracking of last value sent for each gauge
+//
+// StatsD protocol doesn't allow setting gauge to a negative value directly,
+// so Gauge and FGauge with negative value are sent as reset to zero followed by the
+// value in the same packet. With gauge state tracking, updates of the same gauge are
+// serialized, so that reset sequences of concurrent updates are delivered in order.
+// Negative values are never sent as deltas, so gauge doesn't drift on the server
+// if packets are lost.
+//
+// Gauges are identified by name and tags, up to maxGauges gauges are tracked,
+// least recently used gauges are evicted.
+func TrackGaugeState(maxGauges int) Option {
+	return func(c *ClientOptions) {
+		c.TrackGaugeState = maxGauges
+	}
+}
+
+// CompressGauges keeps only the last value of each gauge (identified by name and
+// tags) within the flush interval, and sends it on flush
+//
+// Gauge which is set many times per interval is sent as a single line, as the server
+// keeps only the last value anyway. Gauge deltas are not idempotent, so they're sent
+// as is (ahead of the compressed values of the interval). Negative gauge is sent as reset to zero followed by the value, TrackGaugeState
+// is not applied to compressed gauges. High priority lane is not compressed.
+func CompressGauges(enabled bool) Option {
+	return func(c *ClientOptions) {
+		c.CompressGauges = enabled
+	}
+}
+
+// TrackCardinality enables tracking of distinct metric names emitted via the client
+//
+// Names are tracked with the prefix, number of emissions is counted for every name,
+// see Client.Cardinality. Up to maxNames names are tracked, emissions of the names
+// beyond the limit are only counted, so memory used by the tracker is bounded.
+// Tracking costs a hash and a map update (under one of several locks) per metric.
+func TrackCardinality(maxNames int) Option {
+	return func(c *ClientOptions) {
+		c.TrackCardinality = maxNames
+	}
+}
+
+// TrackSeriesCardinality enables tracking of distinct combinations of metric names
+// and tags (as hashes) in addition to the names, see TrackCardinality
+//
+// Up to maxNames series are tracked.
+func TrackSeriesCardinality(enabled bool) Option {
+	return func(c *ClientOptions) {
+		c.TrackSeriesCardinality = enabled
+	}
+}
+
+// NewlinePolicy controls handling of newlines in metric names and set values
+//
+// Newline is a metric separator in the packet, so it can't be sent as is.
+// With NewlineReplace (default) newlines are replaced with '_', with NewlineDrop
+// such metrics are dropped and counted (see GetInvalidMetrics).
+//
+// Same policy applies to protocol delimiters (':' and '|') in set values
+// passed to SetAdd (e.g. emails or URLs).
+func NewlinePolicy(policy int) Option {
+	return func(c *ClientOptions) {
+		c.NewlinePolicy = policy
+	}
+}
+
+// CloseTimeout sets how long Close keeps trying to deliver queued packets
+//
+// If statsd server is not reachable on Close, send loops keep reconnecting
+// (respecting RetryTimeout) for up to timeout. Packets which couldn't be
+// delivered are abandoned, and Close returns an error with their count.
+//
+// Close returns as soon as all the packets are delivered, so timeout
+// doesn't affect Close when statsd server is reachable.
+func CloseTimeout(timeout time.Duration) Option {
+	return func(c *ClientOptions) {
+		c.CloseTimeout = timeout
+	}
+}
+
+// TeeWriter mirrors every packet sent to the socket to w
+//
+// It's intended for debugging: packets are written as is (metric per line),
+// each packet followed by an empty line. Writes are serialized across send
+// loops, errors writing to w are ignored and don't affect delivery.
+func TeeWriter(w io.Writer) Option {
+	return func(c *ClientOptions) {
+		c.TeeWriter = w
+	}
+}
+
+// DebugDump writes every packet sent to the socket to w in human-readable form
+//
+// Each packet is preceded by a header line with timestamp, packet size in bytes and
+// number of metrics, and followed by an empty line:
+//
+//	# 2006-01-02T15:04:05.000000Z bytes=34 lines=2
+//	app.requests:1|c
+//	app.latency:12|ms
+//
+// Control characters and invalid UTF-8 are escaped as \xNN, so the dump is safe to be
+// written to the terminal (use TeeWriter to get packets as is). Writes are serialized
+// across send loops, errors writing to w are ignored and don't affect delivery.
+func DebugDump(w io.Writer) Option {
+	return func(c *ClientOptions) {
+		c.DebugDump = w
+	}
+}
+
+// WriteRetries enables retries of failed packet writes
+//
+// Packet write is retried up to n times with backoff delay between attempts
+// before packet is dropped and client reconnects to the server. If write fails
+// because of lack of the socket buffer space (ENOBUFS), packet is dropped without
+// reconnecting, as condition is transient.
+//
+// Packets dropped after retries are reported as write errors, separately
+// from queue overflow.
+func WriteRetries(n int, backoff time.Duration) Option {
+	return func(c *ClientOptions) {
+		c.WriteRetries = n
+		c.WriteRetryBackoff = backoff
+	}
+}
+
+// SynchronousMode makes every flush block until the packet is written to the socket
+//
+// It's intended for tests: after Flush returns, metrics are already delivered,
+// so tests could emit metrics, call Flush and check what was received without
+// any sleeps. Write errors (or lack of the connection) don't block the flush,
+// packet is dropped and the error is returned by the next FlushAndWait call.
+//
+// Emitters are blocked while the packet is being written (including flushes
+// of the full buffer), so production use is discouraged. Send queue, RetainOverflow
+// and SendBatchSize are bypassed in this mode.
+func SynchronousMode(enabled bool) Option {
+	return func(c *ClientOptions) {
+		c.SynchronousMode = enabled
+	}
+}
+
+// Route sends metrics with the name prefix to a different destination,
+// e.g. `Route("billing.", "billing-statsd:8125")`
+//
+// Option could be used several times, destination is picked by the longest
+// prefix matching metric name (without the client metric prefix), metrics
+// which don't match any prefix go to the default destination. Each destination
+// has its own buffers, send queue and connection, so packets never mix metrics
+// of different destinations. All the other settings (default tags, tag format,
+// packet size, etc.) are shared, statistics are tracked per destination,
+// see Client.GetRouteStats.
+func Route(prefix string, addr string) Option {
+	return func(c *ClientOptions) {
+		c.Routes = append(c.Routes, MetricRoute{Prefix: prefix, Addr: addr})
+	}
+}
+
+// PassiveMode turns the client into a pure serializer: background goroutines
+// (periodic flush, send loops, reports) are never started, and metrics are
+// delivered by the caller with Client.FlushTo
+//
+// It's intended for environments where background goroutines can't be relied upon
+// (e.g. serverless functions which are frozen between invocations). Buffers which are
+// full are handed to the send queue as usual, so SendQueueCapacity should be large
+// enough to keep packets between FlushTo calls. Periodic reporters (e.g. QuantileTimer)
+// report on every FlushTo call instead of the flush interval, and SynchronousMode is ignored.
+func PassiveMode() Option {
+	return func(c *ClientOptions) {
+		c.PassiveMode = true
+	}
+}
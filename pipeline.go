@@ -0,0 +1,274 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// pipelineBatch is maximum number of chunks packed while holding shard lock
+const pipelineBatch = 64
+
+// pipeline is an experimental lock-free alternative to buffer shards
+//
+// Producers serialize each metric into its own scratch chunk and push it to the multi-producer single-consumer queue, packer goroutine
+// assembles packets out of the chunks in the single buffer shard.
+//
+// Queue is intrusive Vyukov MPSC queue: producers only swap the head, consumer
+// owns the tail.
+type pipeline struct {
+	// number of producers between acquire and push
+	producers int32
+	stopped   int32
+	idle      int32
+	running   int32
+
+	head atomic.Pointer[bufShard]
+	tail *bufShard
+	stub bufShard
+
+	// serializes consumers when packer is not running (PassiveMode)
+	packLock sync.Mutex
+
+	wake     chan struct{}
+	flushReq chan flushRequest
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// flushRequest asks packer to flush the buffer, ack is closed when flush is done
+type flushRequest struct {
+	ack      chan struct{}
+	periodic bool
+}
+
+func newPipeline() *pipeline {
+	p := &pipeline{
+		wake:     make(chan struct{}, 1),
+		flushReq: make(chan flushRequest),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	p.head.Store(&p.stub)
+	p.tail = &p.stub
+
+	return p
+}
+
+// acquire returns empty chunk to serialize metric into
+func (p *pipeline) acquire(t *transport) *bufShard {
+	atomic.AddInt32(&p.producers, 1)
+
+	return t.getChunk()
+}
+
+// push enqueues chunk and wakes up the packer if it's idle
+//
+// If pipeline is stopped, chunk is discarded.
+func (p *pipeline) push(t *transport, chunk *bufShard) {
+	defer atomic.AddInt32(&p.producers, -1)
+
+	if atomic.LoadInt32(&p.stopped) != 0 || len(chunk.buf) == 0 {
+		if len(chunk.buf) > 0 {
+			atomic.AddInt64(&t.closedMetrics, 1)
+		}
+
+		t.putChunk(chunk)
+
+		return
+	}
+
+	chunk.next.Store(nil)
+	prev := p.head.Swap(chunk)
+	prev.next.Store(chunk)
+
+	if atomic.LoadInt32(&p.idle) != 0 && atomic.CompareAndSwapInt32(&p.idle, 1, 0) {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pop dequeues next chunk, it returns nil if queue is empty (or producer hasn't finished push yet)
+//
+// pop should be called only by a single consumer.
+func (p *pipeline) pop() *bufShard {
+	tail := p.tail
+	next := tail.next.Load()
+
+	if tail == &p.stub {
+		if next == nil {
+			return nil
+		}
+
+		p.tail = next
+		tail = next
+		next = next.next.Load()
+	}
+
+	if next != nil {
+		p.tail = next
+		return tail
+	}
+
+	if tail != p.head.Load() {
+		// push is in progress
+		return nil
+	}
+
+	p.stub.next.Store(nil)
+	prev := p.head.Swap(&p.stub)
+	prev.next.Store(&p.stub)
+
+	if next = tail.next.Load(); next != nil {
+		p.tail = next
+		return tail
+	}
+
+	return nil
+}
+
+// pack appends queued chunks to the buffer shard, it returns false if queue was empty
+func (t *transport) pack() bool {
+	p := t.pipeline
+	s := t.shards[0]
+
+	chunk := p.pop()
+	if chunk == nil {
+		return false
+	}
+
+	for chunk != nil {
+		s.bufLock.Lock()
+
+		for i := 0; chunk != nil && i < pipelineBatch; i++ {
+			t.appendChunk(s, chunk.buf)
+
+			t.putChunk(chunk)
+			chunk = p.pop()
+		}
+
+		s.bufLock.Unlock()
+	}
+
+	return true
+}
+
+// packLoop assembles packets out of the chunks pushed by producers
+func (t *transport) packLoop() {
+	p := t.pipeline
+	defer close(p.done)
+
+	for {
+		for t.pack() {
+		}
+
+		atomic.StoreInt32(&p.idle, 1)
+
+		// chunk might have been pushed before producer noticed packer is idle
+		if t.pack() {
+			atomic.StoreInt32(&p.idle, 0)
+			continue
+		}
+
+		select {
+		case <-p.wake:
+		case req := <-p.flushReq:
+			atomic.StoreInt32(&p.idle, 0)
+
+			for t.pack() {
+			}
+
+			t.flushShards(req.periodic)
+			close(req.ack)
+		case <-p.quit:
+			for t.pack() {
+			}
+
+			return
+		}
+
+		atomic.StoreInt32(&p.idle, 0)
+	}
+}
+
+// drainPipeline packs all the queued chunks in the caller goroutine
+//
+// It's used in PassiveMode, where packer is never started.
+func (t *transport) drainPipeline() {
+	p := t.pipeline
+
+	p.packLock.Lock()
+	defer p.packLock.Unlock()
+
+	if atomic.LoadInt32(&p.stopped) != 0 {
+		return
+	}
+
+	for t.pack() {
+	}
+}
+
+// flushPipeline packs all the queued chunks and flushes the buffer
+func (t *transport) flushPipeline(periodic bool) {
+	req := flushRequest{ack: make(chan struct{}), periodic: periodic}
+
+	select {
+	case t.pipeline.flushReq <- req:
+		<-req.ack
+	case <-t.pipeline.done:
+	}
+}
+
+// stopPipeline discards chunks pushed from now on, waits for in-flight producers
+// and packs all the queued chunks
+func (t *transport) stopPipeline(packerRunning bool) {
+	p := t.pipeline
+
+	atomic.StoreInt32(&p.stopped, 1)
+
+	for atomic.LoadInt32(&p.producers) > 0 {
+		runtime.Gosched()
+	}
+
+	if packerRunning {
+		close(p.quit)
+		<-p.done
+
+		return
+	}
+
+	// packer was never started, metrics emitted concurrently with close are discarded
+	p.packLock.Lock()
+	defer p.packLock.Unlock()
+
+	for chunk := p.pop(); chunk != nil; chunk = p.pop() {
+		atomic.AddInt64(&t.closedMetrics, 1)
+	}
+}
@@ -0,0 +1,146 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+)
+
+// Priority is the lane metrics are sent through, see PriorityLanes
+type Priority int
+
+// Priorities
+const (
+	// PriorityNormal lane is used by default, its packets are shed first on overload
+	PriorityNormal Priority = iota
+	// PriorityHigh lane has its own buffer and send queue, which is drained first
+	PriorityHigh
+)
+
+// WithPriority returns a clone of the client which sends metrics through the lane
+//
+// If PriorityLanes is not enabled, all the metrics go through the normal lane.
+func (c *Client) WithPriority(priority Priority) *Client {
+	clone := c.clone()
+	clone.high = priority == PriorityHigh && c.trans.highShard != nil
+
+	return clone
+}
+
+// GetLostPacketsByPriority returns number of packets of the lane dropped as
+// its send queue was full
+//
+// Without PriorityLanes all the packets go through the normal lane. Zero is
+// returned for unknown priority.
+func (c *Client) GetLostPacketsByPriority(priority Priority) int64 {
+	if !priority.valid() {
+		return 0
+	}
+
+	return atomic.LoadInt64(&c.trans.laneLostPackets[priority])
+}
+
+// GetLostMetricsByPriority returns number of metrics in the packets counted in GetLostPacketsByPriority
+func (c *Client) GetLostMetricsByPriority(priority Priority) int64 {
+	if !priority.valid() {
+		return 0
+	}
+
+	return atomic.LoadInt64(&c.trans.laneLostMetrics[priority])
+}
+
+// valid returns true if priority is one of the known lanes
+func (priority Priority) valid() bool {
+	return priority >= PriorityNormal && priority <= PriorityHigh
+}
+
+// initPriorityLanes sets up buffer and send queue of the high priority lane
+//
+// High priority buffer is flushed along with the local buffers.
+func (t *transport) initPriorityLanes(capacity int) {
+	t.highShard = &bufShard{buf: make([]byte, 0, t.bufferSize()), high: true}
+	t.highQueue = make(chan queuedPacket, capacity)
+	t.locals[t.highShard] = struct{}{}
+}
+
+// acquireHigh returns scratch buffer to format metric line for the high priority lane into
+func (t *transport) acquireHigh() *bufShard {
+	chunk := t.getChunk()
+	chunk.target = t.highShard
+
+	return chunk
+}
+
+// enqueueHigh sends packet to the high priority queue
+//
+// Retain, batching and overflow policies are not applied to the high priority
+// lane: it's drained first, so it overflows only if the normal lane is already stalled.
+// On overflow packet is spilled into the normal send queue evicting its oldest packet,
+// so that normal lane is still shed first.
+func (t *transport) enqueueHigh(sendBuf []byte, lines int) {
+	select {
+	case t.highQueue <- t.queued(sendBuf):
+		t.packetFlushed(len(sendBuf), lines)
+	default:
+		if t.replaceOldest(sendBuf) {
+			t.packetFlushed(len(sendBuf), lines)
+			return
+		}
+
+		t.overflowLost(PriorityHigh, sendBuf)
+		t.releaseBuf(sendBuf)
+	}
+}
+
+// overflowLost records packet of the lane dropped as send queue was full
+func (t *transport) overflowLost(priority Priority, buf []byte) {
+	atomic.AddInt64(&t.laneLostPackets[priority], 1)
+	atomic.AddInt64(&t.laneLostMetrics[priority], int64(bytes.Count(buf, newline)))
+
+	t.packetLost(buf, DropReasonOverflow)
+}
+
+// sendHigh sends packets waiting in the high priority queue without blocking
+//
+// Once queue is closed and drained, high is set to nil.
+func (t *transport) sendHigh(sock net.Conn, high *chan queuedPacket, addr string, log SomeLogger) error {
+	for {
+		select {
+		case p, ok := <-*high:
+			if !ok {
+				*high = nil
+				return nil
+			}
+
+			if err := t.sendQueued(sock, p, addr, log); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
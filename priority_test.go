@@ -0,0 +1,169 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPriorityLanes(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	unblock := make(chan struct{})
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), SendLoopCount(1), SendQueueCapacity(2),
+		PriorityLanes(3),
+		func(c *ClientOptions) {
+			c.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+
+				conn, err := d.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				return &blockingConn{Conn: conn, unblock: unblock}, nil
+			}
+		})
+	defer client.Close() //nolint:errcheck
+
+	high := client.WithPriority(PriorityHigh)
+
+	client.Incr("debug.first", 1)
+	client.Flush()
+
+	// wait for the send loop to pick up first packet, it's blocked writing it
+	for len(client.trans.sendQueue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// two normal packets stay in the queue, the rest is shed, while all the high priority packets are queued
+	for i := 1; i <= 5; i++ {
+		client.Timing("debug.timer", int64(i))
+		if i <= 3 {
+			high.Incr("billing.charged", int64(i))
+		}
+		client.Flush()
+	}
+
+	if lost := client.GetLostPacketsByPriority(PriorityNormal); lost != 3 {
+		t.Errorf("unexpected lost normal packets: %d", lost)
+	}
+
+	if lost := client.GetLostMetricsByPriority(PriorityNormal); lost != 3 {
+		t.Errorf("unexpected lost normal metrics: %d", lost)
+	}
+
+	if lost := client.GetLostPacketsByPriority(PriorityHigh); lost != 0 {
+		t.Errorf("unexpected lost high priority packets: %d", lost)
+	}
+
+	if length := client.GetStats().HighPriorityQueueLength; length != 3 {
+		t.Errorf("unexpected high priority queue length: %d", length)
+	}
+
+	// once high priority queue is full, packet is spilled into the normal queue evicting the oldest normal packet
+	high.Incr("billing.charged", 4)
+	high.Flush()
+
+	if lost := client.GetLostPacketsByPriority(PriorityHigh); lost != 0 {
+		t.Errorf("unexpected lost high priority packets: %d", lost)
+	}
+
+	if lost := client.GetLostPacketsByPriority(PriorityNormal); lost != 4 {
+		t.Errorf("unexpected lost normal packets: %d", lost)
+	}
+
+	if lost := client.GetLostPackets(); lost != 4 {
+		t.Errorf("unexpected lost packets: %d", lost)
+	}
+
+	close(unblock)
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+
+	if err := client.FlushAndWait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// high priority queue is drained before the normal one
+	for _, expected := range []string{
+		"debug.first:1|c",
+		"billing.charged:1|c", "billing.charged:2|c", "billing.charged:3|c",
+		"debug.timer:2|ms", "billing.charged:4|c",
+	} {
+		select {
+		case buf := <-received:
+			if string(buf) != expected {
+				t.Errorf("unexpected packet: %#v != %#v", string(buf), expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics")
+		}
+	}
+}
+
+func TestPriorityLanesDisabled(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	// without priority lanes metrics go through the normal lane
+	high := client.WithPriority(PriorityHigh)
+	high.Incr("billing.charged", 1)
+	client.Incr("debug.count", 1)
+	client.Flush()
+
+	select {
+	case buf := <-received:
+		if expected := "billing.charged:1|c\ndebug.count:1|c"; string(buf) != expected {
+			t.Errorf("unexpected packet: %#v != %#v", string(buf), expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for metrics")
+	}
+}
+
+func TestLostByUnknownPriority(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", PriorityLanes(10))
+	defer client.Close() //nolint:errcheck
+
+	for _, priority := range []Priority{-1, PriorityHigh + 1, 100} {
+		if lost := client.GetLostPacketsByPriority(priority); lost != 0 {
+			t.Errorf("unexpected lost packets for %d: %d", priority, lost)
+		}
+
+		if lost := client.GetLostMetricsByPriority(priority); lost != 0 {
+			t.Errorf("unexpected lost metrics for %d: %d", priority, lost)
+		}
+	}
+}
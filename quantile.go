@@ -0,0 +1,217 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Quantile sketch parameters
+//
+// Sketch is a DDSketch with fixed logarithmic buckets: duration d falls into
+// bucket ceil(log(d)/log(gamma)), and bucket is represented by the value with
+// relative error at most sketchAccuracy. Buckets cover durations from 1ns up
+// to ~22 hours, longer durations fall into the last bucket.
+const (
+	sketchAccuracy = 0.01
+	sketchBuckets  = 1600
+)
+
+var (
+	sketchGamma       = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchInvLogGamma = 1 / math.Log(sketchGamma)
+)
+
+// quantileSketch accumulates durations in logarithmic buckets
+type quantileSketch struct {
+	buckets [sketchBuckets]uint32
+	count   int64
+	// maximum is the longest duration in nanoseconds
+	maximum int64
+}
+
+// observe records duration, it doesn't allocate and it's safe for concurrent use
+func (s *quantileSketch) observe(d time.Duration) {
+	var i int
+	if d > 1 {
+		i = int(math.Ceil(math.Log(float64(d)) * sketchInvLogGamma))
+		if i >= sketchBuckets {
+			i = sketchBuckets - 1
+		}
+	}
+
+	atomic.AddUint32(&s.buckets[i], 1)
+	atomic.AddInt64(&s.count, 1)
+
+	for {
+		maximum := atomic.LoadInt64(&s.maximum)
+		if int64(d) <= maximum || atomic.CompareAndSwapInt64(&s.maximum, maximum, int64(d)) {
+			break
+		}
+	}
+}
+
+// sketchValue returns duration representing the bucket
+func sketchValue(i int) time.Duration {
+	return time.Duration(2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1))
+}
+
+// snapshot resets the sketch filling counts with the buckets
+//
+// Buckets are swapped one by one, so observation which happens concurrently
+// might be split between two snapshots.
+func (s *quantileSketch) snapshot(counts *[sketchBuckets]uint32) (count int64, maximum time.Duration) {
+	count = atomic.SwapInt64(&s.count, 0)
+	maximum = time.Duration(atomic.SwapInt64(&s.maximum, 0))
+
+	for i := range s.buckets {
+		counts[i] = atomic.SwapUint32(&s.buckets[i], 0)
+	}
+
+	return
+}
+
+// sketchQuantiles computes quantiles (sorted) out of the bucket counts into values
+//
+// Quantile q is the value of the observation with rank q*(count-1) (0-based).
+func sketchQuantiles(counts *[sketchBuckets]uint32, quantiles []float64, maximum time.Duration, values []time.Duration) {
+	var (
+		cumulative int64
+		total      int64
+	)
+
+	for i := range counts {
+		total += int64(counts[i])
+	}
+
+	q := 0
+
+	for i := 0; i < len(counts) && q < len(quantiles); i++ {
+		cumulative += int64(counts[i])
+
+		for q < len(quantiles) && float64(cumulative) > quantiles[q]*float64(total-1) {
+			values[q] = sketchValue(i)
+			if values[q] > maximum {
+				// last bucket covers all the long durations
+				values[q] = maximum
+			}
+
+			q++
+		}
+	}
+}
+
+// QuantileTimer computes quantiles of durations client-side
+//
+// Every flush interval timer emits gauges with the quantiles of durations observed
+// since the last flush (stat.p50, stat.p99, stat.p99_9 for 0.5, 0.99, 0.999),
+// maximum duration (stat.max) in milliseconds and number of observations (stat.count).
+// Quantiles are computed with relative error under 1%, memory used by the timer
+// doesn't depend on the number of observations (~6 KiB). If there were no observations,
+// only stat.count is emitted. Suffixes are joined with NameSeparator.
+type QuantileTimer struct {
+	client    *Client
+	quantiles []float64
+	names     []string
+	tags      []Tag
+
+	maxName   string
+	countName string
+
+	sketch quantileSketch
+	// used only from the flush loop
+	counts [sketchBuckets]uint32
+	values []time.Duration
+}
+
+// NewQuantileTimer creates timer reporting quantiles of the observed durations as gauges
+//
+// Quantiles should be in (0, 1], other values are ignored, see DisablePeriodicFlush.
+func (c *Client) NewQuantileTimer(stat string, quantiles []float64, tags ...Tag) *QuantileTimer {
+	sep := c.trans.nameSeparator
+
+	qt := &QuantileTimer{
+		client:    c.reporterClient(),
+		tags:      append([]Tag(nil), tags...),
+		maxName:   joinPrefix(stat, "max", sep),
+		countName: joinPrefix(stat, "count", sep),
+	}
+
+	for _, q := range quantiles {
+		if q > 0 && q <= 1 {
+			qt.quantiles = append(qt.quantiles, q)
+		}
+	}
+
+	sort.Float64s(qt.quantiles)
+
+	qt.names = make([]string, len(qt.quantiles))
+	qt.values = make([]time.Duration, len(qt.quantiles))
+
+	for i, q := range qt.quantiles {
+		// percentile might be fractional, e.g. 0.999 is p99_9
+		percentile := strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64)
+		qt.names[i] = joinPrefix(stat, "p", sep) + strings.ReplaceAll(percentile, ".", "_")
+	}
+
+	c.trans.register(qt)
+
+	return qt
+}
+
+// Observe records duration in the timer
+func (qt *QuantileTimer) Observe(d time.Duration) {
+	qt.sketch.observe(d)
+
+	// background goroutines are started lazily, so make sure flush loop is running
+	qt.client.trans.start()
+}
+
+// Stop unregisters timer, observations which were not reported yet are discarded
+func (qt *QuantileTimer) Stop() {
+	qt.client.trans.unregister(qt)
+}
+
+// report emits gauges for the observations since the last flush
+func (qt *QuantileTimer) report(time.Time) {
+	count, maximum := qt.sketch.snapshot(&qt.counts)
+
+	if count > 0 {
+		sketchQuantiles(&qt.counts, qt.quantiles, maximum, qt.values)
+
+		for i := range qt.values {
+			qt.client.FGauge(qt.names[i], float64(qt.values[i])/float64(time.Millisecond), qt.tags...)
+		}
+
+		qt.client.FGauge(qt.maxName, float64(maximum)/float64(time.Millisecond), qt.tags...)
+	}
+
+	qt.client.Gauge(qt.countName, count, qt.tags...)
+}
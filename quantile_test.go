@@ -0,0 +1,183 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuantileSketchAccuracy(t *testing.T) {
+	quantiles := []float64{0.5, 0.9, 0.99, 0.999, 1}
+
+	for _, tt := range []struct {
+		name     string
+		generate func(rnd *rand.Rand) time.Duration
+	}{
+		{"Uniform", func(rnd *rand.Rand) time.Duration {
+			return time.Millisecond + time.Duration(rnd.Int63n(int64(time.Second)))
+		}},
+		{"LogNormal", func(rnd *rand.Rand) time.Duration {
+			// median 20ms, long tail
+			return time.Duration(math.Exp(math.Log(float64(20*time.Millisecond)) + rnd.NormFloat64()))
+		}},
+		{"Microseconds", func(rnd *rand.Rand) time.Duration {
+			return time.Duration(rnd.Int63n(int64(100 * time.Microsecond)))
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rnd := rand.New(rand.NewSource(1))
+
+			var sketch quantileSketch
+
+			samples := make([]time.Duration, 100000)
+			for i := range samples {
+				samples[i] = tt.generate(rnd)
+				sketch.observe(samples[i])
+			}
+
+			sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+			var counts [sketchBuckets]uint32
+
+			count, maximum := sketch.snapshot(&counts)
+			if count != int64(len(samples)) {
+				t.Errorf("unexpected count %d", count)
+			}
+
+			if maximum != samples[len(samples)-1] {
+				t.Errorf("unexpected maximum %v != %v", maximum, samples[len(samples)-1])
+			}
+
+			values := make([]time.Duration, len(quantiles))
+			sketchQuantiles(&counts, quantiles, maximum, values)
+
+			for i, q := range quantiles {
+				exact := samples[int(q*float64(len(samples)-1))]
+
+				if relErr := math.Abs(float64(values[i]-exact)) / float64(exact); relErr > sketchAccuracy+1e-6 && exact > 100 {
+					t.Errorf("quantile %v: %v != %v (error %.4f)", q, values[i], exact, relErr)
+				}
+			}
+
+			// sketch is reset by snapshot
+			if count, _ = sketch.snapshot(&counts); count != 0 {
+				t.Errorf("sketch wasn't reset: %d", count)
+			}
+		})
+	}
+}
+
+func TestQuantileTimerFlush(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), MetricPrefix("web."), FloatPrecision(0))
+	defer client.Close() //nolint:errcheck
+
+	qt := client.NewQuantileTimer("req.latency", []float64{0.99, 0.5, 0.999, 2}, StringTag("route", "api"))
+	defer qt.Stop()
+
+	for i := 0; i < 99; i++ {
+		qt.Observe(20 * time.Millisecond)
+	}
+
+	qt.Observe(3 * time.Second)
+
+	expected := []string{
+		"web.req.latency.p50,route=api:20|g",
+		"web.req.latency.p99,route=api:20|g",
+		// rank of p99.9 is 98.9, so it's still the 99th observation
+		"web.req.latency.p99_9,route=api:20|g",
+		"web.req.latency.max,route=api:3000|g",
+		"web.req.latency.count,route=api:100|g",
+	}
+
+	if packet := readReported(t, client, received); packet != strings.Join(expected, "\n") {
+		t.Errorf("unexpected packet: %#v != %#v", packet, strings.Join(expected, "\n"))
+	}
+
+	// no observations since the last flush
+	if packet := readReported(t, client, received); packet != "web.req.latency.count,route=api:0|g" {
+		t.Errorf("unexpected packet: %#v", packet)
+	}
+
+	qt.Stop()
+	qt.Observe(time.Millisecond)
+
+	if packet := readReported(t, client, received); packet != "" {
+		t.Errorf("unexpected packet after stop: %#v", packet)
+	}
+}
+
+func TestQuantileTimerSeparator(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour), NameSeparator("_"), FloatPrecision(0))
+	defer client.Close() //nolint:errcheck
+
+	qt := client.NewQuantileTimer("req_latency", []float64{0.5})
+	defer qt.Stop()
+
+	qt.Observe(20 * time.Millisecond)
+
+	if packet := readReported(t, client, received); packet != "req_latency_p50:20|g\nreq_latency_max:20|g\nreq_latency_count:1|g" {
+		t.Errorf("unexpected packet: %q", packet)
+	}
+}
+
+func TestQuantileTimerAllocs(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	qt := client.NewQuantileTimer("req.latency", []float64{0.5, 0.99})
+	defer qt.Stop()
+
+	if allocs := testing.AllocsPerRun(1000, func() { qt.Observe(15 * time.Millisecond) }); allocs != 0 {
+		t.Errorf("unexpected allocations: %v", allocs)
+	}
+}
+
+func BenchmarkQuantileTimer(b *testing.B) {
+	client := NewClient("127.0.0.1:8125", FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	qt := client.NewQuantileTimer("req.latency", []float64{0.5, 0.9, 0.99})
+	defer qt.Stop()
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		d := time.Millisecond
+		for pb.Next() {
+			qt.Observe(d)
+			d += time.Microsecond
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RateTracker computes rate of events client-side and reports it as a gauge
+//
+// Marks are counted with atomics, every flush interval tracker emits FGauge
+// with the number of marks per second over the elapsed window. This is useful
+// for backends which don't normalize counters by the flush interval.
+type RateTracker struct {
+	marks int64
+
+	client *Client
+	stat   string
+	tags   []Tag
+
+	// start of the current window, accessed only from the flush loop
+	start time.Time
+}
+
+// NewRateTracker creates RateTracker which reports rate of marks as gauge stat
+//
+// Window shorter than half of the flush interval is carried over to the next flush,
+// so the first value is not skewed, see DisablePeriodicFlush.
+func (c *Client) NewRateTracker(stat string, tags ...Tag) *RateTracker {
+	r := &RateTracker{
+		client: c.reporterClient(),
+		stat:   stat,
+		tags:   append([]Tag(nil), tags...),
+		start:  c.trans.now(),
+	}
+
+	c.trans.register(r)
+
+	return r
+}
+
+// Mark records n events
+func (r *RateTracker) Mark(n int64) {
+	atomic.AddInt64(&r.marks, n)
+
+	// background goroutines are started lazily, so make sure flush loop is running
+	r.client.trans.start()
+}
+
+// Stop unregisters tracker, marks which were not reported yet are discarded
+func (r *RateTracker) Stop() {
+	r.client.trans.unregister(r)
+}
+
+// report emits the rate over the window ending now
+func (r *RateTracker) report(now time.Time) {
+	elapsed := now.Sub(r.start)
+	if elapsed <= 0 || elapsed < r.client.trans.rateMinWindow {
+		return
+	}
+
+	marks := atomic.SwapInt64(&r.marks, 0)
+	r.start = now
+
+	r.client.FGauge(r.stat, float64(marks)/elapsed.Seconds(), r.tags...)
+}
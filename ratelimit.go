@@ -0,0 +1,88 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a lock-free token bucket
+//
+// It's implemented as GCRA: instead of tracking number of tokens, theoretical
+// arrival time (tat) of the next event is tracked. Bucket allows bursts of up
+// to one second worth of events.
+type rateLimiter struct {
+	tat      int64
+	interval int64
+	burst    int64
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		interval: int64(time.Second) / int64(perSecond),
+		burst:    int64(time.Second),
+	}
+}
+
+// allow returns true if event fits into the budget
+func (l *rateLimiter) allow() bool {
+	now := time.Now().UnixNano()
+
+	for {
+		tat := atomic.LoadInt64(&l.tat)
+
+		newTat := tat
+		if newTat < now {
+			newTat = now
+		}
+
+		newTat += l.interval
+
+		if newTat-now > l.burst {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&l.tat, tat, newTat) {
+			return true
+		}
+	}
+}
+
+// clone returns new limiter with the same rate and full budget
+func (l *rateLimiter) clone() *rateLimiter {
+	if l == nil {
+		return nil
+	}
+
+	return &rateLimiter{
+		interval: l.interval,
+		burst:    l.burst,
+	}
+}
@@ -0,0 +1,229 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// MetricRoute sends metrics with the name prefix to a different destination, see Route
+type MetricRoute struct {
+	Prefix string
+	Addr   string
+}
+
+// RouteStats is a snapshot of internal state of the destination, see Route
+type RouteStats struct {
+	// Addr is the destination address
+	Addr string
+	// Prefixes are metric name prefixes routed to the destination
+	Prefixes []string
+
+	Stats
+}
+
+// router picks destination of the metric by name prefix
+type router struct {
+	// longest prefix first
+	routes []route
+	// clients of the destinations other than the default one
+	clients []*Client
+}
+
+type route struct {
+	prefix string
+	// index of the destination client, -1 for the default destination
+	dest int
+}
+
+// newRouter creates clients for each destination, destinations share client options
+func newRouter(addr string, routes []MetricRoute, options []Option) *router {
+	r := &router{}
+
+	// later route for the same prefix wins
+	prefixes := map[string]string{}
+	for _, rt := range routes {
+		prefixes[rt.Prefix] = rt.Addr
+	}
+
+	dests := map[string]int{addr: -1}
+
+	options = append(options[:len(options):len(options)], func(c *ClientOptions) {
+		c.Routes = nil
+		// client own metrics are reported by the default destination
+		c.TelemetryInterval = 0
+	})
+
+	for _, rt := range routes {
+		destAddr, ok := prefixes[rt.Prefix]
+		if !ok {
+			continue
+		}
+
+		delete(prefixes, rt.Prefix)
+
+		dest, ok := dests[destAddr]
+		if !ok {
+			dest = len(r.clients)
+			dests[destAddr] = dest
+
+			r.clients = append(r.clients, NewClient(destAddr, options...))
+		}
+
+		r.routes = append(r.routes, route{prefix: rt.Prefix, dest: dest})
+	}
+
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+
+	return r
+}
+
+// match returns destination of the metric by the longest matching prefix
+func (r *router) match(stat string) int {
+	for i := range r.routes {
+		if strings.HasPrefix(stat, r.routes[i].prefix) {
+			return r.routes[i].dest
+		}
+	}
+
+	return -1
+}
+
+// routeFor returns client which sends metric to the destination picked by name
+//
+// Clients of the destinations inherit prefix, tags and settings of c,
+// they're created on first use.
+func (c *Client) routeFor(stat string) *Client {
+	if c.router == nil {
+		return c
+	}
+
+	dest := c.router.match(stat)
+	if dest < 0 || atomic.LoadInt32(&c.detached) != 0 {
+		return c
+	}
+
+	clients := c.routed.Load()
+	if clients == nil {
+		clients = c.routeClients()
+	}
+
+	return (*clients)[dest]
+}
+
+func (c *Client) routeClients() *[]*Client {
+	clients := make([]*Client, len(c.router.clients))
+
+	for i, dest := range c.router.clients {
+		clone := c.clone()
+		clone.trans = dest.trans
+		clone.router = nil
+		// routing is transparent, so rate limit and name cache are shared
+		clone.limiter = c.limiter
+		clone.names = c.names
+		clone.local = nil
+		clone.high = c.high && dest.trans.highShard != nil
+
+		clients[i] = clone
+	}
+
+	if !c.routed.CompareAndSwap(nil, &clients) {
+		return c.routed.Load()
+	}
+
+	return &clients
+}
+
+// flushRoutes flushes buffers of all the destinations other than the default one
+func (c *Client) flushRoutes() {
+	if c.router == nil {
+		return
+	}
+
+	for _, dest := range c.router.clients {
+		dest.Flush()
+	}
+}
+
+// waitRoutes flushes buffers of the destinations other than the default one and
+// waits for the packets to be sent, first error is returned
+func (c *Client) waitRoutes(ctx context.Context) error {
+	if c.router == nil {
+		return nil
+	}
+
+	var firstErr error
+
+	for _, dest := range c.router.clients {
+		if err := dest.FlushAndWait(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// closeRoutes stops clients of the destinations other than the default one
+func (c *Client) closeRoutes() error {
+	if c.router == nil {
+		return nil
+	}
+
+	var firstErr error
+
+	for _, dest := range c.router.clients {
+		if err := dest.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// GetRouteStats returns snapshot of internal state of each destination, see Route
+//
+// Default destination goes first, it's the same as GetStats.
+func (c *Client) GetRouteStats() []RouteStats {
+	result := []RouteStats{{Addr: c.trans.addr, Stats: c.GetStats()}}
+
+	if c.router == nil {
+		return result
+	}
+
+	for _, dest := range c.router.clients {
+		result = append(result, RouteStats{Addr: dest.trans.addr, Stats: dest.GetStats()})
+	}
+
+	for _, rt := range c.router.routes {
+		result[rt.dest+1].Prefixes = append(result[rt.dest+1].Prefixes, rt.prefix)
+	}
+
+	return result
+}
@@ -0,0 +1,148 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoute(t *testing.T) {
+	defaultSocket, defaultReceived := setupListener(t)
+	defer defaultSocket.Close() //nolint:errcheck
+
+	billingSocket, billingReceived := setupListener(t)
+	defer billingSocket.Close() //nolint:errcheck
+
+	defaultAddr, billingAddr := defaultSocket.LocalAddr().String(), billingSocket.LocalAddr().String()
+
+	client := NewClient(defaultAddr, FlushInterval(time.Hour), MaxPacketSize(100), SendQueueCapacity(100),
+		MetricPrefix("app."), TagStyle(TagFormatDatadog), DefaultTags(StringTag("host", "a")),
+		Route("billing.", billingAddr), Route("billing.debug.", defaultAddr), Route("invoices.", billingAddr))
+	defer client.Close() //nolint:errcheck
+
+	clone := client.CloneWithPrefix("api.")
+
+	var expectedDefault, expectedBilling []string
+
+	for i := 1; i <= 10; i++ {
+		client.Incr("req.count", int64(i))
+		client.Incr("billing.charged", int64(i), IntTag("plan", i))
+		client.Timing("billing.debug.time", int64(i))
+		clone.Gauge("invoices.pending", int64(i))
+		clone.SetAdd("billingsomething", "x")
+
+		expectedDefault = append(expectedDefault,
+			"app.req.count:"+strconv.Itoa(i)+"|c|#host:a",
+			"app.billing.debug.time:"+strconv.Itoa(i)+"|ms|#host:a",
+			"api.billingsomething:x|s|#host:a")
+		expectedBilling = append(expectedBilling,
+			"app.billing.charged:"+strconv.Itoa(i)+"|c|#host:a,plan:"+strconv.Itoa(i),
+			"api.invoices.pending:"+strconv.Itoa(i)+"|g|#host:a")
+	}
+
+	if err := client.SendMetrics([]Metric{
+		{Name: "billing.refunds", Type: MetricCounter, Value: 1},
+		{Name: "req.time", Type: MetricTiming, Value: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedBilling = append(expectedBilling, "app.billing.refunds:1|c|#host:a")
+	expectedDefault = append(expectedDefault, "app.req.time:2|ms|#host:a")
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second)
+	defer ctxCancel()
+
+	if err := client.FlushAndWait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	collect := func(received chan []byte, expected int) []string {
+		var lines []string
+
+		for len(lines) < expected {
+			select {
+			case buf := <-received:
+				lines = append(lines, strings.Split(string(buf), "\n")...)
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for metrics: %q", lines)
+			}
+		}
+
+		select {
+		case buf := <-received:
+			t.Errorf("unexpected packet: %q", buf)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		sort.Strings(lines)
+
+		return lines
+	}
+
+	sort.Strings(expectedDefault)
+	sort.Strings(expectedBilling)
+
+	if lines := collect(defaultReceived, len(expectedDefault)); !reflect.DeepEqual(lines, expectedDefault) {
+		t.Errorf("unexpected default metrics: %q != %q", lines, expectedDefault)
+	}
+
+	if lines := collect(billingReceived, len(expectedBilling)); !reflect.DeepEqual(lines, expectedBilling) {
+		t.Errorf("unexpected billing metrics: %q != %q", lines, expectedBilling)
+	}
+
+	stats := client.GetRouteStats()
+	if len(stats) != 2 {
+		t.Fatalf("unexpected routes: %+v", stats)
+	}
+
+	if stats[0].Addr != defaultAddr || !reflect.DeepEqual(stats[0].Prefixes, []string{"billing.debug."}) ||
+		stats[0].PacketsSent == 0 || stats[0].PacketsSent != client.GetStats().PacketsSent {
+		t.Errorf("unexpected default route stats: %+v", stats[0])
+	}
+
+	if stats[1].Addr != billingAddr || !reflect.DeepEqual(stats[1].Prefixes, []string{"invoices.", "billing."}) ||
+		stats[1].PacketsSent == 0 {
+		t.Errorf("unexpected billing route stats: %+v", stats[1])
+	}
+
+	// detached clone doesn't send anything
+	clone.Close() //nolint:errcheck
+	clone.Gauge("invoices.pending", 1)
+
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if packets := client.GetRouteStats()[1].PacketsSent; packets != stats[1].PacketsSent {
+		t.Errorf("unexpected packets sent after close: %d", packets)
+	}
+}
@@ -0,0 +1,79 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+)
+
+// SetSampleRate changes default sample rate for counters at runtime
+//
+// Sample rate is shared by the client and all its clones. See DefaultSampleRate.
+func (c *Client) SetSampleRate(rate float64) {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+
+	atomic.StoreUint64(&c.trans.sampleRate, math.Float64bits(rate))
+
+	if c.router != nil {
+		for _, dest := range c.router.clients {
+			dest.SetSampleRate(rate)
+		}
+	}
+}
+
+// GetSampleRate returns current default sample rate for counters
+func (c *Client) GetSampleRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.trans.sampleRate))
+}
+
+// sample decides whether counter should be sent according to the per-call
+// sample rate (if non-zero, see WithRate) or the client sample rate
+func (c *Client) sample(rate float64) (float64, bool) {
+	if rate == 0 {
+		rate = c.GetSampleRate()
+	}
+
+	return rate, sampled(rate)
+}
+
+// sampled returns true if the metric sampled with the rate should be sent
+func sampled(rate float64) bool {
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// appendSampleRate appends sample rate annotation unless rate is 1
+func appendSampleRate(buf []byte, rate float64) []byte {
+	if rate >= 1 {
+		return buf
+	}
+
+	buf = append(buf, '|', '@')
+	return strconv.AppendFloat(buf, rate, 'f', -1, 64)
+}
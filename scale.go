@@ -0,0 +1,99 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Send loop scaling parameters
+const (
+	// DefaultScaleInterval is how often send queue length is checked to scale send loops
+	DefaultScaleInterval = 100 * time.Millisecond
+
+	// scaleUpIntervals is number of consecutive checks with the queue at least half full to start a send loop
+	scaleUpIntervals = 3
+	// scaleDownIntervals is number of consecutive checks with the queue nearly empty to retire a send loop
+	scaleDownIntervals = 50
+)
+
+// scaleLoop starts additional send loops (up to maxLoops) while the send queue
+// stays at least half full and retires them when queue stays nearly empty
+//
+// Additional send loops are started with spawn, each of them gets its own
+// stop channel which is closed to retire the loop.
+func (t *transport) scaleLoop(maxLoops int, interval time.Duration, spawn func(index int, stop <-chan struct{})) {
+	defer t.shutdownWg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var (
+		stops                []chan struct{}
+		pressure, idleChecks int
+		capacity             = cap(t.sendQueue)
+	)
+
+	for {
+		select {
+		case <-t.shutdown:
+			// additional send loops drain the queue along with the others until it's closed
+			return
+		case <-ticker.C:
+		}
+
+		depth := len(t.sendQueue)
+
+		switch {
+		case depth*2 >= capacity:
+			pressure++
+			idleChecks = 0
+		case depth*16 <= capacity:
+			idleChecks++
+			pressure = 0
+		default:
+			pressure, idleChecks = 0, 0
+		}
+
+		if pressure >= scaleUpIntervals && t.sendLoopCount+len(stops) < maxLoops {
+			pressure = 0
+
+			stop := make(chan struct{})
+			stops = append(stops, stop)
+
+			t.shutdownWg.Add(1)
+			atomic.AddInt32(&t.sendLoopsActive, 1)
+			spawn(len(stops)%t.sendLoopCount, stop)
+		}
+
+		if idleChecks >= scaleDownIntervals && len(stops) > 0 {
+			idleChecks = 0
+
+			close(stops[len(stops)-1])
+			stops = stops[:len(stops)-1]
+			atomic.AddInt32(&t.sendLoopsActive, -1)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bufShard is a buffer metrics are appended to
+//
+// Client might have several shards to reduce lock contention when metrics
+// are emitted from many goroutines.
+type bufShard struct {
+	bufLock    sync.Mutex
+	buf        []byte
+	bufLines   int
+	blockTimer *time.Timer
+	// time of the first append after the flush (UnixNano), tracked only with MinFlushSize
+	firstAppend int64
+
+	// next chunk in the pipeline queue
+	next atomic.Pointer[bufShard]
+	// shard scratch buffer is copied to
+	target *bufShard
+	// buffer of the high priority lane, see PriorityLanes
+	high bool
+}
+
+// initShards allocates buffer shards, if shards <= 0, GOMAXPROCS is used
+func (t *transport) initShards(shards int) {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+
+	t.shards = make([]*bufShard, shards)
+	for i := range t.shards {
+		t.shards[i] = &bufShard{buf: make([]byte, 0, t.bufferSize())}
+	}
+
+	t.locals = make(map[*bufShard]struct{})
+	t.localPool.New = func() interface{} {
+		return &bufShard{buf: make([]byte, 0, t.bufferSize())}
+	}
+
+	t.chunkPool.New = func() interface{} {
+		return &bufShard{buf: make([]byte, 0, scratchSize)}
+	}
+
+	var next uint32
+
+	t.shardPool.New = func() interface{} {
+		return t.shards[atomic.AddUint32(&next, 1)%uint32(len(t.shards))]
+	}
+}
+
+// scratchSize is initial capacity of the buffer metric line is formatted into
+const scratchSize = 256
+
+// pickShard picks a shard for the calling goroutine
+//
+// Shards are kept in sync.Pool, so that goroutine tends to reuse the same shard.
+func (t *transport) pickShard() *bufShard {
+	if len(t.shards) == 1 {
+		return t.shards[0]
+	}
+
+	s := t.shardPool.Get().(*bufShard) //nolint:errcheck,forcetypeassert
+	t.shardPool.Put(s)
+
+	return s
+}
+
+// shardFor picks a shard by metric name
+//
+// Gauges are not commutative, so values of the same gauge should always go
+// through the same shard to be delivered in order.
+func (t *transport) shardFor(stat string) *bufShard {
+	if len(t.shards) == 1 {
+		return t.shards[0]
+	}
+
+	// FNV-1a
+	hash := uint32(2166136261)
+	for i := 0; i < len(stat); i++ {
+		hash ^= uint32(stat[i])
+		hash *= 16777619
+	}
+
+	return t.shards[hash%uint32(len(t.shards))]
+}
+
+// acquireBuf picks and locks a shard to format metric line into
+//
+// In pipeline mode line is formatted into the chunk instead.
+func (t *transport) acquireBuf() *bufShard {
+	if t.pipeline != nil {
+		return t.pipeline.acquire(t)
+	}
+
+	return t.lockShard(t.pickShard())
+}
+
+// acquireBufFor locks a shard picked by metric name to format metric line into
+func (t *transport) acquireBufFor(stat string) *bufShard {
+	if t.pipeline != nil {
+		return t.pipeline.acquire(t)
+	}
+
+	return t.lockShard(t.shardFor(stat))
+}
+
+// lockShard locks the shard to format metric line directly into
+func (t *transport) lockShard(s *bufShard) *bufShard {
+	s.bufLock.Lock()
+
+	return s
+}
+
+// commit finishes appending metric to the shard locked with acquireBuf and unlocks it
+//
+// In pipeline mode shard is a chunk which is pushed to the pipeline queue.
+func (t *transport) commit(s *bufShard, lastLen int) {
+	if t.pipeline != nil {
+		t.pipeline.push(t, s)
+		return
+	}
+
+	t.checkBuf(s, lastLen)
+	s.bufLock.Unlock()
+}
+
+// commitChunk copies formatted metric line to the target shard buffer
+func (t *transport) commitChunk(chunk *bufShard) {
+	s := chunk.target
+	chunk.target = nil
+
+	if len(chunk.buf) > 0 {
+		s.bufLock.Lock()
+		t.appendChunk(s, chunk.buf)
+		s.bufLock.Unlock()
+	}
+
+	t.putChunk(chunk)
+}
+
+// appendChunk appends formatted metric lines to the shard buffer
+//
+// If lines don't fit into the packet, buffer is flushed before the append,
+// so that lines are not copied once again to the new buffer.
+func (t *transport) appendChunk(s *bufShard, chunk []byte) {
+	maxPacketSize := t.packetSize()
+
+	if len(s.buf) > 0 && len(s.buf)+len(chunk) > maxPacketSize && len(chunk) <= maxPacketSize && !t.queueClosed {
+		t.flushBuf(s, len(s.buf))
+	}
+
+	lastLen := len(s.buf)
+	s.buf = append(s.buf, chunk...)
+	t.checkBuf(s, lastLen)
+}
+
+// getChunk returns empty scratch buffer
+func (t *transport) getChunk() *bufShard {
+	chunk := t.chunkPool.Get().(*bufShard) //nolint:errcheck,forcetypeassert
+	chunk.buf = chunk.buf[:0]
+
+	return chunk
+}
+
+// putChunk returns scratch buffer to the pool, buffers grown by huge metrics are dropped
+func (t *transport) putChunk(chunk *bufShard) {
+	if int64(cap(chunk.buf)) > atomic.LoadInt64(&t.bufCapLimit) {
+		return
+	}
+
+	t.chunkPool.Put(chunk)
+}
+
+// lockShards locks all the shards and local buffers
+//
+// New local buffers can't be created until shards are unlocked.
+func (t *transport) lockShards() {
+	t.localsLock.Lock()
+
+	for _, s := range t.shards {
+		s.bufLock.Lock()
+	}
+
+	for s := range t.locals {
+		s.bufLock.Lock()
+	}
+}
+
+// unlockShards unlocks all the shards and local buffers
+func (t *transport) unlockShards() {
+	for s := range t.locals {
+		s.bufLock.Unlock()
+	}
+
+	for _, s := range t.shards {
+		s.bufLock.Unlock()
+	}
+
+	t.localsLock.Unlock()
+}
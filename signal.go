@@ -0,0 +1,104 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// signalFlushTimeout limits time spent delivering metrics on termination signal
+const signalFlushTimeout = time.Second
+
+// FlushOnSignal installs handler which flushes client on termination signals
+//
+// When one of the signals is received, buffered metrics are flushed and delivered
+// (waiting up to one second), after that handler is uninstalled and the signal
+// is re-raised, so that default handling (e.g. process termination) proceeds.
+// Only first signal is handled, just like with signal.NotifyContext.
+//
+// If no signals are passed, os.Interrupt and syscall.SIGTERM are handled.
+//
+// Applications which handle the same signals on their own receive the signal
+// twice (original and re-raised one), so it's better to call FlushAndWait
+// from application handler instead.
+//
+// Returned function uninstalls the handler.
+func FlushOnSignal(c *Client, signals ...os.Signal) (stop func()) {
+	return handleSignals(c, false, signals)
+}
+
+// CloseOnSignal is similar to FlushOnSignal, but client is closed on signal
+func CloseOnSignal(c *Client, signals ...os.Signal) (stop func()) {
+	return handleSignals(c, true, signals)
+}
+
+func handleSignals(c *Client, closeClient bool, signals []os.Signal) func() {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	sigC := make(chan os.Signal, 1)
+	done := make(chan struct{})
+
+	var once sync.Once
+
+	stop := func() {
+		once.Do(func() {
+			signal.Stop(sigC)
+			close(done)
+		})
+	}
+
+	signal.Notify(sigC, signals...)
+
+	go func() {
+		select {
+		case <-done:
+			return
+		case sig := <-sigC:
+			if closeClient {
+				_ = c.Close()
+			} else {
+				ctx, ctxCancel := context.WithTimeout(context.Background(), signalFlushTimeout)
+				_ = c.FlushAndWait(ctx)
+				ctxCancel()
+			}
+
+			stop()
+
+			// re-raise the signal, as handler is stopped, default action happens
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				_ = p.Signal(sig)
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,103 @@
+//go:build !windows
+
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFlushOnSignal(t *testing.T) {
+	for _, closeClient := range []bool{false, true} {
+		name := "Flush"
+		if closeClient {
+			name = "Close"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			inSocket, err := net.ListenUDP("udp4", &net.UDPAddr{
+				IP: net.IPv4(127, 0, 0, 1),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer inSocket.Close() //nolint:errcheck
+
+			client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour))
+			defer client.Close() //nolint:errcheck
+
+			// application handler keeps the test process alive when signal is re-raised
+			appC := make(chan os.Signal, 2)
+			signal.Notify(appC, syscall.SIGUSR1)
+
+			defer signal.Stop(appC)
+
+			var stop func()
+			if closeClient {
+				stop = CloseOnSignal(client, syscall.SIGUSR1)
+			} else {
+				stop = FlushOnSignal(client, syscall.SIGUSR1)
+			}
+
+			defer stop()
+
+			client.Incr("req.count", 1)
+
+			if err = syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+				t.Fatal(err)
+			}
+
+			// original signal and re-raised one
+			for i := 0; i < 2; i++ {
+				select {
+				case <-appC:
+				case <-time.After(2 * time.Second):
+					t.Fatal("timeout waiting for signal")
+				}
+			}
+
+			// metric should be delivered by the time signal is re-raised
+			buf := make([]byte, 1500)
+
+			_ = inSocket.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+
+			n, err := inSocket.Read(buf)
+			if err != nil {
+				t.Fatalf("metric not delivered: %v", err)
+			}
+
+			if string(buf[:n]) != "req.count:1|c" {
+				t.Errorf("unexpected packet: %#v", string(buf[:n]))
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of client internal state
+type Stats struct {
+	// SendLoopCount is number of goroutines sending packets
+	//
+	// With AutoScaleSendLoops it changes with the send queue pressure.
+	SendLoopCount int
+
+	// SendQueueLength is current number of packets in the send queue
+	SendQueueLength int
+	// SendQueueCapacity is capacity of the send queue
+	SendQueueCapacity int
+	// SendQueueHighWater is maximum observed length of the send queue
+	SendQueueHighWater int
+	// HighPriorityQueueLength is current number of packets in the high priority send queue, see PriorityLanes
+	HighPriorityQueueLength int
+
+	// BufPoolLength is current number of buffers in the pool
+	BufPoolLength int
+	// BufPoolCapacity is current capacity of the buffer pool
+	BufPoolCapacity int
+	// BufPoolMisses is number of times new buffer was allocated as pool was empty
+	BufPoolMisses int64
+	// BuffersAllocated is number of buffers allocated after the client was created
+	BuffersAllocated int64
+
+	// PacketsSent is number of packets written to the socket
+	PacketsSent int64
+	// BytesSent is number of bytes written to the socket (including partial writes)
+	BytesSent int64
+	// LostPackets is number of packets dropped on overflow or close, see GetLostPackets
+	LostPackets int64
+	// WriteErrors is number of packets dropped due to socket write errors
+	WriteErrors int64
+	// DialFailures is number of failed attempts to connect to the server
+	DialFailures int64
+	// Connects is number of successful connects (including reconnects) to the server
+	Connects int64
+
+	// RecommendedMaxPacketSize is maximum packet size safe for the transport,
+	// zero means there's no limit (or transport is not known)
+	RecommendedMaxPacketSize int
+}
+
+// GetStats returns snapshot of client internal state
+func (c *Client) GetStats() Stats {
+	return Stats{
+		SendLoopCount:      int(atomic.LoadInt32(&c.trans.sendLoopsActive)),
+		SendQueueLength:    len(c.trans.sendQueue),
+		SendQueueCapacity:  cap(c.trans.sendQueue),
+		SendQueueHighWater: int(atomic.LoadInt64(&c.trans.queueHighWaterOverall)),
+		BufPoolLength:      len(c.trans.bufPool),
+		BufPoolCapacity:    int(atomic.LoadInt64(&c.trans.bufPoolCapacity)),
+		BufPoolMisses:      atomic.LoadInt64(&c.trans.poolMissesOverall),
+		BuffersAllocated:   atomic.LoadInt64(&c.trans.buffersAllocated),
+		PacketsSent:        atomic.LoadInt64(&c.trans.sentPacketsOverall),
+		BytesSent:          atomic.LoadInt64(&c.trans.sentBytesOverall),
+		LostPackets:        atomic.LoadInt64(&c.trans.lostPacketsOverall),
+		WriteErrors:        atomic.LoadInt64(&c.trans.writeErrorsOverall),
+		DialFailures:       atomic.LoadInt64(&c.trans.dialFailuresOverall),
+		Connects:           atomic.LoadInt64(&c.trans.connectsOverall),
+
+		HighPriorityQueueLength:  len(c.trans.highQueue),
+		RecommendedMaxPacketSize: int(atomic.LoadInt64(&c.trans.recommendedPacketSize)),
+	}
+}
+
+// Report is client statistics for the ReportInterval passed to ReportHandler
+type Report struct {
+	// Interval is the reporting period
+	Interval time.Duration
+
+	// LostOverflow is number of packets dropped as send queue was full
+	LostOverflow int64
+	// LostMetrics is number of metrics in the packets counted in LostOverflow
+	LostMetrics int64
+	// LostBytes is number of bytes in the packets counted in LostOverflow
+	LostBytes int64
+	// LostWriteErrors is number of packets dropped due to socket write errors
+	LostWriteErrors int64
+	// DialFailures is number of failed attempts to connect to the server
+	DialFailures int64
+
+	// PacketsSent is number of packets written to the socket
+	PacketsSent int64
+	// BytesSent is number of bytes written to the socket (including partial writes)
+	BytesSent int64
+
+	// SendQueueLength is number of packets in the send queue at the moment of report
+	SendQueueLength int
+	// BufPoolLength is number of buffers in the pool at the moment of report
+	BufPoolLength int
+	// BufPoolMisses is number of buffers allocated as pool was empty
+	BufPoolMisses int64
+}
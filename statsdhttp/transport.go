@@ -0,0 +1,249 @@
+/*
+Package statsdhttp implements http.RoundTripper which reports outbound
+HTTP request metrics via statsd client.
+
+Wrap existing transport of http.Client:
+
+	httpClient := &http.Client{
+	    Transport: statsdhttp.NewTransport(client, http.DefaultTransport,
+	        statsdhttp.ConnectionTrace()),
+	}
+*/
+package statsdhttp
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/smira/go-statsd"
+)
+
+// Metric names
+const (
+	MetricDuration = "http.client.duration"
+	MetricDNS      = "http.client.dns"
+	MetricConnect  = "http.client.connect"
+	MetricTLS      = "http.client.tls"
+	MetricTTFB     = "http.client.ttfb"
+)
+
+// Transport is http.RoundTripper which measures outbound requests
+//
+// Each request is reported as PrecisionTiming MetricDuration tagged with
+// host, method and response status.
+type Transport struct {
+	client statsd.Statter
+	next   http.RoundTripper
+	trace  bool
+}
+
+// Option is type for Transport options
+type Option func(t *Transport)
+
+// ConnectionTrace enables reporting of connection phases
+//
+// When enabled, httptrace.ClientTrace is installed for every request and
+// DNS lookup, TCP connect, TLS handshake and time to first response byte
+// are reported as separate PrecisionTimings tagged with host and whether
+// the connection was reused. For reused connections only TTFB is reported.
+func ConnectionTrace() Option {
+	return func(t *Transport) {
+		t.trace = true
+	}
+}
+
+// NewTransport wraps next http.RoundTripper with metrics reporting
+//
+// If next is nil, http.DefaultTransport is used.
+func NewTransport(client statsd.Statter, next http.RoundTripper, options ...Option) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &Transport{
+		client: client,
+		next:   next,
+	}
+
+	for _, option := range options {
+		option(t)
+	}
+
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var tr *connTrace
+
+	if t.trace {
+		tr = &connTrace{}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), tr.clientTrace()))
+	}
+
+	start := time.Now()
+	tr.setStart(start)
+
+	resp, err := t.next.RoundTrip(req)
+
+	duration := time.Since(start)
+
+	status := statsd.StringTag("status", "error")
+	if err == nil {
+		status = statsd.IntTag("status", resp.StatusCode)
+	}
+
+	t.client.PrecisionTiming(MetricDuration, duration,
+		statsd.StringTag("host", req.URL.Hostname()), statsd.StringTag("method", req.Method), status)
+
+	if tr != nil {
+		tr.report(t.client, req.URL.Hostname())
+	}
+
+	return resp, err
+}
+
+// connTrace collects timings of a single request
+//
+// httptrace hooks might be called from different goroutines, so
+// all the fields are protected with the mutex
+type connTrace struct {
+	mu sync.Mutex
+
+	start                     time.Time
+	dnsStart, dnsDone         time.Time
+	connectStart, connectDone time.Time
+	tlsStart, tlsDone         time.Time
+	firstByte                 time.Time
+	reused, gotConn           bool
+	connectFailed, tlsFailed  bool
+	dnsFailed                 bool
+}
+
+func (tr *connTrace) setStart(start time.Time) {
+	if tr == nil {
+		return
+	}
+
+	tr.mu.Lock()
+	tr.start = start
+	tr.mu.Unlock()
+}
+
+func (tr *connTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			tr.mu.Lock()
+			tr.dnsStart = time.Now()
+			tr.mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			tr.mu.Lock()
+			tr.dnsDone = time.Now()
+			tr.dnsFailed = info.Err != nil
+			tr.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			tr.mu.Lock()
+			// with multiple addresses dialer might attempt several connections,
+			// measure from the first attempt
+			if tr.connectStart.IsZero() {
+				tr.connectStart = time.Now()
+			}
+			tr.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			tr.mu.Lock()
+			if err == nil {
+				tr.connectDone = time.Now()
+				tr.connectFailed = false
+			} else if tr.connectDone.IsZero() {
+				tr.connectFailed = true
+			}
+			tr.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			tr.mu.Lock()
+			tr.tlsStart = time.Now()
+			tr.mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			tr.mu.Lock()
+			tr.tlsDone = time.Now()
+			tr.tlsFailed = err != nil
+			tr.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			tr.mu.Lock()
+			tr.gotConn = true
+			tr.reused = info.Reused
+			tr.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			tr.mu.Lock()
+			tr.firstByte = time.Now()
+			tr.mu.Unlock()
+		},
+	}
+}
+
+// report sends collected timings
+//
+// Phases which didn't happen (or failed) are skipped, for reused
+// connections only TTFB is reported
+func (tr *connTrace) report(client statsd.Statter, host string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	reused := "false"
+	if tr.reused {
+		reused = "true"
+	}
+
+	hostTag, reusedTag := statsd.StringTag("host", host), statsd.StringTag("reused", reused)
+
+	if tr.gotConn && !tr.reused {
+		if !tr.dnsStart.IsZero() && !tr.dnsDone.IsZero() && !tr.dnsFailed {
+			client.PrecisionTiming(MetricDNS, tr.dnsDone.Sub(tr.dnsStart), hostTag, reusedTag)
+		}
+
+		if !tr.connectStart.IsZero() && !tr.connectDone.IsZero() && !tr.connectFailed {
+			client.PrecisionTiming(MetricConnect, tr.connectDone.Sub(tr.connectStart), hostTag, reusedTag)
+		}
+
+		if !tr.tlsStart.IsZero() && !tr.tlsDone.IsZero() && !tr.tlsFailed {
+			client.PrecisionTiming(MetricTLS, tr.tlsDone.Sub(tr.tlsStart), hostTag, reusedTag)
+		}
+	}
+
+	if !tr.firstByte.IsZero() {
+		client.PrecisionTiming(MetricTTFB, tr.firstByte.Sub(tr.start), hostTag, reusedTag)
+	}
+}
@@ -0,0 +1,130 @@
+package statsdhttp
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/smira/go-statsd"
+	"github.com/smira/go-statsd/statsdtest"
+)
+
+// collectNames drains recorded metrics and returns sorted connection phase names with tags
+func collectNames(rec *statsdtest.Recorder) []string {
+	var names []string
+
+	for _, record := range rec.Drain() {
+		if record.Name != MetricDuration {
+			names = append(names, strings.SplitN(record.String(), ":", 2)[0])
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func TestConnectionTrace(t *testing.T) {
+	rec := statsdtest.NewRecordingClient()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	// use host name to make sure DNS lookup is performed
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	host := "localhost"
+
+	httpClient := &http.Client{
+		Transport: NewTransport(rec, &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+		}, ConnectionTrace()),
+	}
+	defer httpClient.CloseIdleConnections()
+
+	get := func() {
+		resp, err := httpClient.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	t.Run("Cold", func(t *testing.T) {
+		get()
+
+		expected := []string{
+			MetricConnect + ",host=" + host + ",reused=false",
+			MetricDNS + ",host=" + host + ",reused=false",
+			MetricTLS + ",host=" + host + ",reused=false",
+			MetricTTFB + ",host=" + host + ",reused=false",
+		}
+
+		if names := collectNames(rec); strings.Join(names, " ") != strings.Join(expected, " ") {
+			t.Errorf("unexpected metrics: %v != %v", names, expected)
+		}
+	})
+
+	t.Run("Warm", func(t *testing.T) {
+		get()
+
+		expected := []string{
+			MetricTTFB + ",host=" + host + ",reused=true",
+		}
+
+		if names := collectNames(rec); strings.Join(names, " ") != strings.Join(expected, " ") {
+			t.Errorf("unexpected metrics: %v != %v", names, expected)
+		}
+	})
+}
+
+func TestDuration(t *testing.T) {
+	rec := statsdtest.NewRecordingClient()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	httpClient := &http.Client{Transport: NewTransport(rec, nil)}
+
+	resp, err := httpClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	statsdtest.AssertTiming(t, rec, MetricDuration, 1,
+		statsd.StringTag("host", "127.0.0.1"), statsd.StringTag("method", "GET"), statsd.IntTag("status", 404))
+}
@@ -0,0 +1,288 @@
+/*
+Package statsdparse parses statsd lines in the formats emitted by statsd.Client.
+
+Tag format could be detected automatically:
+
+	metric, err := statsdparse.Parse([]byte("web.requests,host=example:1|c|@0.5"))
+
+or specified explicitly when it is known (e.g. in relays which receive
+metrics only from the clients configured the same way):
+
+	metric, err := statsdparse.ParseFormat(line, statsd.TagFormatDatadog)
+*/
+package statsdparse
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/smira/go-statsd"
+)
+
+// Type is statsd metric type
+type Type string
+
+// Metric types, values match statsd protocol suffixes
+const (
+	Counter Type = "c"
+	Timing  Type = "ms"
+	Gauge   Type = "g"
+	Set     Type = "s"
+)
+
+// Metric is a single parsed statsd line
+type Metric struct {
+	Name string
+	Type Type
+	// Value is counter increment, timing in milliseconds or gauge value
+	Value float64
+	// Delta is set for gauge changes (value with explicit sign)
+	Delta bool
+	// SetValue is the element added to the set
+	SetValue string
+	// Rate is sample rate of the counter, 1 if not sampled
+	Rate float64
+	// Tags are decoded with string values
+	Tags []statsd.Tag
+}
+
+// ParsePacket parses newline-separated statsd lines, empty lines are skipped
+//
+// Tag format is detected for every line. Malformed lines are skipped,
+// errors for them are joined together.
+func ParsePacket(packet []byte) ([]Metric, error) {
+	var (
+		metrics []Metric
+		errs    []error
+	)
+
+	for len(packet) > 0 {
+		line := packet
+
+		if idx := bytes.IndexByte(packet, '\n'); idx >= 0 {
+			line, packet = packet[:idx], packet[idx+1:]
+		} else {
+			packet = nil
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		metric, err := Parse(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, errors.Join(errs...)
+}
+
+// Parse parses single statsd line detecting the tag format
+//
+// Any of the formats supported by the client (InfluxDB, Datadog, Graphite and
+// Okmeter) is detected by the separators. Metric name containing separators
+// of other formats (e.g. ',' with Graphite tags) could be detected incorrectly,
+// use ParseFormat in that case.
+func Parse(line []byte) (Metric, error) {
+	return ParseFormat(line, DetectFormat(line))
+}
+
+// DetectFormat returns tag format of the line, or nil if line has no tags
+func DetectFormat(line []byte) *statsd.TagFormat {
+	name := line
+	if idx := bytes.IndexByte(line, ':'); idx >= 0 {
+		name = line[:idx]
+	}
+
+	switch {
+	case bytes.Contains(line, []byte(statsd.TagFormatDatadog.FirstSeparator)):
+		return statsd.TagFormatDatadog
+	case bytes.Contains(name, []byte(statsd.TagFormatInfluxDB.FirstSeparator)):
+		return statsd.TagFormatInfluxDB
+	case bytes.Contains(name, []byte(statsd.TagFormatGraphite.FirstSeparator)):
+		return statsd.TagFormatGraphite
+	case bytes.Contains(name, statsd.TagFormatOkmeter.KeyValueSeparator):
+		return statsd.TagFormatOkmeter
+	}
+
+	return nil
+}
+
+// ParseFormat parses single statsd line with tags in the given format
+//
+// If format is nil, line is parsed as not having any tags.
+func ParseFormat(line []byte, format *statsd.TagFormat) (Metric, error) {
+	metric := Metric{Rate: 1}
+	s := string(line)
+
+	colon := strings.IndexByte(s, ':')
+	if colon < 0 {
+		return metric, fmt.Errorf("missing value separator: %q", s)
+	}
+
+	name, rest := s[:colon], s[colon+1:]
+
+	var (
+		tags string
+		err  error
+	)
+
+	if format != nil && format.Placement == statsd.TagPlacementSuffix {
+		if idx := strings.Index(rest, format.FirstSeparator); idx >= 0 {
+			rest, tags = rest[:idx], rest[idx+len(format.FirstSeparator):]
+
+			if metric.Tags, err = parseTags(tags, format); err != nil {
+				return metric, fmt.Errorf("%s: %q", err, s)
+			}
+		}
+	} else if format != nil {
+		name, tags = splitNameTags(name, format)
+
+		if tags != "" {
+			if metric.Tags, err = parseTags(tags, format); err != nil {
+				return metric, fmt.Errorf("%s: %q", err, s)
+			}
+		}
+	}
+
+	if name == "" {
+		return metric, fmt.Errorf("empty metric name: %q", s)
+	}
+
+	metric.Name = name
+
+	fields := strings.Split(rest, "|")
+	if len(fields) < 2 {
+		return metric, fmt.Errorf("missing metric type: %q", s)
+	}
+
+	if err = metric.parseValue(fields[0], Type(fields[1])); err != nil {
+		return metric, fmt.Errorf("%s: %q", err, s)
+	}
+
+	for _, field := range fields[2:] {
+		if !strings.HasPrefix(field, "@") || metric.Type != Counter {
+			return metric, fmt.Errorf("unexpected field %q: %q", field, s)
+		}
+
+		metric.Rate, err = strconv.ParseFloat(field[1:], 64)
+		if err != nil || metric.Rate <= 0 || metric.Rate > 1 {
+			return metric, fmt.Errorf("invalid sample rate %q: %q", field[1:], s)
+		}
+	}
+
+	return metric, nil
+}
+
+func (m *Metric) parseValue(value string, typ Type) (err error) {
+	m.Type = typ
+
+	switch typ {
+	case Set:
+		if value == "" {
+			return fmt.Errorf("empty set value")
+		}
+
+		m.SetValue = value
+
+		return nil
+	case Gauge:
+		m.Delta = strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+	case Counter, Timing:
+	default:
+		return fmt.Errorf("unknown metric type %q", typ)
+	}
+
+	m.Value, err = strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %q", value)
+	}
+
+	return nil
+}
+
+// splitNameTags splits tags placed in the name off the name
+//
+// When tags are joined as name components (e.g. Okmeter), tags start
+// with the first component which has key-value separator.
+func splitNameTags(name string, format *statsd.TagFormat) (string, string) {
+	if format.FirstSeparator != statsd.DefaultNameSeparator || format.OtherSeparator != statsd.DefaultNameSeparator[0] {
+		if idx := strings.Index(name, format.FirstSeparator); idx >= 0 {
+			return name[:idx], name[idx+len(format.FirstSeparator):]
+		}
+
+		return name, ""
+	}
+
+	kv := string(format.KeyValueSeparator)
+	start := 0
+
+	for start < len(name) {
+		end := strings.IndexByte(name[start:], format.OtherSeparator)
+		if end < 0 {
+			end = len(name)
+		} else {
+			end += start
+		}
+
+		if strings.Contains(name[start:end], kv) {
+			if start == 0 {
+				return "", name
+			}
+
+			return name[:start-len(format.FirstSeparator)], name[start:]
+		}
+
+		start = end + 1
+	}
+
+	return name, ""
+}
+
+func parseTags(tags string, format *statsd.TagFormat) ([]statsd.Tag, error) {
+	kv := string(format.KeyValueSeparator)
+	parts := strings.Split(tags, string(format.OtherSeparator))
+	result := make([]statsd.Tag, 0, len(parts))
+
+	for _, part := range parts {
+		idx := strings.Index(part, kv)
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid tag %q", part)
+		}
+
+		result = append(result, statsd.StringTag(part[:idx], part[idx+len(kv):]))
+	}
+
+	return result, nil
+}
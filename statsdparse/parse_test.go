@@ -0,0 +1,296 @@
+package statsdparse_test
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smira/go-statsd"
+	"github.com/smira/go-statsd/statsdparse"
+	"github.com/smira/go-statsd/statsdtest"
+)
+
+// format serializes parsed metric back with InfluxDB-style tags
+func format(m statsdparse.Metric) string {
+	var tags []string
+	for _, tag := range m.Tags {
+		tags = append(tags, string(tag.Append(nil, statsd.TagFormatInfluxDB)))
+	}
+
+	value := fmt.Sprint(m.Value)
+	if m.Type == statsdparse.Set {
+		value = m.SetValue
+	} else if m.Delta && m.Value >= 0 {
+		value = "+" + value
+	}
+
+	result := strings.Join(append([]string{m.Name}, tags...), ",") + ":" + value + "|" + string(m.Type)
+	if m.Rate != 1 {
+		result += fmt.Sprintf("|@%v", m.Rate)
+	}
+
+	return result
+}
+
+func TestParse(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected string
+	}{
+		{line: "req:1|c", expected: "req:1|c"},
+		{line: "req:-2.5|c|@0.1", expected: "req:-2.5|c|@0.1"},
+		{line: "lat:12.345|ms", expected: "lat:12.345|ms"},
+		{line: "workers:3|g", expected: "workers:3|g"},
+		{line: "workers:+3|g", expected: "workers:+3|g"},
+		{line: "workers:-3|g", expected: "workers:-3|g"},
+		{line: "users:alice|s", expected: "users:alice|s"},
+		{line: "req,host=example,port=80:1|c", expected: "req,host=example,port=80:1|c"},
+		{line: "req:1|c|@0.5|#host:example,port:80", expected: "req,host=example,port=80:1|c|@0.5"},
+		{line: "req:1|c|#url:http://example", expected: "req,url=http://example:1|c"},
+		{line: "req;host=example;port=80:1|c", expected: "req,host=example,port=80:1|c"},
+		{line: "web.req.host_is_example.port_is_80:1|c", expected: "web.req,host=example,port=80:1|c"},
+		{line: "web.req.count:1|c", expected: "web.req.count:1|c"},
+	} {
+		metric, err := statsdparse.Parse([]byte(test.line))
+		if err != nil {
+			t.Errorf("unexpected error for %q: %s", test.line, err)
+			continue
+		}
+
+		if format(metric) != test.expected {
+			t.Errorf("%q parsed as %q, expected %q", test.line, format(metric), test.expected)
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected string
+	}{
+		{"", `missing value separator: ""`},
+		{"req", `missing value separator: "req"`},
+		{"req:1", `missing metric type: "req:1"`},
+		{":1|c", `empty metric name: ":1|c"`},
+		{"req:|c", `invalid value "": "req:|c"`},
+		{"req:abc|c", `invalid value "abc": "req:abc|c"`},
+		{"req:1|x", `unknown metric type "x": "req:1|x"`},
+		{"req:1|c|@", `invalid sample rate "": "req:1|c|@"`},
+		{"req:1|c|@0", `invalid sample rate "0": "req:1|c|@0"`},
+		{"req:1|c|@2", `invalid sample rate "2": "req:1|c|@2"`},
+		{"lat:1|ms|@0.5", `unexpected field "@0.5": "lat:1|ms|@0.5"`},
+		{"req:1|c|x", `unexpected field "x": "req:1|c|x"`},
+		{"req:1|c|#", `invalid tag "": "req:1|c|#"`},
+		{"req:1|c|#host", `invalid tag "host": "req:1|c|#host"`},
+		{"req:1|c|#:example", `invalid tag ":example": "req:1|c|#:example"`},
+		{"req,host:1|c", `invalid tag "host": "req,host:1|c"`},
+		{"req,=example:1|c", `invalid tag "=example": "req,=example:1|c"`},
+		{"req;host:1|c", `invalid tag "host": "req;host:1|c"`},
+		{"host_is_example:1|c", `empty metric name: "host_is_example:1|c"`},
+		{"web.host_is_example.req:1|c", `invalid tag "req": "web.host_is_example.req:1|c"`},
+		{"users:|s", `empty set value: "users:|s"`},
+		{"req,url=http://example:1|c", `invalid value "//example:1": "req,url=http://example:1|c"`},
+	} {
+		metric, err := statsdparse.Parse([]byte(test.line))
+		if err == nil {
+			t.Errorf("error expected for %q, parsed as %q", test.line, format(metric))
+		} else if err.Error() != test.expected {
+			t.Errorf("unexpected error for %q: %s", test.line, err)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	// with explicit format separators of other formats are part of the name
+	metric, err := statsdparse.ParseFormat([]byte("req,v2;x_is_y:1|c|#host:example"), statsd.TagFormatDatadog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format(metric) != "req,v2;x_is_y,host=example:1|c" {
+		t.Errorf("unexpected metric %q", format(metric))
+	}
+
+	metric, err = statsdparse.ParseFormat([]byte("req,host=example:1|c"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metric.Name != "req,host=example" || len(metric.Tags) != 0 {
+		t.Errorf("unexpected metric %q", format(metric))
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	metrics, err := statsdparse.ParsePacket([]byte("a:1|c\nb\n\nc:x|s\nd:1|x\n"))
+	if err == nil || err.Error() != "missing value separator: \"b\"\nunknown metric type \"x\": \"d:1|x\"" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if len(metrics) != 2 || metrics[0].Name != "a" || metrics[1].Name != "c" {
+		t.Errorf("malformed lines should be skipped: %v", metrics)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"req:1|c|@0.5",
+		"req,host=example:1|c",
+		"req:1|c|#host:example",
+		"req;host=example:-1.5|g",
+		"web.req.host_is_example:1|ms",
+		"users:alice|s",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		metric, err := statsdparse.Parse(line)
+		if err != nil {
+			return
+		}
+
+		if metric.Name == "" {
+			t.Errorf("empty name parsed out of %q", line)
+		}
+
+		if metric.Rate <= 0 || metric.Rate > 1 {
+			t.Errorf("invalid rate parsed out of %q: %v", line, metric.Rate)
+		}
+	})
+}
+
+// TestRoundTrip serializes random metrics with the client and parses them back
+func TestRoundTrip(t *testing.T) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-"
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	randomString := func() string {
+		b := make([]byte, 1+rnd.Intn(10))
+		for i := range b {
+			b[i] = alphabet[rnd.Intn(len(alphabet))]
+		}
+
+		return string(b)
+	}
+
+	for name, tagFormat := range map[string]*statsd.TagFormat{
+		"InfluxDB": statsd.TagFormatInfluxDB,
+		"Datadog":  statsd.TagFormatDatadog,
+		"Graphite": statsd.TagFormatGraphite,
+		"Okmeter":  statsd.TagFormatOkmeter,
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := statsdtest.NewServer(t, "udp")
+			prefix := "app." + randomString() + "."
+
+			client := statsd.NewClient(server.Addr(), statsd.TagStyle(tagFormat), statsd.FloatPrecision(-1),
+				statsd.MetricPrefix(prefix))
+			defer client.Close() //nolint:errcheck
+
+			// Okmeter lowercases names and tags (but not set values)
+			normalize := func(s string) string { return s }
+			if tagFormat == statsd.TagFormatOkmeter {
+				normalize = strings.ToLower
+			}
+
+			expected := map[string]statsdparse.Metric{}
+
+			for i := 0; i < 200; i++ {
+				m := statsdparse.Metric{Name: fmt.Sprintf("metric%d.%s", i, randomString()), Rate: 1}
+
+				var tags []statsd.Tag
+				for j := rnd.Intn(4); j > 0; j-- {
+					name, value := randomString(), randomString()
+					tags = append(tags, statsd.StringTag(name, value))
+					m.Tags = append(m.Tags, statsd.StringTag(normalize(name), normalize(value)))
+				}
+
+				switch rnd.Intn(6) {
+				case 0:
+					m.Type, m.Value = statsdparse.Counter, float64(rnd.Int63n(1000000)-500000)
+					if m.Value == 0 {
+						m.Value = 1
+					}
+					client.Incr(m.Name, int64(m.Value), tags...)
+				case 1:
+					m.Type, m.Value = statsdparse.Counter, rnd.NormFloat64()*1000
+					client.FIncr(m.Name, m.Value, tags...)
+				case 2:
+					m.Type, m.Value = statsdparse.Timing, float64(rnd.Int63n(100000))
+					client.Timing(m.Name, int64(m.Value), tags...)
+				case 3:
+					m.Type, m.Value = statsdparse.Gauge, float64(rnd.Int63n(1000000))
+					client.Gauge(m.Name, int64(m.Value), tags...)
+				case 4:
+					m.Type, m.Value, m.Delta = statsdparse.Gauge, rnd.NormFloat64()*1000, true
+					client.FGaugeDelta(m.Name, m.Value, tags...)
+				case 5:
+					m.Type, m.SetValue = statsdparse.Set, randomString()
+					client.SetAdd(m.Name, m.SetValue, tags...)
+				}
+
+				m.Name = normalize(m.Name)
+				expected[m.Name] = m
+			}
+
+			prefix = normalize(prefix)
+
+			client.Incr("done", 1)
+			server.WaitFor(prefix+"done", time.Second)
+
+			received := 0
+
+			for _, line := range server.Metrics() {
+				metric, err := statsdparse.ParseFormat([]byte(line.Line), tagFormat)
+				if err != nil {
+					t.Errorf("error parsing %q: %s", line.Line, err)
+					continue
+				}
+
+				if metric.Name == prefix+"done" {
+					continue
+				}
+
+				metric.Name = strings.TrimPrefix(metric.Name, prefix)
+
+				if format(metric) != format(expected[metric.Name]) {
+					t.Errorf("round trip mismatch for %q: %q != %q", line.Line, format(metric), format(expected[metric.Name]))
+				}
+
+				received++
+			}
+
+			if received != len(expected) {
+				t.Errorf("received %d metrics, expected %d", received, len(expected))
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Package statsdprom exposes internal counters of statsd client as Prometheus metrics.
+
+Register collector in the existing registry:
+
+	prometheus.MustRegister(statsdprom.NewCollector(client, nil))
+
+Package is a separate Go module, so that Prometheus client library is not
+a dependency of go-statsd itself.
+*/
+package statsdprom
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/smira/go-statsd"
+)
+
+// Namespace is prefix of the metric names
+const Namespace = "statsd_client"
+
+// Collector is prometheus.Collector which reports internal counters of statsd client
+//
+// Values are read on scrape from the client atomic counters (see Client.GetStats),
+// so collector doesn't add any overhead to sending metrics.
+type Collector struct {
+	client *statsd.Client
+
+	packetsSent      *prometheus.Desc
+	bytesSent        *prometheus.Desc
+	packetsDropped   *prometheus.Desc
+	metricsDropped   *prometheus.Desc
+	dialFailures     *prometheus.Desc
+	connects         *prometheus.Desc
+	sendLoops        *prometheus.Desc
+	queueLength      *prometheus.Desc
+	queueCapacity    *prometheus.Desc
+	poolLength       *prometheus.Desc
+	poolCapacity     *prometheus.Desc
+	poolMisses       *prometheus.Desc
+	buffersAllocated *prometheus.Desc
+}
+
+// NewCollector creates collector for the client
+//
+// constLabels are attached to every metric, they're needed to tell apart
+// several clients registered in the same registry.
+func NewCollector(client *statsd.Client, constLabels prometheus.Labels) *Collector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(Namespace, "", name), help, labels, constLabels)
+	}
+
+	return &Collector{
+		client: client,
+
+		packetsSent:      desc("packets_sent_total", "Number of packets written to the socket."),
+		bytesSent:        desc("bytes_sent_total", "Number of bytes written to the socket."),
+		packetsDropped:   desc("packets_dropped_total", "Number of packets dropped.", "reason"),
+		metricsDropped:   desc("metrics_dropped_total", "Number of metrics dropped before they were buffered.", "reason"),
+		dialFailures:     desc("dial_failures_total", "Number of failed attempts to connect to the server."),
+		connects:         desc("connects_total", "Number of successful connects (including reconnects) to the server."),
+		sendLoops:        desc("send_loops", "Number of goroutines sending packets."),
+		queueLength:      desc("send_queue_length", "Number of packets in the send queue."),
+		queueCapacity:    desc("send_queue_capacity", "Capacity of the send queue."),
+		poolLength:       desc("buffer_pool_length", "Number of buffers in the pool."),
+		poolCapacity:     desc("buffer_pool_capacity", "Capacity of the buffer pool."),
+		poolMisses:       desc("buffer_pool_misses_total", "Number of times buffer was allocated as pool was empty."),
+		buffersAllocated: desc("buffers_allocated_total", "Number of buffers allocated after the client was created."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.packetsSent, c.bytesSent, c.packetsDropped, c.metricsDropped, c.dialFailures, c.connects,
+		c.sendLoops, c.queueLength, c.queueCapacity, c.poolLength, c.poolCapacity, c.poolMisses, c.buffersAllocated,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.GetStats()
+
+	counter := func(desc *prometheus.Desc, value int64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+
+	gauge := func(desc *prometheus.Desc, value int) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+
+	counter(c.packetsSent, stats.PacketsSent)
+	counter(c.bytesSent, stats.BytesSent)
+	counter(c.packetsDropped, stats.LostPackets, "overflow")
+	counter(c.packetsDropped, stats.WriteErrors, "write_error")
+	counter(c.metricsDropped, c.client.GetOversizedMetrics(), "oversized")
+	counter(c.metricsDropped, c.client.GetRateLimitedMetrics(), "rate_limit")
+	counter(c.metricsDropped, c.client.GetFilteredMetrics(), "filtered")
+	counter(c.metricsDropped, c.client.GetInvalidMetrics(), "invalid")
+	counter(c.metricsDropped, c.client.GetClosedMetrics(), "closed")
+	counter(c.dialFailures, stats.DialFailures)
+	counter(c.connects, stats.Connects)
+	counter(c.poolMisses, stats.BufPoolMisses)
+	counter(c.buffersAllocated, stats.BuffersAllocated)
+
+	gauge(c.sendLoops, stats.SendLoopCount)
+	gauge(c.queueLength, stats.SendQueueLength)
+	gauge(c.queueCapacity, stats.SendQueueCapacity)
+	gauge(c.poolLength, stats.BufPoolLength)
+	gauge(c.poolCapacity, stats.BufPoolCapacity)
+}
@@ -0,0 +1,126 @@
+package statsdprom
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/smira/go-statsd"
+	"github.com/smira/go-statsd/statsdtest"
+)
+
+func TestCollector(t *testing.T) {
+	server := statsdtest.NewServer(t, "udp")
+
+	client := statsd.NewClient(server.Addr(), statsd.SendLoopCount(1), statsd.SendQueueCapacity(10),
+		statsd.BufPoolCapacity(5), statsd.FlushInterval(time.Hour), statsd.MaxMetricsPerSecond(1000))
+	defer client.Close() //nolint:errcheck
+
+	collector := NewCollector(client, map[string]string{"client": "test"})
+
+	if problems, err := testutil.CollectAndLint(collector); err != nil || len(problems) > 0 {
+		t.Fatalf("lint failed: %v %v", err, problems)
+	}
+
+	compare := func(t *testing.T, expected string, names ...string) {
+		t.Helper()
+
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), names...); err != nil {
+			t.Error(err)
+		}
+	}
+
+	compare(t, `
+# HELP statsd_client_packets_sent_total Number of packets written to the socket.
+# TYPE statsd_client_packets_sent_total counter
+statsd_client_packets_sent_total{client="test"} 0
+# HELP statsd_client_send_queue_capacity Capacity of the send queue.
+# TYPE statsd_client_send_queue_capacity gauge
+statsd_client_send_queue_capacity{client="test"} 10
+`, "statsd_client_packets_sent_total", "statsd_client_send_queue_capacity")
+
+	// "counter:1|c\ngauge:2|g" is 21 bytes
+	client.Incr("counter", 1)
+	client.Gauge("gauge", 2)
+	client.Incr("counter", 1, statsd.StringTag("oversized", strings.Repeat("x", 2000)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.FlushAndWait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	server.WaitFor("gauge", time.Second)
+
+	compare(t, `
+# HELP statsd_client_bytes_sent_total Number of bytes written to the socket.
+# TYPE statsd_client_bytes_sent_total counter
+statsd_client_bytes_sent_total{client="test"} 21
+# HELP statsd_client_connects_total Number of successful connects (including reconnects) to the server.
+# TYPE statsd_client_connects_total counter
+statsd_client_connects_total{client="test"} 1
+# HELP statsd_client_metrics_dropped_total Number of metrics dropped before they were buffered.
+# TYPE statsd_client_metrics_dropped_total counter
+statsd_client_metrics_dropped_total{client="test",reason="closed"} 0
+statsd_client_metrics_dropped_total{client="test",reason="filtered"} 0
+statsd_client_metrics_dropped_total{client="test",reason="invalid"} 0
+statsd_client_metrics_dropped_total{client="test",reason="oversized"} 1
+statsd_client_metrics_dropped_total{client="test",reason="rate_limit"} 0
+# HELP statsd_client_packets_sent_total Number of packets written to the socket.
+# TYPE statsd_client_packets_sent_total counter
+statsd_client_packets_sent_total{client="test"} 1
+# HELP statsd_client_send_loops Number of goroutines sending packets.
+# TYPE statsd_client_send_loops gauge
+statsd_client_send_loops{client="test"} 1
+`, "statsd_client_bytes_sent_total", "statsd_client_connects_total", "statsd_client_metrics_dropped_total",
+		"statsd_client_packets_sent_total", "statsd_client_send_loops")
+}
+
+func TestCollectorDropped(t *testing.T) {
+	client := statsd.NewClient("BOOM:BOOM", statsd.SendQueueCapacity(0), statsd.FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	collector := NewCollector(client, nil)
+
+	for i := 0; i < 3; i++ {
+		client.Incr("counter", 1)
+		client.Flush()
+	}
+
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP statsd_client_packets_dropped_total Number of packets dropped.
+# TYPE statsd_client_packets_dropped_total counter
+statsd_client_packets_dropped_total{reason="overflow"} 3
+statsd_client_packets_dropped_total{reason="write_error"} 0
+`), "statsd_client_packets_dropped_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,150 @@
+package statsdtest
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/smira/go-statsd"
+)
+
+// Source provides captured metrics, implemented by Recorder and Server
+type Source interface {
+	Records() []Record
+}
+
+// AssertIncr checks that the sum of counter increments for the metric equals expected
+//
+// Only records with exactly the given tags are summed, sample rate is ignored.
+func AssertIncr(t testing.TB, src Source, name string, expected float64, tags ...statsd.Tag) {
+	t.Helper()
+
+	records, found := filter(src, Counter, name, tags)
+	if !found {
+		t.Errorf("counter %s was not sent%s", describe(name, tags), dump(src, name))
+		return
+	}
+
+	var sum float64
+	for _, record := range records {
+		sum += record.Value
+	}
+
+	if sum != expected {
+		t.Errorf("counter %s: got %v, expected %v%s", describe(name, tags), sum, expected, dump(src, name))
+	}
+}
+
+// AssertGauge checks the last value of the gauge with gauge changes applied in order
+func AssertGauge(t testing.TB, src Source, name string, expected float64, tags ...statsd.Tag) {
+	t.Helper()
+
+	records, found := filter(src, Gauge, name, tags)
+	if !found {
+		t.Errorf("gauge %s was not sent%s", describe(name, tags), dump(src, name))
+		return
+	}
+
+	var value float64
+	for _, record := range records {
+		if record.Delta {
+			value += record.Value
+		} else {
+			value = record.Value
+		}
+	}
+
+	if value != expected {
+		t.Errorf("gauge %s: got %v, expected %v%s", describe(name, tags), value, expected, dump(src, name))
+	}
+}
+
+// AssertTiming checks number of timings sent for the metric
+func AssertTiming(t testing.TB, src Source, name string, count int, tags ...statsd.Tag) {
+	t.Helper()
+
+	records, _ := filter(src, Timing, name, tags)
+	if len(records) != count {
+		t.Errorf("timing %s: got %d values, expected %d%s", describe(name, tags), len(records), count, dump(src, name))
+	}
+}
+
+// AssertSetContains checks that the value was added to the set
+func AssertSetContains(t testing.TB, src Source, name string, value string, tags ...statsd.Tag) {
+	t.Helper()
+
+	records, _ := filter(src, Set, name, tags)
+	for _, record := range records {
+		if record.SetValue == value {
+			return
+		}
+	}
+
+	t.Errorf("set %s doesn't contain %q%s", describe(name, tags), value, dump(src, name))
+}
+
+// AssertNotSent checks that no metrics with the name were sent (with any tags)
+func AssertNotSent(t testing.TB, src Source, name string) {
+	t.Helper()
+
+	for _, record := range src.Records() {
+		if record.Name == name {
+			t.Errorf("metric %s was not expected%s", name, dump(src, name))
+			return
+		}
+	}
+}
+
+func filter(src Source, typ MetricType, name string, tags []statsd.Tag) (records []Record, found bool) {
+	for _, record := range src.Records() {
+		if record.Name == name && record.Type == typ && record.HasTags(tags...) {
+			records = append(records, record)
+		}
+	}
+
+	return records, len(records) > 0
+}
+
+func describe(name string, tags []statsd.Tag) string {
+	return string(appendNameTags(nil, name, tags))
+}
+
+// dump lists all the records for the name to make failures easier to debug
+func dump(src Source, name string) string {
+	var lines []string
+
+	for _, record := range src.Records() {
+		if record.Name == name {
+			lines = append(lines, "\t"+record.String())
+		}
+	}
+
+	if len(lines) == 0 {
+		return ""
+	}
+
+	return "\nrecorded:\n" + strings.Join(lines, "\n")
+}
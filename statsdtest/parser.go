@@ -0,0 +1,90 @@
+package statsdtest
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/smira/go-statsd/statsdparse"
+)
+
+// Metric is statsd metric parsed out of the packet
+type Metric struct {
+	Record
+
+	// Line is the original statsd line
+	Line string
+}
+
+// ParsePacket parses newline-separated statsd lines, empty lines are skipped
+//
+// Malformed lines are skipped as well, errors for them are joined together.
+func ParsePacket(packet []byte) ([]Metric, error) {
+	var (
+		metrics []Metric
+		errs    []error
+	)
+
+	for _, line := range strings.Split(string(packet), "\n") {
+		if line == "" {
+			continue
+		}
+
+		metric, err := ParseLine(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, errors.Join(errs...)
+}
+
+// ParseLine parses single statsd line with statsdparse.Parse
+//
+// Tag format is detected automatically. Tag values are parsed as strings,
+// Record.HasTags compares them with IntTag by formatted value.
+func ParseLine(line string) (Metric, error) {
+	parsed, err := statsdparse.Parse([]byte(line))
+	if err != nil {
+		return Metric{Line: line}, err
+	}
+
+	return Metric{
+		Record: Record{
+			Name:     parsed.Name,
+			Type:     MetricType(parsed.Type),
+			Value:    parsed.Value,
+			Delta:    parsed.Delta,
+			SetValue: parsed.SetValue,
+			Tags:     parsed.Tags,
+			Rate:     parsed.Rate,
+		},
+		Line: line,
+	}, nil
+}
@@ -0,0 +1,65 @@
+package statsdtest
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"testing"
+
+	"github.com/smira/go-statsd"
+)
+
+func TestParseLine(t *testing.T) {
+	metric, err := ParseLine("req:1|c|@0.5|#host:example,port:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metric.Line != "req:1|c|@0.5|#host:example,port:80" {
+		t.Errorf("line not preserved: %q", metric.Line)
+	}
+
+	if metric.String() != "req,host=example,port=80:1|c|@0.5" {
+		t.Errorf("unexpected metric: %q", metric.String())
+	}
+
+	if !metric.HasTags(statsd.IntTag("port", 80), statsd.StringTag("host", "example")) {
+		t.Errorf("unexpected tags: %v", metric.Tags)
+	}
+
+	if _, err = ParseLine("req:1|x"); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	metrics, err := ParsePacket([]byte("a:1|c\nb\n\nc:x|s\nd:1|x\n"))
+	if err == nil || err.Error() != "missing value separator: \"b\"\nunknown metric type \"x\": \"d:1|x\"" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if len(metrics) != 2 || metrics[0].Line != "a:1|c" || metrics[1].Line != "c:x|s" {
+		t.Errorf("malformed lines should be skipped: %v", metrics)
+	}
+}
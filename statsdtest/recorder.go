@@ -0,0 +1,303 @@
+/*
+Package statsdtest provides in-memory statsd.Statter for testing code which emits metrics.
+
+Instead of spinning up UDP listener and parsing datagrams, pass recording client
+to the code under test and assert on the captured metrics:
+
+	rec := statsdtest.NewRecordingClient()
+
+	handler := NewHandler(rec)
+	...
+
+	statsdtest.AssertIncr(t, rec, "req.count", 30, statsd.StringTag("route", "/api"))
+
+Recorder captures every call synchronously, so there's no need to flush or sleep.
+It is safe for concurrent use.
+
+For integration tests with real statsd.Client, Server receives and parses the packets,
+assertion helpers work with both:
+
+	server := statsdtest.NewServer(t, "udp")
+
+	client := statsd.NewClient(server.Addr())
+	defer client.Close()
+	...
+
+	server.WaitFor("req.count", time.Second)
+	statsdtest.AssertIncr(t, server, "req.count", 30)
+*/
+package statsdtest
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/smira/go-statsd"
+)
+
+// MetricType is statsd metric type
+type MetricType string
+
+// Metric types, values match statsd protocol suffixes
+const (
+	Counter MetricType = "c"
+	Timing  MetricType = "ms"
+	Gauge   MetricType = "g"
+	Set     MetricType = "s"
+)
+
+// Record is a single metric captured by Recorder
+type Record struct {
+	Name string
+	Type MetricType
+	// Value is counter increment, timing in milliseconds or gauge value
+	Value float64
+	// Delta is set for gauge changes (GaugeDelta, FGaugeDelta)
+	Delta bool
+	// SetValue is the element added to the set
+	SetValue string
+	Tags     []statsd.Tag
+	// Rate is sample rate of the counter (or timing with statsd.WithRate), 1 for other metrics
+	Rate float64
+	// Timestamp is set with statsd.WithTimestamp
+	Timestamp time.Time
+}
+
+// String formats record similar to statsd line with InfluxDB-style tags
+func (r Record) String() string {
+	buf := appendNameTags(nil, r.Name, r.Tags)
+	buf = append(buf, ':')
+
+	switch {
+	case r.Type == Set:
+		buf = append(buf, r.SetValue...)
+	case r.Delta && r.Value >= 0:
+		buf = append(buf, '+')
+		fallthrough
+	default:
+		buf = strconv.AppendFloat(buf, r.Value, 'f', -1, 64)
+	}
+
+	buf = append(buf, '|')
+	buf = append(buf, r.Type...)
+
+	if r.Rate != 1 {
+		buf = append(buf, "|@"...)
+		buf = strconv.AppendFloat(buf, r.Rate, 'f', -1, 64)
+	}
+
+	return string(buf)
+}
+
+// HasTags checks whether record has exactly the given tags
+//
+// Tags are compared by name and formatted value regardless of the order,
+// so IntTag("status", 200) matches StringTag("status", "200").
+func (r Record) HasTags(tags ...statsd.Tag) bool {
+	if len(r.Tags) != len(tags) {
+		return false
+	}
+
+	used := make([]bool, len(r.Tags))
+
+outer:
+	for _, tag := range tags {
+		key := tagKey(tag)
+
+		for i := range r.Tags {
+			if !used[i] && tagKey(r.Tags[i]) == key {
+				used[i] = true
+				continue outer
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+func appendNameTags(buf []byte, name string, tags []statsd.Tag) []byte {
+	buf = append(buf, name...)
+
+	for _, tag := range tags {
+		buf = append(buf, ',')
+		buf = tag.Append(buf, statsd.TagFormatInfluxDB)
+	}
+
+	return buf
+}
+
+func tagKey(tag statsd.Tag) string {
+	return string(tag.Append(nil, statsd.TagFormatInfluxDB))
+}
+
+// Recorder is statsd.Statter which captures metrics in memory
+type Recorder struct {
+	mu      sync.Mutex
+	records []Record
+	rate    float64
+}
+
+var _ statsd.Statter = (*Recorder)(nil)
+
+// NewRecordingClient creates empty Recorder
+func NewRecordingClient() *Recorder {
+	return &Recorder{rate: 1}
+}
+
+// SetSampleRate sets sample rate recorded for counters
+//
+// Recorder never drops counters, the rate is only captured in Record.Rate,
+// so the tests stay deterministic.
+func (r *Recorder) SetSampleRate(rate float64) {
+	r.mu.Lock()
+	r.rate = rate
+	r.mu.Unlock()
+}
+
+// Records returns copy of all the records captured so far
+func (r *Recorder) Records() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Record(nil), r.records...)
+}
+
+// Drain returns records captured so far in emission order and clears the recorder
+func (r *Recorder) Drain() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := r.records
+	r.records = nil
+
+	return records
+}
+
+// Reset clears captured records
+func (r *Recorder) Reset() {
+	r.Drain()
+}
+
+// Find returns records with the given name and exactly the given tags
+func (r *Recorder) Find(name string, tags ...statsd.Tag) []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result []Record
+
+	for _, record := range r.records {
+		if record.Name == name && record.HasTags(tags...) {
+			result = append(result, record)
+		}
+	}
+
+	return result
+}
+
+func (r *Recorder) record(record Record, tags []statsd.Tag) {
+	tags, rate, timestamp := statsd.SplitCallOptions(tags)
+
+	record.Tags = append([]statsd.Tag(nil), tags...)
+	record.Timestamp = timestamp
+
+	r.mu.Lock()
+	record.Rate = 1
+	if record.Type == Counter {
+		record.Rate = r.rate
+	}
+	if rate != 0 && (record.Type == Counter || record.Type == Timing) {
+		record.Rate = rate
+	}
+	r.records = append(r.records, record)
+	r.mu.Unlock()
+}
+
+func (r *Recorder) counter(stat string, count float64, tags []statsd.Tag) {
+	if count == 0 {
+		return
+	}
+
+	r.record(Record{Name: stat, Type: Counter, Value: count}, tags)
+}
+
+// Incr records a counter increment
+func (r *Recorder) Incr(stat string, count int64, tags ...statsd.Tag) {
+	r.counter(stat, float64(count), tags)
+}
+
+// Decr records a counter decrement (as negative increment)
+func (r *Recorder) Decr(stat string, count int64, tags ...statsd.Tag) {
+	r.counter(stat, -float64(count), tags)
+}
+
+// FIncr records a float counter increment
+func (r *Recorder) FIncr(stat string, count float64, tags ...statsd.Tag) {
+	r.counter(stat, count, tags)
+}
+
+// FDecr records a float counter decrement (as negative increment)
+func (r *Recorder) FDecr(stat string, count float64, tags ...statsd.Tag) {
+	r.counter(stat, -count, tags)
+}
+
+// Timing records a duration in milliseconds
+func (r *Recorder) Timing(stat string, delta int64, tags ...statsd.Tag) {
+	r.record(Record{Name: stat, Type: Timing, Value: float64(delta)}, tags)
+}
+
+// PrecisionTiming records a duration, value is converted to milliseconds
+func (r *Recorder) PrecisionTiming(stat string, delta time.Duration, tags ...statsd.Tag) {
+	r.record(Record{Name: stat, Type: Timing, Value: float64(delta) / float64(time.Millisecond)}, tags)
+}
+
+// Gauge records gauge value
+func (r *Recorder) Gauge(stat string, value int64, tags ...statsd.Tag) {
+	r.record(Record{Name: stat, Type: Gauge, Value: float64(value)}, tags)
+}
+
+// GaugeDelta records gauge change
+func (r *Recorder) GaugeDelta(stat string, value int64, tags ...statsd.Tag) {
+	r.record(Record{Name: stat, Type: Gauge, Value: float64(value), Delta: true}, tags)
+}
+
+// FGauge records floating point gauge value
+func (r *Recorder) FGauge(stat string, value float64, tags ...statsd.Tag) {
+	r.record(Record{Name: stat, Type: Gauge, Value: value}, tags)
+}
+
+// FGaugeDelta records floating point gauge change
+func (r *Recorder) FGaugeDelta(stat string, value float64, tags ...statsd.Tag) {
+	r.record(Record{Name: stat, Type: Gauge, Value: value, Delta: true}, tags)
+}
+
+// SetAdd records element added to the set
+func (r *Recorder) SetAdd(stat string, value string, tags ...statsd.Tag) {
+	r.record(Record{Name: stat, Type: Set, SetValue: value}, tags)
+}
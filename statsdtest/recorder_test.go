@@ -0,0 +1,176 @@
+package statsdtest
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smira/go-statsd"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecordingClient()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 3; j++ {
+				rec.Incr("req.count", 1, statsd.StringTag("route", "/api"), statsd.IntTag("status", 200))
+				rec.PrecisionTiming("req.latency", time.Millisecond)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	rec.Decr("req.count", 5, statsd.IntTag("status", 200), statsd.StringTag("route", "/api"))
+	rec.Incr("req.count", 0)
+	rec.Gauge("workers", 10)
+	rec.GaugeDelta("workers", -3)
+	rec.FGaugeDelta("workers", 0.5)
+	rec.SetAdd("users", "alice")
+
+	AssertIncr(t, rec, "req.count", 25, statsd.StringTag("route", "/api"), statsd.StringTag("status", "200"))
+	AssertTiming(t, rec, "req.latency", 30)
+	AssertGauge(t, rec, "workers", 7.5)
+	AssertSetContains(t, rec, "users", "alice")
+	AssertNotSent(t, rec, "errors")
+
+	if records := rec.Find("req.count"); len(records) != 0 {
+		t.Errorf("untagged counter shouldn't be recorded: %v", records)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	rec := NewRecordingClient()
+
+	rec.Incr("a", 1, statsd.StringTag("host", "example"))
+	rec.SetSampleRate(0.5)
+	rec.FDecr("b", 1.5)
+	rec.Timing("c", 20)
+	rec.PrecisionTiming("d", 1500*time.Microsecond)
+	rec.GaugeDelta("e", 3)
+	rec.FGauge("f", -2.25)
+	rec.SetAdd("g", "x")
+
+	var lines []string
+	for _, record := range rec.Drain() {
+		lines = append(lines, record.String())
+	}
+
+	expected := "a,host=example:1|c b:-1.5|c|@0.5 c:20|ms d:1.5|ms e:+3|g f:-2.25|g g:x|s"
+	if strings.Join(lines, " ") != expected {
+		t.Errorf("unexpected records: %q != %q", strings.Join(lines, " "), expected)
+	}
+
+	if records := rec.Drain(); len(records) != 0 {
+		t.Errorf("recorder should be empty after Drain: %v", records)
+	}
+}
+
+func TestRecorderCallOptions(t *testing.T) {
+	rec := NewRecordingClient()
+
+	ts := time.Unix(1700000000, 0)
+
+	rec.Incr("a", 1, statsd.WithRate(0.1), statsd.StringTag("route", "api"))
+	rec.Timing("b", 5, statsd.WithTags(statsd.StringTag("route", "api"), statsd.WithTimestamp(ts)), statsd.WithRate(0.5))
+	rec.Gauge("c", 3, statsd.WithRate(0.1))
+
+	records := rec.Records()
+
+	if records[0].Rate != 0.1 || !records[0].HasTags(statsd.StringTag("route", "api")) {
+		t.Errorf("unexpected record %v", records[0])
+	}
+
+	if records[1].Rate != 0.5 || !records[1].Timestamp.Equal(ts) || !records[1].HasTags(statsd.StringTag("route", "api")) {
+		t.Errorf("unexpected record %v", records[1])
+	}
+
+	// rate is not applicable to gauges
+	if records[2].Rate != 1 || len(records[2].Tags) != 0 {
+		t.Errorf("unexpected record %v", records[2])
+	}
+
+	AssertIncr(t, rec, "a", 1, statsd.StringTag("route", "api"))
+}
+
+type fakeTB struct {
+	testing.TB
+
+	mu     sync.Mutex
+	errors []string
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.mu.Lock()
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+	f.mu.Unlock()
+}
+
+func (f *fakeTB) Fatalf(format string, args ...interface{}) {
+	f.Errorf(format, args...)
+}
+
+func TestAssertFailures(t *testing.T) {
+	rec := NewRecordingClient()
+
+	rec.Incr("req.count", 2, statsd.StringTag("route", "/api"))
+	rec.Gauge("workers", 3)
+	rec.SetAdd("users", "alice")
+
+	tb := &fakeTB{}
+
+	AssertIncr(tb, rec, "req.count", 3, statsd.StringTag("route", "/api"))
+	AssertIncr(tb, rec, "req.count", 2)
+	AssertGauge(tb, rec, "workers", 4)
+	AssertTiming(tb, rec, "req.latency", 1)
+	AssertSetContains(tb, rec, "users", "bob")
+	AssertNotSent(tb, rec, "workers")
+
+	expected := []string{
+		"counter req.count,route=/api: got 2, expected 3\nrecorded:\n\treq.count,route=/api:2|c",
+		"counter req.count was not sent\nrecorded:\n\treq.count,route=/api:2|c",
+		"gauge workers: got 3, expected 4\nrecorded:\n\tworkers:3|g",
+		"timing req.latency: got 0 values, expected 1",
+		"set users doesn't contain \"bob\"\nrecorded:\n\tusers:alice|s",
+		"metric workers was not expected\nrecorded:\n\tworkers:3|g",
+	}
+
+	if strings.Join(tb.errors, "\n--\n") != strings.Join(expected, "\n--\n") {
+		t.Errorf("unexpected errors:\n%s", strings.Join(tb.errors, "\n--\n"))
+	}
+}
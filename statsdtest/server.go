@@ -0,0 +1,179 @@
+package statsdtest
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server is statsd server for integration tests
+//
+// Server receives packets sent by statsd.Client, parses them and
+// keeps parsed metrics in memory. Malformed lines fail the test.
+type Server struct {
+	t    testing.TB
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	metrics []Metric
+	updated chan struct{}
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewServer starts listening on the local address
+//
+// Supported networks are udp (udp4, udp6) and unixgram, socket for unixgram
+// is created in the temporary directory of the test. Server is closed
+// automatically when the test finishes.
+func NewServer(t testing.TB, network string) *Server {
+	t.Helper()
+
+	var (
+		conn net.PacketConn
+		err  error
+	)
+
+	switch network {
+	case "udp", "udp4":
+		conn, err = net.ListenPacket("udp4", "127.0.0.1:0")
+	case "udp6":
+		conn, err = net.ListenPacket("udp6", "[::1]:0")
+	case "unixgram":
+		conn, err = net.ListenPacket("unixgram", filepath.Join(t.TempDir(), "statsd.sock"))
+	default:
+		t.Fatalf("statsdtest: unsupported network %q", network)
+	}
+
+	if err != nil {
+		t.Fatalf("statsdtest: error listening: %s", err)
+	}
+
+	s := &Server{
+		t:       t,
+		conn:    conn,
+		updated: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go s.readLoop()
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Addr returns address to pass to statsd.NewClient
+func (s *Server) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Metrics returns all the metrics received so far in the order of arrival
+func (s *Server) Metrics() []Metric {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Metric(nil), s.metrics...)
+}
+
+// Records returns received metrics without the original lines
+func (s *Server) Records() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]Record, len(s.metrics))
+	for i := range s.metrics {
+		records[i] = s.metrics[i].Record
+	}
+
+	return records
+}
+
+// WaitFor waits for the first metric with the name to arrive
+//
+// If metric doesn't arrive before the timeout, test is failed with t.Fatalf,
+// so WaitFor should be called from the goroutine running the test.
+func (s *Server) WaitFor(name string, timeout time.Duration) Metric {
+	s.t.Helper()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		updated := s.updated
+		for _, metric := range s.metrics {
+			if metric.Name == name {
+				s.mu.Unlock()
+				return metric
+			}
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			s.t.Fatalf("statsdtest: timeout waiting for metric %q, received %d metrics", name, len(s.Metrics()))
+			return Metric{}
+		}
+	}
+}
+
+// Close stops the server
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		_ = s.conn.Close()
+		<-s.done
+	})
+}
+
+func (s *Server) readLoop() {
+	defer close(s.done)
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		metrics, err := ParsePacket(buf[:n])
+		if err != nil {
+			s.t.Errorf("statsdtest: malformed packet: %s", err)
+		}
+
+		s.mu.Lock()
+		s.metrics = append(s.metrics, metrics...)
+		close(s.updated)
+		s.updated = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,104 @@
+package statsdtest
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/smira/go-statsd"
+)
+
+func TestServer(t *testing.T) {
+	for _, network := range []string{"udp", "unixgram"} {
+		for name, format := range map[string]*statsd.TagFormat{
+			"InfluxDB": statsd.TagFormatInfluxDB,
+			"Datadog":  statsd.TagFormatDatadog,
+			"Graphite": statsd.TagFormatGraphite,
+			"Okmeter":  statsd.TagFormatOkmeter,
+		} {
+			t.Run(network+"/"+name, func(t *testing.T) {
+				server := NewServer(t, network)
+
+				client := statsd.NewClient(server.Addr(), statsd.Network(network), statsd.TagStyle(format),
+					statsd.MetricPrefix("web."), statsd.DefaultTags(statsd.StringTag("app", "billing")))
+				defer client.Close() //nolint:errcheck
+
+				host := statsd.StringTag("host", "example")
+
+				client.Incr("req", 3, host)
+				client.Decr("req", 1, host)
+				client.FIncr("bytes", 1.5)
+				client.Timing("lat", 12, host)
+				client.PrecisionTiming("lat", 1500*time.Microsecond, host)
+				client.Gauge("workers", -3, statsd.IntTag("port", 80))
+				client.GaugeDelta("workers", 5, statsd.IntTag("port", 80))
+				client.FGauge("load", 0.25)
+				client.SetAdd("users", "alice", host)
+				client.Incr("done", 1)
+
+				server.WaitFor("web.done", time.Second)
+
+				app := statsd.StringTag("app", "billing")
+
+				AssertIncr(t, server, "web.req", 2, app, host)
+				AssertIncr(t, server, "web.bytes", 1.5, app)
+				AssertTiming(t, server, "web.lat", 2, host, app)
+				AssertGauge(t, server, "web.workers", 2, app, statsd.IntTag("port", 80))
+				AssertGauge(t, server, "web.load", 0.25, app)
+				AssertSetContains(t, server, "web.users", "alice", app, host)
+			})
+		}
+	}
+}
+
+func TestServerWaitForTimeout(t *testing.T) {
+	tb := &fakeTB{TB: t}
+	server := NewServer(tb, "udp")
+
+	server.WaitFor("missing", 10*time.Millisecond)
+
+	if len(tb.errors) != 1 {
+		t.Errorf("timeout expected: %v", tb.errors)
+	}
+}
+
+func TestServerMalformed(t *testing.T) {
+	tb := &fakeTB{TB: t}
+	server := NewServer(tb, "udp")
+
+	client := statsd.NewClient(server.Addr())
+	defer client.Close() //nolint:errcheck
+
+	client.Incr("bad:name", 1)
+	client.Incr("done", 1)
+
+	server.WaitFor("done", time.Second)
+
+	if fmt.Sprint(tb.errors) != `[statsdtest: malformed packet: invalid value "name:1": "bad:name:1|c"]` {
+		t.Errorf("unexpected errors: %v", tb.errors)
+	}
+}
@@ -0,0 +1,52 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import "time"
+
+// Statter is the set of metric methods implemented by Client and Local
+//
+// Code which emits metrics could accept Statter instead of *Client, so that
+// tests can substitute recording implementation (see package statsdtest).
+// Calls through the interface allocate the variadic tags slice on every
+// call, so hot paths should keep using *Client directly (or TagSet).
+type Statter interface {
+	Incr(stat string, count int64, tags ...Tag)
+	Decr(stat string, count int64, tags ...Tag)
+	FIncr(stat string, count float64, tags ...Tag)
+	FDecr(stat string, count float64, tags ...Tag)
+	Timing(stat string, delta int64, tags ...Tag)
+	PrecisionTiming(stat string, delta time.Duration, tags ...Tag)
+	Gauge(stat string, value int64, tags ...Tag)
+	GaugeDelta(stat string, value int64, tags ...Tag)
+	FGauge(stat string, value float64, tags ...Tag)
+	FGaugeDelta(stat string, value float64, tags ...Tag)
+	SetAdd(stat string, value string, tags ...Tag)
+}
+
+var (
+	_ Statter = (*Client)(nil)
+	_ Statter = (*Local)(nil)
+)
@@ -0,0 +1,90 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// errNotConnected is reported for synchronous packets if connection was never established
+var errNotConnected = errors.New("not connected")
+
+// syncPacket is a packet flushed in SynchronousMode
+//
+// Send loop writes the packet and reports the result to done.
+type syncPacket struct {
+	buf  []byte
+	done chan error
+}
+
+// complete reports write result of synchronous packet
+func complete(done chan<- error, err error) {
+	if done != nil {
+		done <- err
+	}
+}
+
+// sendSync hands packet over to a send loop and waits for it to be written
+//
+// It's called with the shard lock held, so all the emitters are blocked
+// until the packet is written. Write error is kept to be returned by FlushAndWait.
+func (t *transport) sendSync(buf []byte, lines int) {
+	packet := syncPacket{buf: buf, done: make(chan error, 1)}
+
+	t.syncQueue <- packet
+
+	if err := <-packet.done; err != nil {
+		t.syncErr.CompareAndSwap(nil, &err)
+		return
+	}
+
+	t.packetFlushed(len(buf), lines)
+}
+
+// rejectSync drops synchronous packet which can't be written as send loop is not connected
+func (t *transport) rejectSync(packet syncPacket, err error) {
+	if err == nil {
+		err = errNotConnected
+	}
+
+	t.packetDone()
+	atomic.AddInt64(&t.writeErrorsPeriod, 1)
+	atomic.AddInt64(&t.writeErrorsOverall, 1)
+	t.packetDropped(packet.buf, DropReasonWriteError)
+	t.releaseBuf(packet.buf)
+
+	complete(packet.done, fmt.Errorf("statsd: packet dropped: %w", err))
+}
+
+// takeSyncErr returns first error writing synchronous packets since the last call
+func (t *transport) takeSyncErr() error {
+	if err := t.syncErr.Swap(nil); err != nil {
+		return *err
+	}
+
+	return nil
+}
@@ -42,12 +42,29 @@ type TagFormat struct {
 	OtherSeparator byte
 	// KeyValueSeparator separates tag name and tag value
 	KeyValueSeparator []byte
+
+	// sanitize is a set of format-specific restrictions on names and tags
+	sanitize byte
 }
 
+// Format-specific restrictions on names and tags (TagFormat.sanitize)
+const (
+	sanitizeNone = iota
+	// only lowercase letters, digits, '_' and '-' in tags (and '.' in metric names)
+	sanitizeOkmeter
+	// no ';' anywhere, no '!', '^', '=' in tag names, no '~' as first character
+	// of tag value, tags with empty name or value are omitted
+	sanitizeGraphite
+)
+
 // Tag types
 const (
 	typeString = iota
 	typeInt64
+	// call options, see CallOption
+	typeRate
+	typeTimestamp
+	typeGroup
 )
 
 // Tag is metric-specific tag
@@ -56,16 +73,139 @@ type Tag struct {
 	strvalue string
 	intvalue int64
 	typ      byte
+	// tags grouped with WithTags
+	group *[]Tag
 }
 
 // Append formats tag and appends it to the buffer
 func (tag Tag) Append(buf []byte, style *TagFormat) []byte {
-	buf = append(buf, []byte(tag.name)...)
+	if tag.typ > typeInt64 {
+		// call options are not tags
+		return buf
+	}
+
+	if style.sanitize != sanitizeNone {
+		return tag.appendSanitized(buf, style)
+	}
+
+	buf = append(buf, tag.name...)
 	buf = append(buf, style.KeyValueSeparator...)
 	if tag.typ == typeString {
-		return append(buf, []byte(tag.strvalue)...)
+		return append(buf, tag.strvalue...)
+	}
+	return appendInt(buf, tag.intvalue)
+}
+
+// appendSanitized is Append for the formats with restrictions on tags
+//
+// Characters which are not allowed are replaced with '_'.
+func (tag Tag) appendSanitized(buf []byte, style *TagFormat) []byte {
+	nameChars, valueChars := &okmeterChars, &okmeterChars
+	if style.sanitize == sanitizeGraphite {
+		nameChars, valueChars = &graphiteTagNameChars, &graphiteTagValueChars
+	}
+
+	buf = appendMapped(buf, tag.name, nameChars)
+	buf = append(buf, style.KeyValueSeparator...)
+	if tag.typ != typeString {
+		return appendInt(buf, tag.intvalue)
+	}
+
+	start := len(buf)
+	buf = appendMapped(buf, tag.strvalue, valueChars)
+
+	if style.sanitize == sanitizeGraphite && len(buf) > start && buf[start] == '~' {
+		// '~' prefix has special meaning in Graphite tag queries
+		buf[start] = '_'
+	}
+
+	return buf
+}
+
+// omits returns true if tag can't be represented in the format
+func (style *TagFormat) omits(tag *Tag) bool {
+	return style.sanitize == sanitizeGraphite && (tag.name == "" || (tag.typ == typeString && tag.strvalue == ""))
+}
+
+// omitsAny returns true if any of the tags can't be represented in the format
+func (style *TagFormat) omitsAny(tags []Tag) bool {
+	if style.sanitize != sanitizeGraphite {
+		return false
+	}
+
+	for i := range tags {
+		if style.omits(&tags[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sanitizeName replaces characters which are not allowed in the metric name in place
+func (style *TagFormat) sanitizeName(name []byte) {
+	switch style.sanitize {
+	case sanitizeOkmeter:
+		for i, c := range name {
+			if c != '.' {
+				name[i] = okmeterChars[c]
+			}
+		}
+	case sanitizeGraphite:
+		for i, c := range name {
+			name[i] = graphiteTagValueChars[c]
+		}
+	}
+}
+
+// appendMapped appends s with every byte mapped with the table
+func appendMapped(buf []byte, s string, table *[256]byte) []byte {
+	for i := 0; i < len(s); i++ {
+		buf = append(buf, table[s[i]])
+	}
+
+	return buf
+}
+
+// characters allowed in the formats, other characters are mapped to '_'
+var (
+	// okmeterChars lowercases letters, keeps digits, '_' and '-'
+	okmeterChars = charMap(func(c byte) byte {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			return c + 'a' - 'A'
+		case c == '.' || !safeNameChars[c]:
+			return '_'
+		default:
+			return c
+		}
+	})
+
+	graphiteTagNameChars = charMap(func(c byte) byte {
+		switch c {
+		case ';', '!', '^', '=':
+			return '_'
+		default:
+			return c
+		}
+	})
+
+	// graphiteTagValueChars is used for metric names as well
+	graphiteTagValueChars = charMap(func(c byte) byte {
+		if c == ';' {
+			return '_'
+		}
+
+		return c
+	})
+)
+
+func charMap(mapping func(c byte) byte) (table [256]byte) {
+	for i := range table {
+		table[i] = mapping(byte(i))
 	}
-	return strconv.AppendInt(buf, tag.intvalue, 10)
+
+	return
 }
 
 // StringTag creates Tag with string value
@@ -83,30 +223,111 @@ func Int64Tag(name string, value int64) Tag {
 	return Tag{name: name, intvalue: value, typ: typeInt64}
 }
 
+// value returns tag value as string
+func (tag Tag) value() string {
+	if tag.typ == typeString {
+		return tag.strvalue
+	}
+	return strconv.FormatInt(tag.intvalue, 10)
+}
+
+// setDefaultTags sets tags applied to every metric and serializes them
+//
+// Default tags are serialized once as a block without leading and trailing
+// separators, per-call tags are appended after the block.
+func (c *Client) setDefaultTags(tags []Tag) {
+	tags = plainTags(tags)
+
+	if c.trans.tagFormat.omitsAny(tags) {
+		var allowed []Tag
+
+		for i := range tags {
+			if !c.trans.tagFormat.omits(&tags[i]) {
+				allowed = append(allowed, tags[i])
+			}
+		}
+
+		tags = allowed
+	}
+
+	c.defaultTags = tags
+	c.defaultTagBytes = nil
+
+	for i := range tags {
+		if i > 0 {
+			c.defaultTagBytes = append(c.defaultTagBytes, c.trans.tagFormat.OtherSeparator)
+		}
+
+		c.defaultTagBytes = tags[i].Append(c.defaultTagBytes, c.trans.tagFormat)
+	}
+}
+
 func (c *Client) formatTags(buf []byte, tags []Tag) []byte {
-	tagsLen := len(c.defaultTags) + len(tags)
-	if tagsLen == 0 {
+	if len(c.defaultTags)+len(tags) == 0 {
 		return buf
 	}
 
-	buf = append(buf, []byte(c.trans.tagFormat.FirstSeparator)...)
-	for i := range c.defaultTags {
-		buf = c.defaultTags[i].Append(buf, c.trans.tagFormat)
-		if i != tagsLen-1 {
-			buf = append(buf, c.trans.tagFormat.OtherSeparator)
-		}
+	if c.tagMapper != nil || c.trans.tagFormat.omitsAny(tags) {
+		return c.formatFilteredTags(buf, tags)
 	}
 
+	buf = append(buf, c.trans.tagFormat.FirstSeparator...)
+	buf = append(buf, c.defaultTagBytes...)
+
 	for i := range tags {
-		buf = tags[i].Append(buf, c.trans.tagFormat)
-		if i+len(c.defaultTags) != tagsLen-1 {
+		if i > 0 || len(c.defaultTags) > 0 {
 			buf = append(buf, c.trans.tagFormat.OtherSeparator)
 		}
+
+		buf = tags[i].Append(buf, c.trans.tagFormat)
 	}
 
 	return buf
 }
 
+// formatFilteredTags is a slow path of formatTags which passes every tag through the tag mapper
+// and omits tags which can't be represented in the format
+func (c *Client) formatFilteredTags(buf []byte, tags []Tag) []byte {
+	first := true
+
+	for _, list := range [2][]Tag{c.defaultTags, tags} {
+		for i := range list {
+			tag := list[i]
+
+			if c.tagMapper != nil {
+				name, value, ok := c.tagMapper(tag.name, tag.value())
+				if !ok {
+					continue
+				}
+
+				tag = StringTag(name, value)
+			}
+
+			if c.trans.tagFormat.omits(&tag) {
+				continue
+			}
+
+			if first {
+				buf = append(buf, c.trans.tagFormat.FirstSeparator...)
+				first = false
+			} else {
+				buf = append(buf, c.trans.tagFormat.OtherSeparator)
+			}
+
+			buf = tag.Append(buf, c.trans.tagFormat)
+		}
+	}
+
+	return buf
+}
+
+// flattensTags returns true if tags are joined into the metric name as
+// name hierarchy components (e.g. TagFormatOkmeter)
+func flattensTags(format *TagFormat) bool {
+	return format.Placement == TagPlacementName && format.FirstSeparator == DefaultNameSeparator &&
+		format.OtherSeparator == DefaultNameSeparator[0]
+}
+
 var (
 	// TagFormatInfluxDB is format for InfluxDB StatsD telegraf plugin
 	//
@@ -130,21 +351,36 @@ var (
 
 	// TagFormatGraphite is format for Graphite
 	//
+	// Graphite 1.1 restrictions are applied: ';' in metric names, tag names and
+	// values and '!', '^', '=' in tag names are replaced with '_', as well as '~'
+	// as the first character of the tag value. Tags with empty name or value are omitted.
+	//
 	// Docs: https://graphite.readthedocs.io/en/latest/tags.html
 	TagFormatGraphite = &TagFormat{
 		Placement:         TagPlacementName,
 		FirstSeparator:    ";",
 		OtherSeparator:    ';',
 		KeyValueSeparator: []byte{'='},
+		sanitize:          sanitizeGraphite,
 	}
 
 	// TagFormatOkmeter is format for Okmeter agent
 	//
+	// Tags are appended to the metric name as name components:
+	//
+	//	<prefix><name>.<tag>_is_<value>.<tag>_is_<value>:<value>|<type>
+	//
+	// Okmeter agent accepts only lowercase names, so metric prefix and name are
+	// lowercased, and characters other than letters, digits, '_', '-' and '.' are
+	// replaced with '_'. Tag names and values are normalized the same way, but
+	// dots are replaced as well, as they separate tags.
+	//
 	// Docs: https://okmeter.io/misc/docs#statsd-plugin-config
 	TagFormatOkmeter = &TagFormat{
 		Placement:         TagPlacementName,
 		FirstSeparator:    ".",
 		OtherSeparator:    '.',
 		KeyValueSeparator: []byte("_is_"),
+		sanitize:          sanitizeOkmeter,
 	}
 )
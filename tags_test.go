@@ -24,7 +24,10 @@ SOFTWARE.
 
 */
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestTags(t *testing.T) {
 	compare := func(tag Tag, style *TagFormat, expected string) func(*testing.T) {
@@ -78,3 +81,103 @@ func TestFormatTags(t *testing.T) {
 	t.Run("Okmeter",
 		compare([]Tag{StringTag("type", "web"), IntTag("status", 200)}, TagFormatOkmeter, ".host_is_foo.type_is_web.status_is_200"))
 }
+
+func TestFormatDefaultTags(t *testing.T) {
+	compare := func(defaultTags, cloneTags, tags []Tag, style *TagFormat, expected string) func(*testing.T) {
+		return func(t *testing.T) {
+			client := NewClient("127.0.0.1:4444", TagStyle(style), DefaultTags(defaultTags...))
+			defer client.Close() //nolint:errcheck
+
+			if cloneTags != nil {
+				client = client.CloneWithTags(cloneTags...)
+			}
+
+			buf := client.formatTags([]byte{}, tags)
+
+			if string(buf) != expected {
+				t.Errorf("unexpected tag format: %#v != %#v", string(buf), expected)
+			}
+		}
+	}
+
+	t.Run("None",
+		compare(nil, nil, nil, TagFormatDatadog, ""))
+	t.Run("DefaultOnly",
+		compare([]Tag{StringTag("host", "foo"), IntTag("shard", 3)}, nil, nil, TagFormatDatadog, "|#host:foo,shard:3"))
+	t.Run("CallOnly",
+		compare(nil, nil, []Tag{StringTag("type", "web"), IntTag("status", 200)}, TagFormatInfluxDB, ",type=web,status=200"))
+	t.Run("Both",
+		compare([]Tag{StringTag("host", "foo"), IntTag("shard", 3)}, nil, []Tag{StringTag("type", "web")}, TagFormatGraphite,
+			";host=foo;shard=3;type=web"))
+	t.Run("Clone",
+		compare([]Tag{StringTag("host", "foo")}, []Tag{IntTag("shard", 3)}, []Tag{StringTag("type", "web")}, TagFormatDatadog,
+			"|#host:foo,shard:3,type:web"))
+	t.Run("CloneOnly",
+		compare(nil, []Tag{IntTag("shard", 3)}, nil, TagFormatOkmeter, ".shard_is_3"))
+}
+
+func TestFormatMappedTags(t *testing.T) {
+	mapper := func(name, value string) (string, string, bool) {
+		switch name {
+		case "env":
+			return "environment", value, true
+		case "user_id":
+			return name, strings.Repeat("x", len(value)), true
+		case "debug":
+			return "", "", false
+		}
+
+		return name, value, true
+	}
+
+	compare := func(defaultTags, tags []Tag, style *TagFormat, expected string) func(*testing.T) {
+		return func(t *testing.T) {
+			client := NewClient("127.0.0.1:4444", TagStyle(style), DefaultTags(defaultTags...), TagMapper(mapper))
+			buf := client.formatTags([]byte{}, tags)
+
+			if string(buf) != expected {
+				t.Errorf("unexpected tag format: %#v != %#v", string(buf), expected)
+			}
+
+			_ = client.Close()
+		}
+	}
+
+	t.Run("Rename",
+		compare([]Tag{StringTag("env", "prod")}, []Tag{IntTag("status", 200)}, TagFormatDatadog, "|#environment:prod,status:200"))
+	t.Run("Value",
+		compare(nil, []Tag{StringTag("type", "web"), IntTag("user_id", 12345)}, TagFormatInfluxDB, ",type=web,user_id=xxxxx"))
+	t.Run("DropFirst",
+		compare([]Tag{StringTag("debug", "true")}, []Tag{StringTag("type", "web")}, TagFormatInfluxDB, ",type=web"))
+	t.Run("DropLast",
+		compare([]Tag{StringTag("host", "foo")}, []Tag{StringTag("type", "web"), StringTag("debug", "true")}, TagFormatGraphite, ";host=foo;type=web"))
+	t.Run("DropAll",
+		compare([]Tag{StringTag("debug", "true")}, []Tag{StringTag("debug", "false")}, TagFormatDatadog, ""))
+}
+
+func BenchmarkFormatTags(b *testing.B) {
+	tags := []Tag{StringTag("type", "web"), IntTag("status", 200)}
+
+	for _, bc := range []struct {
+		name    string
+		options []Option
+	}{
+		{"NoMapper", nil},
+		{"Mapper", []Option{TagMapper(func(name, value string) (string, string, bool) { return name, value, true })}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			client := NewClient("127.0.0.1:4444", append(bc.options, DefaultTags(StringTag("host", "foo")))...)
+			buf := make([]byte, 0, 1024)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				buf = client.formatTags(buf[:0], tags)
+			}
+
+			b.StopTimer()
+			_ = client.Close()
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+import "time"
+
+// TagSet is an immutable list of tags built once and reused across calls
+//
+// Methods with variadic tags (e.g. Incr) don't allocate as long as the
+// compiler can see that tags don't escape, which is the case for direct
+// calls on *Client. When the client is called through an interface or a
+// function value, the compiler has to allocate the []Tag backing array
+// on the heap for every call. Methods with T suffix (e.g. IncrT) take
+// prebuilt TagSet instead, so they never allocate for the tags.
+//
+// The trade-off is that tag values are fixed when TagSet is created, so
+// TagSet fits best for the tags which don't change between calls (e.g.
+// route or status class). Nil *TagSet is valid and means no tags.
+type TagSet struct {
+	tags []Tag
+}
+
+// NewTagSet builds TagSet out of the tags, call options are ignored
+func NewTagSet(tags ...Tag) *TagSet {
+	return &TagSet{tags: append([]Tag(nil), plainTags(tags)...)}
+}
+
+// With returns new TagSet with additional tags appended, call options are ignored
+func (s *TagSet) With(tags ...Tag) *TagSet {
+	return &TagSet{tags: append(append([]Tag(nil), s.list()...), plainTags(tags)...)}
+}
+
+// Len returns number of tags in the set
+func (s *TagSet) Len() int {
+	return len(s.list())
+}
+
+func (s *TagSet) list() []Tag {
+	if s == nil {
+		return nil
+	}
+
+	return s.tags
+}
+
+// IncrT increments a counter metric with the tags from the TagSet, see Incr
+func (c *Client) IncrT(stat string, count int64, tags *TagSet) {
+	c.Incr(stat, count, tags.list()...)
+}
+
+// DecrT decrements a counter metric with the tags from the TagSet, see Decr
+func (c *Client) DecrT(stat string, count int64, tags *TagSet) {
+	c.Decr(stat, count, tags.list()...)
+}
+
+// FIncrT increments a float counter metric with the tags from the TagSet, see FIncr
+func (c *Client) FIncrT(stat string, count float64, tags *TagSet) {
+	c.FIncr(stat, count, tags.list()...)
+}
+
+// FDecrT decrements a float counter metric with the tags from the TagSet, see FDecr
+func (c *Client) FDecrT(stat string, count float64, tags *TagSet) {
+	c.FDecr(stat, count, tags.list()...)
+}
+
+// TimingT tracks a duration event with the tags from the TagSet, see Timing
+func (c *Client) TimingT(stat string, delta int64, tags *TagSet) {
+	c.Timing(stat, delta, tags.list()...)
+}
+
+// PrecisionTimingT tracks a duration event with the tags from the TagSet, see PrecisionTiming
+func (c *Client) PrecisionTimingT(stat string, delta time.Duration, tags *TagSet) {
+	c.PrecisionTiming(stat, delta, tags.list()...)
+}
+
+// GaugeT sets or updates constant value for the interval with the tags from the TagSet, see Gauge
+func (c *Client) GaugeT(stat string, value int64, tags *TagSet) {
+	c.Gauge(stat, value, tags.list()...)
+}
+
+// GaugeDeltaT sends a change for a gauge with the tags from the TagSet, see GaugeDelta
+func (c *Client) GaugeDeltaT(stat string, value int64, tags *TagSet) {
+	c.GaugeDelta(stat, value, tags.list()...)
+}
+
+// FGaugeT sends a floating point value for a gauge with the tags from the TagSet, see FGauge
+func (c *Client) FGaugeT(stat string, value float64, tags *TagSet) {
+	c.FGauge(stat, value, tags.list()...)
+}
+
+// FGaugeDeltaT sends a floating point change for a gauge with the tags from the TagSet, see FGaugeDelta
+func (c *Client) FGaugeDeltaT(stat string, value float64, tags *TagSet) {
+	c.FGaugeDelta(stat, value, tags.list()...)
+}
+
+// SetAddT adds unique element to a set with the tags from the TagSet, see SetAdd
+func (c *Client) SetAddT(stat string, value string, tags *TagSet) {
+	c.SetAdd(stat, value, tags.list()...)
+}
@@ -0,0 +1,148 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+import (
+	"testing"
+	"time"
+)
+
+// emitter is used to call client through an interface, so that variadic tags escape
+type emitter interface {
+	Incr(stat string, count int64, tags ...Tag)
+	IncrT(stat string, count int64, tags *TagSet)
+	PrecisionTimingT(stat string, delta time.Duration, tags *TagSet)
+	GaugeT(stat string, value int64, tags *TagSet)
+	SetAddT(stat string, value string, tags *TagSet)
+}
+
+var emitterSink emitter
+
+func TestTagSet(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), MetricPrefix("foo."), TagStyle(TagFormatDatadog),
+		DefaultTags(StringTag("host", "web1")), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	base := NewTagSet(StringTag("route", "api"))
+	tags := base.With(IntTag("status", 200))
+
+	if base.Len() != 1 || tags.Len() != 2 {
+		t.Fatalf("unexpected tag set length: %d, %d", base.Len(), tags.Len())
+	}
+
+	compare := func(variadic, set func()) func(*testing.T) {
+		return func(t *testing.T) {
+			packets := make([]string, 0, 2)
+
+			for _, emit := range []func(){variadic, set} {
+				emit()
+				client.Flush()
+
+				select {
+				case buf := <-received:
+					packets = append(packets, string(buf))
+				case <-time.After(time.Second):
+					t.Fatal("timeout waiting for metrics")
+				}
+			}
+
+			if packets[0] != packets[1] {
+				t.Errorf("unexpected packet: %#v != %#v", packets[1], packets[0])
+			}
+		}
+	}
+
+	t.Run("Incr", compare(
+		func() { client.Incr("counter", 1, StringTag("route", "api"), IntTag("status", 200)) },
+		func() { client.IncrT("counter", 1, tags) }))
+	t.Run("Decr", compare(
+		func() { client.Decr("counter", 1, StringTag("route", "api")) },
+		func() { client.DecrT("counter", 1, base) }))
+	t.Run("FIncr", compare(
+		func() { client.FIncr("counter", 0.5, StringTag("route", "api")) },
+		func() { client.FIncrT("counter", 0.5, base) }))
+	t.Run("FDecr", compare(
+		func() { client.FDecr("counter", 0.5, StringTag("route", "api")) },
+		func() { client.FDecrT("counter", 0.5, base) }))
+	t.Run("Timing", compare(
+		func() { client.Timing("timing", 153, StringTag("route", "api")) },
+		func() { client.TimingT("timing", 153, base) }))
+	t.Run("PrecisionTiming", compare(
+		func() { client.PrecisionTiming("timing", time.Millisecond, StringTag("route", "api")) },
+		func() { client.PrecisionTimingT("timing", time.Millisecond, base) }))
+	t.Run("Gauge", compare(
+		func() { client.Gauge("gauge", 42, StringTag("route", "api")) },
+		func() { client.GaugeT("gauge", 42, base) }))
+	t.Run("GaugeDelta", compare(
+		func() { client.GaugeDelta("gauge", -1, StringTag("route", "api")) },
+		func() { client.GaugeDeltaT("gauge", -1, base) }))
+	t.Run("FGauge", compare(
+		func() { client.FGauge("gauge", 4.2, StringTag("route", "api")) },
+		func() { client.FGaugeT("gauge", 4.2, base) }))
+	t.Run("FGaugeDelta", compare(
+		func() { client.FGaugeDelta("gauge", -0.5, StringTag("route", "api")) },
+		func() { client.FGaugeDeltaT("gauge", -0.5, base) }))
+	t.Run("SetAdd", compare(
+		func() { client.SetAdd("set", "bob", StringTag("route", "api")) },
+		func() { client.SetAddT("set", "bob", base) }))
+	t.Run("Nil", compare(
+		func() { client.Incr("counter", 1) },
+		func() { client.IncrT("counter", 1, nil) }))
+}
+
+func TestTagSetAllocs(t *testing.T) {
+	client := NewClient("127.0.0.1:8125", MetricPrefix("metricPrefix."), MaxPacketSize(65000), SuppressMTUWarning(), FlushInterval(time.Hour),
+		TagStyle(TagFormatDatadog))
+	defer client.Close() //nolint:errcheck
+
+	emitterSink = client
+
+	tags := NewTagSet(StringTag("route", "api"), IntTag("status", 200))
+
+	for _, tt := range []struct {
+		name   string
+		action func()
+	}{
+		{"IncrT", func() { emitterSink.IncrT("foo.bar.counter", 1, tags) }},
+		{"PrecisionTimingT", func() { emitterSink.PrecisionTimingT("foo.bar.timing", time.Millisecond, tags) }},
+		{"GaugeT", func() { emitterSink.GaugeT("foo.bar.gauge", 42, tags) }},
+		{"SetAddT", func() { emitterSink.SetAddT("foo.bar.set", "bob", tags) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if allocs := testing.AllocsPerRun(1000, tt.action); allocs != 0 {
+				t.Errorf("unexpected allocations: %v", allocs)
+			}
+		})
+	}
+
+	// variadic form keeps working through the interface, at the cost of the allocation
+	if allocs := testing.AllocsPerRun(1000, func() {
+		emitterSink.Incr("foo.bar.counter", 1, StringTag("route", "api"), IntTag("status", 200))
+	}); allocs > 1 {
+		t.Errorf("unexpected allocations: %v", allocs)
+	}
+}
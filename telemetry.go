@@ -0,0 +1,94 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// telemetryLoop periodically emits client own metrics via telemetry client
+//
+// Every interval fixed number of lines is emitted, so telemetry can't amplify
+// the load when the client is overflowing. Telemetry counters are never sampled.
+func (t *transport) telemetryLoop(telemetry *Client, interval time.Duration) {
+	defer t.shutdownWg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last struct {
+		emitted, sent, bytes, overflow, stale, closed, writeErrors int64
+	}
+
+	delta := func(value int64, last *int64) int64 {
+		d := value - *last
+		*last = value
+
+		return d
+	}
+
+	unsampled := WithRate(1)
+	overflowTag := StringTag("reason", "overflow")
+	staleTag := StringTag("reason", "stale")
+	closedTag := StringTag("reason", "closed")
+	writeErrorTag := StringTag("reason", "write_error")
+
+	for {
+		select {
+		case <-t.shutdown:
+			return
+		case <-ticker.C:
+			// write errors are either failed writes or the rest of the batch lost with the connection
+			writeErrors := atomic.LoadInt64(&t.writeErrorsOverall) + atomic.LoadInt64(&t.lostByReason[DropReasonWriteError])
+
+			telemetry.Incr("metrics", delta(atomic.LoadInt64(&t.emittedOverall), &last.emitted), unsampled)
+			telemetry.Incr("packets_sent", delta(atomic.LoadInt64(&t.sentPacketsOverall), &last.sent), unsampled)
+			telemetry.Incr("bytes_sent", delta(atomic.LoadInt64(&t.sentBytesOverall), &last.bytes), unsampled)
+			telemetry.Incr("packets_dropped", delta(atomic.LoadInt64(&t.lostByReason[DropReasonOverflow]), &last.overflow),
+				overflowTag, unsampled)
+			telemetry.Incr("packets_dropped", delta(atomic.LoadInt64(&t.lostByReason[DropReasonStale]), &last.stale),
+				staleTag, unsampled)
+			telemetry.Incr("packets_dropped", delta(atomic.LoadInt64(&t.lostByReason[DropReasonClosed]), &last.closed),
+				closedTag, unsampled)
+			telemetry.Incr("packets_dropped", delta(writeErrors, &last.writeErrors), writeErrorTag, unsampled)
+			telemetry.Gauge("queue_length", int64(len(t.sendQueue)))
+		}
+	}
+}
+
+// newTelemetryClient creates client which shares transport with c, but
+// doesn't apply filtering and rate limiting (sampling is overridden by telemetryLoop)
+func (c *Client) newTelemetryClient(prefix string) *Client {
+	telemetry := &Client{
+		trans: c.trans,
+	}
+	telemetry.setPrefix(prefix)
+	telemetry.setDefaultTags([]Tag{StringTag("client_id", fmt.Sprintf("%08x", rand.Uint32()))})
+
+	return telemetry
+}
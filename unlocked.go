@@ -0,0 +1,124 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// unlockedBuf is a buffer of the client in Unlocked mode
+//
+// Buffer is owned by the goroutine emitting metrics, it is appended to without
+// taking the lock. Flush loop can't touch the buffer, so periodic flush is handed
+// over to the emitter: flush loop posts a request to the flushReq channel, and
+// emitter flushes the buffer when it sends next metric.
+type unlockedBuf struct {
+	// 1 while metric is being appended, used only in debug mode
+	owner int32
+	debug bool
+
+	shard    bufShard
+	flushReq chan struct{}
+}
+
+func (t *transport) initUnlocked(debug bool) {
+	t.unlocked = &unlockedBuf{
+		debug:    debug,
+		shard:    bufShard{buf: make([]byte, 0, t.bufferSize())},
+		flushReq: make(chan struct{}, 1),
+	}
+}
+
+// acquireUnlocked returns the emitter buffer
+//
+// In debug mode concurrent use of the buffer is detected, and acquireUnlocked panics.
+func (t *transport) acquireUnlocked() *bufShard {
+	u := t.unlocked
+
+	if u.debug && !atomic.CompareAndSwapInt32(&u.owner, 0, 1) {
+		panic("statsd: concurrent use of the client in Unlocked mode, metrics should be sent from a single goroutine")
+	}
+
+	return &u.shard
+}
+
+// commitUnlocked finishes appending metric to the emitter buffer and
+// serves pending flush request
+func (t *transport) commitUnlocked(lastLen int) {
+	u := t.unlocked
+	s := &u.shard
+
+	t.checkBuf(s, lastLen)
+
+	select {
+	case <-u.flushReq:
+		var now int64
+		if t.minFlushSize > 0 {
+			now = time.Now().UnixNano()
+		}
+
+		if t.flushDue(s, now) {
+			t.flushBuf(s, len(s.buf))
+		}
+	default:
+	}
+
+	if u.debug {
+		atomic.StoreInt32(&u.owner, 0)
+	}
+}
+
+// requestUnlockedFlush asks emitter to flush the buffer on next metric
+func (t *transport) requestUnlockedFlush() {
+	select {
+	case t.unlocked.flushReq <- struct{}{}:
+	default:
+	}
+}
+
+// flushUnlocked flushes the emitter buffer, it should be called by the emitter
+// (or when emitter is stopped)
+func (t *transport) flushUnlocked() {
+	u := t.unlocked
+
+	if u.debug && !atomic.CompareAndSwapInt32(&u.owner, 0, 1) {
+		panic("statsd: concurrent use of the client in Unlocked mode, Flush should be called from the goroutine sending metrics")
+	}
+
+	// pending request is served now
+	select {
+	case <-u.flushReq:
+	default:
+	}
+
+	if s := &u.shard; len(s.buf) > 0 {
+		t.flushBuf(s, len(s.buf))
+	}
+
+	if u.debug {
+		atomic.StoreInt32(&u.owner, 0)
+	}
+}
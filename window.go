@@ -0,0 +1,124 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// WindowAgg is an aggregation applied to values observed by WindowGauge over the flush window
+type WindowAgg int
+
+// Window aggregations
+const (
+	// WindowMax reports maximum observed value
+	WindowMax WindowAgg = iota
+	// WindowMin reports minimum observed value
+	WindowMin
+	// WindowLast reports last observed value
+	WindowLast
+)
+
+// windowEmpty marks window without observations, NaN values are never stored
+var windowEmpty = math.Float64bits(math.NaN())
+
+// WindowGauge aggregates values observed over the flush window and reports aggregate as gauge
+//
+// E.g. with WindowMax gauge reports maximum queue depth over the window instead
+// of the value last Gauge call happened to record.
+type WindowGauge struct {
+	// value is float64 stored as bits
+	value uint64
+
+	client *Client
+	stat   string
+	agg    WindowAgg
+	tags   []Tag
+}
+
+// NewWindowGauge creates WindowGauge which reports aggregate of values over the flush window
+//
+// Nothing is reported for the window without observations, see DisablePeriodicFlush.
+func (c *Client) NewWindowGauge(stat string, agg WindowAgg, tags ...Tag) *WindowGauge {
+	g := &WindowGauge{
+		value:  windowEmpty,
+		client: c.reporterClient(),
+		stat:   stat,
+		agg:    agg,
+		tags:   append([]Tag(nil), tags...),
+	}
+
+	c.trans.register(g)
+
+	return g
+}
+
+// Observe records value in the current window, NaN values are ignored
+func (g *WindowGauge) Observe(value float64) {
+	if math.IsNaN(value) {
+		return
+	}
+
+	bits := math.Float64bits(value)
+
+	switch g.agg {
+	case WindowLast:
+		atomic.StoreUint64(&g.value, bits)
+	case WindowMax, WindowMin:
+		for {
+			old := atomic.LoadUint64(&g.value)
+			if old != windowEmpty {
+				current := math.Float64frombits(old)
+				if (g.agg == WindowMax && current >= value) || (g.agg == WindowMin && current <= value) {
+					break
+				}
+			}
+
+			if atomic.CompareAndSwapUint64(&g.value, old, bits) {
+				break
+			}
+		}
+	}
+
+	// background goroutines are started lazily, so make sure flush loop is running
+	g.client.trans.start()
+}
+
+// Stop unregisters gauge, value which was not reported yet is discarded
+func (g *WindowGauge) Stop() {
+	g.client.trans.unregister(g)
+}
+
+// report emits the aggregate and resets the window
+func (g *WindowGauge) report(time.Time) {
+	bits := atomic.SwapUint64(&g.value, windowEmpty)
+	if bits == windowEmpty {
+		return
+	}
+
+	g.client.FGauge(g.stat, math.Float64frombits(bits), g.tags...)
+}
@@ -0,0 +1,111 @@
+package statsd
+
+/*
+
+Copyright (c) 2017 Andrey Smirnov
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+
+*/
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWindowGauge(t *testing.T) {
+	inSocket, received := setupListener(t)
+	defer inSocket.Close() //nolint:errcheck
+
+	client := NewClient(inSocket.LocalAddr().String(), FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	for _, tc := range []struct {
+		agg      WindowAgg
+		windows  [][]float64
+		expected []string
+	}{
+		{WindowMax, [][]float64{{3, -1, 7.5, 2}, {}, {-5, -3}}, []string{"queue:7.5|g", "", "queue:0|g\nqueue:-3|g"}},
+		{WindowMin, [][]float64{{3, -1, 7.5, 2}, {math.NaN()}, {5}}, []string{"queue:0|g\nqueue:-1|g", "", "queue:5|g"}},
+		{WindowLast, [][]float64{{3, -1, 7.5, 2}, {1, math.NaN()}}, []string{"queue:2|g", "queue:1|g"}},
+	} {
+		t.Run(strconv.Itoa(int(tc.agg)), func(t *testing.T) {
+			g := client.NewWindowGauge("queue", tc.agg)
+			defer g.Stop()
+
+			for i, window := range tc.windows {
+				for _, value := range window {
+					g.Observe(value)
+				}
+
+				if packet := readReported(t, client, received); packet != tc.expected[i] {
+					t.Errorf("window %d: unexpected packet %q != %q", i, packet, tc.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWindowGaugeConcurrent(t *testing.T) {
+	client := NewClient("127.0.0.1:4444", FlushInterval(time.Hour))
+	defer client.Close() //nolint:errcheck
+
+	maxGauge := client.NewWindowGauge("max", WindowMax)
+	defer maxGauge.Stop()
+
+	minGauge := client.NewWindowGauge("min", WindowMin)
+	defer minGauge.Stop()
+
+	for window := 0; window < 5; window++ {
+		var wg sync.WaitGroup
+
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < 1000; j++ {
+					value := float64((i*7919+j*104729)%10000 + window*100)
+					maxGauge.Observe(value)
+					minGauge.Observe(value)
+				}
+			}(i)
+		}
+
+		wg.Wait()
+
+		if value := math.Float64frombits(maxGauge.value); value != float64(9999+window*100) {
+			t.Errorf("window %d: unexpected max %v", window, value)
+		}
+
+		if value := math.Float64frombits(minGauge.value); value != float64(window*100) {
+			t.Errorf("window %d: unexpected min %v", window, value)
+		}
+
+		client.trans.runReporters()
+
+		if maxGauge.value != windowEmpty || minGauge.value != windowEmpty {
+			t.Errorf("window %d: window wasn't reset", window)
+		}
+	}
+}